@@ -0,0 +1,60 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"math"
+	"time"
+)
+
+// autoConcurrencySlowdown is the factor by which an execution must be
+// slower than the baseline to count as slow.
+const autoConcurrencySlowdown = 2
+
+// autoConcurrency adapts the number of jobs of a topic that may be
+// executed at the same time (AIMD-style): It increases the limit by one
+// after each fast, successful execution, and halves it after each failed
+// or slow execution, within [min, max]. It is guarded by Manager.mu.
+type autoConcurrency struct {
+	min, max int
+	limit    float64
+	baseline time.Duration // typical duration of a fast execution
+	inflight int           // number of jobs currently executing
+}
+
+func newAutoConcurrency(min, max int) *autoConcurrency {
+	return &autoConcurrency{min: min, max: max, limit: float64(min)}
+}
+
+// Limit returns the current number of jobs that may execute concurrently.
+func (c *autoConcurrency) Limit() int {
+	return int(c.limit)
+}
+
+// available returns true if another job may be started.
+func (c *autoConcurrency) available() bool {
+	return c.inflight < c.Limit()
+}
+
+// observe adapts the limit to an execution that took d.
+func (c *autoConcurrency) observe(d time.Duration, failed bool) {
+	if failed {
+		c.limit = math.Max(float64(c.min), c.limit/2)
+		return
+	}
+	slow := c.baseline > 0 && d > autoConcurrencySlowdown*c.baseline
+	// Follow the fastest executions immediately, and slower ones slowly,
+	// so that the baseline adapts if the downstream gets slower for good
+	if c.baseline == 0 || d < c.baseline {
+		c.baseline = d
+	} else {
+		c.baseline += (d - c.baseline) / 16
+	}
+	if slow {
+		c.limit = math.Max(float64(c.min), c.limit/2)
+	} else {
+		c.limit = math.Min(float64(c.max), c.limit+1)
+	}
+}
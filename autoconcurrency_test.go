@@ -0,0 +1,59 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoConcurrency(t *testing.T) {
+	c := newAutoConcurrency(2, 10)
+	if have, want := c.Limit(), 2; have != want {
+		t.Fatalf("initial Limit = %d, want %d", have, want)
+	}
+
+	// Fast, successful executions increase the limit up to max
+	for i := 0; i < 20; i++ {
+		c.observe(10*time.Millisecond, false)
+	}
+	if have, want := c.Limit(), 10; have != want {
+		t.Fatalf("Limit after fast executions = %d, want %d", have, want)
+	}
+
+	// Increasing latency backs off towards min
+	prev := c.Limit()
+	for _, d := range []time.Duration{50, 100, 200, 400} {
+		c.observe(d*time.Millisecond, false)
+		if have := c.Limit(); have > prev {
+			t.Fatalf("Limit increased from %d to %d at latency %v", prev, have, d*time.Millisecond)
+		}
+		prev = c.Limit()
+	}
+	if have, want := c.Limit(), 2; have != want {
+		t.Fatalf("Limit after slow executions = %d, want %d", have, want)
+	}
+
+	// Failures back off as well
+	c = newAutoConcurrency(1, 8)
+	for i := 0; i < 10; i++ {
+		c.observe(10*time.Millisecond, false)
+	}
+	c.observe(10*time.Millisecond, true)
+	if have, want := c.Limit(), 4; have != want {
+		t.Fatalf("Limit after failure = %d, want %d", have, want)
+	}
+}
+
+func TestAutoConcurrencyAvailable(t *testing.T) {
+	c := newAutoConcurrency(2, 10)
+	if !c.available() {
+		t.Fatal("expected a job to be allowed to start")
+	}
+	c.inflight = 2
+	if c.available() {
+		t.Fatal("expected no job to be allowed to start")
+	}
+}
@@ -14,6 +14,38 @@ import (
 // vary the timespan between retries of failed jobs.
 type BackoffFunc func(attempts int) time.Duration
 
+// ExponentialBackoff returns a BackoffFunc that doubles the backoff with
+// every attempt, starting at base, up to max. If max is 0 or less, the
+// backoff is not capped.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 0; i < attempts; i++ {
+			if max > 0 && d >= max {
+				break
+			}
+			if d > math.MaxInt64/2 {
+				// Avoid overflow
+				d = math.MaxInt64
+				break
+			}
+			d *= 2
+		}
+		if max > 0 && d > max {
+			return max
+		}
+		return d
+	}
+}
+
+// ConstantBackoff returns a BackoffFunc that returns the same backoff d
+// for all attempts.
+func ConstantBackoff(d time.Duration) BackoffFunc {
+	return func(attempts int) time.Duration {
+		return d
+	}
+}
+
 // exponentialBackoff is the default backoff function. It performs
 // exponential backoff.
 func exponentialBackoff(attempts int) time.Duration {
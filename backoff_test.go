@@ -27,3 +27,40 @@ func TestExponentialBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestExponentialBackoffFunc(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second)
+	tests := []struct {
+		Expected time.Duration
+	}{
+		{100 * time.Millisecond},
+		{200 * time.Millisecond},
+		{400 * time.Millisecond},
+		{800 * time.Millisecond},
+		{time.Second},
+		{time.Second},
+	}
+	for i, test := range tests {
+		if want, have := test.Expected, backoff(i); want != have {
+			t.Fatalf("#%d: want %v, have %v", i, want, have)
+		}
+	}
+
+	// Without max, the backoff must not overflow
+	backoff = ExponentialBackoff(time.Second, 0)
+	if want, have := 1024*time.Second, backoff(10); want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	if have := backoff(1000); have <= 0 {
+		t.Fatalf("expected backoff to stay positive, have %v", have)
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	backoff := ConstantBackoff(5 * time.Second)
+	for i := 0; i < 5; i++ {
+		if want, have := 5*time.Second, backoff(i); want != have {
+			t.Fatalf("#%d: want %v, have %v", i, want, have)
+		}
+	}
+}
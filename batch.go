@@ -0,0 +1,87 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BatchError is returned by processors of batch jobs, i.e. jobs whose
+// arguments are items that are processed independently, to report that
+// some of the items have failed. It maps the index of each failed item
+// in the arguments to its error. Items that are not in the map have
+// succeeded.
+//
+// How a batch job with failed items is handled depends on the BatchPolicy
+// of its topic, see SetBatchPolicy. In any case, the failed items and
+// their errors are kept in Job.LastError.
+type BatchError map[int]error
+
+// Error lists the failed items, ordered by their index.
+func (e BatchError) Error() string {
+	var parts []string
+	for _, i := range e.indexes() {
+		parts = append(parts, fmt.Sprintf("item %d: %v", i, e[i]))
+	}
+	return fmt.Sprintf("jobqueue: %d batch item(s) failed: %s", len(e), strings.Join(parts, "; "))
+}
+
+// indexes returns the indexes of the failed items in ascending order.
+func (e BatchError) indexes() []int {
+	list := make([]int, 0, len(e))
+	for i := range e {
+		list = append(list, i)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// items returns the failed items of args, in their original order.
+func (e BatchError) items(args []interface{}) []interface{} {
+	var items []interface{}
+	for _, i := range e.indexes() {
+		if i >= 0 && i < len(args) {
+			items = append(items, args[i])
+		}
+	}
+	return items
+}
+
+// BatchPolicy specifies how the manager handles batch jobs whose items
+// have partially failed, i.e. whose processor returned a BatchError.
+// The zero value fails the attempt if any item has failed, and retries
+// all items.
+type BatchPolicy struct {
+	// MaxFailedRatio is the ratio of items, between 0 and 1, that may fail
+	// while the job still counts as succeeded. With 0.1, a job of 20
+	// items succeeds if up to 2 of its items failed.
+	MaxFailedRatio float64
+
+	// RetryFailedOnly indicates whether to pass only the failed items
+	// to the processor when the job is retried, so that items that have
+	// succeeded are not processed again. The arguments of the job are
+	// replaced by the failed items before the job is retried.
+	RetryFailedOnly bool
+}
+
+// batch applies the batch policy of the topic of job to the partial
+// failure e. It returns nil if the job counts as succeeded, and e
+// otherwise.
+func (m *Manager) batch(job *Job, e BatchError) error {
+	if len(e) == 0 {
+		return nil
+	}
+	job.LastError = e.Error()
+	policy := m.batchPolicies[job.Topic]
+	if float64(len(e)) <= policy.MaxFailedRatio*float64(len(job.Args)) {
+		return nil
+	}
+	if policy.RetryFailedOnly && job.Retry < job.MaxRetry {
+		job.Args = e.items(job.Args)
+	}
+	return e
+}
@@ -0,0 +1,20 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+// BlobStore keeps large payloads outside of the Store, e.g. in S3 or on
+// the filesystem. Store implementations may use a BlobStore to offload
+// oversized job arguments and only keep a reference to them.
+type BlobStore interface {
+	// Put saves data under the given key, replacing any existing data.
+	Put(key string, data []byte) error
+
+	// Get returns the data saved under the given key.
+	Get(key string) ([]byte, error)
+
+	// Delete removes the data saved under the given key. Deleting a key
+	// that does not exist must not return an error.
+	Delete(key string) error
+}
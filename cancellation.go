@@ -0,0 +1,138 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"time"
+)
+
+// CancellationPolicy specifies what happens to a job whose ContextProcessor
+// returns an error after its context has been cancelled, e.g. because the
+// manager is shutting down. It is configured via SetCancellationPolicy.
+type CancellationPolicy int
+
+const (
+	// RequeueOnCancel puts the job back into the Waiting state, so it is
+	// executed again later, e.g. by another manager. The attempt does not
+	// count against MaxRetry. This is the default.
+	RequeueOnCancel CancellationPolicy = iota
+
+	// FailOnCancel moves the job into the Failed state, regardless of
+	// the retries it has left.
+	FailOnCancel
+)
+
+// cancelledError is returned from a ContextProcessor that has failed
+// after its context has been cancelled.
+type cancelledError struct {
+	err error
+}
+
+func (e cancelledError) Error() string {
+	return e.err.Error()
+}
+
+// execution is the state of a job that has been claimed by the manager.
+// It is guarded by Manager.mu.
+type execution struct {
+	ctx       context.Context    // parent of the context of a ContextProcessor, e.g. carrying a span (optional)
+	cancel    context.CancelFunc // cancels the context of a ContextProcessor, if any
+	cancelled bool               // Cancel has been called for the job
+}
+
+// Cancel cancels the job with the given identifier.
+//
+// A waiting job is moved into the Cancelled state immediately, so it is
+// never executed. For a job that this manager is working on, the context
+// passed to its ContextProcessor is cancelled, and the job is moved into
+// the Cancelled state once its processor returns an error. A processor
+// that completes successfully nonetheless makes the job succeed. A job
+// that another manager is working on is moved into the Cancelled state
+// right away; the other manager fails to finalize it then.
+//
+// If the job does not exist, ErrNotFound is returned. If it has already
+// completed, ErrInvalidTransition is returned.
+func (m *Manager) Cancel(id string) error {
+	job, err := m.Lookup(id)
+	if err != nil {
+		return err
+	}
+	st := m.storeOf(job)
+	if job.State == Waiting {
+		// Take the job away from the scheduler before finalizing it
+		ok, err := st.CompareAndSetState(id, Waiting, Working)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// Read the job again for the version that CompareAndSetState
+			// has left, and give it back to the scheduler if we fail
+			if job, err = st.Lookup(id); err == nil {
+				job.store = st
+				job.State = Cancelled
+				job.Completed = time.Now().UnixNano()
+				job.CompletedBy = m.workerID
+				err = st.Update(job)
+			}
+			if err != nil {
+				if _, cerr := st.CompareAndSetState(id, Working, Waiting); cerr != nil {
+					m.errorf("jobqueue: error releasing job %v after failing to cancel it: %v", id, cerr)
+				}
+				return err
+			}
+			m.transition(job, Waiting)
+			m.recent.add(job)
+			m.forgetRetries(job)
+			m.mu.Lock()
+			started := m.started
+			m.mu.Unlock()
+			if started {
+				m.notify(job)
+			}
+			return nil
+		}
+		// The job has been claimed in the meantime
+		if job, err = st.Lookup(id); err != nil {
+			return err
+		}
+		job.store = st
+	}
+	if job.State != Working {
+		return ErrInvalidTransition
+	}
+
+	m.mu.Lock()
+	e := m.running[id]
+	if e != nil {
+		e.cancelled = true
+		if e.cancel != nil {
+			e.cancel()
+		}
+	}
+	m.mu.Unlock()
+	if e != nil {
+		// The worker finalizes the job when its processor returns
+		return nil
+	}
+
+	job.State = Cancelled
+	job.Completed = time.Now().UnixNano()
+	job.CompletedBy = m.workerID
+	if err := st.Update(job); err != nil {
+		return err
+	}
+	m.transition(job, Working)
+	return nil
+}
+
+// cancelRequested reports whether Cancel has been called for the job with
+// the given identifier while this manager is working on it.
+func (m *Manager) cancelRequested(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.running[id]
+	return e != nil && e.cancelled
+}
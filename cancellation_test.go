@@ -0,0 +1,77 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManagerCancellationPolicy(t *testing.T) {
+	tests := []struct {
+		Policy CancellationPolicy
+		State  string
+	}{
+		{RequeueOnCancel, Waiting},
+		{FailOnCancel, Failed},
+	}
+	for _, tt := range tests {
+		started := make(chan struct{}, 1)
+		st := NewInMemoryStore()
+		m := New(
+			SetLogger(&stringLogger{}),
+			SetStore(st),
+			SetConcurrency(0, 1),
+			SetCancellationPolicy(tt.Policy),
+		)
+		err := m.RegisterContext("topic", func(ctx context.Context, args ...interface{}) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if err != nil {
+			t.Fatalf("RegisterContext failed with %v", err)
+		}
+		err = m.Start()
+		if err != nil {
+			t.Fatalf("Start failed with %v", err)
+		}
+		job := &Job{Topic: "topic", MaxRetry: 3}
+		err = m.Add(job)
+		if err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job start timed out")
+		}
+
+		// Shut down while the job is working
+		if err := m.CloseWithTimeout(100 * time.Millisecond); err == nil {
+			t.Fatal("expected CloseWithTimeout to time out")
+		}
+
+		var state string
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			found, err := st.Lookup(job.ID)
+			if err != nil {
+				t.Fatalf("Lookup failed with %v", err)
+			}
+			if state = found.State; state != Working {
+				if have, want := found.Retry, 0; have != want {
+					t.Fatalf("policy %v: Retry = %d, want %d", tt.Policy, have, want)
+				}
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if have, want := state, tt.State; have != want {
+			t.Fatalf("policy %v: State = %q, want %q", tt.Policy, have, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCompletionBatchSize is the max. number of terminal updates
+	// that are written at once unless specified otherwise.
+	defaultCompletionBatchSize = 100
+)
+
+// SetCompletionBatching specifies that the terminal updates of jobs, i.e.
+// into the Succeeded or Failed state, are written in batches to reduce the
+// load on the store at high throughput. The updates of jobs that complete
+// within window are written at once, or as soon as max updates are
+// pending. If max is 0 or less, a default of 100 is used. The store writes
+// them with a single call if it implements BatchUpdateStore.
+//
+// A worker waits until the update of its job has been written before it
+// moves on, e.g. before notifying subscribers and webhooks, so completing
+// a job takes up to window longer. Batching is disabled by default, and
+// if window is 0 or less.
+func SetCompletionBatching(window time.Duration, max int) ManagerOption {
+	return func(m *Manager) {
+		if window <= 0 {
+			m.completions = nil
+			return
+		}
+		if max <= 0 {
+			max = defaultCompletionBatchSize
+		}
+		m.completions = &completionBatcher{
+			window:  window,
+			max:     max,
+			pending: make(map[Store]*completionBatch),
+		}
+	}
+}
+
+// completionBatcher groups the terminal updates of jobs per store.
+type completionBatcher struct {
+	window time.Duration // time to wait for more updates after the first one
+	max    int           // max. number of updates in a batch
+
+	mu      sync.Mutex
+	pending map[Store]*completionBatch
+}
+
+// completionBatch are the pending updates of a store.
+type completionBatch struct {
+	jobs  []*Job
+	errc  []chan error // receive the result of updating the job at the same index
+	timer *time.Timer
+}
+
+// update adds job to the pending updates of st, and waits until it has
+// been written.
+func (b *completionBatcher) update(st Store, job *Job) error {
+	errc := make(chan error, 1)
+	b.mu.Lock()
+	batch := b.pending[st]
+	if batch == nil {
+		batch = &completionBatch{}
+		b.pending[st] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.flush(st, batch) })
+	}
+	batch.jobs = append(batch.jobs, job)
+	batch.errc = append(batch.errc, errc)
+	full := len(batch.jobs) >= b.max
+	b.mu.Unlock()
+	if full {
+		b.flush(st, batch)
+	}
+	return <-errc
+}
+
+// flush writes the updates of batch to st, unless it has been flushed
+// already.
+func (b *completionBatcher) flush(st Store, batch *completionBatch) {
+	b.mu.Lock()
+	if b.pending[st] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, st)
+	batch.timer.Stop()
+	b.mu.Unlock()
+
+	errs := updateBatch(st, batch.jobs)
+	for i, errc := range batch.errc {
+		errc <- errs[i]
+	}
+}
+
+// finalize writes the terminal update of job to its store, batched with
+// the updates of other jobs if SetCompletionBatching is enabled.
+func (m *Manager) finalize(job *Job) error {
+	if m.completions == nil {
+		return m.storeOf(job).Update(job)
+	}
+	return m.completions.update(m.storeOf(job), job)
+}
@@ -0,0 +1,183 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchCountingStore is an InMemoryStore that records the sizes of the
+// batches passed to UpdateBatch.
+type batchCountingStore struct {
+	*InMemoryStore
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (st *batchCountingStore) UpdateBatch(jobs []*Job) []error {
+	st.mu.Lock()
+	st.batches = append(st.batches, len(jobs))
+	st.mu.Unlock()
+	return st.InMemoryStore.UpdateBatch(jobs)
+}
+
+func TestManagerCompletionBatching(t *testing.T) {
+	const n = 5
+	st := &batchCountingStore{InMemoryStore: NewInMemoryStore()}
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetConcurrency(0, n),
+		SetCompletionBatching(500*time.Millisecond, 0),
+	)
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(n)
+	err := m.Register("topic", func(args ...interface{}) error {
+		started.Done()
+		<-release
+		if args[0].(string) == "fail" {
+			return errors.New("failed job")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(2 * n)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+
+	want := make(map[string]string)
+	for i := 0; i < n; i++ {
+		job := &Job{Topic: "topic", Args: []interface{}{"succeed"}}
+		if i == 0 {
+			job.Args = []interface{}{"fail"}
+		}
+		if err := m.Add(job); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		want[job.ID] = Succeeded
+		if i == 0 {
+			want[job.ID] = Failed
+		}
+	}
+	// Complete all jobs at the same time
+	started.Wait()
+	close(release)
+
+	completed := 0
+	for completed < n {
+		select {
+		case tr := <-sub.C:
+			if tr.From == Working {
+				completed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Jobs timed out; %d of %d completed", completed, n)
+		}
+	}
+
+	st.mu.Lock()
+	batches := st.batches
+	st.mu.Unlock()
+	if len(batches) != 1 || batches[0] != n {
+		t.Fatalf("batches = %v, want a single batch of %d jobs", batches, n)
+	}
+	for id, state := range want {
+		job, err := st.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if job.State != state {
+			t.Errorf("State of job %s = %q, want %q", id, job.State, state)
+		}
+	}
+}
+
+func TestCompletionBatcherFlushesWhenFull(t *testing.T) {
+	st := &batchCountingStore{InMemoryStore: NewInMemoryStore()}
+	m := New(SetStore(st), SetCompletionBatching(time.Hour, 2))
+	jobs := []*Job{
+		{ID: "1", State: Working},
+		{ID: "2", State: Working},
+		{ID: "done", State: Succeeded},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	// The window is long, so only the max. size flushes the batch
+	errc := make(chan error, 2)
+	for _, id := range []string{"1", "done"} {
+		go func(id string) {
+			errc <- m.finalize(&Job{ID: id, State: Succeeded})
+		}(id)
+	}
+	var errs []error
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			errs = append(errs, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("finalize timed out")
+		}
+	}
+	if (errs[0] != nil || errs[1] != ErrInvalidTransition) && (errs[1] != nil || errs[0] != ErrInvalidTransition) {
+		t.Fatalf("finalize returned %v, want nil and %v", errs, ErrInvalidTransition)
+	}
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != Succeeded {
+		t.Fatalf("State = %q, want %q", job.State, Succeeded)
+	}
+	if have, want := len(st.batches), 1; have != want {
+		t.Fatalf("len(batches) = %d, want %d", have, want)
+	}
+}
+
+// BenchmarkCompletionBatching shows the number of writes to the store per
+// completed job with and without batching.
+func BenchmarkCompletionBatching(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(window.String(), func(b *testing.B) {
+			st := &batchCountingStore{InMemoryStore: NewInMemoryStore()}
+			m := New(SetStore(st), SetCompletionBatching(window, 0))
+			for i := 0; i < b.N; i++ {
+				if err := st.Create(&Job{ID: strconv.Itoa(i), State: Working}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := 0; i < b.N; i++ {
+				wg.Add(1)
+				go func(id string) {
+					defer wg.Done()
+					m.finalize(&Job{ID: id, State: Succeeded})
+				}(strconv.Itoa(i))
+			}
+			wg.Wait()
+			writes := len(st.batches)
+			if window == 0 {
+				writes = b.N
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/job")
+		})
+	}
+}
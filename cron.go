@@ -0,0 +1,208 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronSchedule is a schedule registered via RegisterSchedule.
+type cronSchedule struct {
+	id    string        // identifier of the schedule, stored in UniqueKey of its jobs
+	group string        // correlation group of its jobs, used to find its last occurrence
+	spec  string        // cron expression
+	sched cron.Schedule // parsed spec
+	job   Job           // template of the jobs to add
+	next  time.Time     // time when the next job is added (zero if not armed)
+	timer *time.Timer   // fires at next (nil if not armed)
+}
+
+// RegisterSchedule registers a schedule that adds a copy of job at every
+// tick of spec, e.g. "*/5 * * * *" or "@every 5m" (see the robfig/cron
+// package for the syntax). The topic of job must be registered already.
+// Schedules may be registered before or after Start; jobs are only added
+// while the manager is started.
+//
+// Occurrences of a schedule never overlap: a tick is skipped if the job
+// added at a previous tick is still waiting or working. This relies on
+// UniqueKey, which identifies the schedule. It defaults to the topic and
+// spec if the template does not set it. The CorrelationGroup of the jobs
+// also defaults to that identifier.
+//
+// The state of a schedule is kept in the store via the jobs it has added,
+// so it survives a restart: when the manager starts and the last job of
+// the schedule is older than the interval, i.e. a tick was missed while
+// no manager was running, one job is added right away to catch up.
+func (m *Manager) RegisterSchedule(spec string, job *Job) error {
+	if job == nil || job.Topic == "" {
+		return errors.New("jobqueue: no topic specified")
+	}
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("jobqueue: invalid schedule %q: %v", spec, err)
+	}
+	c := &cronSchedule{
+		id:    job.UniqueKey,
+		group: job.CorrelationGroup,
+		spec:  spec,
+		sched: sched,
+		job:   *job,
+	}
+	if c.id == "" {
+		c.id = fmt.Sprintf("schedule:%s:%s", job.Topic, spec)
+	}
+	if c.group == "" {
+		c.group = c.id
+	}
+
+	m.mu.Lock()
+	_, found := m.tm[job.Topic]
+	if !found && m.defaultProc == nil {
+		m.mu.Unlock()
+		return fmt.Errorf("jobqueue: topic %s not registered", job.Topic)
+	}
+	if _, found := m.crons[c.id]; found {
+		m.mu.Unlock()
+		return fmt.Errorf("jobqueue: schedule %s already registered", c.id)
+	}
+	m.crons[c.id] = c
+	started := m.started
+	m.mu.Unlock()
+
+	if started {
+		m.resumeSchedule(c)
+	}
+	return nil
+}
+
+// startSchedules arms the timers of all registered schedules.
+func (m *Manager) startSchedules() {
+	m.mu.Lock()
+	var list []*cronSchedule
+	for _, c := range m.crons {
+		list = append(list, c)
+	}
+	m.mu.Unlock()
+	for _, c := range list {
+		m.resumeSchedule(c)
+	}
+}
+
+// resumeSchedule arms the timer of c for its next tick, or right away if
+// a tick has been missed since its last job was added.
+func (m *Manager) resumeSchedule(c *cronSchedule) {
+	now := time.Now()
+	next := c.sched.Next(now)
+	last, err := m.lastScheduled(c)
+	if err != nil {
+		m.errorf("jobqueue: error looking up last job of schedule %s: %v", c.id, err)
+	} else if last > 0 && !c.sched.Next(time.Unix(0, last)).After(now) {
+		next = now
+	}
+	m.mu.Lock()
+	m.armSchedule(c, next)
+	m.mu.Unlock()
+}
+
+// lastScheduled returns the time when the last job of c has been added
+// (in UnixNano), or 0 if there is none.
+func (m *Manager) lastScheduled(c *cronSchedule) (int64, error) {
+	rsp, err := m.storeOf(&c.job).List(&ListRequest{
+		Topic:            c.job.Topic,
+		CorrelationGroup: c.group,
+		Limit:            10,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	for _, job := range rsp.Jobs {
+		if job.UniqueKey == c.id && job.Created > last {
+			last = job.Created
+		}
+	}
+	return last, nil
+}
+
+// armSchedule lets the timer of c fire at next. It must be called with
+// m.mu held. It does nothing if the manager has been stopped.
+func (m *Manager) armSchedule(c *cronSchedule, next time.Time) {
+	if !m.cronStarted {
+		return
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.next = next
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(next), func() {
+		// Run the tick as a background goroutine of the manager, so that
+		// Stop waits for it. The timer may have fired while the schedule
+		// was being stopped or re-armed, so check that it is still armed.
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.cronStarted && c.timer == timer {
+			m.background.Go(func() { m.tick(c) })
+		}
+	})
+	c.timer = timer
+}
+
+// tick adds the next job of c, unless the previous one is still active,
+// and arms the timer for the tick after that.
+func (m *Manager) tick(c *cronSchedule) {
+	job := c.newJob()
+	switch err := m.Add(job); err {
+	case nil:
+		m.event(job, "added by schedule %s", c.id)
+	case ErrDuplicate:
+		// The job of a previous tick is still waiting or working
+	default:
+		m.errorf("jobqueue: error adding job of schedule %s: %v", c.id, err)
+	}
+	m.mu.Lock()
+	m.armSchedule(c, c.sched.Next(time.Now()))
+	m.mu.Unlock()
+}
+
+// newJob returns a new job from the template of c.
+func (c *cronSchedule) newJob() *Job {
+	return &Job{
+		Topic:            c.job.Topic,
+		Args:             c.job.Args,
+		Rank:             c.job.Rank,
+		SubPriority:      c.job.SubPriority,
+		MaxRetry:         c.job.MaxRetry,
+		MaxRedeliveries:  c.job.MaxRedeliveries,
+		CorrelationGroup: c.group,
+		CorrelationID:    c.job.CorrelationID,
+		MinWorkerVersion: c.job.MinWorkerVersion,
+		CallbackURL:      c.job.CallbackURL,
+		UniqueKey:        c.id,
+		MutexKey:         c.job.MutexKey,
+		Timeout:          c.job.Timeout,
+		store:            c.job.store,
+	}
+}
+
+// stopSchedules stops the timers of all registered schedules. The
+// schedules are armed again when the manager is restarted. Ticks that
+// are running already are background goroutines, so Stop waits for them.
+func (m *Manager) stopSchedules() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cronStarted = false
+	for _, c := range m.crons {
+		if c.timer != nil {
+			c.timer.Stop()
+			c.timer = nil
+		}
+		c.next = time.Time{}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterSchedule(t *testing.T) {
+	m := New()
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	tests := []struct {
+		Spec string
+		Job  *Job
+		Err  string
+	}{
+		{"*/5 * * * *", &Job{Topic: "topic"}, ""},
+		{"@every 1m", &Job{Topic: "topic"}, ""},
+		{"*/5 * * * *", &Job{Topic: "topic"}, `jobqueue: schedule schedule:topic:*/5 * * * * already registered`},
+		{"*/5 * * * *", &Job{Topic: "topic", UniqueKey: "reconcile"}, ""},
+		{"every minute", &Job{Topic: "topic"}, `jobqueue: invalid schedule "every minute": expected exactly 5 fields, found 2: [every minute]`},
+		{"*/5 * * * *", &Job{Topic: "unknown"}, "jobqueue: topic unknown not registered"},
+		{"*/5 * * * *", &Job{}, "jobqueue: no topic specified"},
+	}
+	for i, tt := range tests {
+		err := m.RegisterSchedule(tt.Spec, tt.Job)
+		if tt.Err == "" && err != nil {
+			t.Errorf("#%d: RegisterSchedule failed with %v", i, err)
+		}
+		if tt.Err != "" && (err == nil || err.Error() != tt.Err) {
+			t.Errorf("#%d: expected error %q, got %v", i, tt.Err, err)
+		}
+	}
+}
+
+func TestManagerSchedule(t *testing.T) {
+	succeeded := make(chan struct{}, 10)
+
+	m := New()
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.RegisterSchedule("@every 1s", &Job{Topic: "topic", CorrelationID: "reconcile"})
+	if err != nil {
+		t.Fatalf("RegisterSchedule failed with %v", err)
+	}
+	if have, want := len(m.Schedules()), 0; have != want {
+		t.Fatalf("len(Schedules) = %d before Start, want %d", have, want)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+
+	schedules := m.Schedules()
+	if have, want := len(schedules), 1; have != want {
+		t.Fatalf("len(Schedules) = %d, want %d", have, want)
+	}
+	if have, want := schedules[0].Spec, "@every 1s"; have != want {
+		t.Fatalf("Spec = %q, want %q", have, want)
+	}
+	if have, want := schedules[0].CorrelationID, "reconcile"; have != want {
+		t.Fatalf("CorrelationID = %q, want %q", have, want)
+	}
+
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if have, want := len(m.Schedules()), 0; have != want {
+		t.Fatalf("len(Schedules) = %d after Stop, want %d", have, want)
+	}
+	rsp, err := m.List(&ListRequest{Topic: "topic", CorrelationGroup: "schedule:topic:@every 1s"})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if rsp.Total < 2 {
+		t.Fatalf("Total = %d, want at least %d", rsp.Total, 2)
+	}
+}
+
+func TestManagerScheduleSkipsOverlap(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	m := New(SetConcurrency(0, 2))
+	err := m.Register("topic", func(args ...interface{}) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.RegisterSchedule("@every 1s", &Job{Topic: "topic"})
+	if err != nil {
+		t.Fatalf("RegisterSchedule failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job start timed out")
+	}
+
+	// Let the schedule tick while the first job is still working
+	time.Sleep(2500 * time.Millisecond)
+	rsp, err := m.List(&ListRequest{Topic: "topic"})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := rsp.Total, 1; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+
+	close(release)
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+func TestManagerScheduleCatchesUpAfterRestart(t *testing.T) {
+	succeeded := make(chan struct{}, 1)
+
+	// A previous manager has added a job two hours ago, so it has missed
+	// the tick an hour ago
+	st := NewInMemoryStore()
+	err := st.Create(&Job{
+		ID:               "previous",
+		Topic:            "topic",
+		State:            Succeeded,
+		Created:          time.Now().Add(-2 * time.Hour).UnixNano(),
+		UniqueKey:        "schedule:topic:@every 1h",
+		CorrelationGroup: "schedule:topic:@every 1h",
+	})
+	if err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	m := New(SetStore(st))
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err = m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.RegisterSchedule("@every 1h", &Job{Topic: "topic"})
+	if err != nil {
+		t.Fatalf("RegisterSchedule failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-succeeded:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job success timed out")
+	}
+
+	// The next job is due an hour after the one that caught up
+	var schedules []*Schedule
+	for i := 0; i < 10 && len(schedules) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		schedules = m.Schedules()
+	}
+	if have, want := len(schedules), 1; have != want {
+		t.Fatalf("len(Schedules) = %d, want %d", have, want)
+	}
+	if next := time.Until(schedules[0].NextRunAt); next < 59*time.Minute {
+		t.Fatalf("NextRunAt is due in %v, want about 1h", next)
+	}
+
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// blockingCreateStore blocks in Create until released.
+type blockingCreateStore struct {
+	*InMemoryStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (st *blockingCreateStore) Create(job *Job) error {
+	select {
+	case st.entered <- struct{}{}:
+	default:
+	}
+	<-st.release
+	return st.InMemoryStore.Create(job)
+}
+
+func TestManagerStopWaitsForScheduleTicks(t *testing.T) {
+	st := &blockingCreateStore{
+		InMemoryStore: NewInMemoryStore(),
+		entered:       make(chan struct{}, 1),
+		release:       make(chan struct{}),
+	}
+	m := New(SetStore(st))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.RegisterSchedule("@every 1s", &Job{Topic: "topic"})
+	if err != nil {
+		t.Fatalf("RegisterSchedule failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-st.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Schedule tick timed out")
+	}
+
+	// The tick is adding its job, so Stop must wait for it
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.Stop() }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v while a tick was running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(st.release)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Stop failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop timed out")
+	}
+}
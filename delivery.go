@@ -0,0 +1,25 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+// DeliveryMode specifies how often a job gets executed in case of errors
+// or crashes. It is configured per topic via SetDeliveryMode.
+type DeliveryMode int
+
+const (
+	// AtLeastOnce executes a job until it succeeds or runs out of retries.
+	// If the manager crashes while a job is working, the job is executed
+	// again after the store recovers it. Processors must be idempotent.
+	// This is the default.
+	AtLeastOnce DeliveryMode = iota
+
+	// AtMostOnce executes a job once at most. The job is marked as
+	// succeeded before the processor is executed. If the processor
+	// returns an error, the job is marked as failed and not retried,
+	// regardless of MaxRetry. If the manager crashes while the job is
+	// executing, the job is lost. Use it for processors where running
+	// a job twice is worse than not running it at all.
+	AtMostOnce
+)
@@ -31,6 +31,16 @@
 // is exponential by default (see backoff.go). However, one can specify a
 // custom backoff function by the manager option SetBackoffFunc.
 //
+// A job can also be configured to run a fixed number of times. To do so,
+// specify the Repeats and RepeatEvery fields in Job. Whenever an occurrence
+// succeeds, the manager adds the next occurrence after RepeatEvery has
+// passed, until Repeats is used up. Failed occurrences do not count unless
+// the manager option SetRepeatCountsFailures is used.
+//
+// Jobs are delivered at least once by default, i.e. a job may be executed
+// again after a crash. For processors that must never run twice, use the
+// manager option SetDeliveryMode to switch a topic to AtMostOnce delivery.
+//
 // If the manager crashes and gets restarted, the Store gets started via the
 // Start method. This gives the store implementation a chance to do cleanup.
 // E.g. the MySQL-based store implementation moves all jobs still marked as
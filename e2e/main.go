@@ -45,18 +45,22 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
+	// Log to the standard error output, as the manager and the stores
+	// log nothing by default
+	stderr := log.New(os.Stderr, "", log.LstdFlags)
+
 	// Initialize the store
 	var err error
 	var store jobqueue.Store
 	switch *dbtype {
 	case "mysql":
-		var dboptions []mysql.StoreOption
+		dboptions := []mysql.StoreOption{mysql.SetLogger(stderr)}
 		if *dbdebug {
 			dboptions = append(dboptions, mysql.SetDebug(true))
 		}
 		store, err = mysql.NewStore(*dburl, dboptions...)
 	case "mongodb":
-		var dboptions []mongodb.StoreOption
+		dboptions := []mongodb.StoreOption{mongodb.SetLogger(stderr)}
 		store, err = mongodb.NewStore(*dburl, dboptions...)
 	case "memory":
 	default:
@@ -67,7 +71,7 @@ func main() {
 	}
 
 	// Initialize the manager
-	var options []jobqueue.ManagerOption
+	options := []jobqueue.ManagerOption{jobqueue.SetLogger(stderr)}
 	if store != nil {
 		options = append(options, jobqueue.SetStore(store))
 	}
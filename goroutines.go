@@ -0,0 +1,38 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// goroutines keeps track of a group of goroutines, so that they can be
+// counted and waited for.
+type goroutines struct {
+	wg sync.WaitGroup
+	n  int64 // number of goroutines running
+}
+
+// Go runs f in a new goroutine of the group.
+func (g *goroutines) Go(f func()) {
+	g.wg.Add(1)
+	atomic.AddInt64(&g.n, 1)
+	go func() {
+		defer g.wg.Done()
+		defer atomic.AddInt64(&g.n, -1)
+		f()
+	}()
+}
+
+// Len returns the number of goroutines of the group that are running.
+func (g *goroutines) Len() int {
+	return int(atomic.LoadInt64(&g.n))
+}
+
+// Wait waits for all goroutines of the group to return.
+func (g *goroutines) Wait() {
+	g.wg.Wait()
+}
@@ -6,20 +6,29 @@ package jobqueue
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // InMemoryStore is a simple in-memory store implementation.
 // It implements the Store interface. Do not use in production.
 type InMemoryStore struct {
-	mu   sync.Mutex
-	jobs map[string]Job
+	mu     sync.Mutex
+	jobs   map[string]Job
+	seq    int64                // last sequence number
+	seqs   map[string]int64     // maps job identifier to its sequence number
+	leases map[string]time.Time // maps job identifier to the expiration of its lease
 }
 
 // NewInMemoryStore creates a new InMemoryStore.
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
-		jobs: make(map[string]Job),
+		jobs:   make(map[string]Job),
+		seqs:   make(map[string]int64),
+		leases: make(map[string]time.Time),
 	}
 }
 
@@ -28,11 +37,47 @@ func (st *InMemoryStore) Start() error {
 	return nil
 }
 
-// Create adds a new job.
+// Create adds a new job. It returns ErrDuplicate if there is an active
+// job with the same unique key.
 func (st *InMemoryStore) Create(job *Job) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
+	if st.active(job.UniqueKey) != nil {
+		return ErrDuplicate
+	}
 	st.jobs[job.ID] = *job
+	st.seq++
+	st.seqs[job.ID] = st.seq
+	return nil
+}
+
+// CreateOrGet adds a new job, unless there is an active job with the
+// same unique key.
+func (st *InMemoryStore) CreateOrGet(job *Job) (*Job, bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if existing := st.active(job.UniqueKey); existing != nil {
+		return existing, false, nil
+	}
+	st.jobs[job.ID] = *job
+	st.seq++
+	st.seqs[job.ID] = st.seq
+	return job, true, nil
+}
+
+// active returns a copy of the waiting or working job with the given
+// unique key, or nil if there is none or the key is empty. The caller must
+// hold st.mu.
+func (st *InMemoryStore) active(uniqueKey string) *Job {
+	if uniqueKey == "" {
+		return nil
+	}
+	for _, existing := range st.jobs {
+		if existing.UniqueKey == uniqueKey && (existing.State == Waiting || existing.State == Working) {
+			dup := existing
+			return &dup
+		}
+	}
 	return nil
 }
 
@@ -41,31 +86,374 @@ func (st *InMemoryStore) Delete(job *Job) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 	delete(st.jobs, job.ID)
+	delete(st.seqs, job.ID)
+	delete(st.leases, job.ID)
 	return nil
 }
 
-// Update updates the job.
+// Update updates the job. It returns ErrNotFound if the job has been
+// deleted, and ErrInvalidTransition if it is in a terminal state.
 func (st *InMemoryStore) Update(job *Job) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	st.jobs[job.ID] = *job
+	prev, found := st.jobs[job.ID]
+	if !found {
+		return ErrNotFound
+	}
+	if IsTerminal(prev.State) {
+		return ErrInvalidTransition
+	}
+	st.put(*job)
+	return nil
+}
+
+// put stores job, releasing its lease (see ReserveBatch) if it is not
+// working anymore. The caller must hold st.mu.
+func (st *InMemoryStore) put(job Job) {
+	st.jobs[job.ID] = job
+	if job.State != Working {
+		delete(st.leases, job.ID)
+	}
+}
+
+// UpdateBatch updates several jobs at once. See BatchUpdateStore.
+func (st *InMemoryStore) UpdateBatch(jobs []*Job) []error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	errs := make([]error, len(jobs))
+	for i, job := range jobs {
+		prev, found := st.jobs[job.ID]
+		switch {
+		case !found:
+			errs[i] = ErrNotFound
+		case IsTerminal(prev.State):
+			errs[i] = ErrInvalidTransition
+		default:
+			st.put(*job)
+		}
+	}
+	return errs
+}
+
+// ResetRetries sets the retry counter of a waiting job back to zero.
+func (st *InMemoryStore) ResetRetries(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	job, found := st.jobs[id]
+	if !found || job.State != Waiting {
+		return ErrNotFound
+	}
+	job.Retry = 0
+	job.Updated = time.Now().UnixNano()
+	st.jobs[id] = job
+	return nil
+}
+
+// Heartbeat records that the worker is still working on the job.
+func (st *InMemoryStore) Heartbeat(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	job, found := st.jobs[id]
+	if !found || job.State != Working {
+		return nil
+	}
+	job.Heartbeat = time.Now().UnixNano()
+	st.jobs[id] = job
+	return nil
+}
+
+// ReclaimExpired recovers working jobs without a recent heartbeat.
+func (st *InMemoryStore) ReclaimExpired(olderThan time.Duration) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-olderThan).UnixNano()
+	var n int
+	for id, job := range st.jobs {
+		claimed := job.ClaimedAt
+		if claimed == 0 {
+			// Claimed before ClaimedAt was recorded
+			claimed = job.Started
+		}
+		if job.State != Working || job.Heartbeat >= cutoff || claimed >= cutoff {
+			continue
+		}
+		if expires, leased := st.leases[id]; leased && now.Before(expires) {
+			// The external worker still holds the lease
+			continue
+		}
+		switch {
+		case job.MaxRedeliveries > 0 && job.Redeliveries >= job.MaxRedeliveries:
+			job.State = Failed
+			job.Completed = now.UnixNano()
+			job.LastError = ErrMaxRedeliveries.Error()
+		case job.Retry >= job.MaxRetry:
+			job.State = Failed
+			job.Completed = now.UnixNano()
+		default:
+			job.State = Waiting
+			job.Retry++
+			job.Redeliveries++
+		}
+		job.Updated = now.UnixNano()
+		st.put(job)
+		n++
+	}
+	return n, nil
+}
+
+// CompareAndSetState changes the state of a job if it is currently in
+// the from state.
+func (st *InMemoryStore) CompareAndSetState(id, from, to string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	job, found := st.jobs[id]
+	if !found || job.State != from {
+		return false, nil
+	}
+	job.State = to
+	job.Updated = time.Now().UnixNano()
+	st.put(job)
+	return true, nil
+}
+
+// RenameTopic moves the jobs of a topic to another topic. If states are
+// given, only the jobs in one of them are moved. See TopicRenameStore.
+func (st *InMemoryStore) RenameTopic(from, to string, states ...string) (int64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	moved := make(map[string]bool, len(states))
+	for _, state := range states {
+		moved[state] = true
+	}
+	var n int64
+	now := time.Now().UnixNano()
+	for id, job := range st.jobs {
+		if job.Topic != from || (len(states) > 0 && !moved[job.State]) {
+			continue
+		}
+		job.Topic = to
+		job.Updated = now
+		st.jobs[id] = job
+		n++
+	}
+	return n, nil
+}
+
+// ReserveBatch claims up to n jobs and leases them for the given duration.
+func (st *InMemoryStore) ReserveBatch(n int, lease time.Duration) ([]*ReservedJob, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	var candidates []*Job
+	for _, job := range st.jobs {
+		expires, leased := st.leases[job.ID]
+		if (job.State == Waiting && job.RunAt <= now.UnixNano()) || (job.State == Working && leased && now.After(expires)) {
+			dup := job
+			candidates = append(candidates, &dup)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if executesBefore(a, b) || executesBefore(b, a) {
+			return executesBefore(a, b)
+		}
+		return st.seqs[a.ID] < st.seqs[b.ID]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	token := uuid.New().String()
+	expires := now.Add(lease)
+	var list []*ReservedJob
+	for _, job := range candidates {
+		job.State = Working
+		job.Started = now.UnixNano()
+		job.ClaimedAt = now.UnixNano()
+		job.Heartbeat = now.UnixNano()
+		job.Updated = now.UnixNano()
+		st.jobs[job.ID] = *job
+		st.leases[job.ID] = expires
+		list = append(list, &ReservedJob{Job: job, Token: token, LeaseExpires: expires})
+	}
+	return list, nil
+}
+
+// FailAndRetry records a failed attempt of a working job, and either
+// retries it after delay or moves it into the Failed state.
+func (st *InMemoryStore) FailAndRetry(id string, delay time.Duration, errMsg string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	job, found := st.jobs[id]
+	if !found {
+		return ErrNotFound
+	}
+	if job.State != Working {
+		return ErrInvalidTransition
+	}
+	now := time.Now()
+	job.LastError = errMsg
+	if job.Retry >= job.MaxRetry {
+		job.State = Failed
+		job.Completed = now.UnixNano()
+	} else {
+		job.State = Waiting
+		job.Retry++
+		job.RunAt = now.Add(delay).UnixNano()
+		job.Priority = -job.RunAt
+	}
+	job.Updated = now.UnixNano()
+	st.put(job)
 	return nil
 }
 
-// Next picks the next job to execute.
-func (st *InMemoryStore) Next() (*Job, error) {
+// ImportTerminal adds jobs that are in a terminal state already.
+func (st *InMemoryStore) ImportTerminal(jobs []*Job) error {
+	for _, job := range jobs {
+		if !IsTerminal(job.State) {
+			return fmt.Errorf("jobqueue: cannot import job %s in state %s", job.ID, job.State)
+		}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, job := range jobs {
+		st.jobs[job.ID] = *job
+		st.seq++
+		st.seqs[job.ID] = st.seq
+	}
+	return nil
+}
+
+// Next claims the next job to execute.
+func (st *InMemoryStore) Next(req *NextRequest) (*Job, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rejected := make(map[string]bool) // jobs vetoed by req.Gate
+	for {
+		next := st.pick(req, func(job *Job) bool { return rejected[job.ID] })
+		if next == nil {
+			return nil, nil
+		}
+		if req.Gate != nil {
+			ok, err := req.Gate(next)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				rejected[next.ID] = true
+				continue
+			}
+		}
+		st.claim(next, req)
+		return next, nil
+	}
+}
+
+// NextWithMutex claims the next job to execute whose mutex key is not held.
+func (st *InMemoryStore) NextWithMutex(req *NextRequest) (*Job, error) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
+	held := make(map[string]bool)
+	for _, job := range st.jobs {
+		if job.State == Working && job.MutexKey != "" {
+			held[job.MutexKey] = true
+		}
+	}
+	next := st.pick(req, func(job *Job) bool { return held[job.MutexKey] })
+	if next == nil {
+		return nil, ErrNotFound
+	}
+	st.claim(next, req)
+	return next, nil
+}
+
+// claim moves the picked job into the Working state. The caller must hold
+// st.mu.
+func (st *InMemoryStore) claim(job *Job, req *NextRequest) {
+	now := time.Now().UnixNano()
+	job.State = Working
+	job.WorkerID = req.WorkerID
+	job.Started = now
+	job.ClaimedAt = now
+	job.Heartbeat = now
+	job.Updated = now
+	st.jobs[job.ID] = *job
+	delete(st.leases, job.ID)
+}
+
+// pick returns a copy of the next waiting job to execute, ignoring the
+// jobs that skip returns true for (if specified). The caller must hold
+// st.mu.
+func (st *InMemoryStore) pick(req *NextRequest, skip func(*Job) bool) *Job {
+	before := executesBefore
+	seqBefore := func(a, b *Job) bool { return st.seqs[a.ID] < st.seqs[b.ID] }
+	switch {
+	case req.FIFO:
+		before = createdBefore
+	case req.LIFO:
+		before = func(a, b *Job) bool { return createdBefore(b, a) }
+		seqBefore = func(a, b *Job) bool { return st.seqs[a.ID] > st.seqs[b.ID] }
+	}
+	if req.Fair {
+		// Let the correlation identifier claimed least recently go first
+		lastClaimed := make(map[string]int64)
+		for _, job := range st.jobs {
+			if job.ClaimedAt > lastClaimed[job.CorrelationID] {
+				lastClaimed[job.CorrelationID] = job.ClaimedAt
+			}
+		}
+		order := before
+		before = func(a, b *Job) bool {
+			if la, lb := lastClaimed[a.CorrelationID], lastClaimed[b.CorrelationID]; la != lb {
+				return la < lb
+			}
+			return order(a, b)
+		}
+	}
+	excluded := make(map[string]bool, len(req.ExcludeTopics))
+	for _, topic := range req.ExcludeTopics {
+		excluded[topic] = true
+	}
+	now := time.Now().UnixNano()
 	var next *Job
 	for _, job := range st.jobs {
+		if job.MinWorkerVersion > req.WorkerVersion || job.RunAt > now || excluded[job.Topic] {
+			continue
+		}
+		if skip != nil && skip(&job) {
+			continue
+		}
 		if job.State == Waiting {
-			if next == nil || job.Rank > next.Rank || job.Priority > next.Priority {
+			// Jobs that compare equal are picked in the order they were created
+			// (or the reverse order in LIFO mode)
+			if next == nil || before(&job, next) || (!before(next, &job) && seqBefore(&job, next)) {
 				dup := job
 				next = &dup
 			}
 		}
 	}
-	return next, nil
+	return next
+}
+
+// executesBefore returns true if a should be executed before b, i.e.
+// ordered by rank, priority, and sub-priority (highest first), then by
+// creation time (oldest first).
+func executesBefore(a, b *Job) bool {
+	if a.Rank != b.Rank {
+		return a.Rank > b.Rank
+	}
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.SubPriority != b.SubPriority {
+		return a.SubPriority > b.SubPriority
+	}
+	return a.Created < b.Created
+}
+
+// createdBefore returns true if a has been created before b.
+func createdBefore(a, b *Job) bool {
+	return a.Created < b.Created
 }
 
 // Stats returns statistics about the jobs in the store.
@@ -80,9 +468,9 @@ func (st *InMemoryStore) Stats(req *StatsRequest) (*Stats, error) {
 		if req.CorrelationGroup != "" && job.CorrelationGroup != req.CorrelationGroup {
 			continue
 		}
+		// Other states, e.g. NeedsReview or the one set via
+		// SetZeroRetryFailureState, are not part of Stats
 		switch job.State {
-		default:
-			return nil, fmt.Errorf("found unknown state %v", job.State)
 		case Waiting:
 			stats.Waiting++
 		case Working:
@@ -91,11 +479,41 @@ func (st *InMemoryStore) Stats(req *StatsRequest) (*Stats, error) {
 			stats.Succeeded++
 		case Failed:
 			stats.Failed++
+		case Cancelled:
+			stats.Cancelled++
 		}
 	}
 	return stats, nil
 }
 
+// StatsByTopic returns statistics about the jobs in the store, grouped
+// by topic.
+func (st *InMemoryStore) StatsByTopic() (map[string]*Stats, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	result := make(map[string]*Stats)
+	for _, job := range st.jobs {
+		stats, found := result[job.Topic]
+		if !found {
+			stats = &Stats{}
+			result[job.Topic] = stats
+		}
+		switch job.State {
+		case Waiting:
+			stats.Waiting++
+		case Working:
+			stats.Working++
+		case Succeeded:
+			stats.Succeeded++
+		case Failed:
+			stats.Failed++
+		case Cancelled:
+			stats.Cancelled++
+		}
+	}
+	return result, nil
+}
+
 // Lookup returns the job with the specified identifier (or ErrNotFound).
 func (st *InMemoryStore) Lookup(id string) (*Job, error) {
 	st.mu.Lock()
@@ -123,33 +541,52 @@ func (st *InMemoryStore) LookupByCorrelationID(correlationID string) ([]*Job, er
 	return result, nil
 }
 
-// List finds matching jobs.
+// List finds matching jobs. Jobs are ordered by the time they were last
+// updated, most recent first, with ties broken by the order they were
+// created in.
 func (st *InMemoryStore) List(req *ListRequest) (*ListResponse, error) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	rsp := &ListResponse{}
-	i := -1
+	var list []*Job
 	for _, job := range st.jobs {
-		var skip bool
 		if req.Topic != "" && req.Topic != job.Topic {
-			skip = true
+			continue
 		}
 		if req.State != "" && job.State != req.State {
-			skip = true
+			continue
 		}
-		if req.Offset > 0 && req.Offset < i {
-			skip = true
-			rsp.Total++
+		if req.CorrelationGroup != "" && job.CorrelationGroup != req.CorrelationGroup {
+			continue
 		}
-		if req.Limit > 0 && i > req.Limit {
-			skip = true
-			rsp.Total++
+		if req.CorrelationID != "" && job.CorrelationID != req.CorrelationID {
+			continue
 		}
-		if !skip {
-			dup := job
-			rsp.Jobs = append(rsp.Jobs, &dup)
+		if req.CreatedAfter > 0 && job.Created <= req.CreatedAfter {
+			continue
+		}
+		if req.CreatedBefore > 0 && job.Created >= req.CreatedBefore {
+			continue
+		}
+		dup := job
+		list = append(list, &dup)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Updated != list[j].Updated {
+			return list[i].Updated > list[j].Updated
 		}
-		i++
+		return st.seqs[list[i].ID] > st.seqs[list[j].ID]
+	})
+	rsp := &ListResponse{Total: len(list)}
+	if req.Offset > 0 {
+		if req.Offset >= len(list) {
+			list = nil
+		} else {
+			list = list[req.Offset:]
+		}
+	}
+	if req.Limit > 0 && req.Limit < len(list) {
+		list = list[:req.Limit]
 	}
+	rsp.Jobs = list
 	return rsp, nil
 }
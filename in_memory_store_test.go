@@ -0,0 +1,988 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemoryStoreListIsStable(t *testing.T) {
+	st := NewInMemoryStore()
+	const n = 25
+	for i := 0; i < n; i++ {
+		job := &Job{
+			ID:      fmt.Sprintf("job-%02d", i),
+			Topic:   "topic",
+			State:   Waiting,
+			Updated: 42, // same for all jobs
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for run := 0; run < 3; run++ {
+		var ids []string
+		for offset := 0; offset < n; offset += 10 {
+			rsp, err := st.List(&ListRequest{Offset: offset, Limit: 10})
+			if err != nil {
+				t.Fatalf("List failed with %v", err)
+			}
+			if have, want := rsp.Total, n; have != want {
+				t.Fatalf("Total = %d, want %d", have, want)
+			}
+			for _, job := range rsp.Jobs {
+				ids = append(ids, job.ID)
+			}
+		}
+		if have, want := len(ids), n; have != want {
+			t.Fatalf("found %d jobs across pages, want %d", have, want)
+		}
+		for i, id := range ids {
+			if have, want := id, fmt.Sprintf("job-%02d", n-1-i); have != want {
+				t.Fatalf("run %d: jobs[%d] = %q, want %q", run, i, have, want)
+			}
+		}
+	}
+}
+
+func TestInMemoryStoreListFilters(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "1", Topic: "a", CorrelationID: "x", State: Waiting, Created: 10},
+		{ID: "2", Topic: "a", CorrelationID: "y", State: Waiting, Created: 20},
+		{ID: "3", Topic: "b", CorrelationID: "x", State: Succeeded, Created: 30},
+		{ID: "4", Topic: "a", CorrelationID: "x", State: Waiting, Created: 40},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	tests := []struct {
+		Request *ListRequest
+		Want    []string
+	}{
+		{&ListRequest{}, []string{"1", "2", "3", "4"}},
+		{&ListRequest{State: Waiting}, []string{"1", "2", "4"}},
+		{&ListRequest{Topic: "a"}, []string{"1", "2", "4"}},
+		{&ListRequest{CorrelationID: "x"}, []string{"1", "3", "4"}},
+		{&ListRequest{CreatedAfter: 10, CreatedBefore: 40}, []string{"2", "3"}},
+		{&ListRequest{Topic: "a", CorrelationID: "x", CreatedAfter: 20}, []string{"4"}},
+		{&ListRequest{Topic: "a", CorrelationID: "x", CreatedAfter: 20, Limit: 1, Offset: 1}, nil},
+	}
+	for i, tt := range tests {
+		rsp, err := st.List(tt.Request)
+		if err != nil {
+			t.Fatalf("#%d: List failed with %v", i, err)
+		}
+		var ids []string
+		for _, job := range rsp.Jobs {
+			ids = append(ids, job.ID)
+		}
+		sort.Strings(ids)
+		if have, want := strings.Join(ids, ","), strings.Join(tt.Want, ","); have != want {
+			t.Errorf("#%d: jobs = %q, want %q", i, have, want)
+		}
+		if tt.Request.Offset == 0 && rsp.Total != len(tt.Want) {
+			t.Errorf("#%d: Total = %d, want %d", i, rsp.Total, len(tt.Want))
+		}
+	}
+}
+
+func TestInMemoryStoreStatsByTopic(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "1", Topic: "a", State: Waiting},
+		{ID: "2", Topic: "a", State: Waiting},
+		{ID: "3", Topic: "a", State: Failed},
+		{ID: "4", Topic: "b", State: Succeeded},
+		{ID: "5", Topic: "b", State: Cancelled},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	stats, err := st.StatsByTopic()
+	if err != nil {
+		t.Fatalf("StatsByTopic failed with %v", err)
+	}
+	want := map[string]Stats{
+		"a": {Waiting: 2, Failed: 1},
+		"b": {Succeeded: 1, Cancelled: 1},
+	}
+	if have, want := len(stats), len(want); have != want {
+		t.Fatalf("len(stats) = %d, want %d", have, want)
+	}
+	for topic, w := range want {
+		if s := stats[topic]; s == nil || *s != w {
+			t.Errorf("stats[%q] = %+v, want %+v", topic, s, w)
+		}
+	}
+}
+
+func TestInMemoryStoreStatsIgnoresCustomStates(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "1", Topic: "a", State: Waiting},
+		{ID: "2", Topic: "a", State: "DeadLetter"},
+		{ID: "3", Topic: "a", State: NeedsReview},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	stats, err := st.Stats(&StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := *stats, (Stats{Waiting: 1}); have != want {
+		t.Fatalf("Stats = %+v, want %+v", have, want)
+	}
+}
+
+func TestInMemoryStoreRenameTopicStates(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "1", Topic: "emailV1", State: Waiting},
+		{ID: "2", Topic: "emailV1", State: Working},
+		{ID: "3", Topic: "emailV1", State: Succeeded},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	n, err := st.RenameTopic("emailV1", "email", Waiting)
+	if err != nil {
+		t.Fatalf("RenameTopic failed with %v", err)
+	}
+	if have, want := n, int64(1); have != want {
+		t.Fatalf("RenameTopic returned %d, want %d", have, want)
+	}
+	for id, want := range map[string]string{"1": "email", "2": "emailV1", "3": "emailV1"} {
+		job, err := st.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have := job.Topic; have != want {
+			t.Fatalf("job %q: Topic = %q, want %q", id, have, want)
+		}
+	}
+}
+
+func TestInMemoryStoreNextOrdersBySubPriority(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "low", State: Waiting, Priority: 10, SubPriority: 1, Created: 1},
+		{ID: "high", State: Waiting, Priority: 10, SubPriority: 3, Created: 2},
+		{ID: "medium", State: Waiting, Priority: 10, SubPriority: 2, Created: 3},
+		{ID: "lower-priority", State: Waiting, Priority: 5, SubPriority: 100, Created: 4},
+		{ID: "medium-newer", State: Waiting, Priority: 10, SubPriority: 2, Created: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"high", "medium", "medium-newer", "low", "lower-priority"} {
+		job, err := st.Next(&NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if job == nil {
+			t.Fatalf("Next returned no job, want %q", want)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+		job.State = Succeeded
+		if err := st.Update(job); err != nil {
+			t.Fatalf("Update failed with %v", err)
+		}
+	}
+}
+
+func TestInMemoryStoreNextOrdersByCreated(t *testing.T) {
+	st := NewInMemoryStore()
+	// Jobs of the same priority, enqueued out of order
+	jobs := []*Job{
+		{ID: "second", State: Waiting, Priority: 10, Created: 20},
+		{ID: "fourth", State: Waiting, Priority: 10, Created: 40},
+		{ID: "first", State: Waiting, Priority: 10, Created: 10},
+		{ID: "third", State: Waiting, Priority: 10, Created: 30},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"first", "second", "third", "fourth"} {
+		job, err := st.Next(&NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if job == nil {
+			t.Fatalf("Next returned no job, want %q", want)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+		job.State = Succeeded
+		if err := st.Update(job); err != nil {
+			t.Fatalf("Update failed with %v", err)
+		}
+	}
+}
+
+func TestInMemoryStoreNextExcludeTopics(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "email", Topic: "email", State: Waiting, Priority: 10},
+		{ID: "sms", Topic: "sms", State: Waiting, Priority: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	job, err := st.Next(&NextRequest{ExcludeTopics: []string{"email"}})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job == nil || job.ID != "sms" {
+		t.Fatalf("Next = %v, want %q", job, "sms")
+	}
+	job, err = st.Next(&NextRequest{ExcludeTopics: []string{"email"}})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job != nil {
+		t.Fatalf("Next = %q, want no job", job.ID)
+	}
+	job, err = st.Lookup("email")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != Waiting {
+		t.Fatalf("State = %q, want %q", job.State, Waiting)
+	}
+}
+
+func TestInMemoryStoreNextClaimsJob(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	job, err := st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job == nil {
+		t.Fatal("expected Next to return a job")
+	}
+	if have, want := job.State, Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if job.Started == 0 {
+		t.Fatal("expected Started to be set")
+	}
+	if job.ClaimedAt == 0 {
+		t.Fatal("expected ClaimedAt to be set")
+	}
+	stored, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := stored.State, Working; have != want {
+		t.Fatalf("stored State = %q, want %q", have, want)
+	}
+
+	// The job must not be claimed twice
+	job, err = st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job != nil {
+		t.Fatalf("expected Next to return no job, got %q", job.ID)
+	}
+}
+
+func TestInMemoryStoreNextSkipsDelayedJobs(t *testing.T) {
+	st := NewInMemoryStore()
+	now := time.Now()
+	jobs := []*Job{
+		{ID: "delayed", Topic: "topic", State: Waiting, Priority: 10, RunAt: now.Add(time.Hour).UnixNano()},
+		{ID: "due", Topic: "topic", State: Waiting, Priority: 5, RunAt: now.Add(-time.Second).UnixNano()},
+		{ID: "legacy", Topic: "topic", State: Waiting, Priority: 1},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"due", "legacy"} {
+		job, err := st.Next(&NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if job == nil {
+			t.Fatalf("Next returned no job, want %q", want)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+	}
+	job, err := st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job != nil {
+		t.Fatalf("expected Next to return no job, got %q", job.ID)
+	}
+}
+
+func TestInMemoryStoreCompareAndSetState(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	tests := []struct {
+		From    string
+		To      string
+		Changed bool
+		State   string
+	}{
+		{Working, Succeeded, false, Waiting},
+		{Waiting, Working, true, Working},
+		{Waiting, Working, false, Working},
+		{Working, Succeeded, true, Succeeded},
+	}
+	for i, tt := range tests {
+		changed, err := st.CompareAndSetState("1", tt.From, tt.To)
+		if err != nil {
+			t.Fatalf("#%d: CompareAndSetState failed with %v", i, err)
+		}
+		if have, want := changed, tt.Changed; have != want {
+			t.Fatalf("#%d: CompareAndSetState(%q, %q) = %v, want %v", i, tt.From, tt.To, have, want)
+		}
+		job, err := st.Lookup("1")
+		if err != nil {
+			t.Fatalf("#%d: Lookup failed with %v", i, err)
+		}
+		if have, want := job.State, tt.State; have != want {
+			t.Fatalf("#%d: State = %q, want %q", i, have, want)
+		}
+	}
+
+	changed, err := st.CompareAndSetState("no-such-job", Waiting, Working)
+	if err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if changed {
+		t.Fatal("expected CompareAndSetState of unknown job to report no change")
+	}
+}
+
+func TestInMemoryStoreNextOrdersBySequence(t *testing.T) {
+	st := NewInMemoryStore()
+	ids := []string{"b", "c", "a"}
+	for _, id := range ids {
+		// Same timestamps and priorities for all jobs
+		job := &Job{ID: id, Topic: "topic", State: Waiting, Created: 42}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, fifo := range []bool{false, true} {
+		var order []string
+		for range ids {
+			job, err := st.Next(&NextRequest{FIFO: fifo})
+			if err != nil {
+				t.Fatalf("Next failed with %v", err)
+			}
+			order = append(order, job.ID)
+			job.State = Working
+			if err := st.Update(job); err != nil {
+				t.Fatalf("Update failed with %v", err)
+			}
+		}
+		if have, want := strings.Join(order, ","), "b,c,a"; have != want {
+			t.Fatalf("FIFO=%v: order = %q, want %q", fifo, have, want)
+		}
+		for _, id := range ids {
+			if _, err := st.CompareAndSetState(id, Working, Waiting); err != nil {
+				t.Fatalf("CompareAndSetState failed with %v", err)
+			}
+		}
+	}
+}
+
+func TestInMemoryStoreNextFair(t *testing.T) {
+	st := NewInMemoryStore()
+	// The big correlation identifier has many jobs that are older than
+	// the ones of the small one
+	for i := 0; i < 10; i++ {
+		job := &Job{ID: fmt.Sprintf("big-%d", i), Topic: "topic", State: Waiting, CorrelationID: "big", Created: int64(i)}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		job := &Job{ID: fmt.Sprintf("small-%d", i), Topic: "topic", State: Waiting, CorrelationID: "small", Created: int64(100 + i)}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		job, err := st.Next(&NextRequest{Fair: true})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		order = append(order, job.ID)
+	}
+	if have, want := strings.Join(order, ","), "big-0,small-0,big-1,small-1,big-2"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreUpdateOfTerminalJob(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Working}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	// Two workers finalize the same job
+	first, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	second, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	first.State = Succeeded
+	if err := st.Update(first); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	second.State = Failed
+	if err := st.Update(second); err != ErrInvalidTransition {
+		t.Fatalf("expected Update to return ErrInvalidTransition, got %v", err)
+	}
+
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreReserveBatch(t *testing.T) {
+	st := NewInMemoryStore()
+	const n = 50
+	for i := 0; i < n; i++ {
+		job := &Job{ID: fmt.Sprint(i), Topic: "topic", State: Waiting}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	// Two reservers compete for the jobs
+	var (
+		mu       sync.Mutex
+		reserved = make(map[string]int)
+		wg       sync.WaitGroup
+	)
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				list, err := st.ReserveBatch(3, time.Minute)
+				if err != nil {
+					t.Errorf("ReserveBatch failed with %v", err)
+					return
+				}
+				if len(list) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, rj := range list {
+					reserved[rj.Job.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if have, want := len(reserved), n; have != want {
+		t.Fatalf("reserved %d jobs, want %d", have, want)
+	}
+	for id, count := range reserved {
+		if count != 1 {
+			t.Fatalf("job %q reserved %d times, want 1", id, count)
+		}
+	}
+	job, err := st.Lookup("0")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreReserveBatchAfterLeaseExpired(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	list, err := st.ReserveBatch(10, -time.Second) // expires immediately
+	if err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	if have, want := len(list), 1; have != want {
+		t.Fatalf("len(list) = %d, want %d", have, want)
+	}
+	again, err := st.ReserveBatch(10, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	if have, want := len(again), 1; have != want {
+		t.Fatalf("len(list) = %d, want %d", have, want)
+	}
+	if again[0].Token == list[0].Token {
+		t.Fatal("expected a new token for the new reservation")
+	}
+	none, err := st.ReserveBatch(10, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	if have, want := len(none), 0; have != want {
+		t.Fatalf("len(list) = %d, want %d", have, want)
+	}
+}
+
+func TestInMemoryStoreReserveBatchAfterRetry(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting, MaxRetry: 1}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	list, err := st.ReserveBatch(10, -time.Second) // expires immediately
+	if err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	if have, want := len(list), 1; have != want {
+		t.Fatalf("len(list) = %d, want %d", have, want)
+	}
+	if err := st.FailAndRetry("1", 0, "boom"); err != nil {
+		t.Fatalf("FailAndRetry failed with %v", err)
+	}
+	job, err := st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := job.ID, "1"; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	// The job is claimed via Next now, so the expired lease is gone
+	again, err := st.ReserveBatch(10, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	if have, want := len(again), 0; have != want {
+		t.Fatalf("len(list) = %d, want %d", have, want)
+	}
+}
+
+func TestInMemoryStoreReclaimExpiredKeepsLeasedJobs(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	if _, err := st.ReserveBatch(10, time.Minute); err != nil {
+		t.Fatalf("ReserveBatch failed with %v", err)
+	}
+	n, err := st.ReclaimExpired(0)
+	if err != nil {
+		t.Fatalf("ReclaimExpired failed with %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("ReclaimExpired reclaimed %d jobs, want 0", n)
+	}
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreFailAndRetry(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Working, MaxRetry: 1}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	if err := st.FailAndRetry("1", time.Hour, "boom"); err != nil {
+		t.Fatalf("FailAndRetry failed with %v", err)
+	}
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.Retry, 1; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := job.LastError, "boom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+	if min := time.Now().Add(59 * time.Minute).UnixNano(); job.RunAt < min {
+		t.Fatalf("RunAt = %d, want at least %d", job.RunAt, min)
+	}
+
+	// A job created now must be picked before the delayed one
+	if err := st.Create(&Job{ID: "2", Topic: "topic", State: Waiting, Priority: -time.Now().UnixNano()}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	next, err := st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := next.ID, "2"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+
+	// Only working jobs can fail
+	if err := st.FailAndRetry("1", time.Hour, "boom"); err != ErrInvalidTransition {
+		t.Fatalf("expected FailAndRetry to return ErrInvalidTransition, got %v", err)
+	}
+	if err := st.FailAndRetry("no-such-job", time.Hour, "boom"); err != ErrNotFound {
+		t.Fatalf("expected FailAndRetry to return ErrNotFound, got %v", err)
+	}
+
+	// Retries exhausted
+	if _, err := st.CompareAndSetState("1", Waiting, Working); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if err := st.FailAndRetry("1", time.Hour, "boom again"); err != nil {
+		t.Fatalf("FailAndRetry failed with %v", err)
+	}
+	job, err = st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Failed; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.LastError, "boom again"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreImportTerminal(t *testing.T) {
+	st := NewInMemoryStore()
+	err := st.ImportTerminal([]*Job{
+		{ID: "1", Topic: "topic", State: Succeeded, Priority: 100},
+		{ID: "2", Topic: "topic", State: Waiting},
+	})
+	if err == nil {
+		t.Fatal("expected ImportTerminal of a waiting job to fail")
+	}
+	if _, err := st.Lookup("1"); err != ErrNotFound {
+		t.Fatalf("expected no job to be imported, got %v", err)
+	}
+
+	err = st.ImportTerminal([]*Job{
+		{ID: "1", Topic: "topic", State: Succeeded, Priority: 100},
+		{ID: "2", Topic: "topic", State: Failed, Priority: 100},
+	})
+	if err != nil {
+		t.Fatalf("ImportTerminal failed with %v", err)
+	}
+	job, err := st.Next(&NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job != nil {
+		t.Fatalf("expected Next to return no job, got %q", job.ID)
+	}
+	rsp, err := st.List(&ListRequest{})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := rsp.Total, 2; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+	stats, err := st.Stats(&StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if stats.Succeeded != 1 || stats.Failed != 1 || stats.Waiting != 0 {
+		t.Fatalf("Stats = %+v, want 1 succeeded and 1 failed job", stats)
+	}
+}
+
+func TestInMemoryStoreCreateOrGet(t *testing.T) {
+	st := NewInMemoryStore()
+	first, created, err := st.CreateOrGet(&Job{ID: "1", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"})
+	if err != nil {
+		t.Fatalf("CreateOrGet failed with %v", err)
+	}
+	if !created {
+		t.Fatal("expected first job to be created")
+	}
+	second, created, err := st.CreateOrGet(&Job{ID: "2", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"})
+	if err != nil {
+		t.Fatalf("CreateOrGet failed with %v", err)
+	}
+	if created {
+		t.Fatal("expected second job not to be created")
+	}
+	if have, want := second.ID, first.ID; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	if _, err := st.Lookup("2"); err != ErrNotFound {
+		t.Fatalf("expected second job not to be stored, got %v", err)
+	}
+
+	// Once the first job has completed, the key can be used again
+	if _, err := st.CompareAndSetState("1", Waiting, Succeeded); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	third, created, err := st.CreateOrGet(&Job{ID: "3", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"})
+	if err != nil {
+		t.Fatalf("CreateOrGet failed with %v", err)
+	}
+	if !created {
+		t.Fatal("expected third job to be created")
+	}
+	if have, want := third.ID, "3"; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreCreateDuplicate(t *testing.T) {
+	st := NewInMemoryStore()
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	err := st.Create(&Job{ID: "2", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"})
+	if have, want := err, ErrDuplicate; have != want {
+		t.Fatalf("Create returned %v, want %v", have, want)
+	}
+	if _, err := st.Lookup("2"); err != ErrNotFound {
+		t.Fatalf("expected second job not to be stored, got %v", err)
+	}
+
+	// Once the first job has completed, the key can be used again
+	if _, err := st.CompareAndSetState("1", Waiting, Succeeded); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if err := st.Create(&Job{ID: "3", Topic: "topic", State: Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+}
+
+func TestInMemoryStoreReclaimExpired(t *testing.T) {
+	st := NewInMemoryStore()
+	now := time.Now()
+	long := now.Add(-time.Hour).UnixNano()
+	jobs := []*Job{
+		{ID: "crashed", Topic: "topic", State: Working, MaxRetry: 1, Started: long, Heartbeat: long},
+		{ID: "crashed-no-retries", Topic: "topic", State: Working, Started: long, Heartbeat: long},
+		{ID: "alive", Topic: "topic", State: Working, MaxRetry: 1, Started: long, Heartbeat: now.UnixNano()},
+		{ID: "just-started", Topic: "topic", State: Working, MaxRetry: 1, Started: now.UnixNano()},
+		{ID: "waiting", Topic: "topic", State: Waiting, MaxRetry: 1},
+		// Started is updated after the claim, but the claim has expired
+		{ID: "claimed-long-ago", Topic: "topic", State: Working, MaxRetry: 1, ClaimedAt: long, Started: now.UnixNano(), Heartbeat: long},
+		{ID: "just-claimed", Topic: "topic", State: Working, MaxRetry: 1, ClaimedAt: now.UnixNano(), Started: long, Heartbeat: long},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.ReclaimExpired(time.Minute)
+	if err != nil {
+		t.Fatalf("ReclaimExpired failed with %v", err)
+	}
+	if have, want := n, 3; have != want {
+		t.Fatalf("ReclaimExpired = %d, want %d", have, want)
+	}
+	tests := map[string]string{
+		"crashed":            Waiting,
+		"crashed-no-retries": Failed,
+		"alive":              Working,
+		"just-started":       Working,
+		"waiting":            Waiting,
+		"claimed-long-ago":   Waiting,
+		"just-claimed":       Working,
+	}
+	for id, want := range tests {
+		job, err := st.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have := job.State; have != want {
+			t.Fatalf("job %q: State = %q, want %q", id, have, want)
+		}
+	}
+	job, err := st.Lookup("crashed")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.Retry, 1; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+}
+
+func TestInMemoryStoreReclaimExpiredMaxRedeliveries(t *testing.T) {
+	st := NewInMemoryStore()
+	job := &Job{ID: "poison", Topic: "topic", State: Waiting, MaxRetry: 10, MaxRedeliveries: 2}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	// The job crashes its worker every time it gets claimed
+	for i := 0; i < 3; i++ {
+		next, err := st.Next(&NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if next == nil {
+			t.Fatalf("#%d: expected to claim the job again", i)
+		}
+		time.Sleep(time.Millisecond)
+		if _, err := st.ReclaimExpired(0); err != nil {
+			t.Fatalf("ReclaimExpired failed with %v", err)
+		}
+	}
+
+	job, err := st.Lookup("poison")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Failed; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.Redeliveries, 2; have != want {
+		t.Fatalf("Redeliveries = %d, want %d", have, want)
+	}
+	if have, want := job.LastError, ErrMaxRedeliveries.Error(); have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreNextWithMutex(t *testing.T) {
+	st := NewInMemoryStore()
+	jobs := []*Job{
+		{ID: "a1", Topic: "topic", State: Waiting, MutexKey: "account-1", Priority: 3},
+		{ID: "a2", Topic: "topic", State: Waiting, MutexKey: "account-1", Priority: 2},
+		{ID: "b1", Topic: "topic", State: Waiting, MutexKey: "account-2", Priority: 1},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	// Several workers claim jobs at the same time
+	var (
+		mu      sync.Mutex
+		claimed []string
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job, err := st.NextWithMutex(&NextRequest{})
+			if err == ErrNotFound {
+				return
+			}
+			if err != nil {
+				t.Errorf("NextWithMutex failed with %v", err)
+				return
+			}
+			mu.Lock()
+			claimed = append(claimed, job.ID)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	sort.Strings(claimed)
+	if have, want := strings.Join(claimed, ","), "a1,b1"; have != want {
+		t.Fatalf("claimed = %q, want %q", have, want)
+	}
+
+	// Completing a1 releases the key
+	job, err := st.Lookup("a1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	job.State = Succeeded
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	job, err = st.NextWithMutex(&NextRequest{})
+	if err != nil {
+		t.Fatalf("NextWithMutex failed with %v", err)
+	}
+	if have, want := job.ID, "a2"; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	if have, want := job.State, Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestInMemoryStoreNextStampsWorker(t *testing.T) {
+	st := NewInMemoryStore()
+	err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting})
+	if err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	job, err := st.Next(&NextRequest{WorkerID: "worker-1"})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if job == nil {
+		t.Fatal("Next returned no job")
+	}
+	stored, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	for _, j := range []*Job{job, stored} {
+		if have, want := j.WorkerID, "worker-1"; have != want {
+			t.Fatalf("WorkerID = %q, want %q", have, want)
+		}
+	}
+}
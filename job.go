@@ -4,6 +4,8 @@
 
 package jobqueue
 
+import "time"
+
 const (
 	// Waiting for executing.
 	Waiting string = "waiting"
@@ -13,22 +15,54 @@ const (
 	Succeeded string = "succeeded"
 	// Failed even after retries.
 	Failed string = "failed"
+	// Cancelled via Manager.Cancel before it completed.
+	Cancelled string = "cancelled"
+	// NeedsReview is an optional state for failed jobs that were not
+	// configured to be retried. See SetZeroRetryFailureState.
+	NeedsReview string = "needs_review"
 )
 
+// IsTerminal returns true if state is a final state of a job,
+// i.e. Succeeded, Failed, or Cancelled.
+func IsTerminal(state string) bool {
+	return state == Succeeded || state == Failed || state == Cancelled
+}
+
 // Job is a task that needs to be executed.
 type Job struct {
-	ID               string        `json:"id"`        // internal identifier
-	Topic            string        `json:"topic"`     // topic to find the correct processor
-	State            string        `json:"state"`     // current state
-	Args             []interface{} `json:"args"`      // arguments to pass to processor
-	Rank             int           `json:"rank"`      // jobs with higher ranks get executed earlier
-	Priority         int64         `json:"prio"`      // priority (highest gets executed first)
-	Retry            int           `json:"retry"`     // current number of retries
-	MaxRetry         int           `json:"maxretry"`  // maximum number of retries
-	CorrelationGroup string        `json:"cgroup"`    // external group
-	CorrelationID    string        `json:"cid"`       // external identifier
-	Created          int64         `json:"created"`   // time when Add was called (in UnixNano)
-	Updated          int64         `json:"updated"`   // time when the job was last updated (in UnixNano)
-	Started          int64         `json:"started"`   // time when the job was started (in UnixNano)
-	Completed        int64         `json:"completed"` // time when job reached either state Succeeded or Failed (in UnixNano)
+	ID               string        `json:"id"`          // internal identifier
+	Topic            string        `json:"topic"`       // topic to find the correct processor
+	State            string        `json:"state"`       // current state
+	Args             []interface{} `json:"args"`        // arguments to pass to processor
+	Rank             int           `json:"rank"`        // jobs with higher ranks get executed earlier
+	Priority         int64         `json:"prio"`        // priority (highest gets executed first)
+	SubPriority      int64         `json:"subprio"`     // secondary priority for jobs with the same priority (highest gets executed first)
+	Retry            int           `json:"retry"`       // current number of retries
+	MaxRetry         int           `json:"maxretry"`    // maximum number of retries
+	Redeliveries     int           `json:"redeliv"`     // number of times the job has been reclaimed, see Store.ReclaimExpired
+	MaxRedeliveries  int           `json:"maxredeliv"`  // maximum number of redeliveries (0 for no limit)
+	CorrelationGroup string        `json:"cgroup"`      // external group
+	CorrelationID    string        `json:"cid"`         // external identifier
+	Created          int64         `json:"created"`     // time when Add was called (in UnixNano)
+	Updated          int64         `json:"updated"`     // time when the job was last updated (in UnixNano)
+	Started          int64         `json:"started"`     // time when the job was started (in UnixNano)
+	Completed        int64         `json:"completed"`   // time when job reached either state Succeeded or Failed (in UnixNano)
+	Repeats          int           `json:"repeats"`     // remaining number of occurrences, including this one (0 or 1 runs once)
+	RepeatEvery      time.Duration `json:"repeatevery"` // interval between occurrences
+	WorkerID         string        `json:"workerid"`    // identifier of the worker that claimed the job
+	CompletedBy      string        `json:"completedby"` // identifier of the worker that moved the job into a terminal state
+	MinWorkerVersion int           `json:"minversion"`  // minimum version of the worker required to execute the job
+	LastError        string        `json:"lasterror"`   // error of the last failed attempt
+	CallbackURL      string        `json:"callbackurl"` // URL to notify when the job has completed (optional)
+	UniqueKey        string        `json:"uniquekey"`   // business key that identifies the active job, see ErrDuplicate (optional)
+	Heartbeat        int64         `json:"heartbeat"`   // time the worker last reported to be working on the job, see Store.ReclaimExpired
+	MutexKey         string        `json:"mutexkey"`    // jobs with the same key are executed one at a time, see MutexStore (optional)
+	RunAt            int64         `json:"runat"`       // time before which the job must not be executed (in UnixNano, 0 for no delay)
+	ClaimedAt        int64         `json:"claimedat"`   // time when the job was claimed by a store, see Store.Next (in UnixNano)
+	Result           []byte        `json:"result"`      // result of the processor if it succeeded, see Manager.RegisterResult
+	LogOutput        string        `json:"logoutput"`   // log output of the last attempt, see LogWriter
+	Timeout          time.Duration `json:"timeout"`     // max. execution time of an attempt (0 for the default of the topic), see SetTopicTimeout
+	TraceContext     TraceContext  `json:"tracectx"`    // trace context of the code that added the job, see Tracer (optional)
+
+	store Store // store the job was picked up from, see NewManagerWithStores
 }
@@ -4,7 +4,9 @@
 
 package jobqueue
 
-import "log"
+import (
+	"fmt"
+)
 
 // Logger defines an interface that implementers can use to redirect
 // logging into their own application.
@@ -12,9 +14,48 @@ type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
-// stdLogger implements the Logger interface by wrapping the Go log package.
-type stdLogger struct{}
+// LeveledLogger is a Logger that distinguishes errors from events of
+// the life cycle of jobs, e.g. to route them into structured logging.
+// If the logger passed to SetLogger implements it, the manager reports
+// errors via Errorf instead of Printf, and jobs being claimed, succeeding,
+// failing, and being scheduled for a retry via Debugf. The events are not
+// reported to a plain Logger.
+type LeveledLogger interface {
+	Logger
+	Debugf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NopLogger discards all log output. It is the default logger of the
+// manager and the stores.
+type NopLogger struct{}
+
+// Printf does nothing.
+func (NopLogger) Printf(format string, v ...interface{}) {}
+
+// Debugf does nothing.
+func (NopLogger) Debugf(format string, v ...interface{}) {}
+
+// Errorf does nothing.
+func (NopLogger) Errorf(format string, v ...interface{}) {}
+
+// errorf reports an error via the logger of the manager.
+func (m *Manager) errorf(format string, v ...interface{}) {
+	if l, ok := m.logger.(LeveledLogger); ok {
+		l.Errorf(format, v...)
+		return
+	}
+	m.logger.Printf(format, v...)
+}
 
-func (stdLogger) Printf(format string, v ...interface{}) {
-	log.Printf(format, v...)
+// event reports an event of the life cycle of job, if the logger of the
+// manager is a LeveledLogger. The message is prefixed with the identifier,
+// topic, and correlation identifier of the job.
+func (m *Manager) event(job *Job, format string, v ...interface{}) {
+	l, ok := m.logger.(LeveledLogger)
+	if !ok {
+		return
+	}
+	prefix := fmt.Sprintf("jobqueue: job %v (topic %s, correlation id %q) ", job.ID, job.Topic, job.CorrelationID)
+	l.Debugf("%s", prefix+fmt.Sprintf(format, v...))
 }
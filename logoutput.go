@@ -0,0 +1,73 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// defaultMaxLogOutput is the default number of bytes of log output that
+// is kept per job, see SetMaxLogOutput.
+const defaultMaxLogOutput = 64 * 1024
+
+// logWriterKey is the key of the log writer in the context passed to a
+// ContextProcessor.
+type logWriterKey struct{}
+
+// LogWriter returns the writer for the log output of the job that is
+// executed with ctx, i.e. the context passed to a ContextProcessor. When
+// the processor returns, the output is stored in Job.LogOutput, up to
+// the size set via SetMaxLogOutput. It is safe to write to it from
+// several goroutines, e.g. with a log.Logger:
+//
+//	m.RegisterContext("import", func(ctx context.Context, args ...interface{}) error {
+//		logger := log.New(jobqueue.LogWriter(ctx), "", log.LstdFlags)
+//		logger.Printf("importing %v", args[0])
+//		...
+//	})
+//
+// If ctx does not belong to the execution of a job, or capturing log
+// output is disabled, the output is discarded.
+func LogWriter(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(logWriterKey{}).(io.Writer); ok {
+		return w
+	}
+	return ioutil.Discard
+}
+
+// logBuffer keeps the first max bytes written to it, and discards the rest.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max}
+}
+
+// Write implements io.Writer. It never fails, so that processors are not
+// affected by the truncation.
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := b.max - len(b.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf = append(b.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// String returns the output written so far.
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestLogWriter(t *testing.T) {
+	tests := []struct {
+		Max  int
+		Want string
+	}{
+		{Max: 0, Want: ""},
+		{Max: 1024, Want: "import 1\nimport 2\n"},
+		{Max: 10, Want: "import 1\ni"},
+	}
+	for i, tt := range tests {
+		m := New(SetLogger(&stringLogger{}), SetMaxLogOutput(tt.Max))
+		err := m.RegisterContext("topic", func(ctx context.Context, args ...interface{}) error {
+			logger := log.New(LogWriter(ctx), "", 0)
+			for _, arg := range args {
+				logger.Printf("import %v", arg)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("#%d: RegisterContext failed with %v", i, err)
+		}
+		sub := m.Subscribe(10)
+		err = m.Start()
+		if err != nil {
+			t.Fatalf("#%d: Start failed with %v", i, err)
+		}
+		job := &Job{Topic: "topic", Args: []interface{}{1, 2}}
+		if err := m.Add(job); err != nil {
+			t.Fatalf("#%d: Add failed with %v", i, err)
+		}
+		for done := false; !done; {
+			select {
+			case tr := <-sub.C:
+				done = tr.To == Succeeded
+			case <-time.After(10 * time.Second):
+				t.Fatalf("#%d: Job success timed out", i)
+			}
+		}
+		sub.Close()
+		err = m.Stop()
+		if err != nil {
+			t.Fatalf("#%d: Stop failed with %v", i, err)
+		}
+
+		job, err = m.Lookup(job.ID)
+		if err != nil {
+			t.Fatalf("#%d: Lookup failed with %v", i, err)
+		}
+		if have, want := job.LogOutput, tt.Want; have != want {
+			t.Errorf("#%d: LogOutput = %q, want %q", i, have, want)
+		}
+	}
+}
+
+func TestLogWriterWithoutJob(t *testing.T) {
+	if have, want := LogWriter(context.Background()), ioutil.Discard; have != want {
+		t.Fatalf("LogWriter = %v, want %v", have, want)
+	}
+}
+
+func TestLogBufferIsBounded(t *testing.T) {
+	b := newLogBuffer(8)
+	for i := 0; i < 3; i++ {
+		n, err := fmt.Fprintf(b, "line %d\n", i)
+		if err != nil {
+			t.Fatalf("Write failed with %v", err)
+		}
+		if n != 7 {
+			t.Fatalf("Write returned %d, want %d", n, 7)
+		}
+	}
+	if have, want := b.String(), "line 0\nl"; have != want {
+		t.Fatalf("String = %q, want %q", have, want)
+	}
+}
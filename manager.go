@@ -5,8 +5,13 @@
 package jobqueue
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,25 +20,94 @@ import (
 
 const (
 	defaultConcurrency = 5
+
+	// defaultHeartbeatInterval is the default interval in which workers
+	// report that they are still working on a job.
+	defaultHeartbeatInterval = 30 * time.Second
+
+	// drainPollInterval is the interval in which DrainTopic checks
+	// the progress of the jobs it waits for.
+	drainPollInterval = 250 * time.Millisecond
 )
 
 func nop() {}
 
 // Manager schedules job executing. Create a new manager via New.
 type Manager struct {
-	logger  Logger
-	st      Store // persistent storage
-	backoff BackoffFunc
-
-	mu          sync.Mutex           // guards the following block
-	tm          map[string]Processor // maps topic to processor
-	concurrency map[int]int          // number of parallel workers
-	working     map[int]int          // number of busy workers
+	logger    Logger
+	st        Store     // persistent storage
+	stores    []Store   // all stores to pick up jobs from, including st
+	scheduler Scheduler // decides which job to claim next
+	backoff   BackoffFunc
+	workerID  string      // identifies this manager in Job.WorkerID
+	version   int         // version of the workers, see Job.MinWorkerVersion
+	fifo      bool        // pick jobs in the order they were created
+	lifo      bool        // pick the most recently created jobs first
+	fair      bool        // pick jobs round-robin across correlation identifiers
+	claimGate ClaimGate   // vetoes claiming jobs (optional)
+	metrics   *metrics    // counters about the operation of the manager
+	sink      MetricsSink // receives metrics about the lifecycle of jobs (optional)
+	tracer    Tracer      // starts spans around the execution of jobs (optional)
+	recent    *recentJobs // most recently completed jobs
+
+	completions *completionBatcher // batches terminal updates (optional)
+
+	repeatFailures bool                     // failed occurrences count against Job.Repeats
+	zeroRetryState string                   // state for failed jobs with MaxRetry == 0 (Failed if empty)
+	latencyTargets map[string]time.Duration // maps topic to the max. time a job should wait
+	retryDelta     map[string]int64         // maps topic to the priority delta applied on retry
+	batchPolicies  map[string]BatchPolicy   // maps topic to the handling of partially failed batch jobs
+	timeouts       map[string]time.Duration // maps topic to the default of Job.Timeout
+	topicLimits    map[string]int           // maps topic to the max. number of its jobs executing at the same time
+
+	drainHook        func()          // called when the queue becomes empty
+	backlogHook      func(depth int) // called when the queue exceeds backlogThreshold
+	backlogThreshold int
+	retryStormHook   func(job *Job) // called when a job retries too often
+	retryStormMax    int            // max. number of retries of a job within retryStormWindow
+	retryStormWindow time.Duration
+	beforeExecute    func(job *Job) error // called right before the processor
+	deadLetterHook   func(job *Job)       // called when a job has exhausted its retries
+	webhookClient    *http.Client         // posts to Job.CallbackURL
+	webhookRetries   int                  // number of retries if posting to Job.CallbackURL fails
+	cancellation     CancellationPolicy   // what to do with jobs of a ContextProcessor that got cancelled
+	maxLogOutput     int                  // max. number of bytes of Job.LogOutput (0 to disable)
+	correlations     *correlationLimits   // rate limits per correlation identifier (scheduler only)
+	heartbeat        time.Duration        // interval of heartbeats of working jobs (0 to disable)
+	idleTimeout      time.Duration        // time without jobs after which the manager is idle (0 to disable)
+	workerRoutines   goroutines           // goroutines of the workers
+	background       goroutines           // other goroutines, e.g. the scheduler and webhooks
+	feed             transitionFeed       // subscribers of transitions of jobs
+	drained          bool                 // queue was empty on last check (scheduler only)
+	backlogged       bool                 // queue exceeded backlog threshold on last check (scheduler only)
+
+	mu          sync.Mutex                  // guards the following block
+	tm          map[string]Processor        // maps topic to processor
+	results     map[string]ResultProcessor  // maps topic to processor that returns a result (also in tm)
+	contexts    map[string]ContextProcessor // maps topic to processor that gets passed a context (also in tm)
+	defaultProc DefaultProcessor            // processor for topics not in tm
+	delivery    map[string]DeliveryMode     // maps topic to delivery mode
+	concurrency map[int]int                 // number of parallel workers
+	working     map[int]int                 // number of busy workers
+	auto        map[string]*autoConcurrency // maps topic to its adaptive concurrency limit
+	inflight    map[string]int              // maps topic to the number of its executing jobs
 	started     bool
+	paused      bool
+	pausedTopic map[string]bool    // topics paused via PauseTopic
+	ctx         context.Context    // passed to ContextProcessors
+	cancel      context.CancelFunc // cancels ctx
+	claimCtx    context.Context    // passed to the store when claiming jobs
+	stopClaims  context.CancelFunc // cancels claimCtx
 	workers     map[int][]*worker
 	stopSched   chan struct{} // stop signal for scheduler
-	workersWg   sync.WaitGroup
 	jobc        map[int]chan *Job
+	repeats     map[string]*Schedule     // maps identifier of pending occurrences of repeating jobs to their schedule
+	crons       map[string]*cronSchedule // schedules registered via RegisterSchedule, by identifier
+	cronStarted bool                     // timers of the schedules are armed
+	retries     map[string][]time.Time   // maps job identifier to the times of its recent retries
+	lastActive  time.Time                // when a job was last claimed or finished
+	idlec       chan struct{}            // closed when the manager has been idle for idleTimeout
+	running     map[string]*execution    // maps identifier of claimed jobs to their execution
 
 	testManagerStarted   func() // testing hook
 	testManagerStopped   func() // testing hook
@@ -45,17 +119,37 @@ type Manager struct {
 	testJobRetry         func() // testing hook
 	testJobFailed        func() // testing hook
 	testJobSucceeded     func() // testing hook
+	testJobRepeated      func() // testing hook
 }
 
 // New creates a new manager. Pass options to Manager to configure it.
 func New(options ...ManagerOption) *Manager {
 	m := &Manager{
-		logger:               stdLogger{},
+		logger:               NopLogger{},
 		st:                   NewInMemoryStore(),
 		backoff:              exponentialBackoff,
+		scheduler:            NewDefaultScheduler(),
+		workerID:             defaultWorkerID(),
+		metrics:              newMetrics(),
+		recent:               newRecentJobs(0),
+		webhookClient:        http.DefaultClient,
+		heartbeat:            defaultHeartbeatInterval,
 		tm:                   make(map[string]Processor),
+		results:              make(map[string]ResultProcessor),
+		contexts:             make(map[string]ContextProcessor),
+		maxLogOutput:         defaultMaxLogOutput,
+		delivery:             make(map[string]DeliveryMode),
+		latencyTargets:       make(map[string]time.Duration),
+		retryDelta:           make(map[string]int64),
+		batchPolicies:        make(map[string]BatchPolicy),
+		timeouts:             make(map[string]time.Duration),
+		topicLimits:          make(map[string]int),
 		concurrency:          map[int]int{0: defaultConcurrency},
 		working:              map[int]int{0: 0},
+		auto:                 make(map[string]*autoConcurrency),
+		inflight:             make(map[string]int),
+		crons:                make(map[string]*cronSchedule),
+		pausedTopic:          make(map[string]bool),
 		testManagerStarted:   nop,
 		testManagerStopped:   nop,
 		testSchedulerStarted: nop,
@@ -66,10 +160,30 @@ func New(options ...ManagerOption) *Manager {
 		testJobRetry:         nop,
 		testJobFailed:        nop,
 		testJobSucceeded:     nop,
+		testJobRepeated:      nop,
 	}
 	for _, opt := range options {
 		opt(m)
 	}
+	if len(m.stores) == 0 {
+		m.stores = []Store{m.st}
+	}
+	return m
+}
+
+// NewManagerWithStores creates a new manager that picks up jobs from
+// all of the given stores, e.g. to drain an old and a new store during
+// a migration. The scheduler asks the stores for waiting jobs in turn,
+// and updates each job in the store it came from.
+//
+// New jobs are added to the first store. Stats, List, and DrainTopic
+// only consider the first store, while Lookup searches all stores.
+func NewManagerWithStores(stores []Store, options ...ManagerOption) *Manager {
+	m := New(options...)
+	if len(stores) > 0 {
+		m.st = stores[0]
+		m.stores = stores
+	}
 	return m
 }
 
@@ -79,6 +193,10 @@ func New(options ...ManagerOption) *Manager {
 type ManagerOption func(*Manager)
 
 // SetLogger specifies the logger to use when e.g. reporting errors.
+// If logger implements LeveledLogger, the manager also reports the life
+// cycle of jobs to it. By default, the manager logs nothing (see NopLogger).
+// Pass e.g. log.New(os.Stderr, "", log.LstdFlags) to write to the standard
+// error output.
 func SetLogger(logger Logger) ManagerOption {
 	return func(m *Manager) {
 		m.logger = logger
@@ -92,8 +210,104 @@ func SetStore(store Store) ManagerOption {
 	}
 }
 
+// SetWebhookClient specifies the HTTP client used to notify the
+// CallbackURL of jobs when they complete, and how often to retry if the
+// notification fails. Use the timeout of the client to limit the time
+// for a single attempt. The backoff function of the manager determines
+// the time between attempts. By default, http.DefaultClient is used
+// without retries.
+func SetWebhookClient(client *http.Client, retries int) ManagerOption {
+	return func(m *Manager) {
+		if client != nil {
+			m.webhookClient = client
+		} else {
+			m.webhookClient = http.DefaultClient
+		}
+		m.webhookRetries = retries
+	}
+}
+
+// SetCancellationPolicy specifies what happens to jobs of a
+// ContextProcessor that fail after their context has been cancelled,
+// e.g. when the manager shuts down. By default, they are requeued.
+//
+// Jobs of topics with AtMostOnce delivery are never requeued, as they
+// are marked as succeeded before they are executed.
+func SetCancellationPolicy(policy CancellationPolicy) ManagerOption {
+	return func(m *Manager) {
+		m.cancellation = policy
+	}
+}
+
+// SetTopicTimeout specifies the maximum execution time of an attempt of
+// the jobs of the given topic, unless the job specifies its own timeout
+// in Job.Timeout. The timeout applies to processors registered via
+// RegisterContext only: Their context is cancelled when it passes, and
+// the attempt fails if the processor returns an error. There is no
+// timeout by default.
+func SetTopicTimeout(topic string, timeout time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.timeouts[topic] = timeout
+	}
+}
+
+// SetMaxLogOutput specifies the maximum number of bytes of the log output
+// that ContextProcessors write to LogWriter, which is stored in
+// Job.LogOutput. Output beyond that is discarded. A value of 0 disables
+// capturing log output. The default is 64 KiB.
+func SetMaxLogOutput(n int) ManagerOption {
+	return func(m *Manager) {
+		if n < 0 {
+			n = 0
+		}
+		m.maxLogOutput = n
+	}
+}
+
+// SetCorrelationRateLimit limits how many jobs with the same correlation
+// identifier are started per second, with bursts of up to burst jobs, so
+// that e.g. a single tenant cannot monopolize the workers by adding lots
+// of jobs. Jobs that exceed the limit are deferred by moving their RunAt
+// to the time they are allowed to start, letting jobs of other
+// correlation identifiers go first. Jobs without a correlation identifier
+// are not limited.
+func SetCorrelationRateLimit(perSecond float64, burst int) ManagerOption {
+	return func(m *Manager) {
+		m.correlations = newCorrelationLimits(perSecond, burst)
+	}
+}
+
+// SetHeartbeatInterval specifies how often workers record a heartbeat
+// of the jobs they are working on, so that Store.ReclaimExpired can tell
+// the jobs of crashed workers from those that are still alive. Make sure
+// to pass ReclaimExpired a multiple of the interval. The default is 30
+// seconds. Use 0 to disable heartbeats.
+func SetHeartbeatInterval(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.heartbeat = d
+	}
+}
+
+// SetIdleTimeout specifies how long the manager may go without claiming a
+// job before it considers itself idle. RunWithSignals then stops the
+// manager and returns, e.g. so that an autoscaler can remove the worker
+// process from a scaled-to-zero deployment. Jobs that are working keep
+// the manager busy, and are finished before RunWithSignals returns. The
+// queue is polled once per second, so the timeout is only precise to a
+// second. There is no idle timeout by default.
+func SetIdleTimeout(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.idleTimeout = d
+	}
+}
+
 // SetBackoffFunc specifies the backoff function that returns the time span
-// between retries of failed jobs. Exponential backoff is used by default.
+// between retries of failed jobs. It is passed the number of retries so
+// far. A job is not retried before its backoff has passed, i.e. its RunAt
+// is set accordingly. See ExponentialBackoff and ConstantBackoff for
+// common backoff functions. By default, the backoff is 0 for the first
+// retry and grows by a factor of 10 with every further retry, starting
+// at 10ms.
 func SetBackoffFunc(fn BackoffFunc) ManagerOption {
 	return func(m *Manager) {
 		if fn != nil {
@@ -104,6 +318,137 @@ func SetBackoffFunc(fn BackoffFunc) ManagerOption {
 	}
 }
 
+// SetRetryPriorityDelta specifies a delta that is added to the priority
+// of jobs of the given topic whenever they get retried. A positive delta
+// lets failed jobs jump ahead of fresh work so they recover quickly, while
+// a negative delta keeps e.g. a poison job from hogging the workers.
+//
+// Remember that the priority of a job is the negated time it is due in
+// nanoseconds (see Manager.Add), so use e.g. int64(time.Minute) to move
+// a job ahead by a minute.
+func SetRetryPriorityDelta(topic string, delta int64) ManagerOption {
+	return func(m *Manager) {
+		m.retryDelta[topic] = delta
+	}
+}
+
+// SetFIFOMode indicates whether to execute jobs strictly in the order they
+// were created, ignoring their rank and priority. Use it for pure FIFO
+// queues, where ordering by priority is both unnecessary and expensive.
+func SetFIFOMode(enabled bool) ManagerOption {
+	return func(m *Manager) {
+		m.fifo = enabled
+	}
+}
+
+// SetLIFOMode indicates whether to execute the most recently created jobs
+// first, ignoring their rank and priority. Use it for workloads where the
+// freshest request matters most and stale ones may wait or be dropped.
+// SetFIFOMode takes precedence.
+func SetLIFOMode(enabled bool) ManagerOption {
+	return func(m *Manager) {
+		m.lifo = enabled
+	}
+}
+
+// SetFairMode indicates whether to claim jobs round-robin across their
+// correlation identifiers, so that an entity with many waiting jobs does
+// not delay the jobs of other entities. See NextRequest.Fair.
+func SetFairMode(enabled bool) ManagerOption {
+	return func(m *Manager) {
+		m.fair = enabled
+	}
+}
+
+// SetScheduler specifies the Scheduler that decides which job to claim
+// next. By default, the manager uses NewDefaultScheduler.
+func SetScheduler(scheduler Scheduler) ManagerOption {
+	return func(m *Manager) {
+		m.scheduler = scheduler
+	}
+}
+
+// SetClaimGate specifies a gate that decides whether the scheduler may
+// claim a job, depending on external conditions such as feature flags or
+// maintenance windows. Jobs vetoed by the gate stay in the Waiting state,
+// and the scheduler moves on to the next job. See ClaimGate for details.
+func SetClaimGate(gate ClaimGate) ManagerOption {
+	return func(m *Manager) {
+		m.claimGate = gate
+	}
+}
+
+// SetDeliveryMode specifies the delivery mode for jobs of the given topic.
+// The delivery mode is AtLeastOnce by default. See DeliveryMode for details.
+func SetDeliveryMode(topic string, mode DeliveryMode) ManagerOption {
+	return func(m *Manager) {
+		m.delivery[topic] = mode
+	}
+}
+
+// SetMetricsSink specifies a sink for metrics about the lifecycle of
+// jobs, e.g. to export them to StatsD. See MetricsSink for details.
+// There is no sink by default.
+func SetMetricsSink(sink MetricsSink) ManagerOption {
+	return func(m *Manager) {
+		m.sink = sink
+	}
+}
+
+// SetBatchPolicy specifies how partially failed batch jobs of the given
+// topic are handled, i.e. jobs whose processor returned a BatchError.
+// See BatchPolicy for the default.
+func SetBatchPolicy(topic string, policy BatchPolicy) ManagerOption {
+	return func(m *Manager) {
+		m.batchPolicies[topic] = policy
+	}
+}
+
+// SetLatencyTarget specifies the maximum time that jobs of the given topic
+// should wait before they get started, e.g. as part of an SLO. Jobs that
+// waited longer are counted in Metrics.SLOBreaches when they complete.
+// The wait starts when the job is due, i.e. at its RunAt for delayed and
+// retried jobs, so backoffs do not count as waiting.
+func SetLatencyTarget(topic string, target time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.latencyTargets[topic] = target
+	}
+}
+
+// SetZeroRetryFailureState specifies the state for jobs that fail and
+// have not been configured to be retried, i.e. jobs with a MaxRetry of 0.
+// Use it to e.g. move those jobs into a NeedsReview state, so they don't
+// get lost among the jobs that failed even after retrying. The state is
+// Failed by default.
+func SetZeroRetryFailureState(state string) ManagerOption {
+	return func(m *Manager) {
+		m.zeroRetryState = state
+	}
+}
+
+// SetWorkerID specifies the identifier that the manager stamps on the jobs
+// it claims. It defaults to the hostname and process ID. Use a stable
+// identifier when running more than one manager against the same store.
+func SetWorkerID(id string) ManagerOption {
+	return func(m *Manager) {
+		if id != "" {
+			m.workerID = id
+		} else {
+			m.workerID = defaultWorkerID()
+		}
+	}
+}
+
+// SetWorkerVersion specifies the version of the workers of this manager.
+// The manager only picks jobs whose MinWorkerVersion is less than or equal
+// to this version. Use it to hold jobs for newer workers during a rolling
+// upgrade. The version is 0 by default.
+func SetWorkerVersion(version int) ManagerOption {
+	return func(m *Manager) {
+		m.version = version
+	}
+}
+
 // SetConcurrency sets the maximum number of workers that will be run at
 // the same time, for a given rank. Concurrency must be greater or equal
 // to 1 and is 5 by default.
@@ -117,6 +462,133 @@ func SetConcurrency(rank, n int) ManagerOption {
 	}
 }
 
+// SetAutoConcurrency lets the manager adapt the number of jobs of the
+// given topic that are executed at the same time, between min and max.
+// The manager starts with min, and increases the number while jobs
+// succeed quickly. It backs off when jobs fail or get significantly
+// slower than before, e.g. when a downstream service is overwhelmed.
+// The limit applies in addition to the concurrency of the rank of the
+// job, see SetConcurrency.
+func SetAutoConcurrency(topic string, min, max int) ManagerOption {
+	return func(m *Manager) {
+		if min < 1 {
+			min = 1
+		}
+		if max < min {
+			max = min
+		}
+		m.auto[topic] = newAutoConcurrency(min, max)
+	}
+}
+
+// SetTopicConcurrency sets the maximum number of jobs of the given topic
+// that are executed at the same time, e.g. to protect an expensive
+// downstream service. The scheduler skips the jobs of the topic while the
+// limit is reached, and picks jobs of other topics instead, so a flood of
+// jobs of one topic cannot starve the others as long as the concurrency
+// of the rank (see SetConcurrency) exceeds the limit. The limit must be
+// greater or equal to 1. Topics have no limit by default.
+func SetTopicConcurrency(topic string, n int) ManagerOption {
+	return func(m *Manager) {
+		if n < 1 {
+			n = 1
+		}
+		m.topicLimits[topic] = n
+	}
+}
+
+// SetRepeatCountsFailures specifies whether an occurrence of a repeating
+// job that failed (even after retries) counts against its Repeats.
+// By default, only successful occurrences count, i.e. a failed occurrence
+// is simply scheduled again.
+func SetRepeatCountsFailures(enabled bool) ManagerOption {
+	return func(m *Manager) {
+		m.repeatFailures = enabled
+	}
+}
+
+// defaultWorkerID returns the hostname and process ID as a worker identifier.
+func defaultWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// SetDrainHook specifies a callback that is invoked when the queue becomes
+// empty, i.e. when no jobs are waiting or working anymore. It is checked
+// by the scheduler, so the callback is invoked from the scheduler goroutine
+// and should return quickly.
+func SetDrainHook(fn func()) ManagerOption {
+	return func(m *Manager) {
+		m.drainHook = fn
+	}
+}
+
+// SetBacklogHook specifies a callback that is invoked when the number of
+// waiting jobs exceeds threshold. The callback gets passed the number of
+// waiting jobs. It is invoked again only after the number of waiting jobs
+// has dropped to or below threshold in between. Like the drain hook, it is
+// invoked from the scheduler goroutine and should return quickly.
+func SetBacklogHook(threshold int, fn func(depth int)) ManagerOption {
+	return func(m *Manager) {
+		m.backlogThreshold = threshold
+		m.backlogHook = fn
+	}
+}
+
+// SetRetryStormHook specifies a callback that is invoked when a single job
+// is retried more than threshold times within window, e.g. to notice a job
+// that keeps failing with a high MaxRetry. The callback gets passed the
+// job. It is invoked again for the same job only after its number of
+// retries within window has dropped to or below threshold in between.
+// Retry storms are also counted in Metrics.RetryStorms. The callback is
+// invoked from the worker goroutine and should return quickly.
+func SetRetryStormHook(threshold int, window time.Duration, fn func(job *Job)) ManagerOption {
+	return func(m *Manager) {
+		m.retryStormMax = threshold
+		m.retryStormWindow = window
+		m.retryStormHook = fn
+	}
+}
+
+// SetRecentJobsSize specifies the number of completed jobs that the manager
+// keeps in memory for debugging, see Manager.RecentJobs. It is 0 by default.
+func SetRecentJobsSize(size int) ManagerOption {
+	return func(m *Manager) {
+		if size < 0 {
+			size = 0
+		}
+		m.recent = newRecentJobs(size)
+	}
+}
+
+// SetBeforeExecuteHook specifies a callback that is invoked after a job
+// has been claimed and right before its processor gets executed. The
+// callback may modify the job, e.g. to inject a fresh token into its
+// arguments. Changes are passed to the processor, but not necessarily
+// persisted. If the callback returns an error, the processor is not
+// executed and the attempt counts as failed.
+func SetBeforeExecuteHook(fn func(job *Job) error) ManagerOption {
+	return func(m *Manager) {
+		m.beforeExecute = fn
+	}
+}
+
+// SetDeadLetterHook specifies a callback that is invoked when a job has
+// failed for good because it has exhausted its retries, e.g. to push it to
+// an alerting pipeline or a queue for manual review. The callback gets
+// passed the job after it has been moved into its final state, including
+// its LastError. Jobs of topics with AtMostOnce delivery are passed when
+// their only attempt fails. The callback is invoked from the worker
+// goroutine and should return quickly.
+func SetDeadLetterHook(fn func(job *Job)) ManagerOption {
+	return func(m *Manager) {
+		m.deadLetterHook = fn
+	}
+}
+
 // Register registers a topic and the associated processor for jobs with
 // that topic.
 func (m *Manager) Register(topic string, p Processor) error {
@@ -129,9 +601,102 @@ func (m *Manager) Register(topic string, p Processor) error {
 	return nil
 }
 
+// RegisterContext registers a processor for the given topic that gets
+// passed a context. The context is cancelled when the manager stops
+// waiting for working jobs, i.e. when CloseWithTimeout times out. If the
+// processor returns an error after that, the job is handled according to
+// SetCancellationPolicy rather than as a failed attempt.
+//
+// The processor may write log output to LogWriter(ctx), which is stored
+// in Job.LogOutput.
+func (m *Manager) RegisterContext(topic string, p ContextProcessor) error {
+	err := m.Register(topic, func(args ...interface{}) error {
+		return m.callContext(p, nil, 0, "", args...)
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.contexts[topic] = p
+	m.mu.Unlock()
+	return nil
+}
+
+// callContext calls p with the context of the manager. If out is not nil,
+// it is passed as the LogWriter of the context. If timeout is positive,
+// the context is cancelled after timeout, and an error returned after
+// that is reported as a timeout. If id is not empty, the context is also
+// cancelled when the job with that identifier is cancelled via Cancel.
+func (m *Manager) callContext(p ContextProcessor, out io.Writer, timeout time.Duration, id string, args ...interface{}) error {
+	m.mu.Lock()
+	ctx := m.ctx
+	pctx := ctx
+	if e := m.running[id]; e != nil {
+		if e.ctx != nil {
+			pctx = e.ctx
+		}
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithCancel(pctx)
+		defer cancel()
+		e.cancel = cancel
+		if e.cancelled {
+			cancel()
+		}
+	}
+	m.mu.Unlock()
+	if out != nil {
+		pctx = context.WithValue(pctx, logWriterKey{}, out)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithTimeout(pctx, timeout)
+		defer cancel()
+	}
+	err := p(pctx, args...)
+	if err != nil && ctx.Err() != nil {
+		return cancelledError{err}
+	}
+	if err != nil && pctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("jobqueue: job timed out after %v: %v", timeout, err)
+	}
+	return err
+}
+
+// RegisterResult registers a processor for the given topic that returns a
+// result when it succeeds. The result is stored in Job.Result, except for
+// topics with AtMostOnce delivery, as their jobs are finalized before the
+// processor runs.
+func (m *Manager) RegisterResult(topic string, p ResultProcessor) error {
+	err := m.Register(topic, func(args ...interface{}) error {
+		_, err := p(args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.results[topic] = p
+	m.mu.Unlock()
+	return nil
+}
+
+// RegisterDefault registers a processor for jobs of all topics that have
+// no processor registered via Register. Use it e.g. for generic handlers
+// that dispatch jobs by their topic.
+func (m *Manager) RegisterDefault(p DefaultProcessor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.defaultProc != nil {
+		return errors.New("jobqueue: default processor already registered")
+	}
+	m.defaultProc = p
+	return nil
+}
+
 // -- Start and Stop --
 
-// Start runs the manager. Use Stop, Close, or CloseWithTimeout to stop it.
+// Start runs the manager. Use Stop, Close, CloseWithTimeout, or Shutdown
+// to stop it.
 func (m *Manager) Start() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -139,25 +704,38 @@ func (m *Manager) Start() error {
 		return errors.New("jobqueue: manager already started")
 	}
 
-	// Initialize Store
-	err := m.st.Start()
-	if err != nil {
-		return err
+	// Initialize Stores
+	for _, st := range m.stores {
+		err := st.Start()
+		if err != nil {
+			return err
+		}
 	}
 
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.claimCtx, m.stopClaims = context.WithCancel(context.Background())
 	m.jobc = make(map[int]chan *Job)
 	m.workers = make(map[int][]*worker)
 	for rank, concurrency := range m.concurrency {
 		m.jobc[rank] = make(chan *Job, concurrency)
 		m.workers[rank] = make([]*worker, concurrency)
 		for i := 0; i < m.concurrency[rank]; i++ {
-			m.workersWg.Add(1)
 			m.workers[rank][i] = newWorker(m, m.jobc[rank])
 		}
 	}
 
+	m.repeats = make(map[string]*Schedule)
+	m.retries = make(map[string][]time.Time)
+	m.lastActive = time.Now()
+	m.idlec = make(chan struct{})
+	m.running = make(map[string]*execution)
+
 	m.stopSched = make(chan struct{})
-	go m.schedule()
+	m.background.Go(m.schedule)
+	m.cronStarted = true
+	if len(m.crons) > 0 {
+		m.background.Go(m.startSchedules)
+	}
 
 	m.started = true
 
@@ -180,7 +758,53 @@ func (m *Manager) Close() error {
 // CloseWithTimeout stops the manager. It waits for the specified timeout,
 // then closes down, even if there are still jobs working. If the timeout
 // is negative, the manager waits forever for all working jobs to end.
+//
+// If all working jobs have ended, CloseWithTimeout also waits for the
+// background goroutines of the manager to return, e.g. the scheduler and
+// the ones notifying webhooks, so no goroutine of the manager is left
+// running afterwards (see NumActiveGoroutines). Pending retries of
+// webhook notifications are given up.
 func (m *Manager) CloseWithTimeout(timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout.Nanoseconds() >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := m.stop(ctx); err != nil {
+		return errors.New("jobqueue: close timed out")
+	}
+	return nil
+}
+
+// Shutdown stops the manager gracefully: It stops picking new jobs, waits
+// for the working jobs to finish and their final state to be written to
+// the store, and then closes the stores that implement io.Closer, e.g.
+// the MySQL store. Do not close the stores yourself when using Shutdown.
+//
+// If ctx is done before the working jobs have finished, Shutdown cancels
+// the context of the processors registered via RegisterContext, and
+// returns ctx.Err() without closing the stores. The jobs that are still
+// working are left in the Working state, so they are recovered like the
+// jobs of a crashed worker, e.g. by Store.ReclaimExpired.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	if err := m.stop(ctx); err != nil {
+		return err
+	}
+	var err error
+	for _, st := range m.stores {
+		if c, ok := st.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// stop stops the manager, and waits for working jobs to finish until ctx
+// is done. It returns ctx.Err() if they did not finish in time.
+func (m *Manager) stop(ctx context.Context) error {
 	m.mu.Lock()
 	if !m.started {
 		m.mu.Unlock()
@@ -188,7 +812,8 @@ func (m *Manager) CloseWithTimeout(timeout time.Duration) error {
 	}
 	m.mu.Unlock()
 
-	// Stop accepting new jobs
+	// Stop accepting new jobs, aborting a claim that is in flight
+	m.stopClaims()
 	m.stopSched <- struct{}{}
 	<-m.stopSched
 	close(m.stopSched)
@@ -198,26 +823,26 @@ func (m *Manager) CloseWithTimeout(timeout time.Duration) error {
 	}
 	m.mu.Unlock()
 
-	// Wait for all workers to complete?
-	if timeout.Nanoseconds() < 0 {
-		// Yes: Wait forever
-		m.workersWg.Wait()
-		m.testManagerStopped() // testing hook
-		return nil
-	}
-
-	// Wait with timeout
+	// Wait for all workers to complete, or for ctx to be done
+	var err error
 	complete := make(chan struct{}, 1)
 	go func() {
 		// Stop workers
-		m.workersWg.Wait()
+		m.workerRoutines.Wait()
 		close(complete)
 	}()
-	var err error
 	select {
 	case <-complete: // Completed in time
-	case <-time.After(timeout):
-		err = errors.New("jobqueue: close timed out")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	m.cancel() // Let context-aware processors give up
+	m.stopRepeats()
+	m.stopSchedules()
+	if err == nil {
+		// Workers that are still working might start goroutines,
+		// so only wait if they have completed
+		m.background.Wait()
 	}
 
 	m.mu.Lock()
@@ -227,6 +852,98 @@ func (m *Manager) CloseWithTimeout(timeout time.Duration) error {
 	return err
 }
 
+// -- Pause and Resume --
+
+// PauseAll stops the manager from picking new jobs of any topic, e.g. during
+// an outage of a downstream service. Jobs that are already working are
+// completed. New jobs can still be added; they are processed after the
+// manager has been resumed with ResumeAll.
+func (m *Manager) PauseAll() {
+	m.mu.Lock()
+	m.paused = true
+	m.mu.Unlock()
+}
+
+// ResumeAll resumes picking new jobs after PauseAll.
+func (m *Manager) ResumeAll() {
+	m.mu.Lock()
+	m.paused = false
+	m.mu.Unlock()
+}
+
+// Paused returns true if the manager has been paused with PauseAll.
+func (m *Manager) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+// PauseTopic stops the manager from picking new jobs of the given topic,
+// while jobs of other topics are still processed. Jobs of the topic stay
+// in the Waiting state, and are picked again after ResumeTopic. Jobs that
+// are already working are completed. See NextRequest.ExcludeTopics.
+func (m *Manager) PauseTopic(topic string) {
+	m.mu.Lock()
+	m.pausedTopic[topic] = true
+	m.mu.Unlock()
+}
+
+// ResumeTopic resumes picking new jobs of the given topic after PauseTopic.
+func (m *Manager) ResumeTopic(topic string) {
+	m.mu.Lock()
+	delete(m.pausedTopic, topic)
+	m.mu.Unlock()
+}
+
+// PausedTopics returns the topics that have been paused with PauseTopic,
+// in alphabetical order.
+func (m *Manager) PausedTopics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pausedTopics()
+}
+
+// pausedTopics returns the paused topics in alphabetical order. The caller
+// must hold m.mu.
+func (m *Manager) pausedTopics() []string {
+	topics := make([]string, 0, len(m.pausedTopic))
+	for topic := range m.pausedTopic {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// excludedTopics returns the topics whose jobs the scheduler must not
+// pick, i.e. the paused topics and the ones whose concurrency limit has
+// been reached, in alphabetical order. The caller must hold m.mu.
+func (m *Manager) excludedTopics() []string {
+	topics := m.pausedTopics()
+	for topic := range m.topicLimits {
+		if !m.pausedTopic[topic] && m.saturated(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	for topic := range m.auto {
+		if _, limited := m.topicLimits[topic]; !limited && !m.pausedTopic[topic] && m.saturated(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// saturated returns true if no more jobs of topic may be started, because
+// its concurrency limit has been reached. See SetTopicConcurrency and
+// SetAutoConcurrency. The caller must hold m.mu.
+func (m *Manager) saturated(topic string) bool {
+	if limit, found := m.topicLimits[topic]; found && m.inflight[topic] >= limit {
+		return true
+	}
+	auto := m.auto[topic]
+	return auto != nil && !auto.available()
+}
+
 // -- Add --
 
 // Add gives the manager a new job to execute. If Add returns nil, the caller
@@ -239,33 +956,180 @@ func (m *Manager) Add(job *Job) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	_, found := m.tm[job.Topic]
-	if !found {
+	if !found && m.defaultProc == nil {
 		return fmt.Errorf("jobqueue: topic %s not registered", job.Topic)
 	}
 	job.ID = uuid.New().String()
 	job.State = Waiting
 	job.Retry = 0
+	job.Redeliveries = 0
 	job.Priority = -time.Now().UnixNano()
 	job.Created = time.Now().UnixNano()
-	err := m.st.Create(job)
+	if job.RunAt == 0 {
+		job.RunAt = job.Created
+	}
+	err := m.storeOf(job).Create(job)
 	if err != nil {
 		return err
 	}
+	m.transition(job, "")
 	m.testJobAdded() // testing hook
 	return nil
 }
 
+// AddDelayed gives the job to the manager for later execution, i.e. it
+// will not be executed before delay has passed. Jobs that are due are
+// executed in the order of their rank and priority, like jobs added via
+// Add.
+func (m *Manager) AddDelayed(job *Job, delay time.Duration) error {
+	job.RunAt = time.Now().Add(delay).UnixNano()
+	return m.Add(job)
+}
+
+// -- Drain --
+
+// DrainTopic waits until all jobs of the given topic that are waiting or
+// working at the time of the call have been processed, i.e. have reached
+// a state other than Waiting or Working, e.g. Succeeded, Failed, or
+// Cancelled. Jobs added after the call are ignored. It returns the number
+// of jobs processed. If ctx is cancelled before all jobs are processed,
+// DrainTopic returns the number of jobs processed so far and ctx.Err().
+//
+// The jobs are processed by the workers of the manager as usual, so the
+// manager must be started.
+func (m *Manager) DrainTopic(ctx context.Context, topic string) (int, error) {
+	m.mu.Lock()
+	started := m.started
+	m.mu.Unlock()
+	if !started {
+		return 0, errors.New("jobqueue: manager not started")
+	}
+
+	// Take a snapshot of the jobs in all stores. Jobs claimed while
+	// taking it leave Waiting, so look for working jobs afterwards.
+	before := time.Now().UnixNano() + 1
+	pending := make(map[string]Store)
+	for _, st := range m.stores {
+		for _, state := range []string{Waiting, Working} {
+			err := snapshot(st, &ListRequest{Topic: topic, State: state, CreatedBefore: before}, pending)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var processed int
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return processed, ctx.Err()
+		case <-t.C:
+			for id, st := range pending {
+				job, err := st.Lookup(id)
+				if err == ErrNotFound {
+					// Deleted in the meantime
+					delete(pending, id)
+					continue
+				}
+				if err != nil {
+					return processed, err
+				}
+				if job.State != Waiting && job.State != Working {
+					delete(pending, id)
+					processed++
+				}
+			}
+		}
+	}
+	return processed, nil
+}
+
+// snapshot adds the identifiers of the jobs in st that match req to ids.
+// Rather than paging via Offset, which skips jobs when others leave the
+// state concurrently, it splits the range of creation times of req until
+// a single call to List returns all jobs in it, whatever the maximum
+// number of jobs the store returns.
+func snapshot(st Store, req *ListRequest, ids map[string]Store) error {
+	rsp, err := st.List(req)
+	if err != nil {
+		return err
+	}
+	if len(rsp.Jobs) >= rsp.Total || req.CreatedBefore-req.CreatedAfter <= 2 {
+		for _, job := range rsp.Jobs {
+			ids[job.ID] = st
+		}
+		return nil
+	}
+	mid := req.CreatedAfter + (req.CreatedBefore-req.CreatedAfter)/2
+	lower, upper := *req, *req
+	lower.CreatedBefore = mid + 1
+	upper.CreatedAfter = mid
+	if err := snapshot(st, &lower, ids); err != nil {
+		return err
+	}
+	return snapshot(st, &upper, ids)
+}
+
 // -- Stats, Lookup and List --
 
 // Stats returns current statistics about the job queue.
 func (m *Manager) Stats(request *StatsRequest) (*Stats, error) {
-	return m.st.Stats(request)
+	return m.StatsContext(context.Background(), request)
+}
+
+// StatsContext is like Stats, but aborts when ctx is done, e.g. when the
+// client of an HTTP handler has gone away. See ContextStore.
+func (m *Manager) StatsContext(ctx context.Context, request *StatsRequest) (*Stats, error) {
+	return withContext(m.st).StatsContext(ctx, request)
+}
+
+// StatsByTopic returns statistics about the jobs, grouped by topic, e.g. to
+// find the topics that are backing up. If the store does not implement
+// TopicStatsStore, only the registered topics are included.
+func (m *Manager) StatsByTopic() (map[string]*Stats, error) {
+	if st, ok := m.st.(TopicStatsStore); ok {
+		return st.StatsByTopic()
+	}
+	m.mu.Lock()
+	var topics []string
+	for topic := range m.tm {
+		topics = append(topics, topic)
+	}
+	m.mu.Unlock()
+	stats := make(map[string]*Stats)
+	for _, topic := range topics {
+		s, err := m.st.Stats(&StatsRequest{Topic: topic})
+		if err != nil {
+			return nil, err
+		}
+		stats[topic] = s
+	}
+	return stats, nil
 }
 
 // Lookup returns the job with the specified identifer.
 // If no such job exists, ErrNotFound is returned.
 func (m *Manager) Lookup(id string) (*Job, error) {
-	return m.st.Lookup(id)
+	return m.LookupContext(context.Background(), id)
+}
+
+// LookupContext is like Lookup, but aborts when ctx is done.
+// See ContextStore.
+func (m *Manager) LookupContext(ctx context.Context, id string) (*Job, error) {
+	for _, st := range m.stores {
+		job, err := withContext(st).LookupContext(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		job.store = st
+		return job, nil
+	}
+	return nil, ErrNotFound
 }
 
 // LookupByCorrelationID returns the details of jobs by their correlation identifier.
@@ -276,7 +1140,73 @@ func (m *Manager) LookupByCorrelationID(correlationID string) ([]*Job, error) {
 
 // List returns all jobs matching the parameters in the request.
 func (m *Manager) List(request *ListRequest) (*ListResponse, error) {
-	return m.st.List(request)
+	return m.ListContext(context.Background(), request)
+}
+
+// ListContext is like List, but aborts when ctx is done.
+// See ContextStore.
+func (m *Manager) ListContext(ctx context.Context, request *ListRequest) (*ListResponse, error) {
+	return withContext(m.st).ListContext(ctx, request)
+}
+
+// ResetRetries gives a waiting job a fresh set of retries, e.g. after the
+// cause of its failures has been fixed. The state and priority of the job
+// are left unchanged. If there is no waiting job with the identifier,
+// ErrNotFound is returned.
+func (m *Manager) ResetRetries(id string) error {
+	for _, st := range m.stores {
+		err := st.ResetRetries(id)
+		if err == ErrNotFound {
+			continue
+		}
+		return err
+	}
+	return ErrNotFound
+}
+
+// AutoConcurrency returns the number of jobs of the given topic that may
+// currently be executed at the same time, as adapted by the manager.
+// It returns 0 if the topic has not been configured via SetAutoConcurrency.
+func (m *Manager) AutoConcurrency(topic string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if auto := m.auto[topic]; auto != nil {
+		return auto.Limit()
+	}
+	return 0
+}
+
+// RecentJobs returns up to k of the jobs that this manager has completed
+// most recently, i.e. that have either succeeded or failed, most recent
+// first. The jobs are kept in memory, so they are available even if they
+// have been removed from the store already. Use SetRecentJobsSize to
+// specify how many jobs are kept.
+func (m *Manager) RecentJobs(k int) []*Job {
+	return m.recent.list(k)
+}
+
+// Metrics returns a snapshot of the counters that the manager keeps about
+// its operation, e.g. to find out whether the scheduler polls too often.
+func (m *Manager) Metrics() *Metrics {
+	return m.metrics.snapshot()
+}
+
+// NumWorkers returns the number of worker goroutines that are running.
+// While the manager is started, it is the sum of the concurrency of all
+// ranks. It drops to 0 when the manager has been closed and all working
+// jobs have ended.
+func (m *Manager) NumWorkers() int {
+	return m.workerRoutines.Len()
+}
+
+// NumActiveGoroutines returns the number of goroutines that the manager
+// is running, i.e. its workers and its background goroutines such as the
+// scheduler, heartbeats of working jobs, and webhook notifications. Use
+// it to monitor the manager, e.g. in deployments with many managers. It
+// drops to 0 when the manager has been closed and all working jobs have
+// ended.
+func (m *Manager) NumActiveGoroutines() int {
+	return m.workerRoutines.Len() + m.background.Len()
 }
 
 // -- Scheduler --
@@ -286,19 +1216,40 @@ func (m *Manager) schedule() {
 	m.testSchedulerStarted()       // testing hook
 	defer m.testSchedulerStopped() // testing hook
 
+	// The queue is assumed to be drained and not backlogged initially,
+	// so the hooks only fire when that changes.
+	m.drained = true
+	m.backlogged = false
+	idle := false
+
 	t := time.NewTicker(1 * time.Second)
 	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
+			if m.Paused() {
+				continue
+			}
 			// Fill up available worker slots with jobs
+			deferred := make(map[string]bool) // jobs deferred by rate limits
 			for {
-				job, err := m.st.Next()
+				if !m.idle() {
+					// All workers busy
+					break
+				}
+				start := time.Now()
+				job, err := m.next()
+				m.metrics.poll(time.Since(start), err == nil && job != nil)
+				if m.sink != nil {
+					m.sink.Timing(MetricClaimDuration, time.Since(start), nil)
+				}
 				if err == ErrNotFound {
 					break
 				}
 				if err != nil {
-					m.logger.Printf("jobqueue: error picking next job to schedule: %v", err)
+					if m.claimCtx.Err() == nil {
+						m.errorf("jobqueue: error picking next job to schedule: %v", err)
+					}
 					break
 				}
 				if job == nil {
@@ -307,25 +1258,65 @@ func (m *Manager) schedule() {
 				m.mu.Lock()
 				concurrency := m.concurrency[job.Rank]
 				working := m.working[job.Rank]
+				auto := m.auto[job.Topic]
+				throttled := m.saturated(job.Topic)
 				m.mu.Unlock()
-				if working >= concurrency {
-					// All workers busy
+				if working >= concurrency || throttled {
+					// All workers of the rank busy
+					m.release(job)
 					break
 				}
-				m.mu.Lock()
-				job.State = Working
-				job.Started = time.Now().UnixNano()
-				err = m.st.Update(job)
-				if err != nil {
-					m.mu.Unlock()
-					m.logger.Printf("jobqueue: error updating job: %v", err)
+				if deferred[job.ID] {
+					// The store does not honor RunAt
+					m.release(job)
 					break
 				}
+				if wait := m.correlations.reserve(job.CorrelationID, time.Now()); wait > 0 {
+					// Let jobs of other correlation identifiers go first,
+					// whatever the order in which the store returns jobs
+					deferred[job.ID] = true
+					job.RunAt = time.Now().Add(wait).UnixNano()
+					if err := m.release(job); err != nil {
+						break
+					}
+					continue
+				}
+				if job.WorkerID != m.workerID {
+					// The store has not recorded the worker in Next
+					job.WorkerID = m.workerID
+					if err := m.storeOf(job).Update(job); err != nil {
+						m.errorf("jobqueue: error updating job: %v", err)
+						// Put the job back, so that no job is left
+						// working without a worker
+						if _, err := m.storeOf(job).CompareAndSetState(job.ID, Working, Waiting); err != nil {
+							m.errorf("jobqueue: error releasing job %s: %v", job.ID, err)
+						}
+						break
+					}
+				}
+				m.mu.Lock()
 				rank := job.Rank
 				m.working[rank]++
+				busy := m.working[rank]
+				if auto != nil {
+					auto.inflight++
+				}
+				m.inflight[job.Topic]++
+				m.lastActive = time.Now()
+				m.running[job.ID] = &execution{}
 				m.mu.Unlock()
+				m.observeBusy(rank, busy)
+				m.transition(job, Waiting)
+				m.metrics.claim()
+				m.event(job, "claimed by worker %s", m.workerID)
 				m.testJobScheduled()
 				m.jobc[rank] <- job
+				m.drained = false
+			}
+			m.checkQueueHooks()
+			if !idle && m.idleTimeout > 0 && m.inactiveFor() >= m.idleTimeout {
+				idle = true
+				close(m.idlec)
 			}
 		case <-m.stopSched:
 			m.stopSched <- struct{}{}
@@ -333,3 +1324,166 @@ func (m *Manager) schedule() {
 		}
 	}
 }
+
+// inactiveFor returns the time since the last job was claimed or finished,
+// or 0 if there are working jobs.
+func (m *Manager) inactiveFor() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, working := range m.working {
+		if working > 0 {
+			return 0
+		}
+	}
+	return time.Since(m.lastActive)
+}
+
+// idle reports whether there is a worker available for any rank.
+func (m *Manager) idle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rank, concurrency := range m.concurrency {
+		if m.working[rank] < concurrency {
+			return true
+		}
+	}
+	return false
+}
+
+// release puts a job that has been claimed via next, but cannot be
+// executed right now, back into the Waiting state.
+func (m *Manager) release(job *Job) error {
+	job.State = Waiting
+	job.Started = 0
+	job.ClaimedAt = 0
+	job.Heartbeat = 0
+	err := m.storeOf(job).Update(job)
+	if err != nil {
+		m.errorf("jobqueue: error updating job: %v", err)
+	}
+	return err
+}
+
+// next asks the scheduler for the next job to claim, passing it the
+// current state of the manager.
+func (m *Manager) next() (*Job, error) {
+	m.mu.Lock()
+	state := &SchedulerState{
+		Stores: m.stores,
+		Request: NextRequest{
+			WorkerVersion: m.version,
+			FIFO:          m.fifo,
+			LIFO:          m.lifo,
+			Gate:          m.claimGate,
+			Fair:          m.fair,
+			ExcludeTopics: m.excludedTopics(),
+			WorkerID:      m.workerID,
+		},
+		Concurrency: make(map[int]int, len(m.concurrency)),
+		Working:     make(map[int]int, len(m.working)),
+		Logger:      m.logger,
+	}
+	for rank, n := range m.concurrency {
+		state.Concurrency[rank] = n
+	}
+	for rank, n := range m.working {
+		state.Working[rank] = n
+	}
+	m.mu.Unlock()
+	job, st, err := m.scheduler.Next(m.claimCtx, state)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, ErrNotFound
+	}
+	if st != nil {
+		job.store = st
+	}
+	m.mu.Lock()
+	delete(m.repeats, job.ID) // the occurrence is not pending anymore
+	m.mu.Unlock()
+	return job, nil
+}
+
+// checkLatency counts job as an SLO breach if its last attempt had to wait
+// longer than the latency target of its topic before it was started. The
+// attempt is due at the later of Created and RunAt, which retries move to
+// the end of their backoff. Redelivered jobs are not checked, as the time
+// they became due again is unknown.
+func (m *Manager) checkLatency(job *Job) {
+	target, found := m.latencyTargets[job.Topic]
+	if !found || job.Created == 0 || job.Started == 0 || job.Redeliveries > 0 {
+		return
+	}
+	due := job.Created
+	if job.RunAt > due {
+		due = job.RunAt
+	}
+	if time.Duration(job.Started-due) > target {
+		m.metrics.sloBreach(job.Topic)
+	}
+}
+
+// retried records a retry of job and checks whether the job retries too
+// often, invoking the retry storm hook if it does.
+func (m *Manager) retried(job *Job) {
+	if m.retryStormHook == nil {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	var recent []time.Time
+	for _, t := range m.retries[job.ID] {
+		if now.Sub(t) < m.retryStormWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	m.retries[job.ID] = recent
+	m.mu.Unlock()
+
+	// Only fire when crossing the threshold
+	if len(recent) == m.retryStormMax+1 {
+		m.metrics.retryStorm()
+		m.retryStormHook(job)
+	}
+}
+
+// forgetRetries drops the recent retries of a completed job.
+func (m *Manager) forgetRetries(job *Job) {
+	m.mu.Lock()
+	delete(m.retries, job.ID)
+	m.mu.Unlock()
+}
+
+// storeOf returns the store that job belongs to.
+func (m *Manager) storeOf(job *Job) Store {
+	if job.store != nil {
+		return job.store
+	}
+	return m.st
+}
+
+// checkQueueHooks invokes the drain and backlog hooks if the state of the
+// queue has changed since the last check.
+func (m *Manager) checkQueueHooks() {
+	if m.drainHook == nil && m.backlogHook == nil {
+		return
+	}
+	stats, err := m.st.Stats(&StatsRequest{})
+	if err != nil {
+		m.errorf("jobqueue: error retrieving stats: %v", err)
+		return
+	}
+	drained := stats.Waiting == 0 && stats.Working == 0
+	if drained && !m.drained && m.drainHook != nil {
+		m.drainHook()
+	}
+	m.drained = drained
+	backlogged := stats.Waiting > m.backlogThreshold
+	if backlogged && !m.backlogged && m.backlogHook != nil {
+		m.backlogHook(stats.Waiting)
+	}
+	m.backlogged = backlogged
+}
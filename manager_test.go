@@ -5,8 +5,18 @@
 package jobqueue
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,6 +29,32 @@ func (l *stringLogger) Printf(format string, v ...interface{}) {
 	l.Lines = append(l.Lines, fmt.Sprintf(format, v...))
 }
 
+// leveledLogger records the lines logged at each level.
+type leveledLogger struct {
+	mu     sync.Mutex
+	Lines  []string
+	Debug  []string
+	Errors []string
+}
+
+func (l *leveledLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.Lines = append(l.Lines, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *leveledLogger) Debugf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.Debug = append(l.Debug, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *leveledLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.Errors = append(l.Errors, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
 func TestManagerDefaults(t *testing.T) {
 	m := New()
 	if m.st == nil {
@@ -298,3 +334,3231 @@ func TestJobSuccessAfterRetry(t *testing.T) {
 		t.Fatal("expected lines written to Logger")
 	}
 }
+
+// TestJobRepeat will schedule a job that repeats 3 times. We check that
+// the processor is called exactly 3 times with the specified interval
+// between the occurrences.
+func TestJobRepeat(t *testing.T) {
+	const (
+		repeats  = 3
+		interval = 200 * time.Millisecond
+	)
+	repeated := make(chan struct{}, repeats)
+	jobDone := make(chan time.Time, repeats+1)
+
+	m := New()
+	m.testJobRepeated = func() { repeated <- struct{}{} }
+
+	f := func(args ...interface{}) error {
+		jobDone <- time.Now()
+		return nil
+	}
+	err := m.Register("topic", f)
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", Repeats: repeats, RepeatEvery: interval}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	timeout := 3 * time.Second
+	var last time.Time
+	for i := 0; i < repeats; i++ {
+		select {
+		case done := <-jobDone:
+			if i > 0 {
+				if have, want := done.Sub(last), interval; have < want {
+					t.Fatalf("occurrence %d ran after %v, want at least %v", i+1, have, want)
+				}
+			}
+			last = done
+		case <-time.After(timeout):
+			t.Fatalf("Occurrence %d timed out", i+1)
+		}
+	}
+	select {
+	case <-jobDone:
+		t.Fatalf("expected exactly %d occurrences", repeats)
+	case <-time.After(2 * time.Second):
+	}
+	if have, want := len(repeated), repeats-1; have != want {
+		t.Fatalf("repeated %d times, want %d", have, want)
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// TestJobRepeatSurvivesRestart checks that the next occurrence of a
+// repeating job is stored right away, so another manager executes it
+// after the first one has been stopped.
+func TestJobRepeatSurvivesRestart(t *testing.T) {
+	const interval = 500 * time.Millisecond
+	st := NewInMemoryStore()
+	repeated := make(chan struct{}, 1)
+	done := make(chan struct{}, 2)
+	f := func(args ...interface{}) error {
+		done <- struct{}{}
+		return nil
+	}
+
+	first := New(SetStore(st), SetLogger(&stringLogger{}))
+	first.testJobRepeated = func() { repeated <- struct{}{} }
+	if err := first.Register("topic", f); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := first.Start(); err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{
+		Topic:       "topic",
+		Repeats:     2,
+		RepeatEvery: interval,
+		Timeout:     time.Minute,
+		MutexKey:    "mutex",
+		CallbackURL: "http://localhost/callback",
+	}
+	if err := first.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for _, c := range []chan struct{}{done, repeated} {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("First occurrence timed out")
+		}
+	}
+	if err := first.Stop(); err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	rsp, err := st.List(&ListRequest{Topic: "topic", State: Waiting})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := len(rsp.Jobs), 1; have != want {
+		t.Fatalf("len(Jobs) = %d, want %d", have, want)
+	}
+	next := rsp.Jobs[0]
+	if have, want := next.Repeats, 1; have != want {
+		t.Fatalf("Repeats = %d, want %d", have, want)
+	}
+	if have, want := time.Duration(next.RunAt-next.Created), interval; have < want-10*time.Millisecond || have > want {
+		t.Fatalf("RunAt is %v after Created, want about %v", have, want)
+	}
+	if next.Timeout != job.Timeout || next.MutexKey != job.MutexKey || next.CallbackURL != job.CallbackURL {
+		t.Fatalf("next occurrence = %+v, want the options of %+v", next, job)
+	}
+
+	second := New(SetStore(st), SetLogger(&stringLogger{}))
+	if err := second.Register("topic", f); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := second.Start(); err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Second occurrence timed out")
+	}
+	if err := second.Stop(); err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+func TestJobWorkerID(t *testing.T) {
+	started := make(chan struct{}, 1)
+	jobDone := make(chan struct{}, 1)
+
+	m := New(SetWorkerID("worker-1"))
+	m.testJobStarted = func() { started <- struct{}{} }
+
+	f := func(args ...interface{}) error {
+		jobDone <- struct{}{}
+		return nil
+	}
+	err := m.Register("topic", f)
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	timeout := 2 * time.Second
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatal("Job Start timed out")
+	}
+	select {
+	case <-jobDone:
+	case <-time.After(timeout):
+		t.Fatal("Processor func timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.WorkerID, "worker-1"; have != want {
+		t.Fatalf("WorkerID = %q, want %q", have, want)
+	}
+}
+
+func TestJobCompletedBy(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetWorkerID("worker-1"))
+	err := m.Register("topic", func(args ...interface{}) error {
+		if len(args) > 0 {
+			return errors.New("failed job")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(20)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	succeeded := &Job{Topic: "topic"}
+	if err := m.Add(succeeded); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	failed := &Job{Topic: "topic", Args: []interface{}{"fail"}}
+	if err := m.Add(failed); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	states := make(map[string]string)
+	for states[succeeded.ID] != Succeeded || states[failed.ID] != Failed {
+		select {
+		case tr := <-sub.C:
+			states[tr.JobID] = tr.To
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Jobs timed out; states: %v", states)
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	for _, id := range []string{succeeded.ID, failed.ID} {
+		job, err := m.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have, want := job.CompletedBy, "worker-1"; have != want {
+			t.Fatalf("CompletedBy of %s job = %q, want %q", job.State, have, want)
+		}
+	}
+	list, err := m.List(&ListRequest{State: Succeeded})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].CompletedBy != "worker-1" {
+		t.Fatalf("List returned %v, want a job completed by worker-1", list.Jobs)
+	}
+}
+
+// TestQueueHooks checks that the backlog hook fires when too many jobs
+// are waiting and the drain hook fires after the last job completed.
+func TestQueueHooks(t *testing.T) {
+	drained := make(chan struct{}, 1)
+	backlog := make(chan int, 1)
+	release := make(chan struct{})
+
+	m := New(
+		SetConcurrency(0, 1),
+		SetDrainHook(func() { drained <- struct{}{} }),
+		SetBacklogHook(2, func(depth int) { backlog <- depth }),
+	)
+	f := func(args ...interface{}) error {
+		<-release
+		return nil
+	}
+	err := m.Register("topic", f)
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		err = m.Add(&Job{Topic: "topic"})
+		if err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+	timeout := 3 * time.Second
+	select {
+	case depth := <-backlog:
+		if have, want := depth, 3; have != want {
+			t.Fatalf("backlog depth = %d, want %d", have, want)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Backlog hook timed out")
+	}
+	select {
+	case <-drained:
+		t.Fatal("Drain hook fired before the queue was empty")
+	default:
+	}
+	close(release)
+	select {
+	case <-drained:
+	case <-time.After(3 * timeout):
+		t.Fatal("Drain hook timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// TestDrainTopic enqueues jobs for two topics and checks that DrainTopic
+// waits for exactly the jobs of its topic that were waiting at the time
+// of the call.
+func TestDrainTopic(t *testing.T) {
+	const n = 5
+
+	m := New()
+	var once sync.Once
+	fa := func(args ...interface{}) error {
+		// Jobs added while draining must be ignored
+		once.Do(func() {
+			if err := m.Add(&Job{Topic: "a"}); err != nil {
+				t.Errorf("Add failed with %v", err)
+			}
+		})
+		return nil
+	}
+	fb := func(args ...interface{}) error {
+		return nil
+	}
+	if err := m.Register("a", fa); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := m.Register("b", fb); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err := m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := m.Add(&Job{Topic: "a"}); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		if err := m.Add(&Job{Topic: "b"}); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	processed, err := m.DrainTopic(ctx, "a")
+	if err != nil {
+		t.Fatalf("DrainTopic failed with %v", err)
+	}
+	if have, want := processed, n; have != want {
+		t.Fatalf("processed = %d, want %d", have, want)
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// limitedStore is a Store whose List returns at most max jobs, like a
+// store configured with a maximum list limit.
+type limitedStore struct {
+	Store
+	max int
+}
+
+func (st *limitedStore) List(req *ListRequest) (*ListResponse, error) {
+	dup := *req
+	if dup.Limit <= 0 || dup.Limit > st.max {
+		dup.Limit = st.max
+	}
+	return st.Store.List(&dup)
+}
+
+// TestDrainTopicWithCancelledJob checks that DrainTopic finds all jobs in
+// a store that returns small pages, and that a job cancelled while
+// draining counts as processed.
+func TestDrainTopicWithCancelledJob(t *testing.T) {
+	const n = 7
+
+	m := New(SetStore(&limitedStore{Store: NewInMemoryStore(), max: 2}))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	m.PauseAll()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	var jobs []*Job
+	for i := 0; i < n; i++ {
+		job := &Job{Topic: "topic"}
+		if err := m.Add(job); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	go func() {
+		time.Sleep(2 * drainPollInterval)
+		if err := m.Cancel(jobs[0].ID); err != nil {
+			t.Errorf("Cancel failed with %v", err)
+		}
+		m.ResumeAll()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	processed, err := m.DrainTopic(ctx, "topic")
+	if err != nil {
+		t.Fatalf("DrainTopic failed with %v", err)
+	}
+	if have, want := processed, n; have != want {
+		t.Fatalf("processed = %d, want %d", have, want)
+	}
+	job, err := m.Lookup(jobs[0].ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Cancelled; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// TestJobMinWorkerVersion checks that a job requiring a newer worker is
+// not picked by an older worker, but by a worker with that version.
+func TestJobMinWorkerVersion(t *testing.T) {
+	st := NewInMemoryStore()
+	oldDone := make(chan struct{}, 1)
+	newDone := make(chan struct{}, 1)
+
+	older := New(SetStore(st), SetWorkerVersion(1))
+	err := older.Register("topic", func(args ...interface{}) error {
+		oldDone <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = older.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	err = older.Add(&Job{Topic: "topic", MinWorkerVersion: 2})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-oldDone:
+		t.Fatal("Job executed by an older worker")
+	case <-time.After(2 * time.Second):
+	}
+	err = older.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	newer := New(SetStore(st), SetWorkerVersion(2))
+	err = newer.Register("topic", func(args ...interface{}) error {
+		newDone <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = newer.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-newDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Processor func timed out")
+	}
+	err = newer.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+// TestJobAtMostOnce simulates a crash of a manager while it executes a job
+// with AtMostOnce delivery. We check that the job is not executed again by
+// a manager that is started on the same store afterwards.
+func TestJobAtMostOnce(t *testing.T) {
+	st := NewInMemoryStore()
+	started := make(chan struct{}, 1)
+	crash := make(chan struct{})
+	jobDone := make(chan struct{}, 1)
+
+	crashed := New(SetStore(st), SetDeliveryMode("topic", AtMostOnce))
+	crashed.testJobStarted = func() { started <- struct{}{} }
+	err := crashed.Register("topic", func(args ...interface{}) error {
+		<-crash // never returns before the restart
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = crashed.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", MaxRetry: 3}
+	err = crashed.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Job Start timed out")
+	}
+	defer func() {
+		close(crash)
+		crashed.Stop()
+	}()
+
+	// Restart
+	m := New(SetStore(st), SetDeliveryMode("topic", AtMostOnce))
+	err = m.Register("topic", func(args ...interface{}) error {
+		jobDone <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-jobDone:
+		t.Fatal("Job executed again after restart")
+	case <-time.After(2 * time.Second):
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	job, err = st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerMetrics(t *testing.T) {
+	scheduled := make(chan struct{}, 1)
+
+	m := New()
+	m.testJobScheduled = func() { scheduled <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+
+	// Let the scheduler poll the empty queue
+	time.Sleep(1500 * time.Millisecond)
+	metrics := m.Metrics()
+	if metrics.EmptyPolls == 0 {
+		t.Fatal("expected EmptyPolls > 0")
+	}
+	if have, want := metrics.Claims, int64(0); have != want {
+		t.Fatalf("Claims = %d, want %d", have, want)
+	}
+	if have, want := metrics.ClaimDuration.Count, metrics.EmptyPolls; have != want {
+		t.Fatalf("ClaimDuration.Count = %d, want %d", have, want)
+	}
+
+	err = m.Add(&Job{Topic: "topic"})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-scheduled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Scheduler timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	metrics = m.Metrics()
+	if have, want := metrics.Claims, int64(1); have != want {
+		t.Fatalf("Claims = %d, want %d", have, want)
+	}
+	if have, want := metrics.ClaimDuration.Count, metrics.EmptyPolls+metrics.Claims; have != want {
+		t.Fatalf("ClaimDuration.Count = %d, want %d", have, want)
+	}
+}
+
+// TestManagerPauseAll checks that a paused manager does not pick any jobs
+// and processes them after it has been resumed.
+func TestManagerPauseAll(t *testing.T) {
+	const n = 3
+	jobDone := make(chan struct{}, n)
+
+	m := New()
+	err := m.Register("topic", func(args ...interface{}) error {
+		jobDone <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	m.PauseAll()
+	if !m.Paused() {
+		t.Fatal("expected manager to be paused")
+	}
+	for i := 0; i < n; i++ {
+		if err := m.Add(&Job{Topic: "topic"}); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+	select {
+	case <-jobDone:
+		t.Fatal("Job executed while paused")
+	case <-time.After(2 * time.Second):
+	}
+
+	m.ResumeAll()
+	if m.Paused() {
+		t.Fatal("expected manager to be resumed")
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-jobDone:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Processor func timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+func TestManagerPauseTopic(t *testing.T) {
+	jobDone := make(chan string, 4)
+
+	m := New()
+	for _, topic := range []string{"email", "sms"} {
+		topic := topic
+		err := m.Register(topic, func(args ...interface{}) error {
+			jobDone <- topic
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+	}
+	m.PauseTopic("email")
+	m.PauseTopic("push")
+	if have, want := fmt.Sprint(m.PausedTopics()), "[email push]"; have != want {
+		t.Fatalf("PausedTopics = %s, want %s", have, want)
+	}
+	err := m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	email := &Job{Topic: "email"}
+	if err := m.Add(email); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	if err := m.Add(&Job{Topic: "sms"}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+
+	// Only the job of the topic that is not paused gets executed
+	select {
+	case topic := <-jobDone:
+		if topic != "sms" {
+			t.Fatalf("Job of topic %q executed while paused", topic)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Processor func timed out")
+	}
+	select {
+	case topic := <-jobDone:
+		t.Fatalf("Job of topic %q executed while paused", topic)
+	case <-time.After(2 * time.Second):
+	}
+	job, err := m.Lookup(email.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != Waiting {
+		t.Fatalf("State = %q, want %q", job.State, Waiting)
+	}
+
+	m.ResumeTopic("email")
+	if have, want := fmt.Sprint(m.PausedTopics()), "[push]"; have != want {
+		t.Fatalf("PausedTopics = %s, want %s", have, want)
+	}
+	select {
+	case topic := <-jobDone:
+		if topic != "email" {
+			t.Fatalf("Processor of topic %q executed, want %q", topic, "email")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Processor func timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+}
+
+func TestManagerTopicConcurrency(t *testing.T) {
+	limits := map[string]int{"cheap": 5, "expensive": 2}
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+	var wg sync.WaitGroup
+	options := []ManagerOption{SetConcurrency(0, 10)}
+	for topic, n := range limits {
+		options = append(options, SetTopicConcurrency(topic, n))
+	}
+	m := New(options...)
+	for topic := range limits {
+		topic := topic
+		err := m.Register(topic, func(args ...interface{}) error {
+			defer wg.Done()
+			mu.Lock()
+			running[topic]++
+			if running[topic] > peak[topic] {
+				peak[topic] = running[topic]
+			}
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			running[topic]--
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed with %v", err)
+	}
+	err := m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	// Add twice as many jobs as each topic may execute at the same time
+	for topic, limit := range limits {
+		for i := 0; i < 2*limit; i++ {
+			wg.Add(1)
+			if err := m.Add(&Job{Topic: topic}); err != nil {
+				t.Fatalf("Add failed with %v", err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Processor funcs timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for topic, limit := range limits {
+		if peak[topic] > limit {
+			t.Errorf("%s: executed %d jobs at the same time, want at most %d", topic, peak[topic], limit)
+		}
+		if peak[topic] < limit {
+			// The saturated topic must not keep the other one from using its share
+			t.Errorf("%s: executed at most %d jobs at the same time, want %d", topic, peak[topic], limit)
+		}
+	}
+}
+
+// TestSchedules checks that the next occurrence of a repeating job is
+// listed with a plausible time.
+func TestSchedules(t *testing.T) {
+	const interval = 1 * time.Minute
+	succeeded := make(chan struct{}, 1)
+
+	m := New()
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	if have, want := len(m.Schedules()), 0; have != want {
+		t.Fatalf("len(Schedules) = %d, want %d", have, want)
+	}
+	job := &Job{Topic: "topic", CorrelationID: "poll", Repeats: 3, RepeatEvery: interval}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	before := time.Now()
+	select {
+	case <-succeeded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Job success timed out")
+	}
+
+	var schedules []*Schedule
+	for i := 0; i < 10 && len(schedules) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		schedules = m.Schedules()
+	}
+	if have, want := len(schedules), 1; have != want {
+		t.Fatalf("len(Schedules) = %d, want %d", have, want)
+	}
+	sched := schedules[0]
+	if have, want := sched.PreviousJobID, job.ID; have != want {
+		t.Fatalf("PreviousJobID = %q, want %q", have, want)
+	}
+	if have, want := sched.CorrelationID, "poll"; have != want {
+		t.Fatalf("CorrelationID = %q, want %q", have, want)
+	}
+	if have, want := sched.Remaining, 2; have != want {
+		t.Fatalf("Remaining = %d, want %d", have, want)
+	}
+	if sched.NextRunAt.Before(before.Add(interval)) || sched.NextRunAt.After(time.Now().Add(interval)) {
+		t.Fatalf("NextRunAt = %v, want about %v", sched.NextRunAt, before.Add(interval))
+	}
+
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if have, want := len(m.Schedules()), 0; have != want {
+		t.Fatalf("len(Schedules) = %d after Stop, want %d", have, want)
+	}
+}
+
+func TestSchedulesForgetClaimedOccurrences(t *testing.T) {
+	succeeded := make(chan struct{}, 2)
+
+	m := New()
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+	err = m.Add(&Job{Topic: "topic", Repeats: 2, RepeatEvery: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Job success #%d timed out", i+1)
+		}
+	}
+
+	// The second occurrence has been claimed, so it is not pending
+	// anymore, even though nobody has called Schedules
+	m.mu.Lock()
+	n := len(m.repeats)
+	m.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("len(repeats) = %d, want 0", n)
+	}
+}
+
+// TestJobZeroRetryFailureState checks that a failed job without retries
+// ends up in the configured state.
+func TestJobZeroRetryFailureState(t *testing.T) {
+	failed := make(chan struct{}, 1)
+
+	m := New(SetLogger(&stringLogger{}), SetZeroRetryFailureState(NeedsReview))
+	m.testJobFailed = func() { failed <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		return errors.New("failed job")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Job failure timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, NeedsReview; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if _, err := m.Stats(&StatsRequest{}); err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+}
+
+func TestManagerWithStores(t *testing.T) {
+	succeeded := make(chan struct{}, 2)
+
+	st1 := NewInMemoryStore()
+	st2 := NewInMemoryStore()
+	m := NewManagerWithStores([]Store{st1, st2}, SetLogger(&stringLogger{}))
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+
+	job1 := &Job{ID: "1", Topic: "topic", State: Waiting}
+	if err := st1.Create(job1); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	job2 := &Job{ID: "2", Topic: "topic", State: Waiting}
+	if err := st2.Create(job2); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	for _, tt := range []struct {
+		St Store
+		ID string
+	}{
+		{st1, job1.ID},
+		{st2, job2.ID},
+	} {
+		job, err := tt.St.Lookup(tt.ID)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed with %v", tt.ID, err)
+		}
+		if have, want := job.State, Succeeded; have != want {
+			t.Fatalf("State of job %q = %q, want %q", tt.ID, have, want)
+		}
+	}
+	if _, err := st1.Lookup(job2.ID); err != ErrNotFound {
+		t.Fatalf("expected job %q to not be in the first store, got %v", job2.ID, err)
+	}
+	if _, err := m.Lookup(job2.ID); err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+}
+
+func TestManagerResetRetries(t *testing.T) {
+	retried := make(chan struct{}, 1)
+
+	m := New(SetLogger(&stringLogger{}))
+	m.testJobRetry = func() {
+		// Keep the job waiting after its first retry
+		m.PauseAll()
+		select {
+		case retried <- struct{}{}:
+		default:
+		}
+	}
+	err := m.Register("topic", func(args ...interface{}) error {
+		return errors.New("failed job")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+	job := &Job{Topic: "topic", MaxRetry: 10}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-retried:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job retry timed out")
+	}
+
+	// Wait for the job to be put back into the queue
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err = m.Lookup(job.ID)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if job.Retry > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Retry counter was not incremented")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = m.ResetRetries(job.ID)
+	if err != nil {
+		t.Fatalf("ResetRetries failed with %v", err)
+	}
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.Retry, 0; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := job.State, Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+
+	if err := m.ResetRetries("no-such-job"); err != ErrNotFound {
+		t.Fatalf("ResetRetries of unknown job: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestManagerSLOBreaches(t *testing.T) {
+	succeeded := make(chan struct{}, 2)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetLatencyTarget("slow", 1*time.Millisecond),
+		SetLatencyTarget("fast", 1*time.Hour),
+	)
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	for _, topic := range []string{"slow", "fast"} {
+		err := m.Register(topic, func(args ...interface{}) error { return nil })
+		if err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+	}
+	err := m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	// Both jobs wait for the next tick of the scheduler, which is
+	// longer than the latency target of the "slow" topic
+	for _, topic := range []string{"slow", "fast"} {
+		err = m.Add(&Job{Topic: topic})
+		if err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	metrics := m.Metrics()
+	if have, want := metrics.SLOBreaches["slow"], int64(1); have != want {
+		t.Fatalf("SLOBreaches[slow] = %d, want %d", have, want)
+	}
+	if have, want := metrics.SLOBreaches["fast"], int64(0); have != want {
+		t.Fatalf("SLOBreaches[fast] = %d, want %d", have, want)
+	}
+}
+
+func TestManagerSLOBreachesIgnoreDelays(t *testing.T) {
+	succeeded := make(chan struct{}, 2)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetLatencyTarget("topic", 1500*time.Millisecond),
+		SetBackoffFunc(func(attempts int) time.Duration { return 2 * time.Second }),
+	)
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	var failed int32
+	err := m.Register("topic", func(args ...interface{}) error {
+		if len(args) > 0 && atomic.AddInt32(&failed, 1) == 1 {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	// Both jobs are started more than the latency target after they have
+	// been created, but within it after they have become due
+	err = m.AddDelayed(&Job{Topic: "topic"}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("AddDelayed failed with %v", err)
+	}
+	err = m.Add(&Job{Topic: "topic", Args: []interface{}{"retry"}, MaxRetry: 1})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if have, want := m.Metrics().SLOBreaches["topic"], int64(0); have != want {
+		t.Fatalf("SLOBreaches = %d, want %d", have, want)
+	}
+}
+
+func TestManagerRetryPriorityDelta(t *testing.T) {
+	const delta = int64(time.Hour)
+	retried := make(chan time.Time, 1)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetBackoffFunc(func(attempts int) time.Duration { return 0 }),
+		SetRetryPriorityDelta("topic", delta),
+	)
+	m.testJobRetry = func() {
+		// Keep the job waiting after its first retry
+		m.PauseAll()
+		select {
+		case retried <- time.Now():
+		default:
+		}
+	}
+	err := m.Register("topic", func(args ...interface{}) error {
+		return errors.New("failed job")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+	job := &Job{Topic: "topic", MaxRetry: 1}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	var retryAt time.Time
+	select {
+	case retryAt = <-retried:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job retry timed out")
+	}
+
+	// Wait for the job to be put back into the queue
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		job, err = m.Lookup(job.ID)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if job.Retry > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Job was not put back into the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	requeuedBy := time.Now()
+
+	// Without a delta, the priority would be between these bounds
+	min, max := -requeuedBy.UnixNano(), -retryAt.UnixNano()
+	if job.Priority < min+delta || job.Priority > max+delta {
+		t.Fatalf("Priority = %d, want between %d and %d", job.Priority, min+delta, max+delta)
+	}
+}
+
+func TestManagerPicksUpRenamedTopic(t *testing.T) {
+	succeeded := make(chan struct{}, 2)
+
+	st := NewInMemoryStore()
+	for _, id := range []string{"1", "2"} {
+		job := &Job{ID: id, Topic: "emailV1", State: Waiting}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	n, err := st.RenameTopic("emailV1", "email")
+	if err != nil {
+		t.Fatalf("RenameTopic failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("RenameTopic returned %d, want %d", have, want)
+	}
+
+	m := New(SetLogger(&stringLogger{}), SetStore(st))
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err = m.Register("email", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	stats, err := m.Stats(&StatsRequest{Topic: "email"})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := stats.Succeeded, 2; have != want {
+		t.Fatalf("Succeeded = %d, want %d", have, want)
+	}
+}
+
+func TestManagerDoesNotResurrectDeletedJob(t *testing.T) {
+	done := make(chan struct{})
+
+	st := NewInMemoryStore()
+	m := New(SetLogger(&stringLogger{}), SetStore(st))
+	m.testJobSucceeded = func() { t.Error("expected deleted job to not succeed") }
+	err := m.Register("topic", func(args ...interface{}) error {
+		defer close(done)
+		// Delete the job while it is being processed
+		return st.Delete(&Job{ID: "1"})
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := st.Create(&Job{ID: "1", Topic: "topic", State: Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job processing timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if _, err := st.Lookup("1"); err != ErrNotFound {
+		t.Fatalf("expected deleted job to be gone, got %v", err)
+	}
+}
+
+func TestManagerRetryStormHook(t *testing.T) {
+	storm := make(chan Job, 1)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetBackoffFunc(func(attempts int) time.Duration { return 0 }),
+		SetRetryStormHook(1, time.Minute, func(job *Job) {
+			select {
+			case storm <- *job:
+			default:
+			}
+		}),
+	)
+	err := m.Register("topic", func(args ...interface{}) error {
+		return errors.New("failed job")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", MaxRetry: 100}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	var stormy Job
+	select {
+	case stormy = <-storm:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Retry storm hook timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if have, want := stormy.ID, job.ID; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	if have, want := stormy.Retry, 2; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := m.Metrics().RetryStorms, int64(1); have != want {
+		t.Fatalf("RetryStorms = %d, want %d", have, want)
+	}
+}
+
+func TestManagerFIFOMode(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	done := make(chan struct{}, 3)
+
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetConcurrency(0, 1),
+		SetFIFOMode(true),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		mu.Lock()
+		order = append(order, args[0].(string))
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	// Later jobs have higher priorities
+	for i, id := range []string{"1", "2", "3"} {
+		job := &Job{
+			ID:       id,
+			Topic:    "topic",
+			State:    Waiting,
+			Args:     []interface{}{id},
+			Priority: int64(i),
+			Created:  int64(i + 1),
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := strings.Join(order, ","), "1,2,3"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+}
+
+func TestManagerLIFOMode(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	done := make(chan struct{}, 3)
+
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetConcurrency(0, 1),
+		SetLIFOMode(true),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		mu.Lock()
+		order = append(order, args[0].(string))
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	// Earlier jobs have higher priorities
+	for i, id := range []string{"1", "2", "3"} {
+		job := &Job{
+			ID:       id,
+			Topic:    "topic",
+			State:    Waiting,
+			Args:     []interface{}{id},
+			Priority: int64(-i),
+			Created:  int64(i + 1),
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := strings.Join(order, ","), "3,2,1"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+}
+
+func TestManagerClaimGate(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		ran  []string
+		seen = make(map[string]bool)
+	)
+	done := make(chan struct{}, 2)
+
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetClaimGate(func(job *Job) (bool, error) {
+			mu.Lock()
+			seen[job.ID] = true
+			mu.Unlock()
+			return job.ID != "blocked", nil
+		}),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		mu.Lock()
+		ran = append(ran, args[0].(string))
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	// The blocked job has the highest priority, so it is picked first
+	for i, id := range []string{"blocked", "1", "2"} {
+		job := &Job{
+			ID:       id,
+			Topic:    "topic",
+			State:    Waiting,
+			Args:     []interface{}{id},
+			Priority: int64(-i),
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(ran)
+	if have, want := strings.Join(ran, ","), "1,2"; have != want {
+		t.Fatalf("ran = %q, want %q", have, want)
+	}
+	if !seen["blocked"] {
+		t.Fatal("expected the gate to be asked for the blocked job")
+	}
+	job, err := st.Lookup("blocked")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerAddDelayed(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+		ran   = make(map[string]time.Time)
+	)
+	done := make(chan struct{}, 2)
+
+	m := New(SetLogger(&stringLogger{}))
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		mu.Lock()
+		id := args[0].(string)
+		order = append(order, id)
+		ran[id] = time.Now()
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	added := time.Now()
+	const delay = 2 * time.Second
+	if err := m.AddDelayed(&Job{Topic: "topic", Args: []interface{}{"delayed"}}, delay); err != nil {
+		t.Fatalf("AddDelayed failed with %v", err)
+	}
+	if err := m.Add(&Job{Topic: "topic", Args: []interface{}{"now"}}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := strings.Join(order, ","), "now,delayed"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+	if elapsed := ran["delayed"].Sub(added); elapsed < delay {
+		t.Fatalf("delayed job ran after %v, want at least %v", elapsed, delay)
+	}
+}
+
+func TestManagerDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		done := make(chan struct{}, 1)
+		m := New(
+			SetLogger(&stringLogger{}),
+			SetConcurrency(0, 3),
+			SetConcurrency(1, 2),
+			SetHeartbeatInterval(time.Millisecond),
+		)
+		m.testJobSucceeded = func() { done <- struct{}{} }
+		err := m.Register("topic", func(args ...interface{}) error {
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+		err = m.Start()
+		if err != nil {
+			t.Fatalf("Start failed with %v", err)
+		}
+		if have, want := m.NumWorkers(), 5; have != want {
+			t.Fatalf("NumWorkers = %d, want %d", have, want)
+		}
+		// Workers and scheduler
+		if have, want := m.NumActiveGoroutines(), 6; have != want {
+			t.Fatalf("NumActiveGoroutines = %d, want %d", have, want)
+		}
+		if i%10 == 0 {
+			// Process a job now and then, to spin up a heartbeat
+			if err := m.Add(&Job{Topic: "topic"}); err != nil {
+				t.Fatalf("Add failed with %v", err)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Job success timed out")
+			}
+		}
+		err = m.Close()
+		if err != nil {
+			t.Fatalf("Close failed with %v", err)
+		}
+		if have, want := m.NumWorkers(), 0; have != want {
+			t.Fatalf("NumWorkers after Close = %d, want %d", have, want)
+		}
+		if have, want := m.NumActiveGoroutines(), 0; have != want {
+			t.Fatalf("NumActiveGoroutines after Close = %d, want %d", have, want)
+		}
+	}
+
+	// Give goroutines outside of the manager's control, e.g. of
+	// the runtime, a moment to settle
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(2 * time.Second); after > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Fatalf("number of goroutines grew from %d to %d", before, after)
+	}
+}
+
+func TestManagerRetryWaitsForBackoff(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts []time.Time
+	)
+	done := make(chan struct{}, 1)
+
+	const backoff = 2 * time.Second
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetBackoffFunc(ConstantBackoff(backoff)),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", MaxRetry: 1}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job success timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := len(attempts), 2; have != want {
+		t.Fatalf("len(attempts) = %d, want %d", have, want)
+	}
+	if elapsed := attempts[1].Sub(attempts[0]); elapsed < backoff {
+		t.Fatalf("job was retried after %v, want at least %v", elapsed, backoff)
+	}
+	stored, err := st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := stored.Retry, 1; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := stored.State, Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerRegisterDefault(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		topics = make(map[string]bool)
+	)
+	succeeded := make(chan struct{}, 4)
+
+	m := New(SetLogger(&stringLogger{}))
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("known", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.RegisterDefault(func(job *Job) error {
+		mu.Lock()
+		topics[job.Topic] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterDefault failed with %v", err)
+	}
+	if err := m.RegisterDefault(func(job *Job) error { return nil }); err == nil {
+		t.Fatal("expected registering a second default processor to fail")
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for _, topic := range []string{"known", "a", "b", "c"} {
+		err = m.Add(&Job{Topic: topic})
+		if err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, topic := range []string{"a", "b", "c"} {
+		if !topics[topic] {
+			t.Errorf("expected default processor to handle topic %q", topic)
+		}
+	}
+	if topics["known"] {
+		t.Error("expected default processor to not handle registered topic")
+	}
+}
+
+func TestManagerBeforeExecuteHook(t *testing.T) {
+	succeeded := make(chan struct{}, 1)
+	failed := make(chan struct{}, 1)
+	executed := make(chan string, 2)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetBeforeExecuteHook(func(job *Job) error {
+			if job.CorrelationID == "abort" {
+				return errors.New("aborted")
+			}
+			job.Args = []interface{}{"fresh-token"}
+			return nil
+		}),
+	)
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	m.testJobFailed = func() { failed <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error {
+		executed <- args[0].(string)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	err = m.Add(&Job{Topic: "topic", Args: []interface{}{"stale-token"}})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	err = m.Add(&Job{Topic: "topic", Args: []interface{}{"stale-token"}, CorrelationID: "abort"})
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for _, ch := range []chan struct{}{succeeded, failed} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job completion timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	close(executed)
+	var args []string
+	for arg := range executed {
+		args = append(args, arg)
+	}
+	if have, want := strings.Join(args, ","), "fresh-token"; have != want {
+		t.Fatalf("processor executed with %q, want %q", have, want)
+	}
+}
+
+func TestManagerRecentJobs(t *testing.T) {
+	const size = 3
+	succeeded := make(chan struct{}, 5)
+
+	m := New(SetLogger(&stringLogger{}), SetConcurrency(0, 1), SetRecentJobsSize(size))
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		job := &Job{Topic: "topic"}
+		err = m.Add(job)
+		if err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		ids = append(ids, job.ID)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-succeeded:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	recent := m.RecentJobs(10)
+	if have, want := len(recent), size; have != want {
+		t.Fatalf("len(RecentJobs) = %d, want %d", have, want)
+	}
+	for i, job := range recent {
+		// Most recent first, and jobs run in the order they were added
+		if have, want := job.ID, ids[len(ids)-1-i]; have != want {
+			t.Fatalf("RecentJobs[%d] = %q, want %q", i, have, want)
+		}
+		if have, want := job.State, Succeeded; have != want {
+			t.Fatalf("RecentJobs[%d].State = %q, want %q", i, have, want)
+		}
+	}
+	if have, want := len(m.RecentJobs(1)), 1; have != want {
+		t.Fatalf("len(RecentJobs(1)) = %d, want %d", have, want)
+	}
+}
+
+func TestManagerWebhook(t *testing.T) {
+	var attempts int32
+	payloads := make(chan WebhookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Fail the first attempt
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("unable to decode payload: %v", err)
+		}
+		payloads <- payload
+	}))
+	defer srv.Close()
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetBackoffFunc(func(int) time.Duration { return 0 }),
+		SetWebhookClient(&http.Client{Timeout: 5 * time.Second}, 1),
+	)
+	err := m.Register("topic", func(args ...interface{}) error { return errors.New("boom") })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", CorrelationID: "order-1", CallbackURL: srv.URL}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+
+	var payload WebhookPayload
+	select {
+	case payload = <-payloads:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Webhook timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	want := WebhookPayload{ID: job.ID, Topic: "topic", CorrelationID: "order-1", State: Failed, Error: "boom"}
+	if payload != want {
+		t.Fatalf("payload = %+v, want %+v", payload, want)
+	}
+	if have, want := atomic.LoadInt32(&attempts), int32(2); have != want {
+		t.Fatalf("attempts = %d, want %d", have, want)
+	}
+}
+
+func TestManagerCorrelationRateLimit(t *testing.T) {
+	for _, fifo := range []bool{false, true} {
+		var (
+			mu    sync.Mutex
+			order []string
+		)
+		done := make(chan struct{}, 25)
+
+		st := NewInMemoryStore()
+		m := New(SetLogger(&stringLogger{}), SetStore(st), SetFIFOMode(fifo), SetCorrelationRateLimit(1, 1))
+		m.testJobSucceeded = func() { done <- struct{}{} }
+		err := m.Register("topic", func(args ...interface{}) error {
+			mu.Lock()
+			order = append(order, args[0].(string))
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("fifo=%v: Register failed with %v", fifo, err)
+		}
+		// One tenant floods the queue before the other adds a single job
+		var flood []*Job
+		for i := 0; i < 20; i++ {
+			job := &Job{Topic: "topic", CorrelationID: "flood", Args: []interface{}{"flood"}}
+			if err := m.Add(job); err != nil {
+				t.Fatalf("fifo=%v: Add failed with %v", fifo, err)
+			}
+			flood = append(flood, job)
+		}
+		err = m.Add(&Job{Topic: "topic", CorrelationID: "quiet", Args: []interface{}{"quiet"}})
+		if err != nil {
+			t.Fatalf("fifo=%v: Add failed with %v", fifo, err)
+		}
+		err = m.Start()
+		if err != nil {
+			t.Fatalf("fifo=%v: Start failed with %v", fifo, err)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("fifo=%v: Job success timed out", fifo)
+			}
+		}
+		err = m.Stop()
+		if err != nil {
+			t.Fatalf("fifo=%v: Stop failed with %v", fifo, err)
+		}
+		mu.Lock()
+		// Only one flood job may start before the quiet job
+		if order[0] != "quiet" && order[1] != "quiet" {
+			t.Fatalf("fifo=%v: order = %q, want quiet job to be executed along with the first flood job", fifo, strings.Join(order, ","))
+		}
+		mu.Unlock()
+
+		// Deferred jobs keep their priority
+		for _, job := range flood {
+			stored, err := st.Lookup(job.ID)
+			if err != nil {
+				t.Fatalf("fifo=%v: Lookup failed with %v", fifo, err)
+			}
+			if stored.Priority != job.Priority {
+				t.Fatalf("fifo=%v: Priority = %d, want %d", fifo, stored.Priority, job.Priority)
+			}
+		}
+	}
+}
+
+func TestManagerHeartbeat(t *testing.T) {
+	st := NewInMemoryStore()
+	m := New(SetLogger(&stringLogger{}), SetStore(st), SetHeartbeatInterval(10*time.Millisecond))
+	done := make(chan struct{}, 1)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+
+	var heartbeats []int64
+	err := m.Register("topic", func(args ...interface{}) error {
+		// Watch the heartbeat of the job while working on it
+		id := args[0].(string)
+		for i := 0; i < 5; i++ {
+			time.Sleep(25 * time.Millisecond)
+			job, err := st.Lookup(id)
+			if err != nil {
+				return err
+			}
+			heartbeats = append(heartbeats, job.Heartbeat)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	job := &Job{ID: "1", Topic: "topic", State: Waiting, Args: []interface{}{"1"}}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job success timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	for i := 1; i < len(heartbeats); i++ {
+		if heartbeats[i] <= heartbeats[i-1] {
+			t.Fatalf("expected heartbeats to advance, got %v", heartbeats)
+		}
+	}
+}
+
+func TestManagerSubscribe(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetConcurrency(0, 1))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(10)
+	defer sub.Close()
+	slow := m.Subscribe(1)
+	defer slow.Close()
+
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+	job := &Job{Topic: "topic"}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+
+	want := [][2]string{{"", Waiting}, {Waiting, Working}, {Working, Succeeded}}
+	for i, w := range want {
+		select {
+		case tr := <-sub.C:
+			if tr.JobID != job.ID {
+				t.Fatalf("#%d: expected transition of job %q, have %q", i, job.ID, tr.JobID)
+			}
+			if tr.From != w[0] || tr.To != w[1] {
+				t.Fatalf("#%d: expected transition from %q to %q, have from %q to %q", i, w[0], w[1], tr.From, tr.To)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("#%d: transition timed out", i)
+		}
+	}
+
+	// The slow subscriber has missed transitions and got dropped
+	if !slow.Dropped() {
+		t.Fatal("expected slow subscription to be dropped")
+	}
+	if tr := <-slow.C; tr == nil || tr.To != Waiting {
+		t.Fatalf("expected buffered transition to %q, have %+v", Waiting, tr)
+	}
+	if _, ok := <-slow.C; ok {
+		t.Fatal("expected channel of dropped subscription to be closed")
+	}
+	if sub.Dropped() {
+		t.Fatal("expected subscription not to be dropped")
+	}
+}
+
+// slowNextStore is a ContextStore whose NextContext blocks until its
+// context is done.
+type slowNextStore struct {
+	*InMemoryStore
+	calls chan struct{}
+}
+
+func (st *slowNextStore) CreateContext(ctx context.Context, job *Job) error {
+	return st.Create(job)
+}
+
+func (st *slowNextStore) UpdateContext(ctx context.Context, job *Job) error {
+	return st.Update(job)
+}
+
+func (st *slowNextStore) DeleteContext(ctx context.Context, job *Job) error {
+	return st.Delete(job)
+}
+
+func (st *slowNextStore) NextContext(ctx context.Context, req *NextRequest) (*Job, error) {
+	st.calls <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (st *slowNextStore) LookupContext(ctx context.Context, id string) (*Job, error) {
+	return st.Lookup(id)
+}
+
+func (st *slowNextStore) ListContext(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	return st.List(req)
+}
+
+func (st *slowNextStore) StatsContext(ctx context.Context, req *StatsRequest) (*Stats, error) {
+	return st.Stats(req)
+}
+
+func TestManagerCloseAbortsNext(t *testing.T) {
+	st := &slowNextStore{InMemoryStore: NewInMemoryStore(), calls: make(chan struct{}, 1)}
+	logger := &stringLogger{}
+	m := New(SetLogger(logger), SetStore(st))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-st.calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected scheduler to call NextContext")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- m.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to abort the pending NextContext")
+	}
+	if len(logger.Lines) > 0 {
+		t.Fatalf("expected the aborted claim not to be logged, have %v", logger.Lines)
+	}
+}
+
+// unstampedStore does not record the worker in Next, and fails to update
+// the jobs afterwards.
+type unstampedStore struct {
+	*InMemoryStore
+	updates chan struct{}
+}
+
+func (st *unstampedStore) Next(req *NextRequest) (*Job, error) {
+	dup := *req
+	dup.WorkerID = ""
+	return st.InMemoryStore.Next(&dup)
+}
+
+func (st *unstampedStore) Update(job *Job) error {
+	select {
+	case st.updates <- struct{}{}:
+	default:
+	}
+	return errors.New("update failed")
+}
+
+func TestManagerReleasesJobWhenClaimUpdateFails(t *testing.T) {
+	st := &unstampedStore{InMemoryStore: NewInMemoryStore(), updates: make(chan struct{}, 1)}
+	m := New(SetStore(st))
+	err := m.Register("topic", func(args ...interface{}) error {
+		t.Error("Job must not be executed")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	select {
+	case <-st.updates:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Claim timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	job, err = st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerListContext(t *testing.T) {
+	m := New()
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := m.Add(&Job{Topic: "topic"}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	rsp, err := m.ListContext(context.Background(), &ListRequest{})
+	if err != nil {
+		t.Fatalf("ListContext failed with %v", err)
+	}
+	if have, want := rsp.Total, 1; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+
+	// The in-memory store does not implement ContextStore, but must not
+	// run queries for a context that is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.ListContext(ctx, &ListRequest{}); err != context.Canceled {
+		t.Fatalf("expected %v, have %v", context.Canceled, err)
+	}
+	if _, err := m.StatsContext(ctx, &StatsRequest{}); err != context.Canceled {
+		t.Fatalf("expected %v, have %v", context.Canceled, err)
+	}
+}
+
+func TestManagerBatchRetriesFailedItemsOnly(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts [][]interface{}
+	)
+	done := make(chan struct{}, 1)
+
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetBackoffFunc(ConstantBackoff(0)),
+		SetBatchPolicy("batch", BatchPolicy{RetryFailedOnly: true}),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	err := m.Register("batch", func(args ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, args)
+		if len(attempts) == 1 {
+			// The 2nd item fails on the first attempt
+			return BatchError{1: errors.New("kaboom")}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "batch", Args: []interface{}{"a", "b", "c"}, MaxRetry: 1}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job success timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]interface{}{{"a", "b", "c"}, {"b"}}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("attempts = %v, want %v", attempts, want)
+	}
+	job, err = st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.LastError, "jobqueue: 1 batch item(s) failed: item 1: kaboom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+}
+
+func TestManagerBatchMaxFailedRatio(t *testing.T) {
+	m := New(SetBatchPolicy("batch", BatchPolicy{MaxFailedRatio: 0.25}))
+	args := []interface{}{"a", "b", "c", "d"}
+
+	// 1 of 4 items is within the ratio
+	job := &Job{Topic: "batch", Args: args, MaxRetry: 1}
+	if err := m.batch(job, BatchError{0: errors.New("kaboom")}); err != nil {
+		t.Fatalf("expected job to succeed, have %v", err)
+	}
+	if job.LastError == "" {
+		t.Fatal("expected failed items in LastError")
+	}
+
+	// 2 of 4 items are not, and all items are retried by default
+	job = &Job{Topic: "batch", Args: args, MaxRetry: 1}
+	if err := m.batch(job, BatchError{0: errors.New("kaboom"), 3: errors.New("kaboom")}); err == nil {
+		t.Fatal("expected job to fail")
+	}
+	if !reflect.DeepEqual(job.Args, args) {
+		t.Fatalf("Args = %v, want %v", job.Args, args)
+	}
+}
+
+// fakeSink is a MetricsSink that records the names of the metrics it
+// receives, with the value of the topic tag if present.
+type fakeSink struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *fakeSink) record(kind, name string, tags map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if topic, found := tags["topic"]; found {
+		name += "/" + topic
+	}
+	s.calls = append(s.calls, kind+" "+name)
+}
+
+func (s *fakeSink) Counter(name string, delta int64, tags map[string]string) {
+	s.record("counter", name, tags)
+}
+
+func (s *fakeSink) Gauge(name string, value float64, tags map[string]string) {
+	s.record("gauge", name, tags)
+}
+
+func (s *fakeSink) Timing(name string, d time.Duration, tags map[string]string) {
+	s.record("timing", name, tags)
+}
+
+func TestManagerMetricsSink(t *testing.T) {
+	sink := &fakeSink{}
+	m := New(SetLogger(&stringLogger{}), SetMetricsSink(sink))
+	var attempts int32
+	err := m.Register("topic", func(args ...interface{}) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(10)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", MaxRetry: 1}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for done := false; !done; {
+		select {
+		case tr := <-sub.C:
+			done = tr.To == Succeeded
+		case <-time.After(10 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	have := make(map[string]int)
+	for _, call := range sink.calls {
+		have[call]++
+	}
+	want := map[string]int{
+		"counter jobs_added/topic":     1,
+		"counter jobs_started/topic":   2,
+		"counter jobs_retried/topic":   1,
+		"counter jobs_succeeded/topic": 1,
+		"timing job_duration/topic":    2,
+	}
+	for call, n := range want {
+		if have[call] != n {
+			t.Errorf("expected %d call(s) of %q, have %d; calls: %v", n, call, have[call], sink.calls)
+		}
+	}
+	if have["counter jobs_failed/topic"] != 0 {
+		t.Errorf("expected no failed jobs; calls: %v", sink.calls)
+	}
+	if have["timing claim_duration"] == 0 {
+		t.Errorf("expected claim duration; calls: %v", sink.calls)
+	}
+	if have["gauge workers_busy"] < 2 {
+		t.Errorf("expected busy workers; calls: %v", sink.calls)
+	}
+}
+
+func TestManagerStatsByTopic(t *testing.T) {
+	// The store does not implement TopicStatsStore
+	st := struct{ Store }{NewInMemoryStore()}
+	m := New(SetStore(st))
+	for _, topic := range []string{"a", "b"} {
+		err := m.Register(topic, func(args ...interface{}) error { return nil })
+		if err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+	}
+	jobs := []*Job{
+		{ID: "1", Topic: "a", State: Waiting},
+		{ID: "2", Topic: "a", State: Failed},
+		{ID: "3", Topic: "c", State: Waiting},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	stats, err := m.StatsByTopic()
+	if err != nil {
+		t.Fatalf("StatsByTopic failed with %v", err)
+	}
+	want := map[string]Stats{
+		"a": {Waiting: 1, Failed: 1},
+		"b": {},
+	}
+	if have, want := len(stats), len(want); have != want {
+		t.Fatalf("len(stats) = %d, want %d", have, want)
+	}
+	for topic, w := range want {
+		if s := stats[topic]; s == nil || *s != w {
+			t.Errorf("stats[%q] = %+v, want %+v", topic, s, w)
+		}
+	}
+}
+
+func TestManagerRegisterResult(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	err := m.RegisterResult("topic", func(args ...interface{}) ([]byte, error) {
+		if len(args) > 0 {
+			return nil, errors.New("kaboom")
+		}
+		return []byte(`{"answer":42}`), nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterResult failed with %v", err)
+	}
+	if err := m.Register("topic", func(args ...interface{}) error { return nil }); err == nil {
+		t.Fatal("expected Register of the same topic to fail")
+	}
+	sub := m.Subscribe(10)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	succeeded := &Job{Topic: "topic"}
+	failed := &Job{Topic: "topic", Args: []interface{}{1}}
+	for _, job := range []*Job{succeeded, failed} {
+		if err := m.Add(job); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+	}
+	for completed := 0; completed < 2; {
+		select {
+		case tr := <-sub.C:
+			if IsTerminal(tr.To) {
+				completed++
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Jobs timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	job, err := m.Lookup(succeeded.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := string(job.Result), `{"answer":42}`; have != want {
+		t.Fatalf("Result = %q, want %q", have, want)
+	}
+	job, err = m.Lookup(failed.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Failed; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.LastError, "kaboom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+	if job.Result != nil {
+		t.Fatalf("expected no Result, have %q", job.Result)
+	}
+}
+
+func TestManagerRecoversFromPanics(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetConcurrency(0, 1))
+	var attempts int32
+	err := m.Register("panic", func(args ...interface{}) error {
+		atomic.AddInt32(&attempts, 1)
+		panic("boom")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(20)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+
+	panicking := &Job{Topic: "panic", MaxRetry: 1}
+	if err := m.Add(panicking); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	other := &Job{Topic: "topic"}
+	if err := m.Add(other); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+
+	// The single worker survives the panics and executes the other job
+	states := make(map[string]string)
+	for states[panicking.ID] != Failed || states[other.ID] != Succeeded {
+		select {
+		case tr := <-sub.C:
+			states[tr.JobID] = tr.To
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Jobs timed out; states: %v", states)
+		}
+	}
+	if have, want := atomic.LoadInt32(&attempts), int32(2); have != want {
+		t.Fatalf("attempts = %d, want %d", have, want)
+	}
+	job, err := m.Lookup(panicking.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if !strings.HasPrefix(job.LastError, "jobqueue: processor panicked: boom\n") {
+		t.Fatalf("expected LastError to report the panic, have %q", job.LastError)
+	}
+	if !strings.Contains(job.LastError, "goroutine") {
+		t.Fatalf("expected LastError to contain the stack, have %q", job.LastError)
+	}
+}
+
+func TestManagerTimeout(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetTopicTimeout("topic", 50*time.Millisecond))
+	var attempts int32
+	err := m.RegisterContext("topic", func(ctx context.Context, args ...interface{}) error {
+		atomic.AddInt32(&attempts, 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(20)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+
+	// The first job uses the timeout of the topic, the second its own one
+	expired := &Job{Topic: "topic", MaxRetry: 1}
+	if err := m.Add(expired); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	extended := &Job{Topic: "topic", Timeout: 10 * time.Second}
+	if err := m.Add(extended); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+
+	states := make(map[string]string)
+	for states[expired.ID] != Failed || states[extended.ID] != Succeeded {
+		select {
+		case tr := <-sub.C:
+			states[tr.JobID] = tr.To
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Jobs timed out; states: %v", states)
+		}
+	}
+	if have, want := atomic.LoadInt32(&attempts), int32(3); have != want {
+		t.Fatalf("attempts = %d, want %d", have, want)
+	}
+	job, err := m.Lookup(expired.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if want := "jobqueue: job timed out after 50ms: context deadline exceeded"; job.LastError != want {
+		t.Fatalf("LastError = %q, want %q", job.LastError, want)
+	}
+}
+
+// closingStore is an InMemoryStore that records the state of a job when
+// it gets closed.
+type closingStore struct {
+	*InMemoryStore
+	jobID string
+
+	mu       sync.Mutex
+	closed   bool
+	jobState string // state of jobID on Close
+}
+
+func (st *closingStore) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	if job, err := st.Lookup(st.jobID); err == nil {
+		st.jobState = job.State
+	}
+	return nil
+}
+
+func TestManagerShutdown(t *testing.T) {
+	st := &closingStore{InMemoryStore: NewInMemoryStore()}
+	m := New(SetLogger(&stringLogger{}), SetStore(st))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	err := m.Register("topic", func(args ...interface{}) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	st.mu.Lock()
+	st.jobID = job.ID
+	st.mu.Unlock()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job start timed out")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- m.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected to wait for the working job, returned with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected no error, have %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown timed out")
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.closed {
+		t.Fatal("expected store to be closed")
+	}
+	if have, want := st.jobState, Succeeded; have != want {
+		t.Fatalf("State on Close = %q, want %q", have, want)
+	}
+}
+
+func TestManagerShutdownDeadline(t *testing.T) {
+	st := &closingStore{InMemoryStore: NewInMemoryStore()}
+	m := New(SetLogger(&stringLogger{}), SetStore(st))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	err := m.Register("topic", func(args ...interface{}) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	st.mu.Lock()
+	st.jobID = job.ID
+	st.mu.Unlock()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job start timed out")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if have, want := m.Shutdown(ctx), context.DeadlineExceeded; have != want {
+		t.Fatalf("Shutdown returned %v, want %v", have, want)
+	}
+
+	// The job is left for recovery, and the store remains open for it
+	st.mu.Lock()
+	closed := st.closed
+	st.mu.Unlock()
+	if closed {
+		t.Fatal("expected store to remain open")
+	}
+	job, err = st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerAddDuplicate(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := m.Add(&Job{Topic: "topic", UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	err = m.Add(&Job{Topic: "topic", UniqueKey: "refresh-account-42"})
+	if have, want := err, ErrDuplicate; have != want {
+		t.Fatalf("Add returned %v, want %v", have, want)
+	}
+	stats, err := m.Stats(&StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := stats.Waiting, 1; have != want {
+		t.Fatalf("Waiting = %d, want %d", have, want)
+	}
+}
+
+func TestManagerCancelWaiting(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+
+	// The manager is not started, so the job keeps waiting
+	job := &Job{Topic: "topic"}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	if err := m.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel failed with %v", err)
+	}
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != Cancelled {
+		t.Fatalf("State = %q, want %q", job.State, Cancelled)
+	}
+	if job.Completed == 0 {
+		t.Fatal("expected Completed to be set")
+	}
+	if err := m.Cancel(job.ID); err != ErrInvalidTransition {
+		t.Fatalf("Cancel of cancelled job = %v, want %v", err, ErrInvalidTransition)
+	}
+	if err := m.Cancel("no-such-job"); err != ErrNotFound {
+		t.Fatalf("Cancel of unknown job = %v, want %v", err, ErrNotFound)
+	}
+
+	stats, err := m.Stats(&StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if stats.Waiting != 0 || stats.Cancelled != 1 {
+		t.Fatalf("Stats = %+v, want 0 waiting and 1 cancelled", stats)
+	}
+	list, err := m.List(&ListRequest{State: Cancelled})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != job.ID {
+		t.Fatalf("List returned %v, want job %v", list.Jobs, job.ID)
+	}
+}
+
+func TestManagerCancelWaitingReleasesJobWhenUpdateFails(t *testing.T) {
+	st := &unstampedStore{InMemoryStore: NewInMemoryStore(), updates: make(chan struct{}, 1)}
+	m := New(SetStore(st), SetLogger(&stringLogger{}))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	job := &Job{Topic: "topic"}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	if err := m.Cancel(job.ID); err == nil {
+		t.Fatal("expected Cancel to fail")
+	}
+	// The job must not be stranded in the Working state
+	job, err = st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestManagerCancelWorking(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	started := make(chan struct{})
+	err := m.RegisterContext("topic", func(ctx context.Context, args ...interface{}) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(20)
+	defer sub.Close()
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	defer m.Stop()
+
+	job := &Job{Topic: "topic", MaxRetry: 3}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job was not started")
+	}
+	if err := m.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel failed with %v", err)
+	}
+	for done := false; !done; {
+		select {
+		case tr := <-sub.C:
+			if tr.From == Working {
+				if tr.To != Cancelled {
+					t.Fatalf("Job moved into %q, want %q", tr.To, Cancelled)
+				}
+				done = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Job was not cancelled")
+		}
+	}
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != Cancelled {
+		t.Fatalf("State = %q, want %q", job.State, Cancelled)
+	}
+	if want := context.Canceled.Error(); job.LastError != want {
+		t.Fatalf("LastError = %q, want %q", job.LastError, want)
+	}
+	if job.Retry != 0 {
+		t.Fatalf("Retry = %d, want 0", job.Retry)
+	}
+}
+
+func TestManagerLogsNothingByDefault(t *testing.T) {
+	m := New()
+	if _, ok := m.logger.(NopLogger); !ok {
+		t.Fatalf("expected NopLogger by default, have %T", m.logger)
+	}
+}
+
+func TestManagerCancelLogsEvent(t *testing.T) {
+	logger := &leveledLogger{}
+	m := New(SetLogger(logger))
+	started := make(chan struct{})
+	err := m.RegisterContext("topic", func(ctx context.Context, args ...interface{}) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+
+	job := &Job{Topic: "topic", CorrelationID: "order-1"}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job was not started")
+	}
+	if err := m.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel failed with %v", err)
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	debug := strings.Join(logger.Debug, "\n")
+	want := fmt.Sprintf("jobqueue: job %s (topic topic, correlation id \"order-1\") cancelled", job.ID)
+	if !strings.Contains(debug, want) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", want, debug)
+	}
+	if have, want := len(logger.Lines), 0; have != want {
+		t.Fatalf("len(Lines) = %d, want %d: %v", have, want, logger.Lines)
+	}
+}
+
+func TestManagerDeadLetterHook(t *testing.T) {
+	dead := make(chan Job, 1)
+
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetBackoffFunc(func(attempts int) time.Duration { return 0 }),
+		SetDeadLetterHook(func(job *Job) {
+			dead <- *job
+		}),
+	)
+	err := m.Register("topic", func(args ...interface{}) error {
+		return errors.New("failed job")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &Job{Topic: "topic", MaxRetry: 2}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	var letter Job
+	select {
+	case letter = <-dead:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Dead-letter hook timed out")
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+	if have, want := letter.ID, job.ID; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	if have, want := letter.State, Failed; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := letter.Retry, 2; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := letter.LastError, "failed job"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+	select {
+	case <-dead:
+		t.Fatal("Dead-letter hook invoked more than once")
+	default:
+	}
+}
+
+func TestManagerLeveledLogger(t *testing.T) {
+	dead := make(chan struct{}, 1)
+	succeeded := make(chan struct{}, 1)
+
+	logger := &leveledLogger{}
+	m := New(
+		SetLogger(logger),
+		SetBackoffFunc(func(attempts int) time.Duration { return 0 }),
+		SetDeadLetterHook(func(job *Job) { dead <- struct{}{} }),
+	)
+	m.testJobSucceeded = func() { succeeded <- struct{}{} }
+	err := m.Register("fails", func(args ...interface{}) error {
+		return errors.New("kaboom")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Register("succeeds", func(args ...interface{}) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	failing := &Job{Topic: "fails", CorrelationID: "order-1", MaxRetry: 1}
+	if err := m.Add(failing); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	succeeding := &Job{Topic: "succeeds", CorrelationID: "order-2"}
+	if err := m.Add(succeeding); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for _, c := range []chan struct{}{dead, succeeded} {
+		select {
+		case <-c:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Processor func timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	debug := strings.Join(logger.Debug, "\n")
+	for _, want := range []string{
+		fmt.Sprintf("jobqueue: job %s (topic fails, correlation id \"order-1\") claimed by worker %s", failing.ID, m.workerID),
+		fmt.Sprintf("jobqueue: job %s (topic fails, correlation id \"order-1\") scheduled for retry 1 of 1", failing.ID),
+		fmt.Sprintf("jobqueue: job %s (topic fails, correlation id \"order-1\") failed after 1 retries: kaboom", failing.ID),
+		fmt.Sprintf("jobqueue: job %s (topic succeeds, correlation id \"order-2\") succeeded", succeeding.ID),
+	} {
+		if !strings.Contains(debug, want) {
+			t.Errorf("expected debug output to contain %q, got:\n%s", want, debug)
+		}
+	}
+	if have, want := len(logger.Errors), 2; have != want {
+		t.Fatalf("len(Errors) = %d, want %d: %v", have, want, logger.Errors)
+	}
+	if have, want := len(logger.Lines), 0; have != want {
+		t.Fatalf("len(Lines) = %d, want %d: %v", have, want, logger.Lines)
+	}
+}
+
+type tracerKey struct{}
+
+// recordingTracer is a Tracer that records the spans it has started.
+type recordingTracer struct {
+	mu    sync.Mutex
+	Spans []string
+	Ended []error
+}
+
+func (t *recordingTracer) Start(ctx context.Context, job *Job) (context.Context, func(err error)) {
+	t.mu.Lock()
+	t.Spans = append(t.Spans, job.Topic+" "+job.TraceContext["traceparent"])
+	t.mu.Unlock()
+	return context.WithValue(ctx, tracerKey{}, job.ID), func(err error) {
+		t.mu.Lock()
+		t.Ended = append(t.Ended, err)
+		t.mu.Unlock()
+	}
+}
+
+func TestManagerTracer(t *testing.T) {
+	done := make(chan struct{}, 2)
+
+	tracer := &recordingTracer{}
+	m := New(SetTracer(tracer))
+	err := m.RegisterContext("traced", func(ctx context.Context, args ...interface{}) error {
+		defer func() { done <- struct{}{} }()
+		if _, ok := ctx.Value(tracerKey{}).(string); !ok {
+			return errors.New("context has no span")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterContext failed with %v", err)
+	}
+	err = m.Register("fails", func(args ...interface{}) error {
+		defer func() { done <- struct{}{} }()
+		return errors.New("kaboom")
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	traced := &Job{Topic: "traced", TraceContext: TraceContext{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+	if err := m.Add(traced); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			if err := m.Add(&Job{Topic: "fails"}); err != nil {
+				t.Fatalf("Add failed with %v", err)
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Processor func timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	want := []string{"traced 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "fails "}
+	if !reflect.DeepEqual(tracer.Spans, want) {
+		t.Fatalf("Spans = %q, want %q", tracer.Spans, want)
+	}
+	if have, want := len(tracer.Ended), 2; have != want {
+		t.Fatalf("len(Ended) = %d, want %d", have, want)
+	}
+	if tracer.Ended[0] != nil {
+		t.Errorf("expected first span to end without error, got %v", tracer.Ended[0])
+	}
+	if tracer.Ended[1] == nil || tracer.Ended[1].Error() != "kaboom" {
+		t.Errorf("expected second span to end with kaboom, got %v", tracer.Ended[1])
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// claimDurationBuckets are the upper bounds of the buckets of
+// Metrics.ClaimDuration.
+var claimDurationBuckets = []time.Duration{
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+}
+
+// Metrics is a snapshot of the counters that the manager keeps about
+// its operation. Use Manager.Metrics to retrieve it.
+type Metrics struct {
+	EmptyPolls    int64             `json:"empty_polls"`    // number of times the scheduler found no job to execute
+	Claims        int64             `json:"claims"`         // number of jobs the scheduler claimed for execution
+	ClaimDuration DurationHistogram `json:"claim_duration"` // duration of picking the next job from the store
+	SLOBreaches   map[string]int64  `json:"slo_breaches"`   // maps topic to the number of jobs that waited longer than its latency target
+	RetryStorms   int64             `json:"retry_storms"`   // number of times a job has retried too often, see SetRetryStormHook
+	Processed     map[string]int64  `json:"processed"`      // maps topic to the number of jobs that completed, successfully or not
+	Failed        map[string]int64  `json:"failed"`         // maps topic to the number of jobs that failed for good
+}
+
+// DurationHistogram is a histogram of durations. Like in Prometheus,
+// buckets are cumulative, i.e. each bucket counts all observations less
+// than or equal to its upper bound.
+type DurationHistogram struct {
+	Count   int64            `json:"count"`   // number of observations
+	Sum     time.Duration    `json:"sum"`     // sum of all observations
+	Buckets []DurationBucket `json:"buckets"` // cumulative counts by upper bound
+}
+
+// DurationBucket is a single bucket of a DurationHistogram.
+type DurationBucket struct {
+	UpperBound time.Duration `json:"le"`    // upper bound (inclusive)
+	Count      int64         `json:"count"` // number of observations up to UpperBound
+}
+
+// newDurationHistogram creates a histogram with the given bucket bounds.
+func newDurationHistogram(bounds []time.Duration) DurationHistogram {
+	h := DurationHistogram{Buckets: make([]DurationBucket, len(bounds))}
+	for i, bound := range bounds {
+		h.Buckets[i].UpperBound = bound
+	}
+	return h
+}
+
+// observe adds d to the histogram.
+func (h *DurationHistogram) observe(d time.Duration) {
+	h.Count++
+	h.Sum += d
+	for i := range h.Buckets {
+		if d <= h.Buckets[i].UpperBound {
+			h.Buckets[i].Count++
+		}
+	}
+}
+
+// copy returns a deep copy of the histogram.
+func (h DurationHistogram) copy() DurationHistogram {
+	dup := h
+	dup.Buckets = make([]DurationBucket, len(h.Buckets))
+	copy(dup.Buckets, h.Buckets)
+	return dup
+}
+
+// metrics records the counters of a manager.
+type metrics struct {
+	mu sync.Mutex
+	m  Metrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		m: Metrics{
+			ClaimDuration: newDurationHistogram(claimDurationBuckets),
+			SLOBreaches:   make(map[string]int64),
+			Processed:     make(map[string]int64),
+			Failed:        make(map[string]int64),
+		},
+	}
+}
+
+// poll records a call to Store.Next that took d. found indicates
+// whether Next returned a job.
+func (r *metrics) poll(d time.Duration, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m.ClaimDuration.observe(d)
+	if !found {
+		r.m.EmptyPolls++
+	}
+}
+
+// claim records that a job has been claimed for execution.
+func (r *metrics) claim() {
+	r.mu.Lock()
+	r.m.Claims++
+	r.mu.Unlock()
+}
+
+// sloBreach records that a job of the given topic has missed its
+// latency target.
+func (r *metrics) sloBreach(topic string) {
+	r.mu.Lock()
+	r.m.SLOBreaches[topic]++
+	r.mu.Unlock()
+}
+
+// retryStorm records that a job has retried too often.
+func (r *metrics) retryStorm() {
+	r.mu.Lock()
+	r.m.RetryStorms++
+	r.mu.Unlock()
+}
+
+// transition records that job has moved from the given state into its
+// current state, see Manager.transition.
+func (r *metrics) transition(job *Job, from string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case from == Working && (job.State == Succeeded || job.State == Cancelled):
+		r.m.Processed[job.Topic]++
+	case from == Working && job.State != Waiting:
+		r.m.Processed[job.Topic]++
+		r.m.Failed[job.Topic]++
+	case from == Succeeded:
+		// A job with AtMostOnce delivery has failed after being finalized
+		r.m.Failed[job.Topic]++
+	}
+}
+
+// snapshot returns a copy of the current metrics.
+func (r *metrics) snapshot() *Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dup := r.m
+	dup.ClaimDuration = r.m.ClaimDuration.copy()
+	dup.SLOBreaches = make(map[string]int64, len(r.m.SLOBreaches))
+	for topic, n := range r.m.SLOBreaches {
+		dup.SLOBreaches[topic] = n
+	}
+	dup.Processed = make(map[string]int64, len(r.m.Processed))
+	for topic, n := range r.m.Processed {
+		dup.Processed[topic] = n
+	}
+	dup.Failed = make(map[string]int64, len(r.m.Failed))
+	for topic, n := range r.m.Failed {
+		dup.Failed[topic] = n
+	}
+	return &dup
+}
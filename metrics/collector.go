@@ -0,0 +1,138 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/olivere/jobqueue"
+)
+
+// StatsSource returns statistics about the jobs in a queue. Both
+// *jobqueue.Manager and jobqueue.Store implement it.
+type StatsSource interface {
+	Stats(*jobqueue.StatsRequest) (*jobqueue.Stats, error)
+}
+
+// topicStatsSource is a StatsSource that can group its statistics by
+// topic, e.g. *jobqueue.Manager or a jobqueue.TopicStatsStore.
+type topicStatsSource interface {
+	StatsByTopic() (map[string]*jobqueue.Stats, error)
+}
+
+// Collector is a prometheus.Collector that exports the state of a job
+// queue, e.g. for dashboards of the queue depth and throughput. Unlike
+// PrometheusSink, which is fed by the manager as jobs change state,
+// Collector retrieves the statistics from the manager or store whenever
+// Prometheus scrapes them.
+//
+// It exports the gauge "jobs" with the number of jobs by state, labelled
+// by topic if the source can group its statistics by topic. If the source
+// is a *jobqueue.Manager, it also exports the counters
+// "jobs_processed_total" and "jobs_failed_total" by topic, see
+// jobqueue.Metrics. Use a different namespace than for a PrometheusSink,
+// as the latter exports "jobs_failed_total" as well.
+type Collector struct {
+	src StatsSource
+
+	jobs      *prometheus.Desc
+	processed *prometheus.Desc
+	failed    *prometheus.Desc
+}
+
+// NewCollector creates a collector that exports the statistics of src.
+// The names of all metrics are prefixed with namespace, unless it is empty.
+func NewCollector(namespace string, src StatsSource) *Collector {
+	labels := []string{"state"}
+	if _, ok := src.(topicStatsSource); ok {
+		labels = append(labels, "topic")
+	}
+	return &Collector{
+		src: src,
+		jobs: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "jobs"),
+			"Number of jobs by state.",
+			labels, nil,
+		),
+		processed: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "jobs_processed_total"),
+			"Number of jobs that completed, successfully or not.",
+			[]string{"topic"}, nil,
+		),
+		failed: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "jobs_failed_total"),
+			"Number of jobs that failed for good.",
+			[]string{"topic"}, nil,
+		),
+	}
+}
+
+// RegisterWith creates a collector that exports the statistics of src,
+// and registers it with reg, e.g. prometheus.DefaultRegisterer.
+func RegisterWith(reg prometheus.Registerer, namespace string, src StatsSource) (*Collector, error) {
+	c := NewCollector(namespace, src)
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.jobs
+	if _, ok := c.src.(*jobqueue.Manager); ok {
+		ch <- c.processed
+		ch <- c.failed
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if src, ok := c.src.(topicStatsSource); ok {
+		stats, err := src.StatsByTopic()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.jobs, err)
+		}
+		for topic, s := range stats {
+			c.collectStats(ch, s, topic)
+		}
+	} else {
+		s, err := c.src.Stats(&jobqueue.StatsRequest{})
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.jobs, err)
+		} else {
+			c.collectStats(ch, s)
+		}
+	}
+
+	if m, ok := c.src.(*jobqueue.Manager); ok {
+		metrics := m.Metrics()
+		for topic, n := range metrics.Processed {
+			ch <- prometheus.MustNewConstMetric(c.processed, prometheus.CounterValue, float64(n), topic)
+		}
+		for topic, n := range metrics.Failed {
+			ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(n), topic)
+		}
+	}
+}
+
+// collectStats sends the number of jobs by state, with the given
+// additional label values.
+func (c *Collector) collectStats(ch chan<- prometheus.Metric, s *jobqueue.Stats, labels ...string) {
+	states := []struct {
+		State string
+		Count int
+	}{
+		{jobqueue.Waiting, s.Waiting},
+		{jobqueue.Working, s.Working},
+		{jobqueue.Succeeded, s.Succeeded},
+		{jobqueue.Failed, s.Failed},
+		{jobqueue.Cancelled, s.Cancelled},
+	}
+	for _, st := range states {
+		values := append([]string{st.State}, labels...)
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(st.Count), values...)
+	}
+}
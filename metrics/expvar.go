@@ -0,0 +1,69 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package metrics
+
+import (
+	"expvar"
+	"strings"
+	"time"
+)
+
+// ExpvarSink publishes the metrics of a manager via the expvar package,
+// i.e. at /debug/vars when using the default HTTP mux. It implements
+// jobqueue.MetricsSink.
+//
+// All metrics are kept in a single expvar.Map. Tags are appended to the
+// names of the metrics, e.g. "jobs_succeeded{topic=clicks}". Timers are
+// kept as their count and sum, e.g. "job_duration_count" and
+// "job_duration_seconds".
+type ExpvarSink struct {
+	vars *expvar.Map
+}
+
+// NewExpvarSink creates a sink that publishes the metrics as a map with
+// the given name. If there is a map with that name already, e.g. because
+// the sink has been created before, the metrics are added to it.
+func NewExpvarSink(name string) *ExpvarSink {
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+	return &ExpvarSink{vars: vars}
+}
+
+// Counter adds delta to the counter with the given name and tags.
+func (s *ExpvarSink) Counter(name string, delta int64, tags map[string]string) {
+	s.vars.Add(s.key(name, tags), delta)
+}
+
+// Gauge sets the gauge with the given name and tags to value.
+func (s *ExpvarSink) Gauge(name string, value float64, tags map[string]string) {
+	key := s.key(name, tags)
+	v, ok := s.vars.Get(key).(*expvar.Float)
+	if !ok {
+		v = new(expvar.Float)
+		s.vars.Set(key, v)
+	}
+	v.Set(value)
+}
+
+// Timing records an observation of d for the timer with the given name
+// and tags.
+func (s *ExpvarSink) Timing(name string, d time.Duration, tags map[string]string) {
+	s.vars.Add(s.key(name+"_count", tags), 1)
+	s.vars.AddFloat(s.key(name+"_seconds", tags), d.Seconds())
+}
+
+// key returns the key of the metric with the given name and tags.
+func (s *ExpvarSink) key(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	var pairs []string
+	for _, k := range tagKeys(tags) {
+		pairs = append(pairs, sanitize(k)+"="+sanitize(tags[k]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,45 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package metrics provides adapters that export the metrics of a
+// jobqueue.Manager to monitoring systems, i.e. implementations of
+// jobqueue.MetricsSink for Prometheus, StatsD, and expvar. Collector
+// exports the number of jobs by state to Prometheus.
+//
+// Example:
+//
+//	sink, err := metrics.NewStatsDSink("127.0.0.1:8125", "jobqueue")
+//	if err != nil {
+//		panic(err)
+//	}
+//	defer sink.Close()
+//	m := jobqueue.New(jobqueue.SetMetricsSink(sink))
+package metrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagKeys returns the keys of tags in ascending order.
+func tagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sanitize replaces characters that are special in the metric names
+// of StatsD and expvar keys with underscores.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '=', '{', '}', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
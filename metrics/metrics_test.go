@@ -0,0 +1,242 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package metrics
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/olivere/jobqueue"
+)
+
+var (
+	_ jobqueue.MetricsSink = (*ExpvarSink)(nil)
+	_ jobqueue.MetricsSink = (*StatsDSink)(nil)
+	_ jobqueue.MetricsSink = (*PrometheusSink)(nil)
+)
+
+func TestExpvarSink(t *testing.T) {
+	s := NewExpvarSink("jobqueue_test")
+	tags := map[string]string{"topic": "clicks", "a": "b"}
+	s.Counter(jobqueue.MetricJobsSucceeded, 1, tags)
+	s.Counter(jobqueue.MetricJobsSucceeded, 2, tags)
+	s.Gauge(jobqueue.MetricWorkersBusy, 3, map[string]string{"rank": "0"})
+	s.Timing(jobqueue.MetricClaimDuration, 500*time.Millisecond, nil)
+
+	// A second sink of the same name shares the map
+	if NewExpvarSink("jobqueue_test").vars != s.vars {
+		t.Fatal("expected sinks of the same name to share their map")
+	}
+
+	vars := expvar.Get("jobqueue_test").(*expvar.Map)
+	tests := []struct {
+		Key  string
+		Want string
+	}{
+		{"jobs_succeeded{a=b,topic=clicks}", "3"},
+		{"workers_busy{rank=0}", "3"},
+		{"claim_duration_count", "1"},
+		{"claim_duration_seconds", "0.5"},
+	}
+	for _, tt := range tests {
+		v := vars.Get(tt.Key)
+		if v == nil {
+			t.Errorf("expected %q; have %v", tt.Key, vars)
+			continue
+		}
+		if have := v.String(); have != tt.Want {
+			t.Errorf("%s = %s, want %s", tt.Key, have, tt.Want)
+		}
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewStatsDSink(conn.LocalAddr().String(), "jobqueue")
+	if err != nil {
+		t.Fatalf("NewStatsDSink failed with %v", err)
+	}
+	defer s.Close()
+	s.Counter(jobqueue.MetricJobsSucceeded, 1, map[string]string{"topic": "clicks"})
+	s.Gauge(jobqueue.MetricWorkersBusy, 2, map[string]string{"rank": "0"})
+	s.Timing(jobqueue.MetricClaimDuration, 1500*time.Microsecond, nil)
+
+	want := []string{
+		"jobqueue.jobs_succeeded.clicks:1|c",
+		"jobqueue.workers_busy.0:2|g",
+		"jobqueue.claim_duration:1.5|ms",
+	}
+	buf := make([]byte, 512)
+	for i, w := range want {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("#%d: ReadFrom failed with %v", i, err)
+		}
+		if have := string(buf[:n]); have != w {
+			t.Errorf("#%d: expected %q, have %q", i, w, have)
+		}
+	}
+}
+
+func TestPrometheusSink(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := NewPrometheusSink("jobqueue", reg)
+	tags := map[string]string{"topic": "clicks"}
+	s.Counter(jobqueue.MetricJobsSucceeded, 1, tags)
+	s.Counter(jobqueue.MetricJobsSucceeded, 2, tags)
+	s.Gauge(jobqueue.MetricWorkersBusy, 4, map[string]string{"rank": "0"})
+	s.Timing(jobqueue.MetricJobDuration, time.Second, tags)
+
+	have := gather(t, reg)
+	want := map[string]float64{
+		"jobqueue_jobs_succeeded_total{topic=clicks}": 3,
+		"jobqueue_workers_busy{rank=0}":               4,
+		"jobqueue_job_duration_seconds{topic=clicks}": 1,
+	}
+	for key, w := range want {
+		if v, found := have[key]; !found || v != w {
+			t.Errorf("%s = %v, want %v; have %v", key, v, w, have)
+		}
+	}
+}
+
+// gather returns the values of the metrics in reg by name and labels.
+// Histograms are represented by the sum of their observations.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed with %v", err)
+	}
+	have := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			key := f.GetName() + "{" + strings.Join(labels, ",") + "}"
+			switch {
+			case m.GetCounter() != nil:
+				have[key] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				have[key] = m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				have[key] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return have
+}
+
+func TestCollectorWithManager(t *testing.T) {
+	m := jobqueue.New()
+	err := m.Register("clicks", func(args ...interface{}) error {
+		if len(args) > 0 {
+			return errors.New("kaboom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	sub := m.Subscribe(10)
+	defer sub.Close()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	if err := m.Add(&jobqueue.Job{Topic: "clicks"}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	if err := m.Add(&jobqueue.Job{Topic: "clicks", Args: []interface{}{1}}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	for completed := 0; completed < 2; {
+		select {
+		case tr := <-sub.C:
+			if tr.To == jobqueue.Succeeded || tr.To == jobqueue.Failed {
+				completed++
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Jobs timed out")
+		}
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	if _, err := RegisterWith(reg, "jobqueue", m); err != nil {
+		t.Fatalf("RegisterWith failed with %v", err)
+	}
+	have := gather(t, reg)
+	want := map[string]float64{
+		"jobqueue_jobs{state=waiting,topic=clicks}":   0,
+		"jobqueue_jobs{state=succeeded,topic=clicks}": 1,
+		"jobqueue_jobs{state=failed,topic=clicks}":    1,
+		"jobqueue_jobs_processed_total{topic=clicks}": 2,
+		"jobqueue_jobs_failed_total{topic=clicks}":    1,
+	}
+	for key, w := range want {
+		if v, found := have[key]; !found || v != w {
+			t.Errorf("%s = %v, want %v; have %v", key, v, w, have)
+		}
+	}
+}
+
+// statsOnlyStore is a StatsSource that cannot group by topic.
+type statsOnlyStore struct {
+	stats *jobqueue.Stats
+	err   error
+}
+
+func (s statsOnlyStore) Stats(*jobqueue.StatsRequest) (*jobqueue.Stats, error) {
+	return s.stats, s.err
+}
+
+func TestCollectorWithStore(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	_, err := RegisterWith(reg, "", statsOnlyStore{stats: &jobqueue.Stats{Waiting: 3, Working: 1}})
+	if err != nil {
+		t.Fatalf("RegisterWith failed with %v", err)
+	}
+	have := gather(t, reg)
+	want := map[string]float64{
+		"jobs{state=waiting}":   3,
+		"jobs{state=working}":   1,
+		"jobs{state=succeeded}": 0,
+		"jobs{state=failed}":    0,
+		"jobs{state=cancelled}": 0,
+	}
+	if len(have) != len(want) {
+		t.Fatalf("expected %d metrics, have %v", len(want), have)
+	}
+	for key, w := range want {
+		if v, found := have[key]; !found || v != w {
+			t.Errorf("%s = %v, want %v; have %v", key, v, w, have)
+		}
+	}
+
+	// Errors of the store are reported to Prometheus
+	reg = prometheus.NewRegistry()
+	_, err = RegisterWith(reg, "", statsOnlyStore{err: errors.New("kaboom")})
+	if err != nil {
+		t.Fatalf("RegisterWith failed with %v", err)
+	}
+	if _, err := reg.Gather(); err == nil {
+		t.Fatal("expected Gather to fail")
+	}
+}
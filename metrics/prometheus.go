@@ -0,0 +1,103 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusSink exports the metrics of a manager to Prometheus. It
+// implements jobqueue.MetricsSink.
+//
+// Counters are exported with a "_total" suffix, and timers as histograms
+// in seconds, e.g. "jobqueue_job_duration_seconds". Tags become labels.
+// The collectors are registered with the first observation of a metric,
+// so each metric must always be emitted with the same tag keys, as the
+// manager does.
+type PrometheusSink struct {
+	namespace string
+	reg       prometheus.Registerer
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// NewPrometheusSink creates a sink that registers its collectors with reg,
+// e.g. prometheus.DefaultRegisterer. The names of all metrics are prefixed
+// with namespace, unless it is empty.
+func NewPrometheusSink(namespace string, reg prometheus.Registerer) *PrometheusSink {
+	return &PrometheusSink{
+		namespace:  namespace,
+		reg:        reg,
+		counters:   make(map[string]*prometheus.CounterVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+// Counter adds delta to the counter with the given name and tags.
+func (s *PrometheusSink) Counter(name string, delta int64, tags map[string]string) {
+	s.mu.Lock()
+	vec, found := s.counters[name]
+	if !found {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: s.namespace,
+			Name:      name + "_total",
+			Help:      "Counter " + name + " of the job queue.",
+		}, tagKeys(tags))
+		s.register(vec)
+		s.counters[name] = vec
+	}
+	s.mu.Unlock()
+	vec.With(prometheus.Labels(tags)).Add(float64(delta))
+}
+
+// Gauge sets the gauge with the given name and tags to value.
+func (s *PrometheusSink) Gauge(name string, value float64, tags map[string]string) {
+	s.mu.Lock()
+	vec, found := s.gauges[name]
+	if !found {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: s.namespace,
+			Name:      name,
+			Help:      "Gauge " + name + " of the job queue.",
+		}, tagKeys(tags))
+		s.register(vec)
+		s.gauges[name] = vec
+	}
+	s.mu.Unlock()
+	vec.With(prometheus.Labels(tags)).Set(value)
+}
+
+// Timing records an observation of d for the timer with the given name
+// and tags.
+func (s *PrometheusSink) Timing(name string, d time.Duration, tags map[string]string) {
+	s.mu.Lock()
+	vec, found := s.histograms[name]
+	if !found {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: s.namespace,
+			Name:      name + "_seconds",
+			Help:      "Timer " + name + " of the job queue in seconds.",
+		}, tagKeys(tags))
+		s.register(vec)
+		s.histograms[name] = vec
+	}
+	s.mu.Unlock()
+	vec.With(prometheus.Labels(tags)).Observe(d.Seconds())
+}
+
+// register registers c with the registry. Errors are ignored: The sink
+// keeps counting even if e.g. a collector of the same name exists.
+func (s *PrometheusSink) register(c prometheus.Collector) {
+	if s.reg != nil {
+		s.reg.Register(c)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDSink sends the metrics of a manager to a StatsD server via UDP.
+// It implements jobqueue.MetricsSink.
+//
+// The values of the tags are appended to the names of the metrics, in the
+// order of their keys, e.g. "jobqueue.jobs_succeeded.clicks". Sending is
+// fire and forget, i.e. metrics are lost silently if the server is not
+// available.
+type StatsDSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsDSink creates a sink that sends the metrics to the StatsD server
+// at addr, e.g. "127.0.0.1:8125". The names of all metrics are prefixed
+// with prefix, unless it is empty.
+func NewStatsDSink(addr, prefix string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDSink{conn: conn, prefix: prefix}, nil
+}
+
+// Close closes the connection to the StatsD server.
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
+
+// Counter adds delta to the counter with the given name and tags.
+func (s *StatsDSink) Counter(name string, delta int64, tags map[string]string) {
+	s.send(name, tags, strconv.FormatInt(delta, 10), "c")
+}
+
+// Gauge sets the gauge with the given name and tags to value.
+func (s *StatsDSink) Gauge(name string, value float64, tags map[string]string) {
+	s.send(name, tags, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+// Timing records an observation of d for the timer with the given name
+// and tags, in milliseconds.
+func (s *StatsDSink) Timing(name string, d time.Duration, tags map[string]string) {
+	s.send(name, tags, strconv.FormatFloat(d.Seconds()*1000, 'f', -1, 64), "ms")
+}
+
+// send sends a single metric in the StatsD line format.
+func (s *StatsDSink) send(name string, tags map[string]string, value, typ string) {
+	parts := []string{name}
+	if s.prefix != "" {
+		parts = []string{s.prefix, name}
+	}
+	for _, k := range tagKeys(tags) {
+		parts = append(parts, sanitize(tags[k]))
+	}
+	fmt.Fprintf(s.conn, "%s:%s|%s", strings.Join(parts, "."), value, typ)
+}
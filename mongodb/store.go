@@ -3,11 +3,13 @@ package mongodb
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
 
 	"github.com/olivere/jobqueue"
 )
@@ -35,6 +37,12 @@ type Store struct {
 	db             *mgo.Database
 	coll           *mgo.Collection
 	collectionName string
+
+	allowTerminalUpdates bool          // allow Update of jobs in a terminal state
+	reclaimAfter         time.Duration // min. age of working jobs that Start marks as failed (0 for all)
+	maxListLimit         int           // max. number of jobs returned by List (0 for no maximum)
+
+	logger jobqueue.Logger // receives errors, see SetLogger
 }
 
 // StoreOption is an options provider for Store.
@@ -44,6 +52,7 @@ type StoreOption func(*Store)
 func NewStore(mongodbURL string, options ...StoreOption) (*Store, error) {
 	st := &Store{
 		collectionName: defaultCollectionName,
+		logger:         jobqueue.NopLogger{},
 	}
 	for _, opt := range options {
 		opt(st)
@@ -75,7 +84,15 @@ func NewStore(mongodbURL string, options ...StoreOption) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = st.coll.EnsureIndexKey("-rank", "-priority")
+	err = st.coll.EnsureIndexKey("-rank", "-priority", "-sub_priority", "created")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("state", "created")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("lease_token")
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +108,30 @@ func NewStore(mongodbURL string, options ...StoreOption) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = st.coll.EnsureIndexKey("worker_id")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("completed")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("unique_key", "state")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("state", "heartbeat")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("state", "mutex_key")
+	if err != nil {
+		return nil, err
+	}
+	err = st.coll.EnsureIndexKey("run_at")
+	if err != nil {
+		return nil, err
+	}
 
 	return st, nil
 }
@@ -108,6 +149,47 @@ func SetCollectionName(collectionName string) StoreOption {
 	}
 }
 
+// SetLogger specifies the logger of the store. By default, the store logs
+// nothing (see jobqueue.NopLogger).
+func SetLogger(logger jobqueue.Logger) StoreOption {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// SetReclaimAfter specifies how long a job must have been working, without
+// a heartbeat in that time, before Start considers it abandoned, e.g.
+// because its manager crashed, and marks it as failed. Use it when several
+// managers share the database, so that a starting manager keeps its hands
+// off jobs that its peers are still working on. Set it to well above the
+// heartbeat interval. By default, Start marks all working jobs as failed.
+func SetReclaimAfter(d time.Duration) StoreOption {
+	return func(s *Store) {
+		s.reclaimAfter = d
+	}
+}
+
+// SetAllowTerminalUpdates indicates whether Update may change jobs that
+// are in a terminal state already. By default, Update returns
+// jobqueue.ErrInvalidTransition for those jobs, so a job cannot be
+// finalized twice, e.g. by two managers sharing the same database.
+func SetAllowTerminalUpdates(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.allowTerminalUpdates = enabled
+	}
+}
+
+// SetMaxListLimit specifies the maximum number of jobs that List returns,
+// regardless of the limit passed in the request. Use it to protect the
+// process from loading huge numbers of jobs into memory. A request without
+// a limit gets the maximum; a request for more jobs is logged. There is
+// no maximum by default.
+func SetMaxListLimit(n int) StoreOption {
+	return func(s *Store) {
+		s.maxListLimit = n
+	}
+}
+
 func (s *Store) wrapError(err error) error {
 	if err == mgo.ErrNotFound {
 		// Map gorm.ErrRecordNotFound to jobqueue-specific "not found" error
@@ -118,19 +200,54 @@ func (s *Store) wrapError(err error) error {
 
 // Start is called when the manager starts up.
 // We ensure that stale jobs are marked as failed so that we have place
-// for new jobs.
+// for new jobs (see SetReclaimAfter).
 func (s *Store) Start() error {
-	// TODO This will fail if we have two or more job queues working on the same database!
-	change := bson.M{"$set": bson.M{"state": jobqueue.Failed, "completed": time.Now().UnixNano()}}
-	_, err := s.coll.UpdateAll(
-		bson.M{"state": jobqueue.Working},
-		change,
-	)
+	now := time.Now()
+	query := bson.M{}
+	if s.reclaimAfter > 0 {
+		// Keep the jobs that other managers are working on
+		cutoff := now.Add(-s.reclaimAfter).UnixNano()
+		query = claimedBefore(cutoff)
+		query["heartbeat"] = bson.M{"$lt": cutoff}
+	}
+	query["state"] = jobqueue.Working
+	change := bson.M{
+		"$set":   bson.M{"state": jobqueue.Failed, "completed": now.UnixNano(), "last_mod": now.UnixNano()},
+		"$unset": leaseFields,
+	}
+	_, err := s.coll.UpdateAll(query, change)
 	return s.wrapError(err)
 }
 
-// Create adds a new job to the store.
+// claimedBefore returns a query for jobs that have been claimed before
+// the given time. Jobs claimed before claimed_at existed are matched by
+// their start time.
+func claimedBefore(t int64) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"claimed_at": bson.M{"$gt": 0, "$lt": t}},
+		{"claimed_at": bson.M{"$not": bson.M{"$gt": 0}}, "started": bson.M{"$lt": t}},
+	}}
+}
+
+// leaseFields are the fields to $unset to release the lease of a job
+// reserved via ReserveBatch.
+var leaseFields = bson.M{"lease_token": "", "lease_expires": ""}
+
+// Create adds a new job to the store. It returns jobqueue.ErrDuplicate
+// if there is a waiting or working job with the same unique key already.
+//
+// Notice that two concurrent calls may both add a job, see CreateOrGet.
 func (s *Store) Create(job *jobqueue.Job) error {
+	if job.UniqueKey != "" {
+		_, created, err := s.CreateOrGet(job)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return jobqueue.ErrDuplicate
+		}
+		return nil
+	}
 	j, err := newJob(job)
 	if err != nil {
 		return err
@@ -139,6 +256,45 @@ func (s *Store) Create(job *jobqueue.Job) error {
 	return s.wrapError(s.coll.Insert(j))
 }
 
+// CreateOrGet adds a new job to the store, unless there is a waiting or
+// working job with the same unique key already.
+//
+// Notice that two concurrent calls may both add a job, as MongoDB
+// cannot guarantee uniqueness for active jobs only.
+func (s *Store) CreateOrGet(job *jobqueue.Job) (*jobqueue.Job, bool, error) {
+	if job.UniqueKey == "" {
+		if err := s.Create(job); err != nil {
+			return nil, false, err
+		}
+		return job, true, nil
+	}
+	j, err := newJob(job)
+	if err != nil {
+		return nil, false, err
+	}
+	j.LastMod = j.Created
+	var existing Job
+	_, err = s.coll.Find(bson.M{
+		"unique_key": job.UniqueKey,
+		"state":      bson.M{"$in": []string{jobqueue.Waiting, jobqueue.Working}},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$setOnInsert": j},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &existing)
+	if err != nil {
+		return nil, false, s.wrapError(err)
+	}
+	if existing.ID == j.ID {
+		return job, true, nil
+	}
+	found, err := existing.ToJob()
+	if err != nil {
+		return nil, false, err
+	}
+	return found, false, nil
+}
+
 // Update updates the job in the store.
 func (s *Store) Update(job *jobqueue.Job) error {
 	j, err := newJob(job)
@@ -146,16 +302,454 @@ func (s *Store) Update(job *jobqueue.Job) error {
 		return err
 	}
 	j.LastMod = time.Now().UnixNano()
-	return s.wrapError(s.coll.UpdateId(j.ID, j))
+	if s.allowTerminalUpdates {
+		return s.wrapError(s.coll.UpdateId(j.ID, j))
+	}
+	err = s.coll.Update(bson.M{
+		"_id":   j.ID,
+		"state": bson.M{"$nin": []string{jobqueue.Succeeded, jobqueue.Failed, jobqueue.Cancelled}},
+	}, j)
+	if err == mgo.ErrNotFound {
+		// Either the job is gone or it is in a terminal state
+		n, err := s.coll.FindId(j.ID).Count()
+		if err != nil {
+			return s.wrapError(err)
+		}
+		if n > 0 {
+			return jobqueue.ErrInvalidTransition
+		}
+		return jobqueue.ErrNotFound
+	}
+	return s.wrapError(err)
+}
+
+// ResetRetries sets the retry counter of a waiting job back to zero.
+func (s *Store) ResetRetries(id string) error {
+	err := s.coll.Update(
+		bson.M{"_id": id, "state": jobqueue.Waiting},
+		bson.M{"$set": bson.M{"retry": 0, "last_mod": time.Now().UnixNano()}},
+	)
+	return s.wrapError(err)
+}
+
+// Heartbeat records that the worker is still working on the job.
+func (s *Store) Heartbeat(id string) error {
+	err := s.coll.Update(
+		bson.M{"_id": id, "state": jobqueue.Working},
+		bson.M{"$set": bson.M{"heartbeat": time.Now().UnixNano()}},
+	)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return s.wrapError(err)
+}
+
+// ReclaimExpired recovers working jobs without a recent heartbeat.
+func (s *Store) ReclaimExpired(olderThan time.Duration) (int, error) {
+	now := time.Now()
+	cutoff := now.Add(-olderThan).UnixNano()
+	query := claimedBefore(cutoff)
+	query["state"] = jobqueue.Working
+	query["heartbeat"] = bson.M{"$lt": cutoff}
+	// Jobs reserved via ReserveBatch are kept until their lease expires
+	query["lease_expires"] = bson.M{"$not": bson.M{"$gte": now.UnixNano()}}
+	var jobs []Job
+	if err := s.coll.Find(query).All(&jobs); err != nil {
+		return 0, s.wrapError(err)
+	}
+	var n int
+	for _, j := range jobs {
+		change := bson.M{"last_mod": now.UnixNano()}
+		switch {
+		case j.MaxRedeliveries > 0 && j.Redeliveries >= j.MaxRedeliveries:
+			change["state"] = jobqueue.Failed
+			change["completed"] = now.UnixNano()
+			change["last_error"] = jobqueue.ErrMaxRedeliveries.Error()
+		case j.Retry >= j.MaxRetry:
+			change["state"] = jobqueue.Failed
+			change["completed"] = now.UnixNano()
+		default:
+			change["state"] = jobqueue.Waiting
+			change["retry"] = j.Retry + 1
+			change["redeliveries"] = j.Redeliveries + 1
+		}
+		// Skip jobs whose worker has sent a heartbeat in the meantime
+		err := s.coll.Update(
+			bson.M{"_id": j.ID, "state": jobqueue.Working, "heartbeat": j.Heartbeat},
+			bson.M{"$set": change, "$unset": leaseFields},
+		)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return n, s.wrapError(err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// CompareAndSetState changes the state of a job if it is currently in
+// the from state.
+func (s *Store) CompareAndSetState(id, from, to string) (bool, error) {
+	change := bson.M{"$set": bson.M{"state": to, "last_mod": time.Now().UnixNano()}}
+	if to != jobqueue.Working {
+		change["$unset"] = leaseFields
+	}
+	err := s.coll.Update(bson.M{"_id": id, "state": from}, change)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RenameTopic moves the jobs of a topic to another topic, e.g. when a
+// topic gets renamed. If states are given, only the jobs in one of them
+// are moved, e.g. jobqueue.Waiting to leave the history alone. Do not
+// move working jobs while a manager works on jobs of the topic: A working
+// job is saved with its old topic when it completes.
+func (s *Store) RenameTopic(from, to string, states ...string) (int64, error) {
+	query := bson.M{"topic": from}
+	if len(states) > 0 {
+		query["state"] = bson.M{"$in": states}
+	}
+	info, err := s.coll.UpdateAll(
+		query,
+		bson.M{"$set": bson.M{"topic": to, "last_mod": time.Now().UnixNano()}},
+	)
+	if err != nil {
+		return 0, s.wrapError(err)
+	}
+	return int64(info.Updated), nil
+}
+
+// ReserveBatch claims up to n jobs and leases them for the given duration.
+// The jobs are claimed one by one, each atomically, so concurrent calls
+// never return the same job.
+func (s *Store) ReserveBatch(n int, lease time.Duration) ([]*jobqueue.ReservedJob, error) {
+	token := uuid.New().String()
+	now := time.Now()
+	expires := now.Add(lease)
+	query := bson.M{
+		"$or": []bson.M{
+			{"state": jobqueue.Waiting, "run_at": bson.M{"$not": bson.M{"$gt": now.UnixNano()}}},
+			{"state": jobqueue.Working, "lease_expires": bson.M{"$gt": 0, "$lt": now.UnixNano()}},
+		},
+	}
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"state":         jobqueue.Working,
+			"lease_token":   token,
+			"lease_expires": expires.UnixNano(),
+			"started":       now.UnixNano(),
+			"claimed_at":    now.UnixNano(),
+			"heartbeat":     now.UnixNano(),
+			"last_mod":      now.UnixNano(),
+		}},
+		ReturnNew: true,
+	}
+	var reserved []*jobqueue.ReservedJob
+	for i := 0; i < n; i++ {
+		var j Job
+		_, err := s.coll.Find(query).Sort("-rank", "-priority", "-sub_priority", "created").Apply(change, &j)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		job, err := j.ToJob()
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, &jobqueue.ReservedJob{Job: job, Token: token, LeaseExpires: expires})
+	}
+	return reserved, nil
 }
 
-// Next picks the next job to execute, or nil if no executable job is available.
-func (s *Store) Next() (*jobqueue.Job, error) {
+// FailAndRetry records a failed attempt of a working job, and either
+// retries it after delay or moves it into the Failed state.
+func (s *Store) FailAndRetry(id string, delay time.Duration, errMsg string) error {
 	var j Job
-	err := s.coll.Find(bson.M{"state": jobqueue.Waiting}).Sort("-rank", "-priority").One(&j)
+	err := s.coll.FindId(id).One(&j)
+	if err != nil {
+		return s.wrapError(err)
+	}
+	if j.State != jobqueue.Working {
+		return jobqueue.ErrInvalidTransition
+	}
+	now := time.Now()
+	fields := bson.M{
+		"last_error": errMsg,
+		"last_mod":   now.UnixNano(),
+	}
+	if j.Retry >= j.MaxRetry {
+		fields["state"] = jobqueue.Failed
+		fields["completed"] = now.UnixNano()
+	} else {
+		fields["state"] = jobqueue.Waiting
+		fields["retry"] = j.Retry + 1
+		runAt := now.Add(delay).UnixNano()
+		fields["run_at"] = runAt
+		fields["priority"] = -runAt
+	}
+	// Guard against concurrent changes of the job in the meantime
+	err = s.coll.Update(
+		bson.M{"_id": id, "state": jobqueue.Working, "retry": j.Retry},
+		bson.M{"$set": fields, "$unset": leaseFields},
+	)
+	if err == mgo.ErrNotFound {
+		return jobqueue.ErrInvalidTransition
+	}
+	return s.wrapError(err)
+}
+
+// ImportTerminal adds jobs that are in a terminal state already.
+func (s *Store) ImportTerminal(jobs []*jobqueue.Job) error {
+	var docs []interface{}
+	for _, job := range jobs {
+		if !jobqueue.IsTerminal(job.State) {
+			return fmt.Errorf("mongodb: cannot import job %s in state %s", job.ID, job.State)
+		}
+		j, err := newJob(job)
+		if err != nil {
+			return err
+		}
+		j.LastMod = job.Updated
+		if j.LastMod == 0 {
+			j.LastMod = j.Completed
+		}
+		docs = append(docs, j)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	return s.wrapError(s.coll.Insert(docs...))
+}
+
+// Next claims the next job to execute, or nil if no executable job is available.
+// The job is moved into the Working state atomically with findAndModify.
+func (s *Store) Next(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	var j Job
+	query := bson.M{
+		"state": jobqueue.Waiting,
+		// $not also matches jobs that have been created before min_worker_version existed
+		"min_worker_version": bson.M{"$not": bson.M{"$gt": req.WorkerVersion}},
+		// $not also matches jobs that have been created before run_at existed
+		"run_at": bson.M{"$not": bson.M{"$gt": time.Now().UnixNano()}},
+	}
+	if len(req.ExcludeTopics) > 0 {
+		query["topic"] = bson.M{"$nin": req.ExcludeTopics}
+	}
+	sort := []string{"-rank", "-priority", "-sub_priority", "created"}
+	switch {
+	case req.FIFO:
+		sort = []string{"created"}
+	case req.LIFO:
+		sort = []string{"-created"}
+	}
+	if req.Fair {
+		id, err := s.fairCorrelation(query)
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		query["correlation_id"] = id
+	}
+	now := time.Now().UnixNano()
+	claimed := bson.M{
+		"$set": bson.M{
+			"state":      jobqueue.Working,
+			"started":    now,
+			"claimed_at": now,
+			"heartbeat":  now,
+			"last_mod":   now,
+			"worker_id":  req.WorkerID,
+		},
+		"$unset": leaseFields,
+	}
+	if req.Gate == nil {
+		_, err := s.coll.Find(query).Sort(sort...).Apply(mgo.Change{Update: claimed, ReturnNew: true}, &j)
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		return j.ToJob()
+	}
+
+	// Ask the gate before claiming the job
+	var rejected []string
+	for {
+		if len(rejected) > 0 {
+			query["_id"] = bson.M{"$nin": rejected}
+		}
+		j = Job{}
+		err := s.coll.Find(query).Sort(sort...).One(&j)
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		job, err := j.ToJob()
+		if err != nil {
+			return nil, err
+		}
+		ok, err := req.Gate(job)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rejected = append(rejected, j.ID)
+			continue
+		}
+		err = s.coll.Update(bson.M{"_id": j.ID, "state": jobqueue.Waiting}, claimed)
+		if err == mgo.ErrNotFound {
+			// Someone else has claimed the job in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		job.State = jobqueue.Working
+		job.Started = now
+		job.ClaimedAt = now
+		job.Heartbeat = now
+		job.WorkerID = req.WorkerID
+		return job, nil
+	}
+}
+
+// fairCorrelation returns the correlation identifier of the jobs matching
+// query that has been claimed least recently, see jobqueue.NextRequest.Fair.
+// It returns mgo.ErrNotFound if no job matches query.
+func (s *Store) fairCorrelation(query bson.M) (interface{}, error) {
+	var candidates []struct {
+		ID interface{} `bson:"_id"`
+	}
+	err := s.coll.Pipe([]bson.M{
+		{"$match": query},
+		{"$group": bson.M{"_id": "$correlation_id"}},
+	}).All(&candidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	ids := make([]interface{}, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.ID
+	}
+	var groups []struct {
+		ID interface{} `bson:"_id"`
+	}
+	err = s.coll.Pipe([]bson.M{
+		{"$match": bson.M{"correlation_id": bson.M{"$in": ids}}},
+		{"$group": bson.M{"_id": "$correlation_id", "last": bson.M{"$max": "$claimed_at"}}},
+		{"$sort": bson.M{"last": 1}},
+		{"$limit": 1},
+	}).All(&groups)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return groups[0].ID, nil
+}
+
+// NextWithMutex claims the next job to execute whose mutex key is not
+// held by another working job.
+func (s *Store) NextWithMutex(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	var held []string
+	err := s.coll.Find(bson.M{
+		"state":     jobqueue.Working,
+		"mutex_key": bson.M{"$exists": true},
+	}).Distinct("mutex_key", &held)
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
+	query := bson.M{
+		"state": jobqueue.Waiting,
+		// $not also matches jobs that have been created before min_worker_version existed
+		"min_worker_version": bson.M{"$not": bson.M{"$gt": req.WorkerVersion}},
+		// $not also matches jobs that have been created before run_at existed
+		"run_at": bson.M{"$not": bson.M{"$gt": time.Now().UnixNano()}},
+	}
+	if len(held) > 0 {
+		query["mutex_key"] = bson.M{"$nin": held}
+	}
+	if len(req.ExcludeTopics) > 0 {
+		query["topic"] = bson.M{"$nin": req.ExcludeTopics}
+	}
+	sort := []string{"-rank", "-priority", "-sub_priority", "created"}
+	switch {
+	case req.FIFO:
+		sort = []string{"created"}
+	case req.LIFO:
+		sort = []string{"-created"}
+	}
+	if req.Fair {
+		id, err := s.fairCorrelation(query)
+		if err == mgo.ErrNotFound {
+			return nil, jobqueue.ErrNotFound
+		}
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		query["correlation_id"] = id
+	}
+	var j Job
+	err = s.coll.Find(query).Sort(sort...).One(&j)
+	if err == mgo.ErrNotFound {
+		return nil, jobqueue.ErrNotFound
+	}
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	now := time.Now().UnixNano()
+	err = s.coll.Update(
+		bson.M{"_id": j.ID, "state": jobqueue.Waiting},
+		bson.M{
+			"$set":   bson.M{"state": jobqueue.Working, "started": now, "claimed_at": now, "heartbeat": now, "last_mod": now, "worker_id": req.WorkerID},
+			"$unset": leaseFields,
+		},
+	)
+	if err == mgo.ErrNotFound {
+		// Someone else has claimed the job in the meantime
+		return nil, jobqueue.ErrNotFound
+	}
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	if j.MutexKey != "" {
+		// Another job with the same key may have been claimed concurrently.
+		// If so, back off: It is better that both claims give up than that
+		// both succeed.
+		n, err := s.coll.Find(bson.M{
+			"_id":       bson.M{"$ne": j.ID},
+			"state":     jobqueue.Working,
+			"mutex_key": j.MutexKey,
+		}).Count()
+		if err != nil || n > 0 {
+			revert := s.coll.Update(
+				bson.M{"_id": j.ID, "state": jobqueue.Working, "started": now},
+				bson.M{"$set": bson.M{"state": jobqueue.Waiting, "started": j.Started, "claimed_at": j.ClaimedAt, "heartbeat": j.Heartbeat, "last_mod": now, "worker_id": j.WorkerID}},
+			)
+			if revert != nil && revert != mgo.ErrNotFound {
+				return nil, s.wrapError(revert)
+			}
+			if err != nil {
+				return nil, s.wrapError(err)
+			}
+			return nil, jobqueue.ErrNotFound
+		}
+	}
+	j.State = jobqueue.Working
+	j.Started = now
+	j.ClaimedAt = now
+	j.Heartbeat = now
+	j.LastMod = now
+	j.WorkerID = req.WorkerID
 	return j.ToJob()
 }
 
@@ -197,11 +791,8 @@ func (s *Store) LookupByCorrelationID(correlationID string) ([]*jobqueue.Job, er
 	return result, nil
 }
 
-// List returns a list of all jobs stored in the data store.
-func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
-	rsp := &jobqueue.ListResponse{}
-
-	// Common filters for both Count and Find
+// filter returns a query with the filters of the ListRequest.
+func (s *Store) filter(request *jobqueue.ListRequest) bson.M {
 	query := bson.M{}
 	if request.Topic != "" {
 		query["topic"] = request.Topic
@@ -215,6 +806,38 @@ func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, err
 	if request.CorrelationID != "" {
 		query["correlation_id"] = request.CorrelationID
 	}
+	if request.CreatedAfter > 0 || request.CreatedBefore > 0 {
+		created := bson.M{}
+		if request.CreatedAfter > 0 {
+			created["$gt"] = request.CreatedAfter
+		}
+		if request.CreatedBefore > 0 {
+			created["$lt"] = request.CreatedBefore
+		}
+		query["created"] = created
+	}
+	return query
+}
+
+// listLimit returns the number of jobs that List returns at most for the
+// given limit, taking the maximum set via SetMaxListLimit into account.
+func (s *Store) listLimit(limit int) int {
+	if s.maxListLimit <= 0 || (limit > 0 && limit <= s.maxListLimit) {
+		return limit
+	}
+	if limit > 0 {
+		// Only report limits that have been asked for explicitly
+		s.logger.Printf("mongodb: clamping list limit of %d to %d", limit, s.maxListLimit)
+	}
+	return s.maxListLimit
+}
+
+// List returns a list of all jobs stored in the data store.
+func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
+	rsp := &jobqueue.ListResponse{}
+
+	// Common filters for both Count and Find
+	query := s.filter(request)
 
 	// Count
 	count, err := s.coll.Find(query).Count()
@@ -225,7 +848,7 @@ func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, err
 
 	// Find
 	var list []*Job
-	err = s.coll.Find(query).Sort("-last_mod").Skip(request.Offset).Limit(request.Limit).All(&list)
+	err = s.coll.Find(query).Sort("-last_mod", "-_id").Skip(request.Offset).Limit(s.listLimit(request.Limit)).All(&list)
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
@@ -268,23 +891,129 @@ func (s *Store) Stats(req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
+	cancelled, err := s.coll.Find(buildFilter(jobqueue.Cancelled)).Count()
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
 	return &jobqueue.Stats{
 		Waiting:   waiting,
 		Working:   working,
 		Succeeded: succeeded,
 		Failed:    failed,
+		Cancelled: cancelled,
 	}, nil
 }
 
+// StatsByTopic returns statistics about the jobs in the store, grouped
+// by topic. It implements jobqueue.TopicStatsStore.
+func (s *Store) StatsByTopic() (map[string]*jobqueue.Stats, error) {
+	var groups []struct {
+		ID struct {
+			Topic string `bson:"topic"`
+			State string `bson:"state"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	err := s.coll.Pipe([]bson.M{
+		{"$group": bson.M{
+			"_id":   bson.M{"topic": "$topic", "state": "$state"},
+			"count": bson.M{"$sum": 1},
+		}},
+	}).All(&groups)
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	result := make(map[string]*jobqueue.Stats)
+	for _, g := range groups {
+		stats, found := result[g.ID.Topic]
+		if !found {
+			stats = new(jobqueue.Stats)
+			result[g.ID.Topic] = stats
+		}
+		switch g.ID.State {
+		case jobqueue.Waiting:
+			stats.Waiting = g.Count
+		case jobqueue.Working:
+			stats.Working = g.Count
+		case jobqueue.Succeeded:
+			stats.Succeeded = g.Count
+		case jobqueue.Failed:
+			stats.Failed = g.Count
+		case jobqueue.Cancelled:
+			stats.Cancelled = g.Count
+		}
+	}
+	return result, nil
+}
+
+// Throughput returns the number of jobs completed per second within the
+// last window, e.g. to show a live rate on a dashboard. Both succeeded and
+// failed jobs count as completed.
+func (s *Store) Throughput(window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, errors.New("mongodb: window must be positive")
+	}
+	now := time.Now()
+	count, err := s.coll.Find(bson.M{
+		"completed": bson.M{
+			"$gte": now.Add(-window).UnixNano(),
+			"$lte": now.UnixNano(),
+		},
+	}).Count()
+	if err != nil {
+		return 0, s.wrapError(err)
+	}
+	return float64(count) / window.Seconds(), nil
+}
+
+// BulkSetPriority sets the priority of all waiting jobs that match the
+// filter in request. Offset and Limit of the request are ignored. It
+// returns the number of jobs updated. Use it e.g. to deprioritize the
+// backlog of a noisy topic.
+func (s *Store) BulkSetPriority(request *jobqueue.ListRequest, priority int64) (int64, error) {
+	query := s.filter(request)
+	if request.State != "" && request.State != jobqueue.Waiting {
+		return 0, nil
+	}
+	query["state"] = jobqueue.Waiting
+	info, err := s.coll.UpdateAll(query, bson.M{"$set": bson.M{"priority": priority}})
+	if err != nil {
+		return 0, s.wrapError(err)
+	}
+	return int64(info.Updated), nil
+}
+
+// Reassign hands over all jobs in the Working state that were claimed by
+// the worker fromWorker to the worker toWorker. It returns the number of
+// jobs that have been reassigned. Use it to scale in gracefully, i.e.
+// without failing or re-executing the jobs of the worker that goes away.
+//
+// Reassign only changes the jobs in the store: toWorker must look them up
+// again, e.g. via List, send their heartbeats, and complete them. The
+// manager of fromWorker, if it is still running, keeps executing the jobs
+// it holds in memory, and may still complete them. Stop that manager
+// before calling Reassign.
+func (s *Store) Reassign(fromWorker, toWorker string) (int64, error) {
+	info, err := s.coll.UpdateAll(
+		bson.M{"state": jobqueue.Working, "worker_id": fromWorker},
+		bson.M{"$set": bson.M{"worker_id": toWorker, "last_mod": time.Now().UnixNano()}},
+	)
+	if err != nil {
+		return 0, s.wrapError(err)
+	}
+	return int64(info.Updated), nil
+}
+
 // -- MongoDB-internal representation of a task --
 
 type Job struct {
 	ID               string `bson:"_id"`
 	Topic            string
 	State            string
-	Args             *string
+	Args             interface{} // native array; JSON-encoded string in jobs stored by earlier versions
 	Rank             int
 	Priority         int64
+	SubPriority      int64 `bson:"sub_priority"`
 	Retry            int
 	MaxRetry         int    `bson:"max_retry"`
 	CorrelationGroup string `bson:"correlation_group"`
@@ -293,17 +1022,42 @@ type Job struct {
 	Started          int64
 	Completed        int64
 	LastMod          int64 `bson:"last_mod"`
+	Repeats          int
+	RepeatEvery      int64  `bson:"repeat_every"`
+	WorkerID         string `bson:"worker_id"`
+	MinWorkerVersion int    `bson:"min_worker_version"`
+	LastError        string `bson:"last_error"`
+	CallbackURL      string `bson:"callback_url"`
+	UniqueKey        string `bson:"unique_key,omitempty"`
+	Heartbeat        int64
+	MutexKey         string `bson:"mutex_key,omitempty"`
+	RunAt            int64  `bson:"run_at"`
+	ClaimedAt        int64  `bson:"claimed_at"`
+	Result           []byte `bson:"result"`
+	LogOutput        string `bson:"log_output"`
+	Timeout          int64  `bson:"timeout"`
+	Redeliveries     int    `bson:"redeliveries"`
+	MaxRedeliveries  int    `bson:"max_redeliveries"`
+	CompletedBy      string `bson:"completed_by"`
+
+	TraceContext map[string]string `bson:"trace_context,omitempty"`
 }
 
 func newJob(job *jobqueue.Job) (*Job, error) {
-	var args *string
+	var args interface{}
 	if job.Args != nil {
+		// Store the arguments as a native array, but in the shape of their
+		// JSON encoding, so that e.g. JSON tags of structs are honored,
+		// and processors see the same arguments as with other stores
 		v, err := json.Marshal(job.Args)
 		if err != nil {
 			return nil, err
 		}
-		s := string(v)
-		args = &s
+		var list []interface{}
+		if err := json.Unmarshal(v, &list); err != nil {
+			return nil, err
+		}
+		args = list
 	}
 	return &Job{
 		ID:               job.ID,
@@ -312,6 +1066,7 @@ func newJob(job *jobqueue.Job) (*Job, error) {
 		Args:             args,
 		Rank:             job.Rank,
 		Priority:         job.Priority,
+		SubPriority:      job.SubPriority,
 		Retry:            job.Retry,
 		MaxRetry:         job.MaxRetry,
 		CorrelationGroup: job.CorrelationGroup,
@@ -319,15 +1074,31 @@ func newJob(job *jobqueue.Job) (*Job, error) {
 		Created:          job.Created,
 		Started:          job.Started,
 		Completed:        job.Completed,
+		Repeats:          job.Repeats,
+		RepeatEvery:      int64(job.RepeatEvery),
+		WorkerID:         job.WorkerID,
+		MinWorkerVersion: job.MinWorkerVersion,
+		LastError:        job.LastError,
+		CallbackURL:      job.CallbackURL,
+		UniqueKey:        job.UniqueKey,
+		Heartbeat:        job.Heartbeat,
+		MutexKey:         job.MutexKey,
+		RunAt:            job.RunAt,
+		ClaimedAt:        job.ClaimedAt,
+		Result:           job.Result,
+		LogOutput:        job.LogOutput,
+		Timeout:          int64(job.Timeout),
+		Redeliveries:     job.Redeliveries,
+		MaxRedeliveries:  job.MaxRedeliveries,
+		CompletedBy:      job.CompletedBy,
+		TraceContext:     job.TraceContext,
 	}, nil
 }
 
 func (j *Job) ToJob() (*jobqueue.Job, error) {
-	var args []interface{}
-	if j.Args != nil && *j.Args != "" {
-		if err := json.Unmarshal([]byte(*j.Args), &args); err != nil {
-			return nil, err
-		}
+	args, err := decodeArgs(j.Args)
+	if err != nil {
+		return nil, err
 	}
 	job := &jobqueue.Job{
 		ID:               j.ID,
@@ -336,6 +1107,7 @@ func (j *Job) ToJob() (*jobqueue.Job, error) {
 		Args:             args,
 		Rank:             j.Rank,
 		Priority:         j.Priority,
+		SubPriority:      j.SubPriority,
 		Retry:            j.Retry,
 		MaxRetry:         j.MaxRetry,
 		CorrelationGroup: j.CorrelationGroup,
@@ -343,6 +1115,78 @@ func (j *Job) ToJob() (*jobqueue.Job, error) {
 		Created:          j.Created,
 		Started:          j.Started,
 		Completed:        j.Completed,
+		Repeats:          j.Repeats,
+		RepeatEvery:      time.Duration(j.RepeatEvery),
+		WorkerID:         j.WorkerID,
+		MinWorkerVersion: j.MinWorkerVersion,
+		LastError:        j.LastError,
+		CallbackURL:      j.CallbackURL,
+		UniqueKey:        j.UniqueKey,
+		Heartbeat:        j.Heartbeat,
+		MutexKey:         j.MutexKey,
+		RunAt:            j.RunAt,
+		ClaimedAt:        j.ClaimedAt,
+		Result:           j.Result,
+		LogOutput:        j.LogOutput,
+		Timeout:          time.Duration(j.Timeout),
+		Redeliveries:     j.Redeliveries,
+		MaxRedeliveries:  j.MaxRedeliveries,
+		CompletedBy:      j.CompletedBy,
+		TraceContext:     j.TraceContext,
 	}
 	return job, nil
 }
+
+// decodeArgs returns the arguments of a job as stored in MongoDB.
+// The arguments are normalized via JSON, so that e.g. numbers are
+// always float64 and documents are always map[string]interface{},
+// just like the JSON-encoded arguments of jobs stored by earlier versions.
+func decodeArgs(v interface{}) ([]interface{}, error) {
+	var data []byte
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		data = []byte(v)
+	default:
+		var err error
+		data, err = json.Marshal(normalizeBSON(v))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var args []interface{}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// normalizeBSON converts the documents in v, as decoded by mgo, into
+// values that encoding/json can marshal.
+func normalizeBSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalizeBSON(e)
+		}
+		return m
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Name] = normalizeBSON(e.Value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			list[i] = normalizeBSON(e)
+		}
+		return list
+	}
+	return v
+}
@@ -1,6 +1,7 @@
 package mongodb
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 
 	"github.com/olivere/jobqueue"
 )
@@ -116,3 +118,88 @@ func TestJobSuccess(t *testing.T) {
 		t.Fatal("Processor func timed out")
 	}
 }
+
+func TestArgsAreStoredAsDocuments(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	job := &jobqueue.Job{
+		ID:    "1",
+		Topic: "topic",
+		State: jobqueue.Waiting,
+		Args:  []interface{}{"Hello", map[string]interface{}{"name": "Oliver", "age": 42}},
+	}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	var doc bson.M
+	if err := st.coll.FindId("1").One(&doc); err != nil {
+		t.Fatalf("FindId failed with %v", err)
+	}
+	args, ok := doc["args"].([]interface{})
+	if !ok {
+		t.Fatalf("expected args to be stored as an array, got %T", doc["args"])
+	}
+	if have, want := len(args), 2; have != want {
+		t.Fatalf("len(args) = %d, want %d", have, want)
+	}
+	nested, ok := args[1].(bson.M)
+	if !ok {
+		t.Fatalf("expected args[1] to be stored as a document, got %T", args[1])
+	}
+	if have, want := nested["name"], "Oliver"; have != want {
+		t.Fatalf("args[1].name = %v, want %v", have, want)
+	}
+
+	// Args are queryable
+	n, err := st.coll.Find(bson.M{"args.name": "Oliver"}).Count()
+	if err != nil {
+		t.Fatalf("Count failed with %v", err)
+	}
+	if have, want := n, 1; have != want {
+		t.Fatalf("Count = %d, want %d", have, want)
+	}
+}
+
+func TestDecodeArgs(t *testing.T) {
+	tests := []struct {
+		Stored interface{}
+		Want   string
+	}{
+		{nil, `null`},
+		{"", `null`},
+		// Jobs stored by earlier versions have JSON-encoded args
+		{`["Hello",{"age":42}]`, `["Hello",{"age":42}]`},
+		{[]interface{}{"Hello", bson.M{"age": 42}}, `["Hello",{"age":42}]`},
+		{[]interface{}{bson.D{{Name: "age", Value: int64(42)}}, []interface{}{1, 2}}, `[{"age":42},[1,2]]`},
+	}
+	for i, tt := range tests {
+		args, err := decodeArgs(tt.Stored)
+		if err != nil {
+			t.Fatalf("#%d: decodeArgs failed with %v", i, err)
+		}
+		data, err := json.Marshal(args)
+		if err != nil {
+			t.Fatalf("#%d: Marshal failed with %v", i, err)
+		}
+		if have, want := string(data), tt.Want; have != want {
+			t.Fatalf("#%d: args = %s, want %s", i, have, want)
+		}
+		for _, arg := range args {
+			if m, ok := arg.(map[string]interface{}); ok {
+				if _, ok := m["age"].(float64); !ok {
+					t.Fatalf("#%d: expected numbers to be float64 like with JSON, got %T", i, m["age"])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mysql
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/olivere/jobqueue"
+)
+
+const (
+	// blobArgsPrefix marks a reference to arguments kept in the BlobStore.
+	// Inline arguments are always a JSON array, so they never start with it.
+	blobArgsPrefix = "blob:"
+
+	// blobDigestSeparator separates the key of the arguments in the
+	// BlobStore from their SHA-256 digest in a reference, e.g.
+	// "blob:<id>#<digest>". References written by earlier versions have
+	// no digest.
+	blobDigestSeparator = "#"
+
+	// defaultLargeArgsThreshold is the size in bytes above which arguments
+	// are offloaded to the BlobStore. It is a safe margin below the 64 KB
+	// limit of the args column.
+	defaultLargeArgsThreshold = 32 * 1024
+)
+
+// SetLargeArgsStore specifies a BlobStore for arguments that are larger
+// than threshold bytes when serialized. Those arguments are saved in the
+// BlobStore and only a reference is kept in the args column. Smaller
+// arguments are stored inline. If threshold is 0 or less, a default of
+// 32 KB is used.
+//
+// Arguments are uploaded when a job is created, and on updates only if
+// they have changed. They are fetched by Lookup and when a job is claimed,
+// but not for the jobs returned by List or passed to a claim gate: those
+// have nil Args if their arguments have been offloaded. Look up such a job
+// before updating it, or its arguments are removed.
+func SetLargeArgsStore(blobs jobqueue.BlobStore, threshold int) StoreOption {
+	return func(s *Store) {
+		s.blobs = blobs
+		if threshold > 0 {
+			s.blobThreshold = threshold
+		} else {
+			s.blobThreshold = defaultLargeArgsThreshold
+		}
+	}
+}
+
+// offloadArgs moves the arguments of j into the BlobStore if they exceed
+// the configured threshold. stored is the content of the args column of
+// the job in the database, or an empty string for a new job. If it refers
+// to the same arguments already, they are not uploaded again.
+func (s *Store) offloadArgs(j *Job, stored string) error {
+	ref := s.argsRef(j)
+	if ref == "" {
+		return nil
+	}
+	if ref != stored {
+		if err := s.blobs.Put(j.ID, []byte(j.Args.String)); err != nil {
+			return err
+		}
+	}
+	j.Args.String = ref
+	return nil
+}
+
+// argsRef returns the reference that replaces the arguments of j in the
+// args column if they are offloaded, or an empty string if they are
+// stored inline. The reference contains the digest of the arguments, so
+// offloadArgs can tell whether they have changed.
+func (s *Store) argsRef(j *Job) string {
+	if s.blobs == nil || !j.Args.Valid || len(j.Args.String) <= s.blobThreshold {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(j.Args.String))
+	return blobArgsPrefix + j.ID + blobDigestSeparator + hex.EncodeToString(digest[:])
+}
+
+// offloaded returns j as it is written to the database, i.e. with the
+// reference to its arguments if they are offloaded, e.g. to check its
+// size via checkSize before uploading the arguments.
+func (s *Store) offloaded(j *Job) *Job {
+	ref := s.argsRef(j)
+	if ref == "" {
+		return j
+	}
+	dup := *j
+	dup.Args.String = ref
+	return &dup
+}
+
+// blobRef returns the reference to offloaded arguments in args, or an
+// empty string if args are stored inline.
+func blobRef(args sql.NullString) string {
+	if args.Valid && strings.HasPrefix(args.String, blobArgsPrefix) {
+		return args.String
+	}
+	return ""
+}
+
+// toJob converts j into a jobqueue.Job, fetching the arguments from the
+// BlobStore if they have been offloaded.
+func (s *Store) toJob(j *Job) (*jobqueue.Job, error) {
+	if ref := blobRef(j.Args); ref != "" {
+		if s.blobs == nil {
+			return nil, errors.New("mysql: job arguments offloaded but no large args store configured")
+		}
+		key := strings.TrimPrefix(ref, blobArgsPrefix)
+		if i := strings.Index(key, blobDigestSeparator); i >= 0 {
+			key = key[:i]
+		}
+		data, err := s.blobs.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		j.Args.String = string(data)
+	}
+	return j.ToJob()
+}
+
+// peekJob converts j into a jobqueue.Job like toJob, but leaves the Args
+// of the job nil if they have been offloaded instead of fetching them.
+// Unlike toJob, it does not modify j.
+func (s *Store) peekJob(j *Job) (*jobqueue.Job, error) {
+	dup := *j
+	if blobRef(dup.Args) != "" {
+		dup.Args = sql.NullString{}
+	}
+	return dup.ToJob()
+}
@@ -0,0 +1,161 @@
+package mysql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/olivere/jobqueue"
+)
+
+type fakeBlobStore struct {
+	blobs map[string][]byte
+}
+
+func (bs *fakeBlobStore) Put(key string, data []byte) error {
+	bs.blobs[key] = data
+	return nil
+}
+
+func (bs *fakeBlobStore) Get(key string) ([]byte, error) {
+	data, found := bs.blobs[key]
+	if !found {
+		return nil, errors.New("blob not found")
+	}
+	return data, nil
+}
+
+func (bs *fakeBlobStore) Delete(key string) error {
+	delete(bs.blobs, key)
+	return nil
+}
+
+func TestLargeArgsStore(t *testing.T) {
+	blobs := &fakeBlobStore{blobs: make(map[string][]byte)}
+	st := &Store{}
+	SetLargeArgsStore(blobs, 100)(st)
+
+	tests := []struct {
+		ID        string
+		Arg       string
+		Offloaded bool
+	}{
+		{"small", "Hello", false},
+		{"large", strings.Repeat("x", 1000), true},
+	}
+	for _, test := range tests {
+		j, err := newJob(&jobqueue.Job{ID: test.ID, Args: []interface{}{test.Arg}})
+		if err != nil {
+			t.Fatalf("newJob failed with %v", err)
+		}
+		if err := st.offloadArgs(j, ""); err != nil {
+			t.Fatalf("offloadArgs failed with %v", err)
+		}
+		_, found := blobs.blobs[test.ID]
+		if have, want := found, test.Offloaded; have != want {
+			t.Fatalf("%s: offloaded = %v, want %v", test.ID, have, want)
+		}
+		if have, want := strings.HasPrefix(j.Args.String, blobArgsPrefix), test.Offloaded; have != want {
+			t.Fatalf("%s: reference in args = %v, want %v", test.ID, have, want)
+		}
+		job, err := st.toJob(j)
+		if err != nil {
+			t.Fatalf("toJob failed with %v", err)
+		}
+		if have, want := len(job.Args), 1; have != want {
+			t.Fatalf("%s: len(Args) = %d, want %d", test.ID, have, want)
+		}
+		if have, want := job.Args[0], test.Arg; have != want {
+			t.Fatalf("%s: Args[0] = %v, want %v", test.ID, have, want)
+		}
+	}
+}
+
+func TestLargeArgsStoreUploadsChangedArgsOnly(t *testing.T) {
+	blobs := &countingBlobStore{fakeBlobStore: fakeBlobStore{blobs: make(map[string][]byte)}}
+	st := &Store{}
+	SetLargeArgsStore(blobs, 100)(st)
+
+	job := &jobqueue.Job{ID: "1", Args: []interface{}{strings.Repeat("x", 1000)}}
+	j, err := newJob(job)
+	if err != nil {
+		t.Fatalf("newJob failed with %v", err)
+	}
+	if err := st.offloadArgs(j, ""); err != nil {
+		t.Fatalf("offloadArgs failed with %v", err)
+	}
+	stored := j.Args.String
+
+	// Updates with the same arguments keep the reference
+	j, err = newJob(job)
+	if err != nil {
+		t.Fatalf("newJob failed with %v", err)
+	}
+	if err := st.offloadArgs(j, stored); err != nil {
+		t.Fatalf("offloadArgs failed with %v", err)
+	}
+	if have, want := j.Args.String, stored; have != want {
+		t.Fatalf("Args = %q, want %q", have, want)
+	}
+	if have, want := blobs.puts, 1; have != want {
+		t.Fatalf("puts = %d, want %d", have, want)
+	}
+
+	// Changed arguments are uploaded again
+	job.Args = []interface{}{strings.Repeat("y", 1000)}
+	j, err = newJob(job)
+	if err != nil {
+		t.Fatalf("newJob failed with %v", err)
+	}
+	if err := st.offloadArgs(j, stored); err != nil {
+		t.Fatalf("offloadArgs failed with %v", err)
+	}
+	if j.Args.String == stored {
+		t.Fatalf("expected a new reference, got %q", j.Args.String)
+	}
+	if have, want := blobs.puts, 2; have != want {
+		t.Fatalf("puts = %d, want %d", have, want)
+	}
+
+	// Listed jobs are not hydrated, and the row is left intact
+	listed, err := st.peekJob(j)
+	if err != nil {
+		t.Fatalf("peekJob failed with %v", err)
+	}
+	if listed.Args != nil {
+		t.Fatalf("Args = %v, want nil", listed.Args)
+	}
+	if have, want := blobs.gets, 0; have != want {
+		t.Fatalf("gets = %d, want %d", have, want)
+	}
+	found, err := st.toJob(j)
+	if err != nil {
+		t.Fatalf("toJob failed with %v", err)
+	}
+	if have, want := found.Args[0], strings.Repeat("y", 1000); have != want {
+		t.Fatalf("Args[0] = %v, want %v", have, want)
+	}
+
+	// References without a digest, written by earlier versions
+	j.Args.String = blobArgsPrefix + "1"
+	if _, err := st.toJob(j); err != nil {
+		t.Fatalf("toJob failed with %v", err)
+	}
+}
+
+// countingBlobStore counts the calls to Put and Get.
+type countingBlobStore struct {
+	fakeBlobStore
+	puts int
+	gets int
+}
+
+func (bs *countingBlobStore) Put(key string, data []byte) error {
+	bs.puts++
+	return bs.fakeBlobStore.Put(key, data)
+}
+
+func (bs *countingBlobStore) Get(key string) ([]byte, error) {
+	bs.gets++
+	return bs.fakeBlobStore.Get(key)
+}
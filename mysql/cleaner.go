@@ -0,0 +1,152 @@
+package mysql
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/olivere/jobqueue"
+)
+
+// cleanBatchSize is the max. number of jobs that Clean deletes at once,
+// so that it does not lock the table for long.
+const cleanBatchSize = 1000
+
+// SetCleaner enables cleaning up in the background: Every interval, the
+// store deletes succeeded and failed jobs that have been completed longer
+// ago than expiry. It is a shortcut for SetCleanupInterval and SetRetention
+// of both terminal states.
+func SetCleaner(interval, expiry time.Duration) StoreOption {
+	return func(s *Store) {
+		SetCleanupInterval(interval)(s)
+		SetRetention(jobqueue.Succeeded, expiry)(s)
+		SetRetention(jobqueue.Failed, expiry)(s)
+	}
+}
+
+// SetRetention specifies how long jobs in the given state are kept after
+// they have completed. Older jobs are deleted by Clean. Use it to keep e.g.
+// failed jobs longer than succeeded ones. Jobs are kept forever by default.
+//
+// Only the terminal states, i.e. jobqueue.Succeeded, jobqueue.Failed, and
+// jobqueue.Cancelled, are supported. A retention of 0 or less keeps jobs in state forever.
+func SetRetention(state string, retention time.Duration) StoreOption {
+	return func(s *Store) {
+		if s.retention == nil {
+			s.retention = make(map[string]time.Duration)
+		}
+		if retention > 0 {
+			s.retention[state] = retention
+		} else {
+			delete(s.retention, state)
+		}
+	}
+}
+
+// SetCleanupInterval specifies the interval in which the store runs Clean
+// in the background after it has been started. By default, the store does
+// not clean up on its own.
+func SetCleanupInterval(interval time.Duration) StoreOption {
+	return func(s *Store) {
+		s.cleanupInterval = interval
+	}
+}
+
+// SetResultTTL specifies how long the error, result, and log output of a
+// completed job are kept. Clean removes the LastError, Result, and
+// LogOutput of jobs that have been completed longer ago, but keeps the
+// jobs themselves until their retention (see SetRetention) is over. Use
+// it to keep the history of jobs for reporting without keeping their
+// bulky outputs. They are kept by default.
+func SetResultTTL(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.resultTTL = ttl
+	}
+}
+
+// Clean deletes all jobs that have been completed longer ago than the
+// retention configured for their state via SetRetention. It returns the
+// number of jobs deleted. If a result TTL has been configured via
+// SetResultTTL, Clean also removes the error, result, and log output of
+// jobs that have been completed longer ago than that. Finally, it removes the locks that
+// NextWithMutex has left for mutex keys that are not held any more.
+//
+// Jobs are deleted in batches, so concurrent access to the table is not
+// blocked for long. It is safe to run Clean concurrently, e.g. from
+// several processes, although running it from one is sufficient.
+func (s *Store) Clean() (int64, error) {
+	var deleted int64
+	now := time.Now()
+	if s.resultTTL > 0 {
+		err := s.jobs(s.db).
+			Where("state IN (?) AND completed < ? AND (last_error IS NOT NULL OR result IS NOT NULL OR log_output IS NOT NULL)",
+				[]string{jobqueue.Succeeded, jobqueue.Failed, jobqueue.Cancelled},
+				now.Add(-s.resultTTL).UnixNano()).
+			UpdateColumns(map[string]interface{}{
+				"last_error": gorm.Expr("NULL"),
+				"result":     gorm.Expr("NULL"),
+				"log_output": gorm.Expr("NULL"),
+			}).Error
+		if err != nil {
+			return deleted, s.wrapError(err)
+		}
+	}
+	for state, retention := range s.retention {
+		if !jobqueue.IsTerminal(state) {
+			continue
+		}
+		cutoff := now.Add(-retention).UnixNano()
+		for {
+			var ids []string
+			err := s.jobs(s.db).
+				Where("state = ? AND completed < ?", state, cutoff).
+				Limit(cleanBatchSize).
+				Pluck("id", &ids).
+				Error
+			if err != nil {
+				return deleted, s.wrapError(err)
+			}
+			if len(ids) == 0 {
+				break
+			}
+			if s.blobs != nil {
+				// Remove offloaded arguments as well
+				for _, id := range ids {
+					if err := s.blobs.Delete(id); err != nil {
+						return deleted, err
+					}
+				}
+			}
+			res := s.jobs(s.db).Where("id IN (?)", ids).Delete(&Job{})
+			if res.Error != nil {
+				return deleted, s.wrapError(res.Error)
+			}
+			deleted += res.RowsAffected
+			if len(ids) < cleanBatchSize {
+				break
+			}
+		}
+	}
+	err := s.db.Exec(s.rename(mysqlPruneLocks), jobqueue.Working).Error
+	if err != nil {
+		return deleted, s.wrapError(err)
+	}
+	return deleted, nil
+}
+
+// cleaner runs Clean periodically until the store is closed.
+func (s *Store) cleaner() {
+	defer s.cleanerWg.Done()
+	t := time.NewTicker(s.cleanupInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.Clean(); err != nil {
+				s.errorf("mysql: error cleaning up jobs: %v", err)
+			}
+		case <-s.stopClean:
+			return
+		}
+	}
+}
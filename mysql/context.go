@@ -0,0 +1,66 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ctxDB runs the queries of gorm with a context, so that they are
+// cancelled when the context is done. gorm itself does not support
+// contexts.
+type ctxDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (c ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c ctxDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// Begin starts a transaction that is rolled back when the context is
+// done before it has been committed.
+func (c ctxDB) Begin() (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, nil)
+}
+
+// BeginTx is like Begin, for versions of gorm that begin transactions
+// via BeginTx. The transaction is bound to the context of c, as gorm
+// passes context.Background().
+func (c ctxDB) BeginTx(_ context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, opts)
+}
+
+// dbContext returns a connection whose queries are cancelled when ctx
+// is done.
+func (s *Store) dbContext(ctx context.Context) *gorm.DB {
+	if ctx.Done() == nil {
+		// Never cancelled, e.g. context.Background()
+		return s.db
+	}
+	// Opening a gorm.DB on top of an existing connection pool is cheap:
+	// It neither connects nor pings the database.
+	db, err := gorm.Open("mysql", ctxDB{ctx: ctx, db: s.db.DB()})
+	if err != nil {
+		// Does not happen: There is no connection to open
+		return s.db
+	}
+	db.SetLogger(gormLogger{s})
+	if s.debug {
+		db = db.Debug()
+	}
+	return db
+}
@@ -0,0 +1,58 @@
+package mysql
+
+import (
+	"fmt"
+
+	"github.com/olivere/jobqueue"
+)
+
+// SetLogger specifies the logger of the store. It receives errors, the
+// SQL statements if SetDebug is enabled, and, if it implements
+// jobqueue.LeveledLogger, events like jobs being reclaimed. By default,
+// the store logs nothing (see jobqueue.NopLogger).
+func SetLogger(logger jobqueue.Logger) StoreOption {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// errorf reports an error via the logger of the store.
+func (s *Store) errorf(format string, v ...interface{}) {
+	if l, ok := s.logger.(jobqueue.LeveledLogger); ok {
+		l.Errorf(format, v...)
+		return
+	}
+	s.logger.Printf(format, v...)
+}
+
+// debugf reports an event via the logger of the store, if it is a
+// jobqueue.LeveledLogger.
+func (s *Store) debugf(format string, v ...interface{}) {
+	if l, ok := s.logger.(jobqueue.LeveledLogger); ok {
+		l.Debugf(format, v...)
+	}
+}
+
+// gormLogger routes the output of gorm to the logger of the store.
+type gormLogger struct {
+	s *Store
+}
+
+// Print is called by gorm with the kind of message first, followed by
+// the source location. Statements, which gorm only logs in debug mode,
+// are reported via Debugf if possible; everything else is an error.
+func (l gormLogger) Print(v ...interface{}) {
+	if len(v) >= 6 && v[0] == "sql" {
+		format, args := "mysql: %v %v [%v, %v rows]", []interface{}{v[3], v[4], v[2], v[5]}
+		if ll, ok := l.s.logger.(jobqueue.LeveledLogger); ok {
+			ll.Debugf(format, args...)
+		} else {
+			l.s.logger.Printf(format, args...)
+		}
+		return
+	}
+	if len(v) > 2 {
+		v = v[2:]
+	}
+	l.s.errorf("mysql: %s", fmt.Sprint(v...))
+}
@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordingLogger records the lines logged at each level.
+type recordingLogger struct {
+	Lines  []string
+	Debug  []string
+	Errors []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.Lines = append(l.Lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {
+	l.Debug = append(l.Debug, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {
+	l.Errors = append(l.Errors, fmt.Sprintf(format, v...))
+}
+
+// plainLogger is a jobqueue.Logger without levels.
+type plainLogger struct {
+	Lines []string
+}
+
+func (l *plainLogger) Printf(format string, v ...interface{}) {
+	l.Lines = append(l.Lines, fmt.Sprintf(format, v...))
+}
+
+func TestGormLogger(t *testing.T) {
+	leveled := &recordingLogger{}
+	st := &Store{}
+	SetLogger(leveled)(st)
+	gormLogger{st}.Print("sql", "store.go:42", 3*time.Millisecond, "SELECT * FROM jobqueue_jobs WHERE id = ?", []interface{}{"1"}, int64(1))
+	gormLogger{st}.Print("log", "store.go:42", errors.New("connection refused"))
+	if have, want := fmt.Sprint(leveled.Debug), "[mysql: SELECT * FROM jobqueue_jobs WHERE id = ? [1] [3ms, 1 rows]]"; have != want {
+		t.Fatalf("Debug = %s, want %s", have, want)
+	}
+	if have, want := fmt.Sprint(leveled.Errors), "[mysql: connection refused]"; have != want {
+		t.Fatalf("Errors = %s, want %s", have, want)
+	}
+	if have, want := len(leveled.Lines), 0; have != want {
+		t.Fatalf("len(Lines) = %d, want %d", have, want)
+	}
+
+	// Loggers without levels get everything
+	plain := &plainLogger{}
+	SetLogger(plain)(st)
+	gormLogger{st}.Print("sql", "store.go:42", 3*time.Millisecond, "SELECT 1", []interface{}{}, int64(1))
+	gormLogger{st}.Print("log", "store.go:42", errors.New("connection refused"))
+	st.debugf("mysql: reclaimed %d expired jobs", 1)
+	if have, want := len(plain.Lines), 2; have != want {
+		t.Fatalf("len(Lines) = %d, want %d: %v", have, want, plain.Lines)
+	}
+}
+
+func TestListLimitLogsOnlyExplicitLimits(t *testing.T) {
+	logger := &plainLogger{}
+	st := &Store{}
+	SetLogger(logger)(st)
+	SetMaxListLimit(20)(st)
+	tests := []struct {
+		Limit int
+		Want  int
+	}{
+		{0, 20},
+		{-1, 20},
+		{10, 10},
+		{20, 20},
+		{100, 20},
+	}
+	for i, tt := range tests {
+		if have, want := st.listLimit(tt.Limit), tt.Want; have != want {
+			t.Errorf("#%d: listLimit(%d) = %d, want %d", i, tt.Limit, have, want)
+		}
+	}
+	if have, want := fmt.Sprint(logger.Lines), "[mysql: clamping list limit of 100 to 20]"; have != want {
+		t.Fatalf("Lines = %s, want %s", have, want)
+	}
+}
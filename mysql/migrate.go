@@ -0,0 +1,84 @@
+package mysql
+
+import (
+	"fmt"
+	"time"
+)
+
+// mysqlMigrationsSchema is the table of the versions of the updates of
+// the schema that have been applied, see Store.migrate.
+const mysqlMigrationsSchema = `CREATE TABLE IF NOT EXISTS jobqueue_schema_migrations (
+version integer primary key,
+applied bigint not null);`
+
+// migrate brings the schema of the table of the jobs in database dbname
+// up to date by applying mysqlUpdates in order. Applied updates are
+// recorded in jobqueue_schema_migrations, so they are not checked again.
+// Updates of tables created before that table existed are recorded
+// without applying them again if their column or index exists.
+//
+// If SetSkipSchemaCreation is enabled, migrate does not change the schema,
+// but returns an error if it is outdated.
+func (s *Store) migrate(dbname string) error {
+	db := s.db.DB()
+	if s.skipSchema {
+		for _, u := range mysqlUpdates {
+			missing, err := u.missing(db, dbname, s.table)
+			if err != nil {
+				return err
+			}
+			if missing {
+				return fmt.Errorf("mysql: schema of database %s is outdated, see SchemaDiff", dbname)
+			}
+		}
+		return nil
+	}
+
+	if _, err := db.Exec(s.rename(mysqlMigrationsSchema)); err != nil {
+		return err
+	}
+	applied, err := s.appliedVersions()
+	if err != nil {
+		return err
+	}
+	for _, u := range mysqlUpdates {
+		if applied[u.version] {
+			continue
+		}
+		missing, err := u.missing(db, dbname, s.table)
+		if err != nil {
+			return err
+		}
+		if missing {
+			if _, err := db.Exec(s.rename(u.stmt)); err != nil {
+				// Another store may have applied the update in the meantime
+				if missing, _ := u.missing(db, dbname, s.table); missing {
+					return fmt.Errorf("mysql: error applying update %d of the schema: %v", u.version, err)
+				}
+			}
+		}
+		_, err = db.Exec(s.rename("INSERT IGNORE INTO jobqueue_schema_migrations (version, applied) VALUES (?, ?)"), u.version, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedVersions returns the versions recorded in the migrations table.
+func (s *Store) appliedVersions() (map[int]bool, error) {
+	rows, err := s.db.DB().Query(s.rename("SELECT version FROM jobqueue_schema_migrations"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
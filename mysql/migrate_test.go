@@ -0,0 +1,104 @@
+package mysql
+
+import (
+	"fmt"
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+
+	"github.com/olivere/jobqueue"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	// Versions must never be reused or reordered, as they are recorded
+	// in the databases of existing deployments
+	for i, u := range mysqlUpdates {
+		if have, want := u.version, i+1; have != want {
+			t.Fatalf("version of update #%d = %d, want %d", i, have, want)
+		}
+		if (u.column == "") == (u.index == "") {
+			t.Fatalf("update %d must specify either a column or an index", u.version)
+		}
+	}
+}
+
+func TestMigrateFromV1Schema(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	defer dropDatabase(t, testDBURL)
+
+	// Create a database with the first version of the schema
+	cfg, err := mysqldriver.ParseDSN(testDBURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbname := cfg.DBName
+	cfg.DBName = ""
+	setupdb, err := gorm.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = setupdb.DB().Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", dbname))
+	setupdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("mysql", testDBURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.DB().Exec(mysqlSchema); err != nil {
+		t.Fatalf("creating v1 schema failed with %v", err)
+	}
+	_, err = db.DB().Exec(`INSERT INTO jobqueue_jobs (id, topic, state, args, priority, retry, max_retry, created, last_mod) VALUES ('1', 'topic', 'waiting', '["Hello"]', 0, 0, 3, 1, 1)`)
+	if err != nil {
+		t.Fatalf("INSERT failed with %v", err)
+	}
+
+	// NewStore migrates to the latest version
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	stmts, err := SchemaDiff(db.DB())
+	if err != nil {
+		t.Fatalf("SchemaDiff failed with %v", err)
+	}
+	if have, want := len(stmts), 0; have != want {
+		t.Fatalf("len(SchemaDiff) = %d, want %d: %v", have, want, stmts)
+	}
+	applied, err := st.appliedVersions()
+	if err != nil {
+		t.Fatalf("appliedVersions failed with %v", err)
+	}
+	for _, u := range mysqlUpdates {
+		if !applied[u.version] {
+			t.Fatalf("update %d has not been recorded", u.version)
+		}
+	}
+
+	// The existing job is still there, and new jobs use the new columns
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := fmt.Sprint(job.Args), "[Hello]"; have != want {
+		t.Fatalf("Args = %s, want %s", have, want)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "2", Topic: "topic", UniqueKey: "key", CompletedBy: "worker"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	st.Close()
+
+	// Opening the store again applies nothing
+	st, err = NewStore(testDBURL)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	st.Close()
+}
@@ -0,0 +1,78 @@
+package mysql
+
+import (
+	"database/sql"
+	"errors"
+)
+
+const (
+	// maxArgsSize is the max. size in bytes of the args column (TEXT).
+	maxArgsSize = 1<<16 - 1
+
+	// maxResultSize is the max. size in bytes of the result column (MEDIUMBLOB).
+	maxResultSize = 1<<24 - 1
+
+	// mysqlLongColumns widens the args and result columns, see SetLongColumns.
+	mysqlLongColumns = `ALTER TABLE jobqueue_jobs MODIFY args LONGTEXT, MODIFY result LONGBLOB;`
+
+	// mysqlColumnType is the query to find out the data type of a column.
+	mysqlColumnType = `
+		SELECT DATA_TYPE
+			FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = ?
+			AND TABLE_NAME = ?
+			AND COLUMN_NAME = ?
+		`
+)
+
+var (
+	// ErrArgsTooLarge is returned when the serialized arguments of a job
+	// do not fit into the args column. Configure a store for large
+	// arguments via SetLargeArgsStore, or use SetLongColumns.
+	ErrArgsTooLarge = errors.New("mysql: job arguments exceed the size of the args column")
+
+	// ErrResultTooLarge is returned when the result of a job does not fit
+	// into the result column. Use SetLongColumns to allow larger results.
+	ErrResultTooLarge = errors.New("mysql: job result exceeds the size of the result column")
+)
+
+// SetLongColumns indicates whether to widen the args and result columns
+// to LONGTEXT and LONGBLOB, respectively, when NewStore runs. Otherwise,
+// arguments are limited to 64 KB (unless offloaded via SetLargeArgsStore)
+// and results to 16 MB. Notice that max_allowed_packet of the server
+// still limits the size of a job. SchemaDiff does not include this change.
+func SetLongColumns(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.longColumns = enabled
+	}
+}
+
+// widenColumns applies mysqlLongColumns to the given table of jobs in
+// database dbname, unless it has been applied before.
+func widenColumns(db *sql.DB, dbname, table string) error {
+	var dataType string
+	if err := db.QueryRow(mysqlColumnType, dbname, table, "args").Scan(&dataType); err != nil {
+		return err
+	}
+	if dataType == "longtext" {
+		return nil
+	}
+	_, err := db.Exec(renameTables(mysqlLongColumns, table))
+	return err
+}
+
+// checkSize returns an error if the arguments or the result of j exceed
+// the size of their columns. MySQL would silently truncate them otherwise,
+// unless it runs in strict mode.
+func (s *Store) checkSize(j *Job) error {
+	if s.longColumns {
+		return nil
+	}
+	if len(j.Args.String) > maxArgsSize {
+		return ErrArgsTooLarge
+	}
+	if len(j.Result) > maxResultSize {
+		return ErrResultTooLarge
+	}
+	return nil
+}
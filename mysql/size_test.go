@@ -0,0 +1,47 @@
+package mysql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/olivere/jobqueue"
+)
+
+func TestUpdateWithResultTooLarge(t *testing.T) {
+	// The size is checked before the store talks to the database
+	st := &Store{}
+	job := &jobqueue.Job{
+		ID:     "1",
+		Topic:  "topic",
+		State:  jobqueue.Succeeded,
+		Result: make([]byte, maxResultSize+1),
+	}
+	if err := st.Update(job); err != ErrResultTooLarge {
+		t.Fatalf("Update = %v, want %v", err, ErrResultTooLarge)
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	tests := []struct {
+		Args   string
+		Result int
+		Long   bool
+		Err    error
+	}{
+		{"Hello", 100, false, nil},
+		{strings.Repeat("x", maxArgsSize), 0, false, ErrArgsTooLarge},
+		{"Hello", maxResultSize + 1, false, ErrResultTooLarge},
+		{strings.Repeat("x", maxArgsSize), maxResultSize + 1, true, nil},
+	}
+	for i, test := range tests {
+		st := &Store{}
+		SetLongColumns(test.Long)(st)
+		j, err := newJob(&jobqueue.Job{ID: "1", Args: []interface{}{test.Args}, Result: make([]byte, test.Result)})
+		if err != nil {
+			t.Fatalf("#%d: newJob failed with %v", i, err)
+		}
+		if have, want := st.checkSize(j), test.Err; have != want {
+			t.Errorf("#%d: checkSize = %v, want %v", i, have, want)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package mysql
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 
 	"github.com/olivere/jobqueue"
@@ -36,18 +42,315 @@ index ix_jobs_started (started),
 index ix_jobs_completed (completed),
 index ix_jobs_last_mod (last_mod));`
 
+	// mysqlLocksSchema is the table of mutex keys that NextWithMutex locks
+	// to serialize concurrent claims of jobs with the same key. Clean
+	// removes the keys that are not held any more, see mysqlPruneLocks.
+	mysqlLocksSchema = `CREATE TABLE IF NOT EXISTS jobqueue_locks (
+mutex_key varchar(255) primary key,
+job_id varchar(36) not null);`
+
+	// mysqlPruneLocks removes the locks of mutex keys that no working job
+	// holds.
+	mysqlPruneLocks = `DELETE FROM jobqueue_locks WHERE NOT EXISTS (SELECT 1 FROM jobqueue_jobs j WHERE j.mutex_key = jobqueue_locks.mutex_key AND j.state = ?)`
+
 	// add rank column and index on (rank, priority)
 	mysqlUpdate001 = `ALTER TABLE jobqueue_jobs ADD rank INT NOT NULL DEFAULT '0', ADD INDEX ix_jobs_rank_priority (rank, priority);`
 
 	// add correlation_group column and index on (correlation_group, correlation_id)
 	mysqlUpdate002 = `ALTER TABLE jobqueue_jobs ADD correlation_group varchar(255), ADD INDEX ix_jobs_correlation_group_and_id (correlation_group, correlation_id);`
+
+	// add repeats and repeat_every columns for repeating jobs
+	mysqlUpdate003 = `ALTER TABLE jobqueue_jobs ADD repeats INT NOT NULL DEFAULT '0', ADD repeat_every BIGINT NOT NULL DEFAULT '0';`
+
+	// add worker_id column and index on worker_id
+	mysqlUpdate004 = `ALTER TABLE jobqueue_jobs ADD worker_id varchar(255), ADD INDEX ix_jobs_worker_id (worker_id);`
+
+	// add min_worker_version column
+	mysqlUpdate005 = `ALTER TABLE jobqueue_jobs ADD min_worker_version INT NOT NULL DEFAULT '0';`
+
+	// add sub_priority column and replace index on (rank, priority) with (rank, priority, sub_priority)
+	mysqlUpdate006 = `ALTER TABLE jobqueue_jobs ADD sub_priority BIGINT NOT NULL DEFAULT '0', DROP INDEX ix_jobs_rank_priority, ADD INDEX ix_jobs_rank_priority_sub_priority (rank, priority, sub_priority);`
+
+	// add index on (state, created) for picking jobs in FIFO order
+	mysqlUpdate007 = `ALTER TABLE jobqueue_jobs ADD INDEX ix_jobs_state_created (state, created);`
+
+	// add seq column as a monotonic sequence to order jobs with identical timestamps
+	mysqlUpdate008 = `ALTER TABLE jobqueue_jobs ADD seq BIGINT NOT NULL AUTO_INCREMENT, ADD UNIQUE INDEX ix_jobs_seq (seq);`
+
+	// add lease_token and lease_expires columns for reserving jobs via ReserveBatch
+	mysqlUpdate009 = `ALTER TABLE jobqueue_jobs ADD lease_token varchar(36), ADD lease_expires BIGINT NOT NULL DEFAULT '0', ADD INDEX ix_jobs_lease_token (lease_token);`
+
+	// add last_error column
+	mysqlUpdate010 = `ALTER TABLE jobqueue_jobs ADD last_error TEXT;`
+
+	// add callback_url column
+	mysqlUpdate011 = `ALTER TABLE jobqueue_jobs ADD callback_url TEXT;`
+
+	// add unique_key column
+	mysqlUpdate012 = `ALTER TABLE jobqueue_jobs ADD unique_key VARCHAR(255), ADD INDEX ix_jobs_unique_key (unique_key);`
+
+	// add heartbeat column and index on (state, heartbeat) for reclaiming jobs of crashed workers
+	mysqlUpdate013 = `ALTER TABLE jobqueue_jobs ADD heartbeat BIGINT NOT NULL DEFAULT '0', ADD INDEX ix_jobs_state_heartbeat (state, heartbeat);`
+
+	// add mutex_key column and index on mutex_key
+	mysqlUpdate014 = `ALTER TABLE jobqueue_jobs ADD mutex_key varchar(255), ADD INDEX ix_jobs_mutex_key (mutex_key);`
+
+	// add run_at column and index on run_at for delayed jobs
+	mysqlUpdate015 = `ALTER TABLE jobqueue_jobs ADD run_at BIGINT NOT NULL DEFAULT '0', ADD INDEX ix_jobs_run_at (run_at);`
+
+	// add claimed_at column
+	mysqlUpdate016 = `ALTER TABLE jobqueue_jobs ADD claimed_at BIGINT NOT NULL DEFAULT '0';`
+
+	// add result column
+	mysqlUpdate017 = `ALTER TABLE jobqueue_jobs ADD result MEDIUMBLOB;`
+
+	// add log_output column
+	mysqlUpdate018 = `ALTER TABLE jobqueue_jobs ADD log_output MEDIUMTEXT;`
+
+	// add timeout column
+	mysqlUpdate019 = `ALTER TABLE jobqueue_jobs ADD timeout BIGINT NOT NULL DEFAULT '0';`
+
+	// add redeliveries and max_redeliveries columns
+	mysqlUpdate020 = `ALTER TABLE jobqueue_jobs ADD redeliveries INT NOT NULL DEFAULT '0', ADD max_redeliveries INT NOT NULL DEFAULT '0';`
+
+	// add a unique index on the unique_key of waiting and working jobs,
+	// via a generated column as MySQL has no partial indexes
+	mysqlUpdate021 = `ALTER TABLE jobqueue_jobs ADD active_unique_key VARCHAR(255) AS (IF(state IN ('waiting', 'working'), unique_key, NULL)) STORED, ADD UNIQUE INDEX ix_jobs_active_unique_key (active_unique_key);`
+
+	// add completed_by column
+	mysqlUpdate022 = `ALTER TABLE jobqueue_jobs ADD completed_by varchar(255);`
+
+	// add trace_context column
+	mysqlUpdate023 = `ALTER TABLE jobqueue_jobs ADD trace_context TEXT;`
+
+	// mysqlColumnExists is the query to find out whether a column exists.
+	mysqlColumnExists = `
+		SELECT COUNT(*) AS cnt
+			FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = ?
+			AND TABLE_NAME = ?
+			AND COLUMN_NAME = ?
+		`
+
+	// mysqlIndexExists is the query to find out whether an index exists.
+	mysqlIndexExists = `
+		SELECT COUNT(*) AS cnt
+			FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = ?
+			AND TABLE_NAME = ?
+			AND INDEX_NAME = ?
+		`
+
+	// mysqlNow is the current time of the database in nanoseconds,
+	// used instead of the application's clock if SetDatabaseClock is enabled.
+	mysqlNow = `CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000000 AS SIGNED)`
+
+	// mysqlLockedColumns are the columns that UpdateContext and UpdateBatch
+	// read from the jobs they lock: the state and version of a job, and the
+	// reference to its offloaded arguments, if any (see offloadArgs).
+	mysqlLockedColumns = `state, last_mod, IF(args LIKE 'blob:%', args, NULL)`
+
+	// mysqlReserve is the statement that ReserveBatch uses to claim jobs.
+	mysqlReserve = `UPDATE jobqueue_jobs SET state = ?, lease_token = ?, lease_expires = ?, started = ?, claimed_at = ?, heartbeat = ?, last_mod = ? WHERE (state = ? AND run_at <= ?) OR (state = ? AND lease_expires > 0 AND lease_expires < ?) ORDER BY rank desc, priority desc, sub_priority desc, created asc, seq asc LIMIT ?`
+
+	// mysqlClaimedBefore is the condition for jobs that have been claimed
+	// before the given time. Jobs claimed before claimed_at existed are
+	// matched by their start time.
+	mysqlClaimedBefore = `((claimed_at > 0 AND claimed_at < ?) OR (claimed_at = 0 AND started < ?))`
+
+	// mysqlNextOrder is the order in which Next picks jobs by default.
+	mysqlNextOrder = `rank desc, priority desc, sub_priority desc, created asc, seq asc`
+
+	// mysqlNextCandidate is the query that Next uses to pick the next job
+	// in the given order, skipping the jobs vetoed by the claim gate.
+	// The first verb is the condition on excluded topics, see excludeTopics.
+	mysqlNextCandidate = `SELECT * FROM jobqueue_jobs WHERE state = ? AND run_at <= ? AND min_worker_version <= ? AND id NOT IN (?)%s ORDER BY %s LIMIT 1`
+
+	// mysqlNextWithMutex is the query that NextWithMutex uses to pick the
+	// next job whose mutex key is not held by a working job. The first verb
+	// is the condition on excluded topics, see excludeTopics.
+	mysqlNextWithMutex = `SELECT * FROM jobqueue_jobs j WHERE j.state = ? AND j.run_at <= ? AND j.min_worker_version <= ? AND (j.mutex_key IS NULL OR NOT EXISTS (SELECT 1 FROM jobqueue_jobs w WHERE w.mutex_key = j.mutex_key AND w.state = ?))%s ORDER BY %s LIMIT 1 FOR UPDATE`
+
+	// mysqlNextUpdate is the statement that Next uses to claim the next
+	// job on servers that do not support SKIP LOCKED. The first verb is the
+	// condition on excluded topics, see excludeTopics.
+	mysqlNextUpdate = `UPDATE jobqueue_jobs SET state = ?, lease_token = ?, lease_expires = 0, started = ?, claimed_at = ?, heartbeat = ?, last_mod = ?, worker_id = ? WHERE state = ? AND run_at <= ? AND min_worker_version <= ?%s ORDER BY %s LIMIT 1`
+
+	// mysqlFairOrder is prepended to the order of the jobs in fair mode,
+	// so that the correlation identifier claimed least recently goes first.
+	// The argument is the name or alias of the table of the jobs.
+	mysqlFairOrder = `(SELECT COALESCE(MAX(c.claimed_at), 0) FROM jobqueue_jobs c WHERE c.correlation_id <=> %[1]s.correlation_id) asc, `
 )
 
+// createBatchSize is the max. number of jobs that CreateBatch inserts
+// with a single statement. It keeps the number of placeholders well
+// below the limit of 65535 per statement.
+const createBatchSize = 500
+
+// mysqlBatchColumns are the columns that CreateBatch inserts besides the
+// identifier, in the order of the values. See Job.columns.
+var mysqlBatchColumns = []string{
+	"topic", "state", "args", "rank", "priority", "sub_priority", "retry", "max_retry",
+	"correlation_group", "correlation_id", "created", "started", "completed", "last_mod",
+	"repeats", "repeat_every", "worker_id", "min_worker_version", "last_error",
+	"callback_url", "unique_key", "heartbeat", "mutex_key", "run_at", "claimed_at",
+	"result", "log_output", "timeout", "redeliveries", "max_redeliveries", "completed_by",
+	"trace_context",
+}
+
+// mysqlUpdate is an update of the schema. It is applied if its version
+// has not been recorded in jobqueue_schema_migrations yet and the column
+// (or, for updates that add no column, the index) it adds is missing.
+// See Store.migrate.
+type mysqlUpdate struct {
+	version int
+	column  string
+	index   string
+	stmt    string
+}
+
+// mysqlUpdates are the updates of the schema, in the order to apply them.
+var mysqlUpdates = []mysqlUpdate{
+	{version: 1, column: "rank", stmt: mysqlUpdate001},
+	{version: 2, column: "correlation_group", stmt: mysqlUpdate002},
+	{version: 3, column: "repeats", stmt: mysqlUpdate003},
+	{version: 4, column: "worker_id", stmt: mysqlUpdate004},
+	{version: 5, column: "min_worker_version", stmt: mysqlUpdate005},
+	{version: 6, column: "sub_priority", stmt: mysqlUpdate006},
+	{version: 7, index: "ix_jobs_state_created", stmt: mysqlUpdate007},
+	{version: 8, column: "seq", stmt: mysqlUpdate008},
+	{version: 9, column: "lease_token", stmt: mysqlUpdate009},
+	{version: 10, column: "last_error", stmt: mysqlUpdate010},
+	{version: 11, column: "callback_url", stmt: mysqlUpdate011},
+	{version: 12, column: "unique_key", stmt: mysqlUpdate012},
+	{version: 13, column: "heartbeat", stmt: mysqlUpdate013},
+	{version: 14, column: "mutex_key", stmt: mysqlUpdate014},
+	{version: 15, column: "run_at", stmt: mysqlUpdate015},
+	{version: 16, column: "claimed_at", stmt: mysqlUpdate016},
+	{version: 17, column: "result", stmt: mysqlUpdate017},
+	{version: 18, column: "log_output", stmt: mysqlUpdate018},
+	{version: 19, column: "timeout", stmt: mysqlUpdate019},
+	{version: 20, column: "redeliveries", stmt: mysqlUpdate020},
+	{version: 21, column: "active_unique_key", stmt: mysqlUpdate021},
+	{version: 22, column: "completed_by", stmt: mysqlUpdate022},
+	{version: 23, column: "trace_context", stmt: mysqlUpdate023},
+}
+
+// missing returns true if the update has not been applied to the
+// given table of jobs in database dbname yet.
+func (u mysqlUpdate) missing(db *sql.DB, dbname, table string) (bool, error) {
+	qry, name := mysqlColumnExists, u.column
+	if name == "" {
+		qry, name = mysqlIndexExists, u.index
+	}
+	var count int64
+	if err := db.QueryRow(qry, dbname, table, name).Scan(&count); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// SchemaDiff returns the statements that NewStore would execute to bring
+// the schema of the jobqueue_jobs table in the current database of db up
+// to date, without executing them. Use it e.g. to review migrations before
+// deploying a new version.
+func SchemaDiff(db *sql.DB) ([]string, error) {
+	return SchemaDiffTable(db, defaultTableName)
+}
+
+// SchemaDiffTable is like SchemaDiff for a table of jobs whose name has
+// been configured via SetTableName.
+func SchemaDiffTable(db *sql.DB, table string) ([]string, error) {
+	if !tableNameRegexp.MatchString(table) {
+		return nil, fmt.Errorf("mysql: invalid table name %q", table)
+	}
+	var dbname string
+	if err := db.QueryRow("SELECT DATABASE()").Scan(&dbname); err != nil {
+		return nil, err
+	}
+	var stmts []string
+	found, err := tableExists(db, dbname, locksTableName(table))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		stmts = append(stmts, renameTables(mysqlLocksSchema, table))
+	}
+	found, err = tableExists(db, dbname, table)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// All of it
+		stmts = append(stmts, renameTables(mysqlSchema, table))
+		for _, u := range mysqlUpdates {
+			stmts = append(stmts, renameTables(u.stmt, table))
+		}
+		return stmts, nil
+	}
+	for _, u := range mysqlUpdates {
+		missing, err := u.missing(db, dbname, table)
+		if err != nil {
+			return nil, err
+		}
+		if missing {
+			stmts = append(stmts, renameTables(u.stmt, table))
+		}
+	}
+	return stmts, nil
+}
+
+// tableExists returns true if the table exists in database dbname.
+func tableExists(db *sql.DB, dbname, table string) (bool, error) {
+	var count int64
+	err := db.QueryRow(`
+		SELECT COUNT(*) AS cnt
+			FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = ?
+			AND TABLE_NAME = ?
+		`, dbname, table).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 // Store represents a persistent MySQL storage implementation.
 // It implements the jobqueue.Store interface.
 type Store struct {
 	db    *gorm.DB
 	debug bool
+
+	open            func(dialect string, args ...interface{}) (*gorm.DB, error) // opens a connection
+	connectAttempts int                                                         // number of attempts to connect in NewStore
+	connectBackoff  time.Duration                                               // time between the first and second attempt
+	tlsName         string                                                      // name of tlsConfig in the registry of the driver
+	tlsConfig       *tls.Config                                                 // TLS configuration of the connection (optional)
+	skipDatabase    bool                                                        // do not create the database
+	skipSchema      bool                                                        // do not create or update the tables
+	table           string                                                      // name of the table of the jobs, see SetTableName
+	logger          jobqueue.Logger                                             // receives errors and events, see SetLogger
+
+	blobs         jobqueue.BlobStore // keeps oversized arguments
+	blobThreshold int                // size in bytes above which arguments go to blobs
+	longColumns   bool               // use LONGTEXT and LONGBLOB for args and result
+
+	priorityFunc func(int64) int64 // normalizes priorities in Create (optional)
+
+	allowTerminalUpdates bool          // allow Update of jobs in a terminal state
+	reclaimAfter         time.Duration // min. age of working jobs that Start marks as failed (0 for all)
+	databaseClock        bool          // use the database's clock for created and last_mod
+	maxListLimit         int           // max. number of jobs returned by List (0 for no maximum)
+
+	claims     chan struct{} // limits the number of concurrent claims (nil for no limit)
+	skipLocked bool          // server supports SELECT ... FOR UPDATE SKIP LOCKED
+
+	retention       map[string]time.Duration // maps terminal states to their retention
+	resultTTL       time.Duration            // time after which Clean removes the error of completed jobs
+	cleanupInterval time.Duration            // interval for running Clean in the background
+	cleanerOnce     sync.Once
+	cleanerWg       sync.WaitGroup
+	stopClean       chan struct{}
 }
 
 // StoreOption is an options provider for Store.
@@ -55,10 +358,23 @@ type StoreOption func(*Store)
 
 // NewStore initializes a new MySQL-based storage.
 func NewStore(url string, options ...StoreOption) (*Store, error) {
-	st := &Store{}
+	st := &Store{
+		stopClean:       make(chan struct{}),
+		open:            gorm.Open,
+		connectAttempts: 1,
+		table:           defaultTableName,
+		logger:          jobqueue.NopLogger{},
+	}
 	for _, opt := range options {
 		opt(st)
 	}
+	if !tableNameRegexp.MatchString(st.table) {
+		return nil, fmt.Errorf("mysql: invalid table name %q", st.table)
+	}
+	url, err := st.registerTLSConfig(url)
+	if err != nil {
+		return nil, err
+	}
 	cfg, err := mysqldriver.ParseDSN(url)
 	if err != nil {
 		return nil, err
@@ -67,183 +383,1307 @@ func NewStore(url string, options ...StoreOption) (*Store, error) {
 	if dbname == "" {
 		return nil, errors.New("no database specified")
 	}
-	// First connect without DB name
-	cfg.DBName = ""
-	setupdb, err := gorm.Open("mysql", cfg.FormatDSN())
-	if err != nil {
-		return nil, err
+	// Connect, and create database and schema, retrying if the database
+	// is not available yet
+	backoff := st.connectBackoff
+	for attempt := 1; ; attempt++ {
+		err = st.connect(url, cfg, dbname)
+		if err == nil {
+			break
+		}
+		if attempt >= st.connectAttempts {
+			return nil, err
+		}
+		st.errorf("mysql: error connecting to database (attempt %d of %d), retrying in %v: %v", attempt, st.connectAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	// Apply updates
+	if err := st.migrate(dbname); err != nil {
+		return nil, err
+	}
+
+	if st.longColumns {
+		if err := widenColumns(st.db.DB(), dbname, st.table); err != nil {
+			return nil, err
+		}
+	}
+
+	// Claim jobs with SKIP LOCKED if the server supports it
+	var version string
+	err = st.db.DB().QueryRow("SELECT VERSION()").Scan(&version)
+	if err != nil {
+		return nil, err
+	}
+	st.skipLocked = supportsSkipLocked(version)
+
+	return st, nil
+}
+
+// supportsSkipLocked reports whether a server of the given version,
+// as returned by SELECT VERSION(), supports SKIP LOCKED. This is
+// MySQL 8.0.1 and MariaDB 10.6 and later.
+func supportsSkipLocked(version string) bool {
+	min := []int{8, 0, 1}
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		min = []int{10, 6, 0}
+	}
+	parts := strings.Split(strings.SplitN(version, "-", 2)[0], ".")
+	for i, m := range min {
+		if i >= len(parts) {
+			return false
+		}
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+		if n != m {
+			return n > m
+		}
+	}
+	return true
+}
+
+// connect connects to the database, and creates both the database and
+// the schema if necessary, unless disabled via SetSkipDatabaseCreation
+// and SetSkipSchemaCreation.
+func (s *Store) connect(url string, cfg *mysqldriver.Config, dbname string) error {
+	if !s.skipDatabase {
+		// First connect without DB name
+		setupcfg := *cfg
+		setupcfg.DBName = ""
+		setupdb, err := s.open("mysql", setupcfg.FormatDSN())
+		if err != nil {
+			return err
+		}
+		defer setupdb.Close()
+		// Create database
+		_, err = setupdb.DB().Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", dbname))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Now connect again, this time with the db name
+	db, err := s.open("mysql", url)
+	if err != nil {
+		return err
+	}
+	db.SetLogger(gormLogger{s})
+
+	if s.skipSchema {
+		// The tables must have been created before
+		for _, table := range []string{s.table, locksTableName(s.table)} {
+			found, err := tableExists(db.DB(), dbname, table)
+			if err == nil && !found {
+				err = fmt.Errorf("mysql: table %s does not exist in database %s", table, dbname)
+			}
+			if err != nil {
+				db.Close()
+				return err
+			}
+		}
+	} else {
+		// Create schema
+		_, err = db.DB().Exec(s.rename(mysqlSchema))
+		if err != nil {
+			db.Close()
+			return err
+		}
+		_, err = db.DB().Exec(s.rename(mysqlLocksSchema))
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	s.db = db
+	if s.debug {
+		s.db = s.db.Debug()
+	}
+	return nil
+}
+
+// Close stops cleaning up in the background, if enabled, and closes the
+// connection to the database. It waits for a running Clean to complete.
+func (s *Store) Close() error {
+	close(s.stopClean)
+	s.cleanerWg.Wait()
+	return s.db.Close()
+}
+
+// SetDebug indicates whether to enable or disable debugging (which will
+// output SQL to the console).
+func SetDebug(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.debug = enabled
+	}
+}
+
+// SetConnectRetry specifies how often NewStore tries to connect to the
+// database, and to create the database and schema, before it gives up.
+// This helps e.g. when the database is started at the same time as the
+// application. The time between attempts starts at backoff and doubles
+// after each attempt. NewStore gives up after the first attempt by
+// default.
+func SetConnectRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(s *Store) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		s.connectAttempts = attempts
+		s.connectBackoff = backoff
+	}
+}
+
+// SetSkipDatabaseCreation indicates whether NewStore must not create the
+// database, e.g. on managed servers where the user of the application
+// lacks the privileges to do so. NewStore then connects to the database
+// of the DSN directly, which must exist.
+func SetSkipDatabaseCreation(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.skipDatabase = enabled
+	}
+}
+
+// SetSkipSchemaCreation indicates whether NewStore must not create or
+// update the tables, e.g. because they are provisioned separately. NewStore
+// then returns an error if a table is missing or its schema is outdated.
+// Use SchemaDiff to find the statements that need to be applied.
+func SetSkipSchemaCreation(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.skipSchema = enabled
+	}
+}
+
+// SetAllowTerminalUpdates indicates whether Update may change jobs that
+// are in a terminal state already. By default, Update returns
+// jobqueue.ErrInvalidTransition for those jobs, so a job cannot be
+// finalized twice, e.g. by two managers sharing the same database.
+func SetAllowTerminalUpdates(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.allowTerminalUpdates = enabled
+	}
+}
+
+// SetDatabaseClock indicates whether to use the clock of the database
+// instead of the application's clock to timestamp jobs when they are
+// created and updated. Enable it when several workers share a database:
+// As the order of jobs partly depends on the time they were created,
+// drifting clocks of the workers would make that order unfair.
+func SetDatabaseClock(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.databaseClock = enabled
+	}
+}
+
+// SetMaxConcurrentClaims limits the number of queries that claim jobs,
+// i.e. Next and ReserveBatch, that run concurrently via this store. Use it
+// to reduce lock contention on the rows of waiting jobs when many workers
+// claim jobs at the same time, independent of how many jobs they execute
+// at the same time. Claims are not limited by default.
+func SetMaxConcurrentClaims(n int) StoreOption {
+	return func(s *Store) {
+		if n > 0 {
+			s.claims = make(chan struct{}, n)
+		} else {
+			s.claims = nil
+		}
+	}
+}
+
+// SetReclaimAfter specifies how long a job must have been working, without
+// a heartbeat in that time, before Start considers it abandoned, e.g.
+// because its manager crashed, and marks it as failed. Use it when several
+// managers share the database, so that a starting manager keeps its hands
+// off jobs that its peers are still working on. Set it to well above the
+// heartbeat interval. By default, Start marks all working jobs as failed.
+func SetReclaimAfter(d time.Duration) StoreOption {
+	return func(s *Store) {
+		s.reclaimAfter = d
+	}
+}
+
+// SetMaxListLimit specifies the maximum number of jobs that List returns,
+// regardless of the limit passed in the request. Use it to protect the
+// process from loading huge numbers of jobs into memory. A request without
+// a limit gets the maximum; a request for more jobs is logged. There is
+// no maximum by default.
+func SetMaxListLimit(n int) StoreOption {
+	return func(s *Store) {
+		s.maxListLimit = n
+	}
+}
+
+// SetPriorityRange clamps the priority of new jobs into [min, max] when
+// they are created. It protects the queue from producers that pass
+// excessive priorities, e.g. math.MaxInt64, to jump the queue.
+//
+// Notice that Manager.Add derives the priority from the time a job is
+// added, so make sure the range covers those values if jobs are added via
+// the manager.
+func SetPriorityRange(min, max int64) StoreOption {
+	return SetPriorityFunc(func(priority int64) int64 {
+		if priority < min {
+			return min
+		}
+		if priority > max {
+			return max
+		}
+		return priority
+	})
+}
+
+// SetPriorityFunc specifies a function that maps the priority of new jobs
+// when they are created, e.g. to normalize priorities of different
+// producers into a common scale. It overrides SetPriorityRange.
+func SetPriorityFunc(fn func(priority int64) int64) StoreOption {
+	return func(s *Store) {
+		s.priorityFunc = fn
+	}
+}
+
+func (s *Store) wrapError(err error) error {
+	if err == gorm.ErrRecordNotFound {
+		// Map gorm.ErrRecordNotFound to jobqueue-specific "not found" error
+		return jobqueue.ErrNotFound
+	}
+	return err
+}
+
+// Start is called when the manager starts up.
+// We ensure that stale jobs are marked as failed so that we have place
+// for new jobs (see SetReclaimAfter). If a cleanup interval is set, we
+// also start cleaning up completed jobs in the background.
+func (s *Store) Start() error {
+	if s.cleanupInterval > 0 {
+		s.cleanerOnce.Do(func() {
+			s.cleanerWg.Add(1)
+			go s.cleaner()
+		})
+	}
+
+	now := time.Now()
+	qry := s.jobs(s.db).Where("state = ?", jobqueue.Working)
+	if s.reclaimAfter > 0 {
+		// Keep the jobs that other managers are working on
+		cutoff := now.Add(-s.reclaimAfter).UnixNano()
+		qry = qry.Where("heartbeat < ?", cutoff).Where(mysqlClaimedBefore, cutoff, cutoff)
+	}
+	fields := map[string]interface{}{
+		"state":     jobqueue.Failed,
+		"completed": now.UnixNano(),
+		"last_mod":  now.UnixNano(),
+	}
+	releaseLease(fields)
+	res := qry.Updates(fields)
+	if res.Error != nil {
+		return s.wrapError(res.Error)
+	}
+	if res.RowsAffected > 0 {
+		s.debugf("mysql: marked %d stale working jobs as failed", res.RowsAffected)
+	}
+	return nil
+}
+
+// Create adds a new job to the store.
+func (s *Store) Create(job *jobqueue.Job) error {
+	return s.CreateContext(context.Background(), job)
+}
+
+// CreateContext adds a new job to the store, aborting if ctx is done.
+func (s *Store) CreateContext(ctx context.Context, job *jobqueue.Job) error {
+	db := s.dbContext(ctx)
+	if !s.databaseClock {
+		return s.create(db, job)
+	}
+	tx := db.Begin()
+	if err := s.create(tx, job); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.wrapError(tx.Commit().Error)
+}
+
+// CreateOrGet adds a new job to the store, unless there is a waiting or
+// working job with the same unique key already.
+//
+// Locking the active job with the key does not serialise concurrent calls
+// if there is none yet, so the losers of the race run into the unique
+// index or a deadlock. They look up the job of the winner then.
+func (s *Store) CreateOrGet(job *jobqueue.Job) (*jobqueue.Job, bool, error) {
+	if job.UniqueKey == "" {
+		if err := s.Create(job); err != nil {
+			return nil, false, err
+		}
+		return job, true, nil
+	}
+	for attempt := 1; ; attempt++ {
+		found, created, err := s.createOrGet(job)
+		if attempt < mysqlCreateOrGetAttempts && (err == jobqueue.ErrDuplicate || isDeadlock(err)) {
+			continue
+		}
+		return found, created, err
+	}
+}
+
+// mysqlCreateOrGetAttempts is the number of times CreateOrGet tries to
+// either add or find the job.
+const mysqlCreateOrGetAttempts = 3
+
+// isDeadlock returns true if err reports that MySQL has rolled back the
+// transaction to resolve a deadlock.
+func isDeadlock(err error) bool {
+	e, ok := err.(*mysqldriver.MySQLError)
+	return ok && e.Number == 1213
+}
+
+// createOrGet makes a single attempt of CreateOrGet.
+func (s *Store) createOrGet(job *jobqueue.Job) (*jobqueue.Job, bool, error) {
+	tx := s.db.Begin()
+	var existing Job
+	err := s.jobs(tx).Set("gorm:query_option", "FOR UPDATE").
+		Where("unique_key = ? AND state IN (?)", job.UniqueKey, []string{jobqueue.Waiting, jobqueue.Working}).
+		First(&existing).Error
+	if err == nil {
+		tx.Rollback()
+		found, err := s.toJob(&existing)
+		if err != nil {
+			return nil, false, err
+		}
+		return found, false, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil, false, s.wrapError(err)
+	}
+	if err := s.create(tx, job); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, s.wrapError(err)
+	}
+	return job, true, nil
+}
+
+// create adds a new job via db. If the database clock is used,
+// db must be a transaction.
+func (s *Store) create(db *gorm.DB, job *jobqueue.Job) error {
+	j, err := newJob(job)
+	if err != nil {
+		return err
+	}
+	if err := s.offloadArgs(j, ""); err != nil {
+		return err
+	}
+	if err := s.checkSize(j); err != nil {
+		return err
+	}
+	if s.priorityFunc != nil {
+		j.Priority = s.priorityFunc(j.Priority)
+		job.Priority = j.Priority
+	}
+	j.LastMod = j.Created
+	if err := s.jobs(db).Create(j).Error; err != nil {
+		if e, ok := err.(*mysqldriver.MySQLError); ok && e.Number == 1062 && strings.Contains(e.Message, "ix_jobs_active_unique_key") {
+			return jobqueue.ErrDuplicate
+		}
+		return s.wrapError(err)
+	}
+	if !s.databaseClock {
+		job.Updated = j.LastMod
+		return nil
+	}
+	err = s.jobs(db).Where("id = ?", j.ID).UpdateColumns(map[string]interface{}{
+		"created":  gorm.Expr(mysqlNow),
+		"last_mod": gorm.Expr(mysqlNow),
+	}).Error
+	if err != nil {
+		return s.wrapError(err)
+	}
+	err = db.Raw(s.rename("SELECT created FROM jobqueue_jobs WHERE id = ?"), j.ID).Row().Scan(&job.Created)
+	if err != nil {
+		return s.wrapError(err)
+	}
+	job.Updated = job.Created
+	return nil
+}
+
+// CreateBatch adds many jobs to the store at once, e.g. to enqueue
+// thousands of jobs without a round trip per job. The jobs are inserted
+// with multi-row INSERT statements of up to createBatchSize jobs each,
+// in a single transaction: If any job cannot be created, none is.
+//
+// Jobs without an identifier get a new one, and jobs without a state
+// are waiting. Created is set to the current time if it is zero.
+func (s *Store) CreateBatch(jobs []*jobqueue.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	list := make([]*Job, len(jobs))
+	for i, job := range jobs {
+		if job.ID == "" {
+			job.ID = uuid.New().String()
+		}
+		if job.State == "" {
+			job.State = jobqueue.Waiting
+		}
+		if job.Created == 0 {
+			job.Created = now
+		}
+		j, err := newJob(job)
+		if err != nil {
+			return err
+		}
+		if err := s.offloadArgs(j, ""); err != nil {
+			return err
+		}
+		if err := s.checkSize(j); err != nil {
+			return err
+		}
+		if s.priorityFunc != nil {
+			j.Priority = s.priorityFunc(j.Priority)
+		}
+		j.LastMod = j.Created
+		list[i] = j
+	}
+
+	tx := s.db.Begin()
+	for start := 0; start < len(list); start += createBatchSize {
+		end := start + createBatchSize
+		if end > len(list) {
+			end = len(list)
+		}
+		if err := s.insert(tx, list[start:end], false); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if s.databaseClock {
+		ids := make([]string, len(list))
+		for i, j := range list {
+			ids[i] = j.ID
+		}
+		err := s.jobs(tx).Where("id IN (?)", ids).UpdateColumns(map[string]interface{}{
+			"created":  gorm.Expr(mysqlNow),
+			"last_mod": gorm.Expr(mysqlNow),
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return s.wrapError(err)
+		}
+		var created int64
+		err = tx.Raw(s.rename("SELECT created FROM jobqueue_jobs WHERE id = ?"), ids[0]).Row().Scan(&created)
+		if err != nil {
+			tx.Rollback()
+			return s.wrapError(err)
+		}
+		for _, j := range list {
+			j.Created, j.LastMod = created, created
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return s.wrapError(err)
+	}
+	for i, job := range jobs {
+		job.Priority = list[i].Priority
+		job.Created = list[i].Created
+		job.Updated = list[i].LastMod
+	}
+	return nil
+}
+
+// insert adds jobs via db with a single multi-row INSERT statement.
+// If upsert is true, existing jobs are updated instead.
+func (s *Store) insert(db *gorm.DB, jobs []*Job, upsert bool) error {
+	var (
+		sb   strings.Builder
+		vals []interface{}
+	)
+	sb.WriteString("INSERT INTO " + s.table + " (id")
+	for _, name := range mysqlBatchColumns {
+		sb.WriteString(", `")
+		sb.WriteString(name)
+		sb.WriteString("`")
+	}
+	sb.WriteString(") VALUES ")
+	placeholders := "(?" + strings.Repeat(", ?", len(mysqlBatchColumns)) + ")"
+	for i, j := range jobs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(placeholders)
+		columns := j.columns()
+		vals = append(vals, j.ID)
+		for _, name := range mysqlBatchColumns {
+			vals = append(vals, columns[name])
+		}
+	}
+	if upsert {
+		sb.WriteString(" ON DUPLICATE KEY UPDATE ")
+		for i, name := range mysqlBatchColumns {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if name == "last_mod" && s.databaseClock {
+				sb.WriteString("last_mod = " + mysqlNow)
+				continue
+			}
+			fmt.Fprintf(&sb, "`%[1]s` = VALUES(`%[1]s`)", name)
+		}
+		// Release the lease of jobs that leave the Working state
+		sb.WriteString(", lease_token = IF(VALUES(state) = ?, lease_token, NULL)")
+		sb.WriteString(", lease_expires = IF(VALUES(state) = ?, lease_expires, 0)")
+		vals = append(vals, jobqueue.Working, jobqueue.Working)
+	}
+	if err := db.Exec(sb.String(), vals...).Error; err != nil {
+		if e, ok := err.(*mysqldriver.MySQLError); ok && e.Number == 1062 && strings.Contains(e.Message, "ix_jobs_active_unique_key") {
+			return jobqueue.ErrDuplicate
+		}
+		return s.wrapError(err)
+	}
+	return nil
+}
+
+// Update updates the job in the store.
+func (s *Store) Update(job *jobqueue.Job) error {
+	return s.UpdateContext(context.Background(), job)
+}
+
+// UpdateContext updates the job in the store, aborting if ctx is done.
+//
+// Job.Updated serves as a version: If the job has been modified in the
+// store since it has been read, e.g. by another manager, the update is
+// refused with jobqueue.ErrConflict instead of overwriting the changes.
+// A job with a zero Updated is written unconditionally.
+func (s *Store) UpdateContext(ctx context.Context, job *jobqueue.Job) error {
+	j, err := newJob(job)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSize(s.offloaded(j)); err != nil {
+		return err
+	}
+
+	tx := s.dbContext(ctx).Begin()
+	var (
+		state   string
+		lastMod int64
+		ref     sql.NullString
+	)
+	err = tx.Raw(s.rename("SELECT "+mysqlLockedColumns+" FROM jobqueue_jobs WHERE id = ? FOR UPDATE"), job.ID).Row().Scan(&state, &lastMod, &ref)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return jobqueue.ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	if jobqueue.IsTerminal(state) && !s.allowTerminalUpdates {
+		// E.g. another worker has finalized the job already
+		tx.Rollback()
+		return jobqueue.ErrInvalidTransition
+	}
+	if job.Updated != 0 && lastMod != job.Updated {
+		tx.Rollback()
+		return jobqueue.ErrConflict
+	}
+	if err := s.offloadArgs(j, ref.String); err != nil {
+		tx.Rollback()
+		return err
+	}
+	j.LastMod = time.Now().UnixNano()
+	columns := j.columns()
+	if j.State != jobqueue.Working {
+		releaseLease(columns)
+	}
+	if s.databaseClock {
+		columns["last_mod"] = gorm.Expr(mysqlNow)
+	}
+	// Do not use Save here: It would re-create a job that has been
+	// deleted in the meantime.
+	qry := s.jobs(tx).Where("id = ?", j.ID)
+	if job.Updated != 0 {
+		qry = qry.Where("last_mod = ?", job.Updated)
+	}
+	res := qry.UpdateColumns(columns)
+	if res.Error != nil {
+		tx.Rollback()
+		return s.wrapError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		if job.Updated != 0 {
+			return jobqueue.ErrConflict
+		}
+		return jobqueue.ErrNotFound
+	}
+	if s.databaseClock {
+		err = tx.Raw(s.rename("SELECT last_mod FROM jobqueue_jobs WHERE id = ?"), j.ID).Row().Scan(&j.LastMod)
+		if err != nil {
+			tx.Rollback()
+			return s.wrapError(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return s.wrapError(err)
+	}
+	job.Updated = j.LastMod
+	return nil
+}
+
+// UpdateBatch updates several jobs with a single multi-row statement,
+// e.g. the terminal updates grouped by the manager. It returns one error
+// per job. Like UpdateContext, it refuses to update jobs that have been
+// modified since they have been read. See jobqueue.BatchUpdateStore.
+func (s *Store) UpdateBatch(jobs []*jobqueue.Job) []error {
+	errs := make([]error, len(jobs))
+	var (
+		list  []*Job
+		index []int // index of the jobs in list
+		ids   []string
+	)
+	now := time.Now().UnixNano()
+	for i, job := range jobs {
+		j, err := newJob(job)
+		if err == nil {
+			err = s.checkSize(s.offloaded(j))
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		j.LastMod = now
+		list = append(list, j)
+		index = append(index, i)
+		ids = append(ids, j.ID)
+	}
+	if len(list) == 0 {
+		return errs
+	}
+	fail := func(err error) []error {
+		for _, i := range index {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+
+	tx := s.db.Begin()
+	rows, err := tx.Raw(s.rename("SELECT id, "+mysqlLockedColumns+" FROM jobqueue_jobs WHERE id IN (?) FOR UPDATE"), ids).Rows()
+	if err != nil {
+		tx.Rollback()
+		return fail(s.wrapError(err))
+	}
+	states := make(map[string]string, len(ids))
+	versions := make(map[string]int64, len(ids))
+	refs := make(map[string]string, len(ids))
+	for rows.Next() {
+		var (
+			id, state string
+			lastMod   int64
+			ref       sql.NullString
+		)
+		if err := rows.Scan(&id, &state, &lastMod, &ref); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return fail(s.wrapError(err))
+		}
+		states[id] = state
+		versions[id] = lastMod
+		refs[id] = ref.String
+	}
+	rows.Close()
+	// Only update jobs that exist, so that the statement does not
+	// re-create jobs that have been deleted in the meantime
+	var update []*Job
+	for k, j := range list {
+		state, found := states[j.ID]
+		switch {
+		case !found:
+			errs[index[k]] = jobqueue.ErrNotFound
+		case jobqueue.IsTerminal(state) && !s.allowTerminalUpdates:
+			errs[index[k]] = jobqueue.ErrInvalidTransition
+		case jobs[index[k]].Updated != 0 && versions[j.ID] != jobs[index[k]].Updated:
+			errs[index[k]] = jobqueue.ErrConflict
+		default:
+			if err := s.offloadArgs(j, refs[j.ID]); err != nil {
+				errs[index[k]] = err
+				continue
+			}
+			update = append(update, j)
+		}
+	}
+	if len(update) > 0 {
+		if err := s.insert(tx, update, true); err != nil {
+			tx.Rollback()
+			return fail(err)
+		}
+		if s.databaseClock {
+			err = tx.Raw(s.rename("SELECT last_mod FROM jobqueue_jobs WHERE id = ?"), update[0].ID).Row().Scan(&now)
+			if err != nil {
+				tx.Rollback()
+				return fail(s.wrapError(err))
+			}
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fail(s.wrapError(err))
+	}
+	for _, i := range index {
+		if errs[i] == nil {
+			jobs[i].Updated = now
+		}
+	}
+	return errs
+}
+
+// ResetRetries sets the retry counter of a waiting job back to zero.
+func (s *Store) ResetRetries(id string) error {
+	res := s.jobs(s.db).
+		Where("id = ? AND state = ?", id, jobqueue.Waiting).
+		UpdateColumns(map[string]interface{}{
+			"retry":    0,
+			"last_mod": time.Now().UnixNano(),
+		})
+	if res.Error != nil {
+		return s.wrapError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return jobqueue.ErrNotFound
+	}
+	return nil
+}
+
+// Heartbeat records that the worker is still working on the job.
+func (s *Store) Heartbeat(id string) error {
+	err := s.jobs(s.db).
+		Where("id = ? AND state = ?", id, jobqueue.Working).
+		UpdateColumn("heartbeat", time.Now().UnixNano()).
+		Error
+	return s.wrapError(err)
+}
+
+// ReclaimExpired recovers working jobs without a recent heartbeat.
+func (s *Store) ReclaimExpired(olderThan time.Duration) (int, error) {
+	now := time.Now()
+	cutoff := now.Add(-olderThan).UnixNano()
+	// Jobs reserved via ReserveBatch are kept until their lease expires
+	const expired = "state = ? AND heartbeat < ? AND lease_expires < ? AND " + mysqlClaimedBefore
+
+	tx := s.db.Begin()
+	poisoned := s.jobs(tx).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("max_redeliveries > 0 AND redeliveries >= max_redeliveries").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Failed,
+			"completed":     now.UnixNano(),
+			"last_error":    jobqueue.ErrMaxRedeliveries.Error(),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if poisoned.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(poisoned.Error)
+	}
+	failed := s.jobs(tx).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("retry >= max_retry").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Failed,
+			"completed":     now.UnixNano(),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if failed.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(failed.Error)
+	}
+	retried := s.jobs(tx).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("retry < max_retry").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Waiting,
+			"retry":         gorm.Expr("retry + 1"),
+			"redeliveries":  gorm.Expr("redeliveries + 1"),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if retried.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(retried.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, s.wrapError(err)
+	}
+	n := poisoned.RowsAffected + failed.RowsAffected + retried.RowsAffected
+	if n > 0 {
+		s.debugf("mysql: reclaimed %d expired jobs: %d retried, %d failed, %d exceeded their max. redeliveries",
+			n, retried.RowsAffected, failed.RowsAffected, poisoned.RowsAffected)
+	}
+	return int(n), nil
+}
+
+// CompareAndSetState changes the state of a job if it is currently in
+// the from state.
+func (s *Store) CompareAndSetState(id, from, to string) (bool, error) {
+	fields := map[string]interface{}{
+		"state":    to,
+		"last_mod": time.Now().UnixNano(),
+	}
+	if to != jobqueue.Working {
+		releaseLease(fields)
 	}
-	defer setupdb.Close()
-	// Create database
-	_, err = setupdb.DB().Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", dbname))
-	if err != nil {
-		return nil, err
+	res := s.jobs(s.db).
+		Where("id = ? AND state = ?", id, from).
+		UpdateColumns(fields)
+	if res.Error != nil {
+		return false, s.wrapError(res.Error)
 	}
+	return res.RowsAffected > 0, nil
+}
 
-	// Now connect again, this time with the db name
-	st.db, err = gorm.Open("mysql", url)
-	if err != nil {
-		return nil, err
+// RenameTopic moves the jobs of a topic to another topic, e.g. when a
+// topic gets renamed. If states are given, only the jobs in one of them
+// are moved, e.g. jobqueue.Waiting to leave the history alone. Do not
+// move working jobs while a manager works on jobs of the topic: A working
+// job is saved with its old topic when it completes.
+func (s *Store) RenameTopic(from, to string, states ...string) (int64, error) {
+	qry := s.jobs(s.db).Where("topic = ?", from)
+	if len(states) > 0 {
+		qry = qry.Where("state IN (?)", states)
 	}
-	if st.debug {
-		st.db = st.db.Debug()
+	res := qry.UpdateColumns(map[string]interface{}{
+		"topic":    to,
+		"last_mod": time.Now().UnixNano(),
+	})
+	if res.Error != nil {
+		return 0, s.wrapError(res.Error)
 	}
+	return res.RowsAffected, nil
+}
 
-	// Create schema
-	_, err = st.db.DB().Exec(mysqlSchema)
+// ReserveBatch claims up to n jobs and leases them for the given duration.
+// The jobs are claimed in a single UPDATE, so concurrent calls never
+// return the same job.
+func (s *Store) ReserveBatch(n int, lease time.Duration) ([]*jobqueue.ReservedJob, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	defer s.claim()()
+	token := uuid.New().String()
+	now := time.Now()
+	expires := now.Add(lease)
+	err := s.db.Exec(s.rename(mysqlReserve),
+		jobqueue.Working, token, expires.UnixNano(), now.UnixNano(), now.UnixNano(), now.UnixNano(), now.UnixNano(),
+		jobqueue.Waiting, now.UnixNano(), jobqueue.Working, now.UnixNano(), n).Error
 	if err != nil {
-		return nil, err
+		return nil, s.wrapError(err)
 	}
-
-	// Apply update 001
-	var count int64
-	err = st.db.DB().QueryRow(`
-	SELECT COUNT(*) AS cnt
-		FROM information_schema.COLUMNS
-		WHERE TABLE_SCHEMA = ?
-		AND TABLE_NAME = 'jobqueue_jobs'
-		AND COLUMN_NAME = 'rank'
-	`, dbname).Scan(&count)
+	var list []*Job
+	err = s.jobs(s.db).Where("lease_token = ?", token).
+		Order("rank desc, priority desc, sub_priority desc, created asc, seq asc").
+		Find(&list).
+		Error
 	if err != nil {
-		return nil, err
+		return nil, s.wrapError(err)
 	}
-	if count == 0 {
-		// Apply migration
-		_, err = st.db.DB().Exec(mysqlUpdate001)
+	var reserved []*jobqueue.ReservedJob
+	for _, j := range list {
+		job, err := s.toJob(j)
 		if err != nil {
-			return nil, err
+			return nil, s.wrapError(err)
 		}
+		reserved = append(reserved, &jobqueue.ReservedJob{Job: job, Token: token, LeaseExpires: expires})
 	}
+	return reserved, nil
+}
 
-	// Apply update 002
-	err = st.db.DB().QueryRow(`
-		SELECT COUNT(*) AS cnt
-			FROM information_schema.COLUMNS
-			WHERE TABLE_SCHEMA = ?
-			AND TABLE_NAME = 'jobqueue_jobs'
-			AND COLUMN_NAME = 'correlation_group'
-		`, dbname).Scan(&count)
+// FailAndRetry records a failed attempt of a working job, and either
+// retries it after delay or moves it into the Failed state.
+func (s *Store) FailAndRetry(id string, delay time.Duration, errMsg string) error {
+	tx := s.db.Begin()
+	var j Job
+	err := s.jobs(tx).Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).First(&j).Error
 	if err != nil {
-		return nil, err
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	if j.State != jobqueue.Working {
+		tx.Rollback()
+		return jobqueue.ErrInvalidTransition
 	}
-	if count == 0 {
-		// Apply migration
-		_, err = st.db.DB().Exec(mysqlUpdate002)
+	now := time.Now()
+	fields := map[string]interface{}{
+		"last_error": errMsg,
+		"last_mod":   now.UnixNano(),
+	}
+	releaseLease(fields)
+	if j.Retry >= j.MaxRetry {
+		fields["state"] = jobqueue.Failed
+		fields["completed"] = now.UnixNano()
+	} else {
+		fields["state"] = jobqueue.Waiting
+		fields["retry"] = j.Retry + 1
+		runAt := now.Add(delay).UnixNano()
+		fields["run_at"] = runAt
+		fields["priority"] = -runAt
+	}
+	err = s.jobs(tx).Where("id = ?", id).UpdateColumns(fields).Error
+	if err != nil {
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	return s.wrapError(tx.Commit().Error)
+}
+
+// ImportTerminal adds jobs that are in a terminal state already,
+// in a single transaction.
+func (s *Store) ImportTerminal(jobs []*jobqueue.Job) error {
+	var list []*Job
+	for _, job := range jobs {
+		if !jobqueue.IsTerminal(job.State) {
+			return fmt.Errorf("mysql: cannot import job %s in state %s", job.ID, job.State)
+		}
+		j, err := newJob(job)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := s.offloadArgs(j, ""); err != nil {
+			return err
+		}
+		if err := s.checkSize(j); err != nil {
+			return err
+		}
+		if j.LastMod == 0 {
+			j.LastMod = j.Completed
+		}
+		list = append(list, j)
+	}
+	tx := s.db.Begin()
+	for _, j := range list {
+		if err := s.jobs(tx).Create(j).Error; err != nil {
+			tx.Rollback()
+			return s.wrapError(err)
 		}
 	}
+	return s.wrapError(tx.Commit().Error)
+}
 
-	return st, nil
+// Next claims the next job to execute, or nil if no executable job is available.
+//
+// The job is selected with FOR UPDATE SKIP LOCKED and moved into the
+// Working state in the same transaction, so concurrent calls skip it.
+// On servers without SKIP LOCKED, it is claimed with a single UPDATE
+// instead, and read back by a unique token. If the request has a claim
+// gate, the job is selected first and then claimed only if it is still
+// waiting.
+func (s *Store) Next(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	return s.NextContext(context.Background(), req)
 }
 
-// SetDebug indicates whether to enable or disable debugging (which will
-// output SQL to the console).
-func SetDebug(enabled bool) StoreOption {
-	return func(s *Store) {
-		s.debug = enabled
+// NextContext claims the next job to execute like Next, aborting if ctx
+// is done.
+func (s *Store) NextContext(ctx context.Context, req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	defer s.claim()()
+	order := mysqlNextOrder
+	switch {
+	case req.FIFO:
+		order = "created asc, seq asc"
+	case req.LIFO:
+		order = "created desc, seq desc"
+	}
+	if req.Fair {
+		order = fmt.Sprintf(mysqlFairOrder, "jobqueue_jobs") + order
+	}
+	db := s.dbContext(ctx)
+	if !s.skipLocked {
+		// MySQL cannot refer to the updated table in the ORDER BY of an
+		// UPDATE, so jobs are picked before claiming them in fair mode
+		if req.Gate != nil || req.Fair {
+			return s.nextGated(db, req, order)
+		}
+		return s.nextByUpdate(db, req, order)
 	}
-}
 
-/*
-func SetCleaner(interval, expiry time.Duration) StoreOption {
-	return func(s *Store) {
-		s.interval = interval
-		s.expiry = expiry
+	tx := db.Begin()
+	rejected := []string{""} // jobs vetoed by req.Gate; never empty for NOT IN
+	var j Job
+	for {
+		j = Job{}
+		cond, args := excludeTopics(req, "jobqueue_jobs", jobqueue.Waiting, time.Now().UnixNano(), req.WorkerVersion, rejected)
+		err := tx.Raw(s.rename(fmt.Sprintf(mysqlNextCandidate, cond, order))+" FOR UPDATE SKIP LOCKED", args...).Scan(&j).Error
+		if err == gorm.ErrRecordNotFound {
+			tx.Rollback()
+			return nil, jobqueue.ErrNotFound
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		ok, err := s.gate(req, &j)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		rejected = append(rejected, j.ID)
+	}
+	now := time.Now().UnixNano()
+	j.State = jobqueue.Working
+	j.Started = now
+	j.ClaimedAt = now
+	j.Heartbeat = now
+	j.LastMod = now
+	j.WorkerID = claimedBy(req)
+	err := s.jobs(tx).Where("id = ?", j.ID).UpdateColumns(map[string]interface{}{
+		"state":         j.State,
+		"started":       j.Started,
+		"claimed_at":    j.ClaimedAt,
+		"heartbeat":     j.Heartbeat,
+		"last_mod":      j.LastMod,
+		"worker_id":     j.WorkerID,
+		"lease_token":   nil,
+		"lease_expires": 0,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, s.wrapError(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, s.wrapError(err)
 	}
+	return s.toJob(&j)
 }
-*/
 
-func (s *Store) wrapError(err error) error {
-	if err == gorm.ErrRecordNotFound {
-		// Map gorm.ErrRecordNotFound to jobqueue-specific "not found" error
-		return jobqueue.ErrNotFound
+// nextByUpdate claims the next job with a single UPDATE, for servers
+// without SKIP LOCKED.
+func (s *Store) nextByUpdate(db *gorm.DB, req *jobqueue.NextRequest, order string) (*jobqueue.Job, error) {
+	now := time.Now().UnixNano()
+	token := uuid.New().String()
+	cond, args := excludeTopics(req, "jobqueue_jobs",
+		jobqueue.Working, token, now, now, now, now, claimedBy(req),
+		jobqueue.Waiting, now, req.WorkerVersion)
+	res := db.Exec(s.rename(fmt.Sprintf(mysqlNextUpdate, cond, order)), args...)
+	if res.Error != nil {
+		return nil, s.wrapError(res.Error)
 	}
-	return err
+	if res.RowsAffected == 0 {
+		return nil, jobqueue.ErrNotFound
+	}
+	var j Job
+	err := s.jobs(db).Where("lease_token = ?", token).First(&j).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	return s.toJob(&j)
 }
 
-// Start is called when the manager starts up.
-// We ensure that stale jobs are marked as failed so that we have place
-// for new jobs.
-func (s *Store) Start() error {
-	// TODO This will fail if we have two or more job queues working on the same database!
-	err := s.db.Model(&Job{}).
-		Where("state = ?", jobqueue.Working).
-		Updates(map[string]interface{}{
-			"state":     jobqueue.Failed,
-			"completed": time.Now().UnixNano(),
-		}).
-		Error
-	return s.wrapError(err)
+// nextGated picks the next job that passes the claim gate and claims it
+// if it is still waiting, for servers without SKIP LOCKED. It is also used
+// in fair mode.
+func (s *Store) nextGated(db *gorm.DB, req *jobqueue.NextRequest, order string) (*jobqueue.Job, error) {
+	rejected := []string{""} // jobs vetoed by req.Gate; never empty for NOT IN
+	for {
+		var j Job
+		cond, args := excludeTopics(req, "jobqueue_jobs", jobqueue.Waiting, time.Now().UnixNano(), req.WorkerVersion, rejected)
+		err := db.Raw(s.rename(fmt.Sprintf(mysqlNextCandidate, cond, order)), args...).Scan(&j).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil, jobqueue.ErrNotFound
+		}
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		ok, err := s.gate(req, &j)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rejected = append(rejected, j.ID)
+			continue
+		}
+		now := time.Now().UnixNano()
+		res := s.jobs(db).
+			Where("id = ? AND state = ?", j.ID, jobqueue.Waiting).
+			UpdateColumns(map[string]interface{}{
+				"state":         jobqueue.Working,
+				"started":       now,
+				"claimed_at":    now,
+				"heartbeat":     now,
+				"last_mod":      now,
+				"worker_id":     claimedBy(req),
+				"lease_token":   nil,
+				"lease_expires": 0,
+			})
+		if res.Error != nil {
+			return nil, s.wrapError(res.Error)
+		}
+		if res.RowsAffected == 0 {
+			// Someone else has claimed the job in the meantime
+			continue
+		}
+		j.State = jobqueue.Working
+		j.Started = now
+		j.ClaimedAt = now
+		j.Heartbeat = now
+		j.LastMod = now
+		j.WorkerID = claimedBy(req)
+		return s.toJob(&j)
+	}
 }
 
-// Create adds a new job to the store.
-func (s *Store) Create(job *jobqueue.Job) error {
-	j, err := newJob(job)
-	if err != nil {
-		return err
+// excludeTopics returns the condition that filters out the jobs of the
+// topics excluded by req, for the table with the given name or alias, and
+// the arguments of the query including the ones of the condition.
+func excludeTopics(req *jobqueue.NextRequest, table string, args ...interface{}) (string, []interface{}) {
+	if len(req.ExcludeTopics) == 0 {
+		return "", args
 	}
-	j.LastMod = j.Created
-	return s.wrapError(s.db.Create(j).Error)
+	return fmt.Sprintf(" AND %s.topic NOT IN (?)", table), append(args, req.ExcludeTopics)
 }
 
-// Update updates the job in the store.
-func (s *Store) Update(job *jobqueue.Job) error {
-	j, err := newJob(job)
+// gate asks the claim gate of the request, if any, whether j may be claimed.
+func (s *Store) gate(req *jobqueue.NextRequest, j *Job) (bool, error) {
+	if req.Gate == nil {
+		return true, nil
+	}
+	// The gate must be fast, so do not fetch offloaded arguments
+	job, err := s.peekJob(j)
 	if err != nil {
-		return err
+		return false, s.wrapError(err)
 	}
+	return req.Gate(job)
+}
 
+// NextWithMutex claims the next job to execute whose mutex key is not
+// held by another working job.
+func (s *Store) NextWithMutex(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	defer s.claim()()
+	order := "j.rank desc, j.priority desc, j.sub_priority desc, j.created asc, j.seq asc"
+	switch {
+	case req.FIFO:
+		order = "j.created asc, j.seq asc"
+	case req.LIFO:
+		order = "j.created desc, j.seq desc"
+	}
+	if req.Fair {
+		order = fmt.Sprintf(mysqlFairOrder, "j") + order
+	}
 	tx := s.db.Begin()
-	var ids []string
-	err = tx.Raw("SELECT id FROM jobqueue_jobs WHERE id = ? AND last_mod = ? FOR UPDATE", job.ID, job.Updated).
-		Scan(&ids).
-		Error
+	var j Job
+	cond, args := excludeTopics(req, "j", jobqueue.Waiting, time.Now().UnixNano(), req.WorkerVersion, jobqueue.Working)
+	err := tx.Raw(s.rename(fmt.Sprintf(mysqlNextWithMutex, cond, order)), args...).Scan(&j).Error
+	if err == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil, jobqueue.ErrNotFound
+	}
 	if err != nil {
 		tx.Rollback()
-		return s.wrapError(err)
+		return nil, s.wrapError(err)
 	}
-	j.LastMod = time.Now().UnixNano()
-	if err := tx.Save(&j).Error; err != nil {
+	if j.MutexKey.Valid {
+		// Lock the key, so concurrent claims of the key wait for us
+		err = tx.Exec(s.rename(`INSERT INTO jobqueue_locks (mutex_key, job_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE job_id = VALUES(job_id)`), j.MutexKey.String, j.ID).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		// Make sure no one else has claimed a job with the key in the meantime
+		var count int64
+		err = tx.Raw(s.rename(`SELECT COUNT(*) FROM jobqueue_jobs WHERE mutex_key = ? AND state = ? FOR UPDATE`), j.MutexKey.String, jobqueue.Working).Row().Scan(&count)
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		if count > 0 {
+			tx.Rollback()
+			return nil, jobqueue.ErrNotFound
+		}
+	}
+	now := time.Now().UnixNano()
+	j.State = jobqueue.Working
+	j.Started = now
+	j.ClaimedAt = now
+	j.Heartbeat = now
+	j.LastMod = now
+	j.WorkerID = claimedBy(req)
+	err = s.jobs(tx).Where("id = ?", j.ID).UpdateColumns(map[string]interface{}{
+		"state":         j.State,
+		"started":       j.Started,
+		"claimed_at":    j.ClaimedAt,
+		"heartbeat":     j.Heartbeat,
+		"last_mod":      j.LastMod,
+		"worker_id":     j.WorkerID,
+		"lease_token":   nil,
+		"lease_expires": 0,
+	}).Error
+	if err != nil {
 		tx.Rollback()
-		return s.wrapError(err)
+		return nil, s.wrapError(err)
 	}
 	if err := tx.Commit().Error; err != nil {
-		return s.wrapError(err)
+		return nil, s.wrapError(err)
 	}
-	job.Updated = j.LastMod
-	return nil
+	return s.toJob(&j)
 }
 
-// Next picks the next job to execute, or nil if no executable job is available.
-func (s *Store) Next() (*jobqueue.Job, error) {
-	var j Job
-	err := s.db.Where("state = ?", jobqueue.Waiting).
-		Order("rank desc, priority desc").
-		First(&j).
-		Error
-	if err == gorm.ErrRecordNotFound {
-		return nil, jobqueue.ErrNotFound
-	}
-	if err != nil {
-		return nil, s.wrapError(err)
+// claimedBy returns the worker_id to store for a job claimed by req.
+func claimedBy(req *jobqueue.NextRequest) sql.NullString {
+	return sql.NullString{String: req.WorkerID, Valid: req.WorkerID != ""}
+}
+
+// claim waits until another query that claims jobs may run, according
+// to SetMaxConcurrentClaims. It returns a function to call when the query
+// has completed.
+func (s *Store) claim() (release func()) {
+	if s.claims == nil {
+		return func() {}
 	}
-	return j.ToJob()
+	s.claims <- struct{}{}
+	return func() { <-s.claims }
 }
 
 // Delete removes a job from the store.
 func (s *Store) Delete(job *jobqueue.Job) error {
-	return s.wrapError(s.db.Where("id = ?", job.ID).Delete(&Job{}).Error)
+	return s.DeleteContext(context.Background(), job)
+}
+
+// DeleteContext removes a job from the store, aborting if ctx is done.
+func (s *Store) DeleteContext(ctx context.Context, job *jobqueue.Job) error {
+	err := s.jobs(s.dbContext(ctx)).Where("id = ?", job.ID).Delete(&Job{}).Error
+	if err != nil {
+		return s.wrapError(err)
+	}
+	if s.blobs != nil {
+		return s.blobs.Delete(job.ID)
+	}
+	return nil
 }
 
 // Lookup retrieves a single job in the store by its identifier.
 func (s *Store) Lookup(id string) (*jobqueue.Job, error) {
+	return s.LookupContext(context.Background(), id)
+}
+
+// LookupContext retrieves a single job in the store by its identifier,
+// aborting if ctx is done.
+func (s *Store) LookupContext(ctx context.Context, id string) (*jobqueue.Job, error) {
 	var j Job
-	err := s.db.Where("id = ?", id).First(&j).Error
+	err := s.jobs(s.dbContext(ctx)).Where("id = ?", id).First(&j).Error
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
-	job, err := j.ToJob()
+	job, err := s.toJob(&j)
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
@@ -254,13 +1694,13 @@ func (s *Store) Lookup(id string) (*jobqueue.Job, error) {
 // If no such job could be found, an empty array is returned.
 func (s *Store) LookupByCorrelationID(correlationID string) ([]*jobqueue.Job, error) {
 	var jobs []Job
-	err := s.db.Where("correlation_id = ?", correlationID).Find(&jobs).Error
+	err := s.jobs(s.db).Where("correlation_id = ?", correlationID).Find(&jobs).Error
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
 	result := make([]*jobqueue.Job, len(jobs))
-	for i, j := range jobs {
-		job, err := j.ToJob()
+	for i := range jobs {
+		job, err := s.toJob(&jobs[i])
 		if err != nil {
 			return nil, s.wrapError(err)
 		}
@@ -269,12 +1709,8 @@ func (s *Store) LookupByCorrelationID(correlationID string) ([]*jobqueue.Job, er
 	return result, nil
 }
 
-// List returns a list of all jobs stored in the data store.
-func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
-	rsp := &jobqueue.ListResponse{}
-
-	// Count
-	qry := s.db.Model(&Job{})
+// filter applies the filters of the ListRequest to qry.
+func (s *Store) filter(qry *gorm.DB, request *jobqueue.ListRequest) *gorm.DB {
 	if request.Topic != "" {
 		qry = qry.Where("topic = ?", request.Topic)
 	}
@@ -287,34 +1723,56 @@ func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, err
 	if request.CorrelationID != "" {
 		qry = qry.Where("correlation_id = ?", request.CorrelationID)
 	}
-	err := qry.Count(&rsp.Total).Error
+	if request.CreatedAfter > 0 {
+		qry = qry.Where("created > ?", request.CreatedAfter)
+	}
+	if request.CreatedBefore > 0 {
+		qry = qry.Where("created < ?", request.CreatedBefore)
+	}
+	return qry
+}
+
+// listLimit returns the number of jobs that List returns at most for the
+// given limit, taking the maximum set via SetMaxListLimit into account.
+func (s *Store) listLimit(limit int) int {
+	if s.maxListLimit <= 0 || (limit > 0 && limit <= s.maxListLimit) {
+		return limit
+	}
+	if limit > 0 {
+		// Only report limits that have been asked for explicitly
+		s.logger.Printf("mysql: clamping list limit of %d to %d", limit, s.maxListLimit)
+	}
+	return s.maxListLimit
+}
+
+// List returns a list of all jobs stored in the data store.
+func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
+	return s.ListContext(context.Background(), request)
+}
+
+// ListContext returns a list of all jobs stored in the data store,
+// aborting if ctx is done.
+func (s *Store) ListContext(ctx context.Context, request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
+	rsp := &jobqueue.ListResponse{}
+	db := s.dbContext(ctx)
+
+	// Count
+	err := s.filter(s.jobs(db), request).Count(&rsp.Total).Error
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
 
 	// Find
-	qry = s.db.Order("last_mod desc").
+	qry := s.jobs(db).Order("last_mod desc, seq desc").
 		Offset(request.Offset).
-		Limit(request.Limit)
-	if request.Topic != "" {
-		qry = qry.Where("topic = ?", request.Topic)
-	}
-	if request.State != "" {
-		qry = qry.Where("state = ?", request.State)
-	}
-	if request.CorrelationGroup != "" {
-		qry = qry.Where("correlation_group = ?", request.CorrelationGroup)
-	}
-	if request.CorrelationID != "" {
-		qry = qry.Where("correlation_id = ?", request.CorrelationID)
-	}
+		Limit(s.listLimit(request.Limit))
 	var list []*Job
-	err = qry.Find(&list).Error
+	err = s.filter(qry, request).Find(&list).Error
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
 	for _, j := range list {
-		job, err := j.ToJob()
+		job, err := s.peekJob(j)
 		if err != nil {
 			return nil, s.wrapError(err)
 		}
@@ -325,9 +1783,16 @@ func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, err
 
 // Stats returns statistics about the jobs in the store.
 func (s *Store) Stats(req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
+	return s.StatsContext(context.Background(), req)
+}
+
+// StatsContext returns statistics about the jobs in the store, aborting
+// if ctx is done.
+func (s *Store) StatsContext(ctx context.Context, req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
 	stats := new(jobqueue.Stats)
+	db := s.dbContext(ctx)
 	buildFilter := func(state string) *gorm.DB {
-		f := s.db.Model(&Job{}).Where("state = ?", state)
+		f := s.jobs(db).Where("state = ?", state)
 		if req.Topic != "" {
 			f = f.Where("topic = ?", req.Topic)
 		}
@@ -352,9 +1817,176 @@ func (s *Store) Stats(req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
 	if err != nil {
 		return nil, s.wrapError(err)
 	}
+	err = buildFilter(jobqueue.Cancelled).Count(&stats.Cancelled).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
 	return stats, nil
 }
 
+// StatsByTopic returns statistics about the jobs in the store, grouped
+// by topic. It implements jobqueue.TopicStatsStore.
+func (s *Store) StatsByTopic() (map[string]*jobqueue.Stats, error) {
+	rows, err := s.db.Raw(s.rename("SELECT topic, state, COUNT(*) FROM jobqueue_jobs GROUP BY topic, state")).Rows()
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	defer rows.Close()
+	result := make(map[string]*jobqueue.Stats)
+	for rows.Next() {
+		var topic, state string
+		var count int
+		if err := rows.Scan(&topic, &state, &count); err != nil {
+			return nil, s.wrapError(err)
+		}
+		stats, found := result[topic]
+		if !found {
+			stats = new(jobqueue.Stats)
+			result[topic] = stats
+		}
+		switch state {
+		case jobqueue.Waiting:
+			stats.Waiting = count
+		case jobqueue.Working:
+			stats.Working = count
+		case jobqueue.Succeeded:
+			stats.Succeeded = count
+		case jobqueue.Failed:
+			stats.Failed = count
+		case jobqueue.Cancelled:
+			stats.Cancelled = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.wrapError(err)
+	}
+	return result, nil
+}
+
+// Throughput returns the number of jobs completed per second within the
+// last window, e.g. to show a live rate on a dashboard. Both succeeded and
+// failed jobs count as completed.
+func (s *Store) Throughput(window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, errors.New("mysql: window must be positive")
+	}
+	now := time.Now()
+	var count int64
+	err := s.jobs(s.db).
+		Where("completed >= ? AND completed <= ?", now.Add(-window).UnixNano(), now.UnixNano()).
+		Count(&count).
+		Error
+	if err != nil {
+		return 0, s.wrapError(err)
+	}
+	return float64(count) / window.Seconds(), nil
+}
+
+// BulkSetPriority sets the priority of all waiting jobs that match the
+// filter in request. Offset and Limit of the request are ignored. It
+// returns the number of jobs updated. Use it e.g. to deprioritize the
+// backlog of a noisy topic.
+func (s *Store) BulkSetPriority(request *jobqueue.ListRequest, priority int64) (int64, error) {
+	qry := s.filter(s.jobs(s.db), request).
+		Where("state = ?", jobqueue.Waiting)
+	res := qry.Update("priority", priority)
+	if res.Error != nil {
+		return 0, s.wrapError(res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+// Reassign hands over all jobs in the Working state that were claimed by
+// the worker fromWorker to the worker toWorker. It returns the number of
+// jobs that have been reassigned. Use it to scale in gracefully, i.e.
+// without failing or re-executing the jobs of the worker that goes away.
+//
+// Reassign only changes the jobs in the store: toWorker must look them up
+// again, e.g. via List, send their heartbeats, and complete them. The
+// manager of fromWorker, if it is still running, keeps executing the jobs
+// it holds in memory. As Reassign bumps their modification time, its
+// updates of the jobs fail with jobqueue.ErrConflict, i.e. it cannot
+// complete them anymore, and their executions are wasted. Stop that
+// manager before calling Reassign.
+func (s *Store) Reassign(fromWorker, toWorker string) (int64, error) {
+	res := s.jobs(s.db).
+		Where("state = ? AND worker_id = ?", jobqueue.Working, fromWorker).
+		UpdateColumns(map[string]interface{}{
+			"worker_id": toWorker,
+			"last_mod":  time.Now().UnixNano(),
+		})
+	if res.Error != nil {
+		return 0, s.wrapError(res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+// ExplainNext runs EXPLAIN on the query that Next uses to pick the next
+// job and returns the resulting plan as text, one line per row. Use it to
+// check that the query uses an index at the size of your data.
+func (s *Store) ExplainNext() (string, error) {
+	rows, err := s.db.DB().Query("EXPLAIN "+s.rename(fmt.Sprintf(mysqlNextCandidate, "", mysqlNextOrder)), jobqueue.Waiting, time.Now().UnixNano(), 0, "")
+	if err != nil {
+		return "", s.wrapError(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", s.wrapError(err)
+	}
+	var plan []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", s.wrapError(err)
+		}
+		fields := make([]string, len(cols))
+		for i, col := range cols {
+			if values[i].Valid {
+				fields[i] = col + "=" + values[i].String
+			} else {
+				fields[i] = col + "=NULL"
+			}
+		}
+		plan = append(plan, strings.Join(fields, " "))
+	}
+	if err := rows.Err(); err != nil {
+		return "", s.wrapError(err)
+	}
+	return strings.Join(plan, "\n"), nil
+}
+
+// Optimize runs OPTIMIZE TABLE on the jobs table. It reclaims the space
+// left behind by deleted jobs and refreshes the index statistics used by
+// the query planner. Operators can call it on a schedule, e.g. nightly.
+//
+// Notice that InnoDB implements OPTIMIZE TABLE as a table rebuild followed
+// by ANALYZE TABLE. The rebuild runs as online DDL, but it takes a short
+// exclusive metadata lock at the beginning and at the end, so concurrent
+// workers may briefly block on Create, Update, and Next. On large tables,
+// run it when the queue is not busy.
+func (s *Store) Optimize() error {
+	rows, err := s.db.DB().Query("OPTIMIZE TABLE " + s.table)
+	if err != nil {
+		return s.wrapError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, op, msgType, msgText string
+		if err := rows.Scan(&table, &op, &msgType, &msgText); err != nil {
+			return s.wrapError(err)
+		}
+		if msgType == "error" {
+			return fmt.Errorf("mysql: optimize %s failed: %s", table, msgText)
+		}
+	}
+	return s.wrapError(rows.Err())
+}
+
 // -- MySQL-internal representation of a task --
 
 type Job struct {
@@ -364,6 +1996,7 @@ type Job struct {
 	Args             sql.NullString
 	Rank             int
 	Priority         int64
+	SubPriority      int64
 	Retry            int
 	MaxRetry         int
 	CorrelationGroup sql.NullString
@@ -372,10 +2005,34 @@ type Job struct {
 	Started          int64
 	Completed        int64
 	LastMod          int64
+	Repeats          int
+	RepeatEvery      int64
+	WorkerID         sql.NullString
+	MinWorkerVersion int
+	Seq              int64          `gorm:"AUTO_INCREMENT"` // assigned by the database
+	LeaseToken       sql.NullString // set by ReserveBatch
+	LeaseExpires     int64          // set by ReserveBatch
+	LastError        sql.NullString
+	CallbackURL      sql.NullString
+	UniqueKey        sql.NullString
+	Heartbeat        int64
+	MutexKey         sql.NullString
+	RunAt            int64
+	ClaimedAt        int64
+	Result           []byte
+	LogOutput        sql.NullString
+	Timeout          int64
+	Redeliveries     int
+	MaxRedeliveries  int
+	CompletedBy      sql.NullString
+	TraceContext     sql.NullString
 }
 
+// TableName returns the default name of the table of the jobs. Stores
+// configured via SetTableName query their own table instead, see
+// Store.jobs.
 func (Job) TableName() string {
-	return "jobqueue_jobs"
+	return defaultTableName
 }
 
 func newJob(job *jobqueue.Job) (*Job, error) {
@@ -387,6 +2044,14 @@ func newJob(job *jobqueue.Job) (*Job, error) {
 		}
 		args = string(v)
 	}
+	var traceContext string
+	if len(job.TraceContext) > 0 {
+		v, err := json.Marshal(job.TraceContext)
+		if err != nil {
+			return nil, err
+		}
+		traceContext = string(v)
+	}
 	return &Job{
 		ID:               job.ID,
 		Topic:            job.Topic,
@@ -394,6 +2059,7 @@ func newJob(job *jobqueue.Job) (*Job, error) {
 		Args:             sql.NullString{String: args, Valid: args != ""},
 		Rank:             job.Rank,
 		Priority:         job.Priority,
+		SubPriority:      job.SubPriority,
 		Retry:            job.Retry,
 		MaxRetry:         job.MaxRetry,
 		CorrelationGroup: sql.NullString{String: job.CorrelationGroup, Valid: job.CorrelationGroup != ""},
@@ -402,9 +2068,72 @@ func newJob(job *jobqueue.Job) (*Job, error) {
 		LastMod:          job.Updated,
 		Started:          job.Started,
 		Completed:        job.Completed,
+		Repeats:          job.Repeats,
+		RepeatEvery:      int64(job.RepeatEvery),
+		WorkerID:         sql.NullString{String: job.WorkerID, Valid: job.WorkerID != ""},
+		MinWorkerVersion: job.MinWorkerVersion,
+		LastError:        sql.NullString{String: job.LastError, Valid: job.LastError != ""},
+		CallbackURL:      sql.NullString{String: job.CallbackURL, Valid: job.CallbackURL != ""},
+		UniqueKey:        sql.NullString{String: job.UniqueKey, Valid: job.UniqueKey != ""},
+		MutexKey:         sql.NullString{String: job.MutexKey, Valid: job.MutexKey != ""},
+		Heartbeat:        job.Heartbeat,
+		RunAt:            job.RunAt,
+		ClaimedAt:        job.ClaimedAt,
+		Result:           job.Result,
+		LogOutput:        sql.NullString{String: job.LogOutput, Valid: job.LogOutput != ""},
+		Timeout:          int64(job.Timeout),
+		Redeliveries:     job.Redeliveries,
+		MaxRedeliveries:  job.MaxRedeliveries,
+		CompletedBy:      sql.NullString{String: job.CompletedBy, Valid: job.CompletedBy != ""},
+		TraceContext:     sql.NullString{String: traceContext, Valid: traceContext != ""},
 	}, nil
 }
 
+// columns returns the values of all columns of j except the identifier.
+func (j *Job) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"topic":              j.Topic,
+		"state":              j.State,
+		"args":               j.Args,
+		"rank":               j.Rank,
+		"priority":           j.Priority,
+		"sub_priority":       j.SubPriority,
+		"retry":              j.Retry,
+		"max_retry":          j.MaxRetry,
+		"correlation_group":  j.CorrelationGroup,
+		"correlation_id":     j.CorrelationID,
+		"created":            j.Created,
+		"started":            j.Started,
+		"completed":          j.Completed,
+		"last_mod":           j.LastMod,
+		"repeats":            j.Repeats,
+		"repeat_every":       j.RepeatEvery,
+		"worker_id":          j.WorkerID,
+		"min_worker_version": j.MinWorkerVersion,
+		"last_error":         j.LastError,
+		"callback_url":       j.CallbackURL,
+		"unique_key":         j.UniqueKey,
+		"heartbeat":          j.Heartbeat,
+		"mutex_key":          j.MutexKey,
+		"run_at":             j.RunAt,
+		"claimed_at":         j.ClaimedAt,
+		"result":             j.Result,
+		"log_output":         j.LogOutput,
+		"timeout":            j.Timeout,
+		"redeliveries":       j.Redeliveries,
+		"max_redeliveries":   j.MaxRedeliveries,
+		"completed_by":       j.CompletedBy,
+		"trace_context":      j.TraceContext,
+	}
+}
+
+// releaseLease adds the columns to fields that release the lease of a job
+// reserved via ReserveBatch.
+func releaseLease(fields map[string]interface{}) {
+	fields["lease_token"] = nil
+	fields["lease_expires"] = 0
+}
+
 func (j *Job) ToJob() (*jobqueue.Job, error) {
 	var args []interface{}
 	if j.Args.Valid && j.Args.String != "" {
@@ -412,6 +2141,12 @@ func (j *Job) ToJob() (*jobqueue.Job, error) {
 			return nil, err
 		}
 	}
+	var traceContext jobqueue.TraceContext
+	if j.TraceContext.Valid && j.TraceContext.String != "" {
+		if err := json.Unmarshal([]byte(j.TraceContext.String), &traceContext); err != nil {
+			return nil, err
+		}
+	}
 	job := &jobqueue.Job{
 		ID:               j.ID,
 		Topic:            j.Topic,
@@ -419,6 +2154,7 @@ func (j *Job) ToJob() (*jobqueue.Job, error) {
 		Args:             args,
 		Rank:             j.Rank,
 		Priority:         j.Priority,
+		SubPriority:      j.SubPriority,
 		Retry:            j.Retry,
 		MaxRetry:         j.MaxRetry,
 		CorrelationGroup: j.CorrelationGroup.String,
@@ -427,6 +2163,24 @@ func (j *Job) ToJob() (*jobqueue.Job, error) {
 		Started:          j.Started,
 		Updated:          j.LastMod,
 		Completed:        j.Completed,
+		Repeats:          j.Repeats,
+		RepeatEvery:      time.Duration(j.RepeatEvery),
+		WorkerID:         j.WorkerID.String,
+		MinWorkerVersion: j.MinWorkerVersion,
+		LastError:        j.LastError.String,
+		CallbackURL:      j.CallbackURL.String,
+		UniqueKey:        j.UniqueKey.String,
+		Heartbeat:        j.Heartbeat,
+		MutexKey:         j.MutexKey.String,
+		RunAt:            j.RunAt,
+		ClaimedAt:        j.ClaimedAt,
+		Result:           j.Result,
+		LogOutput:        j.LogOutput.String,
+		Timeout:          time.Duration(j.Timeout),
+		Redeliveries:     j.Redeliveries,
+		MaxRedeliveries:  j.MaxRedeliveries,
+		CompletedBy:      j.CompletedBy.String,
+		TraceContext:     traceContext,
 	}
 	return job, nil
 }
@@ -1,8 +1,13 @@
 package mysql
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,7 +30,7 @@ func travisGoVersion() string {
 }
 
 // dropDatabase drops the database specified in the dburl connection string.
-func dropDatabase(t *testing.T, dburl string) {
+func dropDatabase(t testing.TB, dburl string) {
 	cfg, err := mysqldriver.ParseDSN(dburl)
 	if err != nil {
 		t.Fatal(err)
@@ -118,3 +123,2396 @@ func TestJobSuccess(t *testing.T) {
 		t.Fatal("Processor func timed out")
 	}
 }
+
+func TestOptimize(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	for i := 0; i < 10; i++ {
+		job := &jobqueue.Job{
+			ID:      fmt.Sprintf("job-%d", i),
+			Topic:   "topic",
+			State:   jobqueue.Waiting,
+			Args:    []interface{}{i},
+			Created: time.Now().UnixNano(),
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+		if i%2 == 0 {
+			if err := st.Delete(job); err != nil {
+				t.Fatalf("Delete failed with %v", err)
+			}
+		}
+	}
+
+	if err := st.Optimize(); err != nil {
+		t.Fatalf("Optimize failed with %v", err)
+	}
+}
+
+func TestReassign(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "a1", Topic: "topic", State: jobqueue.Working, WorkerID: "a"},
+		{ID: "a2", Topic: "topic", State: jobqueue.Working, WorkerID: "a"},
+		{ID: "a3", Topic: "topic", State: jobqueue.Succeeded, WorkerID: "a"},
+		{ID: "b1", Topic: "topic", State: jobqueue.Working, WorkerID: "b"},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.Reassign("a", "c")
+	if err != nil {
+		t.Fatalf("Reassign failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("Reassign returned %d, want %d", have, want)
+	}
+
+	tests := []struct {
+		ID       string
+		WorkerID string
+	}{
+		{"a1", "c"},
+		{"a2", "c"},
+		{"a3", "a"},
+		{"b1", "b"},
+	}
+	for _, test := range tests {
+		job, err := st.Lookup(test.ID)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed with %v", test.ID, err)
+		}
+		if have, want := job.WorkerID, test.WorkerID; have != want {
+			t.Fatalf("Lookup(%q): WorkerID = %q, want %q", test.ID, have, want)
+		}
+	}
+
+	// The new worker takes over a job that the old one has claimed
+	if err := st.Create(&jobqueue.Job{ID: "a4", Topic: "topic", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	stale, err := st.Next(&jobqueue.NextRequest{WorkerID: "a"})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if _, err := st.Reassign("a", "c"); err != nil {
+		t.Fatalf("Reassign failed with %v", err)
+	}
+
+	// The old worker cannot complete it anymore
+	stale.State = jobqueue.Failed
+	if err := st.Update(stale); err != jobqueue.ErrConflict {
+		t.Fatalf("Update of the stale job returned %v, want %v", err, jobqueue.ErrConflict)
+	}
+
+	job, err := st.Lookup(stale.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.WorkerID, "c"; have != want {
+		t.Fatalf("WorkerID = %q, want %q", have, want)
+	}
+	if err := st.Heartbeat(job.ID); err != nil {
+		t.Fatalf("Heartbeat failed with %v", err)
+	}
+	job, err = st.Lookup(stale.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.Heartbeat <= stale.Heartbeat {
+		t.Fatalf("expected the new worker to have sent a heartbeat")
+	}
+	job.State = jobqueue.Succeeded
+	job.Completed = time.Now().UnixNano()
+	job.CompletedBy = "c"
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	job, err = st.Lookup(stale.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, jobqueue.Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestExplainNext(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	states := []string{jobqueue.Waiting, jobqueue.Working, jobqueue.Succeeded, jobqueue.Failed}
+	for i := 0; i < 1000; i++ {
+		job := &jobqueue.Job{
+			ID:       fmt.Sprintf("job-%d", i),
+			Topic:    "topic",
+			State:    states[i%len(states)],
+			Rank:     i % 3,
+			Priority: int64(i),
+			Created:  time.Now().UnixNano(),
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	plan, err := st.ExplainNext()
+	if err != nil {
+		t.Fatalf("ExplainNext failed with %v", err)
+	}
+	if !strings.Contains(plan, "key=ix_jobs_") {
+		t.Fatalf("expected plan to use an index, have:\n%s", plan)
+	}
+}
+
+func TestPriorityRange(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true), SetPriorityRange(-100, 100))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	tests := []struct {
+		Priority int64
+		Expected int64
+	}{
+		{math.MinInt64, -100},
+		{-101, -100},
+		{-100, -100},
+		{0, 0},
+		{100, 100},
+		{101, 100},
+		{math.MaxInt64, 100},
+	}
+	for i, test := range tests {
+		job := &jobqueue.Job{
+			ID:       fmt.Sprintf("job-%d", i),
+			Topic:    "topic",
+			State:    jobqueue.Waiting,
+			Priority: test.Priority,
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+		job, err := st.Lookup(job.ID)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have, want := job.Priority, test.Expected; have != want {
+			t.Fatalf("#%d: Priority = %d, want %d", i, have, want)
+		}
+	}
+}
+
+func TestListIsStable(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	const n = 25
+	for i := 0; i < n; i++ {
+		job := &jobqueue.Job{
+			ID:      fmt.Sprintf("job-%02d", i),
+			Topic:   "topic",
+			State:   jobqueue.Waiting,
+			Created: 42, // Create uses this as last_mod, so it's the same for all jobs
+		}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for run := 0; run < 3; run++ {
+		var ids []string
+		for offset := 0; offset < n; offset += 10 {
+			rsp, err := st.List(&jobqueue.ListRequest{Offset: offset, Limit: 10})
+			if err != nil {
+				t.Fatalf("List failed with %v", err)
+			}
+			for _, job := range rsp.Jobs {
+				ids = append(ids, job.ID)
+			}
+		}
+		if have, want := len(ids), n; have != want {
+			t.Fatalf("found %d jobs across pages, want %d", have, want)
+		}
+		for i, id := range ids {
+			if have, want := id, fmt.Sprintf("job-%02d", n-1-i); have != want {
+				t.Fatalf("run %d: jobs[%d] = %q, want %q", run, i, have, want)
+			}
+		}
+	}
+}
+
+func TestBulkSetPriority(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "a1", Topic: "a", State: jobqueue.Waiting, Priority: 20},
+		{ID: "a2", Topic: "a", State: jobqueue.Waiting, Priority: 10},
+		{ID: "a3", Topic: "a", State: jobqueue.Succeeded, Priority: 10},
+		{ID: "b1", Topic: "b", State: jobqueue.Waiting, Priority: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	next, err := st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := next.ID, "a1"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+	if _, err := st.CompareAndSetState(next.ID, jobqueue.Working, jobqueue.Waiting); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+
+	n, err := st.BulkSetPriority(&jobqueue.ListRequest{Topic: "a"}, 0)
+	if err != nil {
+		t.Fatalf("BulkSetPriority failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("BulkSetPriority returned %d, want %d", have, want)
+	}
+
+	next, err = st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := next.ID, "b1"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+}
+
+func TestNextOrdersBySubPriority(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "low", State: jobqueue.Waiting, Priority: 10, SubPriority: 1, Created: 1},
+		{ID: "high", State: jobqueue.Waiting, Priority: 10, SubPriority: 3, Created: 2},
+		{ID: "medium", State: jobqueue.Waiting, Priority: 10, SubPriority: 2, Created: 3},
+		{ID: "lower-priority", State: jobqueue.Waiting, Priority: 5, SubPriority: 100, Created: 4},
+		{ID: "medium-newer", State: jobqueue.Waiting, Priority: 10, SubPriority: 2, Created: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"high", "medium", "medium-newer", "low", "lower-priority"} {
+		job, err := st.Next(&jobqueue.NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+		job.State = jobqueue.Succeeded
+		if err := st.Update(job); err != nil {
+			t.Fatalf("Update failed with %v", err)
+		}
+	}
+}
+
+func TestNextOrdersByCreated(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	// Jobs of the same priority, enqueued out of order
+	jobs := []*jobqueue.Job{
+		{ID: "second", State: jobqueue.Waiting, Priority: 10, Created: 20},
+		{ID: "fourth", State: jobqueue.Waiting, Priority: 10, Created: 40},
+		{ID: "first", State: jobqueue.Waiting, Priority: 10, Created: 10},
+		{ID: "third", State: jobqueue.Waiting, Priority: 10, Created: 30},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"first", "second", "third", "fourth"} {
+		job, err := st.Next(&jobqueue.NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+		job.State = jobqueue.Succeeded
+		if err := st.Update(job); err != nil {
+			t.Fatalf("Update failed with %v", err)
+		}
+	}
+}
+
+func TestCleanWithRetentionPerState(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL,
+		SetDebug(true),
+		SetRetention(jobqueue.Succeeded, 24*time.Hour),
+		SetRetention(jobqueue.Failed, 30*24*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	ago := func(d time.Duration) int64 {
+		return time.Now().Add(-d).UnixNano()
+	}
+	jobs := []*jobqueue.Job{
+		{ID: "succeeded-new", State: jobqueue.Succeeded, Completed: ago(1 * time.Hour)},
+		{ID: "succeeded-old", State: jobqueue.Succeeded, Completed: ago(2 * 24 * time.Hour)},
+		{ID: "failed-new", State: jobqueue.Failed, Completed: ago(2 * 24 * time.Hour)},
+		{ID: "failed-old", State: jobqueue.Failed, Completed: ago(31 * 24 * time.Hour)},
+		{ID: "waiting-old", State: jobqueue.Waiting, Created: ago(31 * 24 * time.Hour)},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.Clean()
+	if err != nil {
+		t.Fatalf("Clean failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("Clean returned %d, want %d", have, want)
+	}
+
+	tests := []struct {
+		ID      string
+		Deleted bool
+	}{
+		{"succeeded-new", false},
+		{"succeeded-old", true},
+		{"failed-new", false},
+		{"failed-old", true},
+		{"waiting-old", false},
+	}
+	for _, test := range tests {
+		_, err := st.Lookup(test.ID)
+		if have, want := err == jobqueue.ErrNotFound, test.Deleted; have != want {
+			t.Fatalf("Lookup(%q): deleted = %v, want %v (err = %v)", test.ID, have, want, err)
+		}
+	}
+}
+
+func TestCleanWithResultTTL(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL,
+		SetDebug(true),
+		SetResultTTL(24*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	ago := func(d time.Duration) int64 {
+		return time.Now().Add(-d).UnixNano()
+	}
+	jobs := []*jobqueue.Job{
+		{ID: "failed-new", State: jobqueue.Failed, Completed: ago(1 * time.Hour), LastError: "boom", LogOutput: "retrying"},
+		{ID: "failed-old", State: jobqueue.Failed, Completed: ago(2 * 24 * time.Hour), LastError: "boom", LogOutput: "retrying"},
+		{ID: "succeeded-old", State: jobqueue.Succeeded, Completed: ago(2 * 24 * time.Hour), LastError: "flaky", Result: []byte(`{"ok":true}`), LogOutput: "done"},
+		{ID: "waiting-old", State: jobqueue.Waiting, Created: ago(2 * 24 * time.Hour), LastError: "flaky", LogOutput: "retrying"},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.Clean()
+	if err != nil {
+		t.Fatalf("Clean failed with %v", err)
+	}
+	if have, want := n, int64(0); have != want {
+		t.Fatalf("Clean returned %d, want %d", have, want)
+	}
+
+	tests := []struct {
+		ID        string
+		State     string
+		LastError string
+		Result    string
+		LogOutput string
+	}{
+		{"failed-new", jobqueue.Failed, "boom", "", "retrying"},
+		{"failed-old", jobqueue.Failed, "", "", ""},
+		{"succeeded-old", jobqueue.Succeeded, "", "", ""},
+		{"waiting-old", jobqueue.Waiting, "flaky", "", "retrying"},
+	}
+	for _, test := range tests {
+		job, err := st.Lookup(test.ID)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed with %v", test.ID, err)
+		}
+		if have, want := job.State, test.State; have != want {
+			t.Fatalf("Lookup(%q): State = %q, want %q", test.ID, have, want)
+		}
+		if have, want := job.LastError, test.LastError; have != want {
+			t.Fatalf("Lookup(%q): LastError = %q, want %q", test.ID, have, want)
+		}
+		if have, want := string(job.Result), test.Result; have != want {
+			t.Fatalf("Lookup(%q): Result = %q, want %q", test.ID, have, want)
+		}
+		if have, want := job.LogOutput, test.LogOutput; have != want {
+			t.Fatalf("Lookup(%q): LogOutput = %q, want %q", test.ID, have, want)
+		}
+	}
+}
+
+func TestSetCleaner(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL,
+		SetDebug(true),
+		SetCleaner(100*time.Millisecond, 24*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	ago := func(d time.Duration) int64 {
+		return time.Now().Add(-d).UnixNano()
+	}
+	jobs := []*jobqueue.Job{
+		{ID: "succeeded-new", State: jobqueue.Succeeded, Completed: ago(1 * time.Hour)},
+		{ID: "failed-new", State: jobqueue.Failed, Completed: ago(1 * time.Hour)},
+		{ID: "waiting-old", State: jobqueue.Waiting, Created: ago(2 * 24 * time.Hour)},
+	}
+	// More old jobs than fit into a single batch
+	for i := 0; i < cleanBatchSize+10; i++ {
+		state := jobqueue.Succeeded
+		if i%2 == 1 {
+			state = jobqueue.Failed
+		}
+		jobs = append(jobs, &jobqueue.Job{
+			ID:        fmt.Sprintf("old-%04d", i),
+			State:     state,
+			Completed: ago(2 * 24 * time.Hour),
+		})
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	if err := st.Start(); err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	var total int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		rsp, err := st.List(&jobqueue.ListRequest{Limit: 1})
+		if err != nil {
+			t.Fatalf("List failed with %v", err)
+		}
+		if total = rsp.Total; total == 3 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if have, want := total, 3; have != want {
+		t.Fatalf("found %d jobs after cleaning, want %d", have, want)
+	}
+	for _, id := range []string{"succeeded-new", "failed-new", "waiting-old"} {
+		if _, err := st.Lookup(id); err != nil {
+			t.Fatalf("Lookup(%q) failed with %v", id, err)
+		}
+	}
+
+	// Close stops the cleaner
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	ago := func(d time.Duration) int64 {
+		return time.Now().Add(-d).UnixNano()
+	}
+	jobs := []*jobqueue.Job{
+		{ID: "in-1", State: jobqueue.Succeeded, Completed: ago(10 * time.Second)},
+		{ID: "in-2", State: jobqueue.Succeeded, Completed: ago(30 * time.Second)},
+		{ID: "in-3", State: jobqueue.Failed, Completed: ago(50 * time.Second)},
+		{ID: "out-1", State: jobqueue.Succeeded, Completed: ago(2 * time.Minute)},
+		{ID: "out-2", State: jobqueue.Failed, Completed: ago(10 * time.Minute)},
+		{ID: "waiting", State: jobqueue.Waiting},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	rate, err := st.Throughput(1 * time.Minute)
+	if err != nil {
+		t.Fatalf("Throughput failed with %v", err)
+	}
+	if have, want := rate, 3.0/60.0; have != want {
+		t.Fatalf("Throughput = %v, want %v", have, want)
+	}
+}
+
+func TestResetRetries(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "w", Topic: "topic", State: jobqueue.Waiting, Retry: 3, MaxRetry: 5},
+		{ID: "f", Topic: "topic", State: jobqueue.Failed, Retry: 5, MaxRetry: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	if err := st.ResetRetries("w"); err != nil {
+		t.Fatalf("ResetRetries failed with %v", err)
+	}
+	job, err := st.Lookup("w")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.Retry, 0; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := job.State, jobqueue.Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+
+	if err := st.ResetRetries("f"); err != jobqueue.ErrNotFound {
+		t.Fatalf("ResetRetries of failed job: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestCompareAndSetState(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	changed, err := st.CompareAndSetState("1", jobqueue.Working, jobqueue.Succeeded)
+	if err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if changed {
+		t.Fatal("expected CompareAndSetState from an unexpected state to fail")
+	}
+	changed, err = st.CompareAndSetState("1", jobqueue.Waiting, jobqueue.Working)
+	if err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if !changed {
+		t.Fatal("expected CompareAndSetState from the expected state to succeed")
+	}
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, jobqueue.Working; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestRenameTopic(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "1", Topic: "emailV1", State: jobqueue.Waiting},
+		{ID: "2", Topic: "emailV1", State: jobqueue.Waiting},
+		{ID: "3", Topic: "other", State: jobqueue.Waiting},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.RenameTopic("emailV1", "email")
+	if err != nil {
+		t.Fatalf("RenameTopic failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("RenameTopic returned %d, want %d", have, want)
+	}
+	rsp, err := st.List(&jobqueue.ListRequest{Topic: "email", Limit: 10})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := rsp.Total, 2; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+
+	// Only move the jobs in the given states
+	if err := st.Create(&jobqueue.Job{ID: "4", Topic: "email", State: jobqueue.Succeeded}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	n, err = st.RenameTopic("email", "emailV2", jobqueue.Waiting)
+	if err != nil {
+		t.Fatalf("RenameTopic failed with %v", err)
+	}
+	if have, want := n, int64(2); have != want {
+		t.Fatalf("RenameTopic returned %d, want %d", have, want)
+	}
+	job, err := st.Lookup("4")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.Topic, "email"; have != want {
+		t.Fatalf("Topic = %q, want %q", have, want)
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "1", Topic: "a", CorrelationID: "x", State: jobqueue.Waiting, Created: 10},
+		{ID: "2", Topic: "a", CorrelationID: "y", State: jobqueue.Waiting, Created: 20},
+		{ID: "3", Topic: "b", CorrelationID: "x", State: jobqueue.Succeeded, Created: 30},
+		{ID: "4", Topic: "a", CorrelationID: "x", State: jobqueue.Waiting, Created: 40},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	tests := []struct {
+		Request *jobqueue.ListRequest
+		Want    int
+	}{
+		{&jobqueue.ListRequest{}, 4},
+		{&jobqueue.ListRequest{State: jobqueue.Waiting}, 3},
+		{&jobqueue.ListRequest{CorrelationID: "x"}, 3},
+		{&jobqueue.ListRequest{CreatedAfter: 10, CreatedBefore: 40}, 2},
+		{&jobqueue.ListRequest{Topic: "a", CorrelationID: "x", CreatedAfter: 20}, 1},
+	}
+	for i, tt := range tests {
+		rsp, err := st.List(tt.Request)
+		if err != nil {
+			t.Fatalf("#%d: List failed with %v", i, err)
+		}
+		if have, want := rsp.Total, tt.Want; have != want {
+			t.Errorf("#%d: Total = %d, want %d", i, have, want)
+		}
+		if have, want := len(rsp.Jobs), tt.Want; have != want {
+			t.Errorf("#%d: len(Jobs) = %d, want %d", i, have, want)
+		}
+	}
+}
+
+func TestResultRoundTrip(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	job := &jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	job.State = jobqueue.Succeeded
+	job.Result = []byte{0, 1, 2, 255}
+	job.LastError = "kaboom"
+	job.LogOutput = "step 1\nstep 2\n"
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	found, err := st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := string(found.Result), string(job.Result); have != want {
+		t.Fatalf("Result = %q, want %q", have, want)
+	}
+	if have, want := found.LastError, job.LastError; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+	if have, want := found.LogOutput, job.LogOutput; have != want {
+		t.Fatalf("LogOutput = %q, want %q", have, want)
+	}
+	rsp, err := st.List(&jobqueue.ListRequest{})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if len(rsp.Jobs) != 1 || string(rsp.Jobs[0].Result) != string(job.Result) {
+		t.Fatalf("expected List to return the result, have %+v", rsp.Jobs)
+	}
+}
+
+func TestUpdateDoesNotResurrectDeletedJob(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	job, err := st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if err := st.Delete(job); err != nil {
+		t.Fatalf("Delete failed with %v", err)
+	}
+	job.State = jobqueue.Succeeded
+	if err := st.Update(job); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected Update to return ErrNotFound, got %v", err)
+	}
+	if _, err := st.Lookup("1"); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected deleted job to be gone, got %v", err)
+	}
+}
+
+func TestNextClaimsJob(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		job := &jobqueue.Job{ID: fmt.Sprintf("job-%02d", i), Topic: "topic", State: jobqueue.Waiting}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, skipLocked := range []bool{true, false} {
+		if skipLocked && !st.skipLocked {
+			// Server does not support SKIP LOCKED
+			continue
+		}
+		st.skipLocked = skipLocked
+		err := st.db.Model(&Job{}).Where("state = ?", jobqueue.Working).UpdateColumn("state", jobqueue.Waiting).Error
+		if err != nil {
+			t.Fatalf("resetting jobs failed with %v", err)
+		}
+
+		// Concurrent workers must never claim the same job
+		var (
+			mu      sync.Mutex
+			claimed = make(map[string]int)
+			wg      sync.WaitGroup
+		)
+		for w := 0; w < 5; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					job, err := st.Next(&jobqueue.NextRequest{WorkerID: "worker"})
+					if err == jobqueue.ErrNotFound {
+						return
+					}
+					if err != nil {
+						t.Errorf("Next failed with %v", err)
+						return
+					}
+					if have, want := job.State, jobqueue.Working; have != want {
+						t.Errorf("State = %q, want %q", have, want)
+					}
+					if job.Started == 0 || job.ClaimedAt == 0 {
+						t.Errorf("expected Started and ClaimedAt to be set")
+					}
+					if have, want := job.WorkerID, "worker"; have != want {
+						t.Errorf("WorkerID = %q, want %q", have, want)
+					}
+					mu.Lock()
+					claimed[job.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if have, want := len(claimed), n; have != want {
+			t.Fatalf("skipLocked=%v: claimed %d jobs, want %d", skipLocked, have, want)
+		}
+		for id, count := range claimed {
+			if count != 1 {
+				t.Fatalf("skipLocked=%v: job %s claimed %d times", skipLocked, id, count)
+			}
+		}
+		stats, err := st.Stats(&jobqueue.StatsRequest{})
+		if err != nil {
+			t.Fatalf("Stats failed with %v", err)
+		}
+		if have, want := stats.Working, n; have != want {
+			t.Fatalf("skipLocked=%v: Working = %d, want %d", skipLocked, have, want)
+		}
+		job, err := st.Lookup("job-00")
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have, want := job.WorkerID, "worker"; have != want {
+			t.Fatalf("skipLocked=%v: stored WorkerID = %q, want %q", skipLocked, have, want)
+		}
+	}
+}
+
+func TestSupportsSkipLocked(t *testing.T) {
+	tests := []struct {
+		Version string
+		Want    bool
+	}{
+		{"5.6.40", false},
+		{"5.7.31-log", false},
+		{"8.0.0-dmr", false},
+		{"8.0.1", true},
+		{"8.0.23", true},
+		{"8.4.0-0ubuntu0.24.04.1", true},
+		{"9.0.1", true},
+		{"10.5.12-MariaDB-1:10.5.12+maria~focal", false},
+		{"10.6.4-MariaDB", true},
+		{"11.2.2-MariaDB-log", true},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		if have, want := supportsSkipLocked(tt.Version), tt.Want; have != want {
+			t.Errorf("supportsSkipLocked(%q) = %v, want %v", tt.Version, have, want)
+		}
+	}
+}
+
+func TestNextSkipsDelayedJobs(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	now := time.Now()
+	jobs := []*jobqueue.Job{
+		{ID: "delayed", Topic: "topic", State: jobqueue.Waiting, Priority: 10, RunAt: now.Add(time.Hour).UnixNano()},
+		{ID: "due", Topic: "topic", State: jobqueue.Waiting, Priority: 5, RunAt: now.Add(-time.Second).UnixNano()},
+		{ID: "legacy", Topic: "topic", State: jobqueue.Waiting, Priority: 1},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"due", "legacy"} {
+		job, err := st.Next(&jobqueue.NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if have := job.ID; have != want {
+			t.Fatalf("Next = %q, want %q", have, want)
+		}
+	}
+	if _, err := st.Next(&jobqueue.NextRequest{}); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected Next to return ErrNotFound, got %v", err)
+	}
+	job, err := st.Lookup("delayed")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.RunAt, jobs[0].RunAt; have != want {
+		t.Fatalf("RunAt = %d, want %d", have, want)
+	}
+}
+
+func TestNextInFIFOMode(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "old", Topic: "topic", State: jobqueue.Waiting, Priority: 1, Created: 1},
+		{ID: "new", Topic: "topic", State: jobqueue.Waiting, Priority: 2, Rank: 1, Created: 2},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	job, err := st.Next(&jobqueue.NextRequest{FIFO: true})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := job.ID, "old"; have != want {
+		t.Fatalf("Next in FIFO mode returned %q, want %q", have, want)
+	}
+	job, err = st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := job.ID, "new"; have != want {
+		t.Fatalf("Next returned %q, want %q", have, want)
+	}
+}
+
+func TestNextInFairMode(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	// The big correlation identifier has many jobs that are older than
+	// the ones of the small one
+	for i := 0; i < 10; i++ {
+		job := &jobqueue.Job{ID: fmt.Sprintf("big-%d", i), Topic: "topic", State: jobqueue.Waiting, CorrelationID: "big", Created: int64(1 + i)}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		job := &jobqueue.Job{ID: fmt.Sprintf("small-%d", i), Topic: "topic", State: jobqueue.Waiting, CorrelationID: "small", Created: int64(100 + i)}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		job, err := st.Next(&jobqueue.NextRequest{Fair: true})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		order = append(order, job.ID)
+		// Make sure the claims are ordered in time
+		time.Sleep(time.Millisecond)
+	}
+	if have, want := strings.Join(order, ","), "big-0,small-0,big-1,small-1"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+}
+
+func TestNextOrdersBySequence(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	ids := []string{"b", "c", "a"}
+	for _, id := range ids {
+		// Same timestamps and priorities for all jobs
+		job := &jobqueue.Job{ID: id, Topic: "topic", State: jobqueue.Waiting, Created: 42}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	var order []string
+	for range ids {
+		job, err := st.Next(&jobqueue.NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		order = append(order, job.ID)
+	}
+	if have, want := strings.Join(order, ","), "b,c,a"; have != want {
+		t.Fatalf("order = %q, want %q", have, want)
+	}
+}
+
+func TestUpdateOfTerminalJob(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Working}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	// Two workers finalize the same job
+	first, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	second, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	first.State = jobqueue.Succeeded
+	if err := st.Update(first); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	second.State = jobqueue.Failed
+	if err := st.Update(second); err != jobqueue.ErrInvalidTransition {
+		t.Fatalf("expected Update to return ErrInvalidTransition, got %v", err)
+	}
+
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, jobqueue.Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestMaxListLimit(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true), SetMaxListLimit(2))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	for i := 0; i < 5; i++ {
+		job := &jobqueue.Job{ID: fmt.Sprint(i), Topic: "topic", State: jobqueue.Waiting}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	rsp, err := st.List(&jobqueue.ListRequest{Limit: 1000000})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := rsp.Total, 5; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+	if have, want := len(rsp.Jobs), 2; have != want {
+		t.Fatalf("len(Jobs) = %d, want %d", have, want)
+	}
+}
+
+func TestReserveBatch(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(false))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		job := &jobqueue.Job{ID: fmt.Sprint(i), Topic: "topic", State: jobqueue.Waiting}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	// Two reservers compete for the jobs
+	var (
+		mu       sync.Mutex
+		reserved = make(map[string]int)
+		wg       sync.WaitGroup
+	)
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				list, err := st.ReserveBatch(3, time.Minute)
+				if err != nil {
+					t.Errorf("ReserveBatch failed with %v", err)
+					return
+				}
+				if len(list) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, rj := range list {
+					reserved[rj.Job.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if have, want := len(reserved), n; have != want {
+		t.Fatalf("reserved %d jobs, want %d", have, want)
+	}
+	for id, count := range reserved {
+		if count != 1 {
+			t.Fatalf("job %q reserved %d times, want 1", id, count)
+		}
+	}
+}
+
+func TestFailAndRetry(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Working, MaxRetry: 1}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	if err := st.FailAndRetry("1", time.Hour, "boom"); err != nil {
+		t.Fatalf("FailAndRetry failed with %v", err)
+	}
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, jobqueue.Waiting; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.Retry, 1; have != want {
+		t.Fatalf("Retry = %d, want %d", have, want)
+	}
+	if have, want := job.LastError, "boom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+	if err := st.FailAndRetry("1", time.Hour, "boom"); err != jobqueue.ErrInvalidTransition {
+		t.Fatalf("expected FailAndRetry to return ErrInvalidTransition, got %v", err)
+	}
+	if err := st.FailAndRetry("no-such-job", time.Hour, "boom"); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected FailAndRetry to return ErrNotFound, got %v", err)
+	}
+}
+
+func TestDatabaseClock(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	// Two workers share the database
+	first, err := NewStore(testDBURL, SetDebug(true), SetDatabaseClock(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+	second, err := NewStore(testDBURL, SetDebug(true), SetDatabaseClock(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+
+	// The clock of the first worker is ahead of the clock of the second
+	now := time.Now()
+	a := &jobqueue.Job{ID: "a", Topic: "topic", State: jobqueue.Waiting, Created: now.Add(time.Hour).UnixNano()}
+	if err := first.Create(a); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	b := &jobqueue.Job{ID: "b", Topic: "topic", State: jobqueue.Waiting, Created: now.Add(-time.Hour).UnixNano()}
+	if err := second.Create(b); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	a, err = first.Lookup("a")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	b, err = first.Lookup("b")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if a.Created > b.Created {
+		t.Fatalf("expected job a to be created before job b, got %d > %d", a.Created, b.Created)
+	}
+	next, err := first.Next(&jobqueue.NextRequest{FIFO: true})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := next.ID, "a"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+}
+
+func TestImportTerminal(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	err = st.ImportTerminal([]*jobqueue.Job{
+		{ID: "1", Topic: "topic", State: jobqueue.Succeeded, Completed: 1},
+		{ID: "2", Topic: "topic", State: jobqueue.Waiting},
+	})
+	if err == nil {
+		t.Fatal("expected ImportTerminal of a waiting job to fail")
+	}
+
+	err = st.ImportTerminal([]*jobqueue.Job{
+		{ID: "1", Topic: "topic", State: jobqueue.Succeeded, Completed: 1},
+		{ID: "2", Topic: "topic", State: jobqueue.Failed, Completed: 2},
+	})
+	if err != nil {
+		t.Fatalf("ImportTerminal failed with %v", err)
+	}
+	if _, err := st.Next(&jobqueue.NextRequest{}); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected Next to return ErrNotFound, got %v", err)
+	}
+	rsp, err := st.List(&jobqueue.ListRequest{})
+	if err != nil {
+		t.Fatalf("List failed with %v", err)
+	}
+	if have, want := rsp.Total, 2; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+	stats, err := st.Stats(&jobqueue.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if stats.Succeeded != 1 || stats.Failed != 1 || stats.Waiting != 0 {
+		t.Fatalf("Stats = %+v, want 1 succeeded and 1 failed job", stats)
+	}
+}
+
+func TestCreateOrGet(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	first, created, err := st.CreateOrGet(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"})
+	if err != nil {
+		t.Fatalf("CreateOrGet failed with %v", err)
+	}
+	if !created {
+		t.Fatal("expected first job to be created")
+	}
+	second, created, err := st.CreateOrGet(&jobqueue.Job{ID: "2", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"})
+	if err != nil {
+		t.Fatalf("CreateOrGet failed with %v", err)
+	}
+	if created {
+		t.Fatal("expected second job not to be created")
+	}
+	if have, want := second.ID, first.ID; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	if _, err := st.Lookup("2"); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected second job not to be stored, got %v", err)
+	}
+}
+
+func TestCreateOrGetConcurrently(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(false))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+		ids     = make(map[string]bool)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			job := &jobqueue.Job{ID: fmt.Sprint(i), Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"}
+			found, ok, err := st.CreateOrGet(job)
+			if err != nil {
+				t.Errorf("CreateOrGet failed with %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				created++
+			}
+			ids[found.ID] = true
+		}(i)
+	}
+	wg.Wait()
+
+	if have, want := created, 1; have != want {
+		t.Fatalf("created %d jobs, want %d", have, want)
+	}
+	if have, want := len(ids), 1; have != want {
+		t.Fatalf("CreateOrGet returned %d different jobs, want %d", have, want)
+	}
+}
+
+func TestCreateDuplicate(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	err = st.Create(&jobqueue.Job{ID: "2", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"})
+	if have, want := err, jobqueue.ErrDuplicate; have != want {
+		t.Fatalf("Create returned %v, want %v", have, want)
+	}
+
+	// Once the first job has completed, the key can be used again
+	if _, err := st.CompareAndSetState("1", jobqueue.Waiting, jobqueue.Succeeded); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "3", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	stmts, err := SchemaDiff(st.db.DB())
+	if err != nil {
+		t.Fatalf("SchemaDiff failed with %v", err)
+	}
+	if have, want := len(stmts), 0; have != want {
+		t.Fatalf("len(SchemaDiff) = %d, want %d: %v", have, want, stmts)
+	}
+
+	// Go back to a table without the last_error column
+	if _, err := st.db.DB().Exec("ALTER TABLE jobqueue_jobs DROP COLUMN last_error"); err != nil {
+		t.Fatalf("DROP COLUMN failed with %v", err)
+	}
+	stmts, err = SchemaDiff(st.db.DB())
+	if err != nil {
+		t.Fatalf("SchemaDiff failed with %v", err)
+	}
+	if have, want := len(stmts), 1; have != want {
+		t.Fatalf("len(SchemaDiff) = %d, want %d: %v", have, want, stmts)
+	}
+	if have, want := stmts[0], mysqlUpdate010; have != want {
+		t.Fatalf("SchemaDiff = %q, want %q", have, want)
+	}
+
+	// SchemaDiff must not change the schema
+	again, err := SchemaDiff(st.db.DB())
+	if err != nil {
+		t.Fatalf("SchemaDiff failed with %v", err)
+	}
+	if have, want := len(again), 1; have != want {
+		t.Fatalf("len(SchemaDiff) = %d, want %d: %v", have, want, again)
+	}
+}
+
+func TestStartKeepsJobsOfOtherWorkers(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true), SetReclaimAfter(time.Hour))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	now := time.Now()
+	jobs := []*jobqueue.Job{
+		{ID: "abandoned", Topic: "topic", State: jobqueue.Working, Started: now.Add(-2 * time.Hour).UnixNano()},
+		{ID: "alive", Topic: "topic", State: jobqueue.Working, Started: now.Add(-time.Minute).UnixNano()},
+		// Long-running job of a peer that still sends heartbeats
+		{ID: "heartbeating", Topic: "topic", State: jobqueue.Working, Started: now.Add(-2 * time.Hour).UnixNano(), Heartbeat: now.UnixNano()},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	if err := st.Start(); err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+
+	for id, want := range map[string]string{"abandoned": jobqueue.Failed, "alive": jobqueue.Working, "heartbeating": jobqueue.Working} {
+		job, err := st.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have := job.State; have != want {
+			t.Fatalf("job %q: State = %q, want %q", id, have, want)
+		}
+	}
+	job, err := st.Lookup("abandoned")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.Updated < now.UnixNano() {
+		t.Fatalf("expected Start to bump Updated of job %q, have %d", job.ID, job.Updated)
+	}
+}
+
+func TestReclaimExpired(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	now := time.Now()
+	long := now.Add(-time.Hour).UnixNano()
+	jobs := []*jobqueue.Job{
+		{ID: "crashed", Topic: "topic", State: jobqueue.Working, MaxRetry: 1, Started: long, Heartbeat: long},
+		{ID: "crashed-no-retries", Topic: "topic", State: jobqueue.Working, Started: long, Heartbeat: long},
+		{ID: "alive", Topic: "topic", State: jobqueue.Working, MaxRetry: 1, Started: long, Heartbeat: now.UnixNano()},
+		// Started is updated after the claim, but the claim has expired
+		{ID: "claimed-long-ago", Topic: "topic", State: jobqueue.Working, MaxRetry: 1, ClaimedAt: long, Started: now.UnixNano(), Heartbeat: long},
+		{ID: "just-claimed", Topic: "topic", State: jobqueue.Working, MaxRetry: 1, ClaimedAt: now.UnixNano(), Started: long, Heartbeat: long},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.ReclaimExpired(time.Minute)
+	if err != nil {
+		t.Fatalf("ReclaimExpired failed with %v", err)
+	}
+	if have, want := n, 3; have != want {
+		t.Fatalf("ReclaimExpired = %d, want %d", have, want)
+	}
+	tests := map[string]string{
+		"crashed":            jobqueue.Waiting,
+		"crashed-no-retries": jobqueue.Failed,
+		"alive":              jobqueue.Working,
+		"claimed-long-ago":   jobqueue.Waiting,
+		"just-claimed":       jobqueue.Working,
+	}
+	for id, want := range tests {
+		job, err := st.Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup failed with %v", err)
+		}
+		if have := job.State; have != want {
+			t.Fatalf("job %q: State = %q, want %q", id, have, want)
+		}
+	}
+}
+
+func TestReclaimExpiredMaxRedeliveries(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	long := time.Now().Add(-time.Hour).UnixNano()
+	jobs := []*jobqueue.Job{
+		{ID: "redelivered", Topic: "topic", State: jobqueue.Working, MaxRetry: 10, Redeliveries: 1, MaxRedeliveries: 2, Started: long, Heartbeat: long},
+		{ID: "poison", Topic: "topic", State: jobqueue.Working, MaxRetry: 10, Redeliveries: 2, MaxRedeliveries: 2, Started: long, Heartbeat: long},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	n, err := st.ReclaimExpired(time.Minute)
+	if err != nil {
+		t.Fatalf("ReclaimExpired failed with %v", err)
+	}
+	if have, want := n, 2; have != want {
+		t.Fatalf("ReclaimExpired = %d, want %d", have, want)
+	}
+	job, err := st.Lookup("redelivered")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != jobqueue.Waiting || job.Redeliveries != 2 {
+		t.Fatalf("expected redelivered job to wait with 2 redeliveries, have %q with %d", job.State, job.Redeliveries)
+	}
+	job, err = st.Lookup("poison")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, jobqueue.Failed; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+	if have, want := job.LastError, jobqueue.ErrMaxRedeliveries.Error(); have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+}
+
+func TestNextWithMutex(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "a1", Topic: "topic", State: jobqueue.Waiting, MutexKey: "account-1", Priority: 2},
+		{ID: "a2", Topic: "topic", State: jobqueue.Waiting, MutexKey: "account-1", Priority: 1},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	// Several workers claim jobs at the same time
+	var (
+		mu      sync.Mutex
+		claimed []string
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job, err := st.NextWithMutex(&jobqueue.NextRequest{})
+			if err == jobqueue.ErrNotFound {
+				return
+			}
+			if err != nil {
+				t.Errorf("NextWithMutex failed with %v", err)
+				return
+			}
+			mu.Lock()
+			claimed = append(claimed, job.ID)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if have, want := len(claimed), 1; have != want {
+		t.Fatalf("claimed %d jobs, want %d: %v", have, want, claimed)
+	}
+
+	// Completing the job releases the key
+	job, err := st.Lookup(claimed[0])
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	job.State = jobqueue.Succeeded
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	job, err = st.NextWithMutex(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("NextWithMutex failed with %v", err)
+	}
+	if job.ID == claimed[0] {
+		t.Fatalf("expected NextWithMutex to claim the other job, got %q again", job.ID)
+	}
+
+	// Clean removes the lock once no job holds the key any more
+	job.State = jobqueue.Succeeded
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	if _, err := st.Clean(); err != nil {
+		t.Fatalf("Clean failed with %v", err)
+	}
+	var locks int64
+	if err := st.db.Raw(`SELECT COUNT(*) FROM jobqueue_locks`).Row().Scan(&locks); err != nil {
+		t.Fatalf("counting locks failed with %v", err)
+	}
+	if have, want := locks, int64(0); have != want {
+		t.Fatalf("locks = %d, want %d", have, want)
+	}
+}
+
+func TestNewStoreRetriesToConnect(t *testing.T) {
+	var attempts int
+	unavailable := func(s *Store) {
+		s.open = func(dialect string, args ...interface{}) (*gorm.DB, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		}
+	}
+
+	_, err := NewStore(testDBURL, unavailable, SetConnectRetry(3, time.Millisecond))
+	if err == nil {
+		t.Fatal("expected NewStore to fail")
+	}
+	if have, want := attempts, 3; have != want {
+		t.Fatalf("connected %d times, want %d", have, want)
+	}
+
+	attempts = 0
+	_, err = NewStore(testDBURL, unavailable)
+	if err == nil {
+		t.Fatal("expected NewStore to fail")
+	}
+	if have, want := attempts, 1; have != want {
+		t.Fatalf("connected %d times, want %d", have, want)
+	}
+}
+
+func TestSkipDatabaseCreation(t *testing.T) {
+	var dsns []string
+	unavailable := func(s *Store) {
+		s.open = func(dialect string, args ...interface{}) (*gorm.DB, error) {
+			dsns = append(dsns, args[0].(string))
+			return nil, errors.New("connection refused")
+		}
+	}
+
+	// Connects to the database directly
+	_, err := NewStore(testDBURL, unavailable, SetSkipDatabaseCreation(true))
+	if err == nil {
+		t.Fatal("expected NewStore to fail")
+	}
+	if have, want := len(dsns), 1; have != want {
+		t.Fatalf("connected %d times, want %d", have, want)
+	}
+	cfg, err := mysqldriver.ParseDSN(dsns[0])
+	if err != nil {
+		t.Fatalf("ParseDSN failed with %v", err)
+	}
+	if have, want := cfg.DBName, "jobqueue_e2e"; have != want {
+		t.Fatalf("DBName = %q, want %q", have, want)
+	}
+}
+
+func TestSkipSchemaCreation(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	defer dropDatabase(t, testDBURL)
+
+	// Create an empty database
+	cfg, err := mysqldriver.ParseDSN(testDBURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbname := cfg.DBName
+	cfg.DBName = ""
+	db, err := gorm.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB().Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", dbname))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables are not created
+	_, err = NewStore(testDBURL, SetSkipDatabaseCreation(true), SetSkipSchemaCreation(true))
+	if err == nil || !strings.Contains(err.Error(), "table jobqueue_jobs does not exist") {
+		t.Fatalf("expected NewStore to fail because of the missing table, got %v", err)
+	}
+
+	// Provision the tables, then use them
+	st, err := NewStore(testDBURL)
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	st.Close()
+	st, err = NewStore(testDBURL, SetSkipDatabaseCreation(true), SetSkipSchemaCreation(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer st.Close()
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+}
+
+func TestMaxConcurrentClaims(t *testing.T) {
+	const n = 3
+	var s Store
+	SetMaxConcurrentClaims(n)(&s)
+
+	var (
+		mu      sync.Mutex
+		running int
+		max     int
+		wg      sync.WaitGroup
+	)
+	// A burst of idle workers claims jobs at the same time
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := s.claim()
+			defer release()
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if max > n {
+		t.Fatalf("%d claims ran concurrently, want at most %d", max, n)
+	}
+	if max < 2 {
+		t.Fatalf("%d claims ran concurrently, want them to run in parallel", max)
+	}
+}
+
+func TestStoreImplementsContextStore(t *testing.T) {
+	var _ jobqueue.ContextStore = (*Store)(nil)
+}
+
+func TestStoreImplementsTopicStatsStore(t *testing.T) {
+	var _ jobqueue.TopicStatsStore = (*Store)(nil)
+}
+
+func TestStoreImplementsOptionalStores(t *testing.T) {
+	var _ jobqueue.CreateOrGetStore = (*Store)(nil)
+	var _ jobqueue.MutexStore = (*Store)(nil)
+	var _ jobqueue.BatchReserveStore = (*Store)(nil)
+	var _ jobqueue.RetryStore = (*Store)(nil)
+	var _ jobqueue.ImportStore = (*Store)(nil)
+	var _ jobqueue.TopicRenameStore = (*Store)(nil)
+}
+
+func TestStatsByTopic(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "1", Topic: "a", State: jobqueue.Waiting},
+		{ID: "2", Topic: "a", State: jobqueue.Waiting},
+		{ID: "3", Topic: "a", State: jobqueue.Failed},
+		{ID: "4", Topic: "b", State: jobqueue.Succeeded},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	stats, err := st.StatsByTopic()
+	if err != nil {
+		t.Fatalf("StatsByTopic failed with %v", err)
+	}
+	want := map[string]jobqueue.Stats{
+		"a": {Waiting: 2, Failed: 1},
+		"b": {Succeeded: 1},
+	}
+	if have, want := len(stats), len(want); have != want {
+		t.Fatalf("len(stats) = %d, want %d", have, want)
+	}
+	for topic, w := range want {
+		if s := stats[topic]; s == nil || *s != w {
+			t.Errorf("stats[%q] = %+v, want %+v", topic, s, w)
+		}
+	}
+}
+
+func TestListContext(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	job := &jobqueue.Job{ID: "a", Topic: "topic", State: jobqueue.Waiting}
+	if err := st.CreateContext(context.Background(), job); err != nil {
+		t.Fatalf("CreateContext failed with %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rsp, err := st.ListContext(ctx, &jobqueue.ListRequest{})
+	if err != nil {
+		t.Fatalf("ListContext failed with %v", err)
+	}
+	if have, want := rsp.Total, 1; have != want {
+		t.Fatalf("Total = %d, want %d", have, want)
+	}
+
+	// A cancelled context aborts the queries
+	cancel()
+	if _, err := st.ListContext(ctx, &jobqueue.ListRequest{}); err == nil {
+		t.Fatal("expected ListContext to fail with a cancelled context")
+	}
+	if _, err := st.NextContext(ctx, &jobqueue.NextRequest{}); err == nil || err == jobqueue.ErrNotFound {
+		t.Fatalf("expected NextContext to fail with a cancelled context, have %v", err)
+	}
+}
+
+func TestBatchColumns(t *testing.T) {
+	columns := (&Job{}).columns()
+	if have, want := len(mysqlBatchColumns), len(columns); have != want {
+		t.Fatalf("len(mysqlBatchColumns) = %d, want %d", have, want)
+	}
+	for _, name := range mysqlBatchColumns {
+		if _, found := columns[name]; !found {
+			t.Errorf("column %q of mysqlBatchColumns is not in Job.columns", name)
+		}
+	}
+}
+
+func TestCreateBatch(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(false))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	// More jobs than fit into a single statement
+	n := 2*createBatchSize + 1
+	jobs := make([]*jobqueue.Job, n)
+	for i := range jobs {
+		jobs[i] = &jobqueue.Job{Topic: "topic", Args: []interface{}{"Hello", float64(i)}, Priority: int64(i)}
+	}
+	if err := st.CreateBatch(jobs); err != nil {
+		t.Fatalf("CreateBatch failed with %v", err)
+	}
+	stats, err := st.Stats(&jobqueue.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := stats.Waiting, n; have != want {
+		t.Fatalf("Waiting = %d, want %d", have, want)
+	}
+	last := jobs[n-1]
+	if last.ID == "" || last.Created == 0 || last.Updated != last.Created {
+		t.Fatalf("expected ID, Created, and Updated to be set; got %+v", last)
+	}
+	job, err := st.Lookup(last.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := fmt.Sprint(job.Args), fmt.Sprint(last.Args); have != want {
+		t.Fatalf("Args = %v, want %v", have, want)
+	}
+	if have, want := job.Created, last.Created; have != want {
+		t.Fatalf("Created = %d, want %d", have, want)
+	}
+
+	// A batch with a duplicate identifier is rolled back as a whole
+	err = st.CreateBatch([]*jobqueue.Job{
+		{ID: "new", Topic: "topic"},
+		{ID: last.ID, Topic: "topic"},
+	})
+	if err == nil {
+		t.Fatal("expected CreateBatch to fail")
+	}
+	if _, err := st.Lookup("new"); err != jobqueue.ErrNotFound {
+		t.Fatalf("Lookup returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+}
+
+// BenchmarkCreate and BenchmarkCreateBatch compare enqueuing jobs
+// one-by-one with enqueuing them in batches.
+func BenchmarkCreate(b *testing.B) {
+	benchmarkCreate(b, func(st *Store, jobs []*jobqueue.Job) error {
+		for _, job := range jobs {
+			if err := st.Create(job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkCreateBatch(b *testing.B) {
+	benchmarkCreate(b, (*Store).CreateBatch)
+}
+
+func benchmarkCreate(b *testing.B, create func(*Store, []*jobqueue.Job) error) {
+	if !isTravis() {
+		b.Skip("skipping integration benchmark; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL)
+	if err != nil {
+		b.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(b, testDBURL)
+
+	const n = 1000 // jobs per op
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jobs := make([]*jobqueue.Job, n)
+		for k := range jobs {
+			jobs[k] = &jobqueue.Job{
+				ID:      fmt.Sprintf("%d-%d", i, k),
+				Topic:   "topic",
+				State:   jobqueue.Waiting,
+				Args:    []interface{}{"Hello", k},
+				Created: time.Now().UnixNano(),
+			}
+		}
+		if err := create(st, jobs); err != nil {
+			b.Fatalf("create failed with %v", err)
+		}
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Working}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	// Two managers update the same job
+	first, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	second, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	first.LastError = "still working"
+	if err := st.Update(first); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	second.State = jobqueue.Waiting
+	if err := st.Update(second); err != jobqueue.ErrConflict {
+		t.Fatalf("expected Update to return ErrConflict, got %v", err)
+	}
+	if errs := st.UpdateBatch([]*jobqueue.Job{second}); errs[0] != jobqueue.ErrConflict {
+		t.Fatalf("expected UpdateBatch to return ErrConflict, got %v", errs[0])
+	}
+
+	// The first update is kept, and the job can be updated once re-read
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != jobqueue.Working || job.LastError != "still working" {
+		t.Fatalf("State = %q, LastError = %q, want %q and %q", job.State, job.LastError, jobqueue.Working, "still working")
+	}
+	if job.Updated != first.Updated {
+		t.Fatalf("Updated = %d, want %d", job.Updated, first.Updated)
+	}
+	job.State = jobqueue.Waiting
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+
+	// Jobs that have not been read from the store are written unconditionally
+	job = &jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Succeeded}
+	if err := st.Update(job); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+}
+
+func TestUpdateBatch(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "1", Topic: "topic", State: jobqueue.Working, Args: []interface{}{"Hello"}},
+		{ID: "2", Topic: "topic", State: jobqueue.Working},
+		{ID: "done", Topic: "topic", State: jobqueue.Succeeded},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	errs := st.UpdateBatch([]*jobqueue.Job{
+		{ID: "1", Topic: "topic", State: jobqueue.Succeeded, Args: []interface{}{"Hello"}, Result: []byte(`"ok"`), CompletedBy: "worker-1"},
+		{ID: "2", Topic: "topic", State: jobqueue.Failed, LastError: "kaboom"},
+		{ID: "done", Topic: "topic", State: jobqueue.Failed},
+		{ID: "missing", Topic: "topic", State: jobqueue.Succeeded},
+	})
+	want := []error{nil, nil, jobqueue.ErrInvalidTransition, jobqueue.ErrNotFound}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Fatalf("UpdateBatch returned %v, want %v", errs, want)
+		}
+	}
+
+	job, err := st.Lookup("1")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != jobqueue.Succeeded || string(job.Result) != `"ok"` || job.CompletedBy != "worker-1" || fmt.Sprint(job.Args) != "[Hello]" {
+		t.Fatalf("job 1 = %+v", job)
+	}
+	job, err = st.Lookup("2")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != jobqueue.Failed || job.LastError != "kaboom" {
+		t.Fatalf("job 2 = %+v", job)
+	}
+	job, err = st.Lookup("done")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if job.State != jobqueue.Succeeded {
+		t.Fatalf("State of finalized job = %q, want %q", job.State, jobqueue.Succeeded)
+	}
+	if _, err := st.Lookup("missing"); err != jobqueue.ErrNotFound {
+		t.Fatalf("Lookup returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+}
+
+// BenchmarkUpdate and BenchmarkUpdateBatch compare completing jobs
+// one-by-one with completing them in batches.
+func BenchmarkUpdate(b *testing.B) {
+	benchmarkUpdate(b, func(st *Store, jobs []*jobqueue.Job) error {
+		for _, job := range jobs {
+			if err := st.Update(job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkUpdateBatch(b *testing.B) {
+	benchmarkUpdate(b, func(st *Store, jobs []*jobqueue.Job) error {
+		for _, err := range st.UpdateBatch(jobs) {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func benchmarkUpdate(b *testing.B, update func(*Store, []*jobqueue.Job) error) {
+	if !isTravis() {
+		b.Skip("skipping integration benchmark; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL)
+	if err != nil {
+		b.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(b, testDBURL)
+
+	const n = 100 // jobs per op
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		jobs := make([]*jobqueue.Job, n)
+		for k := range jobs {
+			jobs[k] = &jobqueue.Job{ID: fmt.Sprintf("%d-%d", i, k), Topic: "topic", State: jobqueue.Working}
+		}
+		if err := st.CreateBatch(jobs); err != nil {
+			b.Fatalf("CreateBatch failed with %v", err)
+		}
+		for _, job := range jobs {
+			job.State = jobqueue.Succeeded
+			job.Completed = time.Now().UnixNano()
+		}
+		b.StartTimer()
+		if err := update(st, jobs); err != nil {
+			b.Fatalf("update failed with %v", err)
+		}
+	}
+}
+
+func TestNextExcludeTopics(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	jobs := []*jobqueue.Job{
+		{ID: "email", Topic: "email", State: jobqueue.Waiting, Priority: 10},
+		{ID: "sms", Topic: "sms", State: jobqueue.Waiting, Priority: 5},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	req := &jobqueue.NextRequest{ExcludeTopics: []string{"email"}}
+	job, err := st.Next(req)
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := job.ID, "sms"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+	if _, err := st.Next(req); err != jobqueue.ErrNotFound {
+		t.Fatalf("Next returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+	if _, err := st.NextWithMutex(req); err != jobqueue.ErrNotFound {
+		t.Fatalf("NextWithMutex returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+	job, err = st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if have, want := job.ID, "email"; have != want {
+		t.Fatalf("Next = %q, want %q", have, want)
+	}
+}
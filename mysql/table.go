@@ -0,0 +1,73 @@
+package mysql
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// defaultTableName is the name of the table of the jobs, unless
+// configured otherwise via SetTableName.
+const defaultTableName = "jobqueue_jobs"
+
+// tableNameRegexp matches the valid names of tables. It leaves room for
+// the suffix of the migrations table within the 64 characters MySQL
+// allows.
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,45}$`)
+
+// SetTableName sets the name of the table of the jobs, e.g. to keep
+// several independent queues in the same database. The tables for the
+// locks of NextWithMutex and for the applied updates of the schema are
+// named after it, with a _locks and a _schema_migrations suffix,
+// respectively. The name may only consist of letters, digits, and
+// underscores, and must not start with a digit. It is jobqueue_jobs by
+// default, with jobqueue_locks and jobqueue_schema_migrations.
+func SetTableName(name string) StoreOption {
+	return func(s *Store) {
+		s.table = name
+	}
+}
+
+// locksTableName returns the name of the table of the locks that belongs
+// to the given table of jobs.
+func locksTableName(table string) string {
+	if table == defaultTableName {
+		return "jobqueue_locks"
+	}
+	return table + "_locks"
+}
+
+// migrationsTableName returns the name of the table of the applied
+// updates of the schema that belongs to the given table of jobs.
+func migrationsTableName(table string) string {
+	if table == defaultTableName {
+		return "jobqueue_schema_migrations"
+	}
+	return table + "_schema_migrations"
+}
+
+// renameTables returns stmt, which refers to the tables by their default
+// names, with the names of the tables that belong to the given table of
+// jobs instead.
+func renameTables(stmt, table string) string {
+	if table == defaultTableName {
+		return stmt
+	}
+	return strings.NewReplacer(
+		defaultTableName, table,
+		locksTableName(defaultTableName), locksTableName(table),
+		migrationsTableName(defaultTableName), migrationsTableName(table),
+	).Replace(stmt)
+}
+
+// rename returns stmt with the tables of the store, see renameTables.
+func (s *Store) rename(stmt string) string {
+	return renameTables(stmt, s.table)
+}
+
+// jobs returns a query on the table of the jobs of the store. Use it
+// instead of db.Model(&Job{}), which always refers to the default table.
+func (s *Store) jobs(db *gorm.DB) *gorm.DB {
+	return db.Table(s.table)
+}
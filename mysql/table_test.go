@@ -0,0 +1,104 @@
+package mysql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/olivere/jobqueue"
+)
+
+func TestRenameTables(t *testing.T) {
+	tests := []struct {
+		Table string
+		Stmt  string
+		Want  string
+	}{
+		{defaultTableName, mysqlLocksSchema, mysqlLocksSchema},
+		{defaultTableName, mysqlUpdate022, mysqlUpdate022},
+		{"billing", mysqlUpdate022, "ALTER TABLE billing ADD completed_by varchar(255);"},
+		{"billing", "INSERT INTO jobqueue_locks (mutex_key, job_id) VALUES (?, ?)", "INSERT INTO billing_locks (mutex_key, job_id) VALUES (?, ?)"},
+		{"billing", "SELECT 1 FROM jobqueue_jobs j WHERE NOT EXISTS (SELECT 1 FROM jobqueue_jobs w)", "SELECT 1 FROM billing j WHERE NOT EXISTS (SELECT 1 FROM billing w)"},
+	}
+	for i, tt := range tests {
+		if have := renameTables(tt.Stmt, tt.Table); have != tt.Want {
+			t.Errorf("#%d: renameTables = %q, want %q", i, have, tt.Want)
+		}
+	}
+}
+
+func TestSetTableNameInvalid(t *testing.T) {
+	var attempts int
+	unavailable := func(s *Store) {
+		s.open = func(dialect string, args ...interface{}) (*gorm.DB, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		}
+	}
+
+	for _, name := range []string{"", "1jobs", "jobs; DROP TABLE users", "jobs`", "queue-jobs"} {
+		_, err := NewStore(testDBURL, unavailable, SetTableName(name))
+		if err == nil {
+			t.Fatalf("expected NewStore to fail for table name %q", name)
+		}
+	}
+	if have, want := attempts, 0; have != want {
+		t.Fatalf("connected %d times, want %d", have, want)
+	}
+}
+
+func TestSetTableName(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	defer dropDatabase(t, testDBURL)
+
+	// Two independent queues in the same database
+	billing, err := NewStore(testDBURL, SetTableName("billing_jobs"))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer billing.Close()
+	emails, err := NewStore(testDBURL, SetTableName("email_jobs"))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer emails.Close()
+
+	if err := billing.Create(&jobqueue.Job{ID: "1", Topic: "invoice", MutexKey: "customer-1"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	if _, err := emails.Lookup("1"); err != jobqueue.ErrNotFound {
+		t.Fatalf("Lookup returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+	if _, err := emails.Next(&jobqueue.NextRequest{}); err != jobqueue.ErrNotFound {
+		t.Fatalf("Next returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+	job, err := billing.NextWithMutex(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("NextWithMutex failed with %v", err)
+	}
+	if have, want := job.ID, "1"; have != want {
+		t.Fatalf("ID = %q, want %q", have, want)
+	}
+	stats, err := billing.Stats(&jobqueue.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := stats.Working, 1; have != want {
+		t.Fatalf("Working = %d, want %d", have, want)
+	}
+
+	for _, table := range []string{"billing_jobs", "email_jobs"} {
+		stmts, err := SchemaDiffTable(billing.db.DB(), table)
+		if err != nil {
+			t.Fatalf("SchemaDiffTable failed with %v", err)
+		}
+		if have, want := len(stmts), 0; have != want {
+			t.Fatalf("len(SchemaDiffTable(%s)) = %d, want %d: %v", table, have, want, stmts)
+		}
+	}
+}
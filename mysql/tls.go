@@ -0,0 +1,40 @@
+package mysql
+
+import (
+	"crypto/tls"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// SetTLSConfig connects to the server via TLS with a custom configuration,
+// e.g. to verify the certificate of a managed MySQL server against the
+// CA of its provider. NewStore registers cfg with the driver under the
+// given name and sets the tls parameter of the DSN to it, both for the
+// connection that creates the database and for the store itself.
+//
+// For servers with certificates that are trusted by the system, passing
+// tls=true in the DSN is still enough, and this option is not needed.
+func SetTLSConfig(name string, cfg *tls.Config) StoreOption {
+	return func(s *Store) {
+		s.tlsName = name
+		s.tlsConfig = cfg
+	}
+}
+
+// registerTLSConfig registers the configuration passed to SetTLSConfig,
+// if any, with the driver, and returns url with its tls parameter
+// referring to it.
+func (s *Store) registerTLSConfig(url string) (string, error) {
+	if s.tlsConfig == nil {
+		return url, nil
+	}
+	if err := mysqldriver.RegisterTLSConfig(s.tlsName, s.tlsConfig); err != nil {
+		return "", err
+	}
+	cfg, err := mysqldriver.ParseDSN(url)
+	if err != nil {
+		return "", err
+	}
+	cfg.TLSConfig = s.tlsName
+	return cfg.FormatDSN(), nil
+}
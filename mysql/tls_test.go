@@ -0,0 +1,47 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+)
+
+func TestSetTLSConfig(t *testing.T) {
+	var dsns []string
+	unavailable := func(s *Store) {
+		s.open = func(dialect string, args ...interface{}) (*gorm.DB, error) {
+			dsns = append(dsns, args[0].(string))
+			return nil, errors.New("connection refused")
+		}
+	}
+
+	cfg := &tls.Config{ServerName: "db.example.com"}
+	_, err := NewStore(testDBURL, unavailable, SetTLSConfig("jobqueue-test", cfg))
+	if err == nil {
+		t.Fatal("expected NewStore to fail")
+	}
+	if have, want := len(dsns), 1; have != want {
+		t.Fatalf("connected %d times, want %d", have, want)
+	}
+	// The connection that creates the database uses TLS, too
+	setup, err := mysqldriver.ParseDSN(dsns[0])
+	if err != nil {
+		t.Fatalf("ParseDSN failed with %v", err)
+	}
+	if have, want := setup.TLSConfig, "jobqueue-test"; have != want {
+		t.Fatalf("tls = %q, want %q", have, want)
+	}
+	if have, want := setup.DBName, ""; have != want {
+		t.Fatalf("DBName = %q, want %q", have, want)
+	}
+}
+
+func TestSetTLSConfigReservedName(t *testing.T) {
+	_, err := NewStore(testDBURL, SetTLSConfig("true", &tls.Config{}))
+	if err == nil {
+		t.Fatal("expected NewStore to fail")
+	}
+}
@@ -0,0 +1,23 @@
+package postgres
+
+import (
+	"github.com/olivere/jobqueue"
+)
+
+// SetLogger specifies the logger of the store. It receives errors, e.g.
+// failed attempts to connect to the database. By default, the store logs
+// nothing (see jobqueue.NopLogger).
+func SetLogger(logger jobqueue.Logger) StoreOption {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// errorf reports an error via the logger of the store.
+func (s *Store) errorf(format string, v ...interface{}) {
+	if l, ok := s.logger.(jobqueue.LeveledLogger); ok {
+		l.Errorf(format, v...)
+		return
+	}
+	s.logger.Printf(format, v...)
+}
@@ -0,0 +1,1295 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+
+	"github.com/olivere/jobqueue"
+)
+
+const (
+	postgresSchema = `CREATE TABLE IF NOT EXISTS jobqueue_jobs (
+id varchar(36) primary key,
+topic varchar(255),
+state varchar(30),
+args jsonb,
+rank integer not null default 0,
+priority bigint,
+sub_priority bigint not null default 0,
+retry integer,
+max_retry integer,
+correlation_group varchar(255),
+correlation_id varchar(255),
+created bigint,
+started bigint,
+completed bigint,
+last_mod bigint,
+repeats integer not null default 0,
+repeat_every bigint not null default 0,
+worker_id varchar(255),
+min_worker_version integer not null default 0,
+seq bigserial,
+lease_token varchar(36),
+lease_expires bigint not null default 0,
+last_error text,
+callback_url text,
+unique_key varchar(255),
+heartbeat bigint not null default 0,
+mutex_key varchar(255),
+run_at bigint not null default 0,
+claimed_at bigint not null default 0,
+result bytea,
+log_output text,
+timeout bigint not null default 0,
+redeliveries integer not null default 0,
+max_redeliveries integer not null default 0,
+completed_by varchar(255),
+trace_context text);`
+
+	// postgresColumnExists is the query to find out whether a column of
+	// the jobqueue_jobs table exists.
+	postgresColumnExists = `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'jobqueue_jobs' AND column_name = $1`
+
+	// postgresLocksSchema is the table of mutex keys that NextWithMutex
+	// locks to serialize concurrent claims of jobs with the same key. The
+	// rows only live within the transaction of the claim.
+	postgresLocksSchema = `CREATE TABLE IF NOT EXISTS jobqueue_locks (
+mutex_key varchar(255) primary key,
+job_id varchar(36) not null);`
+
+	// postgresClaimedBefore matches jobs that have been claimed before the
+	// given time. Jobs without ClaimedAt fall back to their start time.
+	postgresClaimedBefore = `((claimed_at > 0 AND claimed_at < ?) OR (claimed_at = 0 AND started < ?))`
+
+	// postgresNextOrder is the order in which Next picks waiting jobs.
+	postgresNextOrder = `rank desc, priority desc, sub_priority desc, created asc, seq asc`
+
+	// postgresNextCandidate selects the next waiting job that is due,
+	// skipping jobs locked by concurrent claims. The first verb is the
+	// condition on excluded topics, see excludeTopics.
+	postgresNextCandidate = `SELECT * FROM jobqueue_jobs WHERE state = ? AND run_at <= ? AND min_worker_version <= ? AND id NOT IN (?)%s ORDER BY %s LIMIT 1 FOR UPDATE SKIP LOCKED`
+
+	// postgresNextWithMutex selects the next waiting job whose mutex key
+	// is not held by a working job. The first verb is the condition on
+	// excluded topics, see excludeTopics.
+	postgresNextWithMutex = `SELECT j.* FROM jobqueue_jobs j WHERE j.state = ? AND j.run_at <= ? AND j.min_worker_version <= ? AND (j.mutex_key IS NULL OR NOT EXISTS (SELECT 1 FROM jobqueue_jobs w WHERE w.mutex_key = j.mutex_key AND w.state = ?))%s ORDER BY %s LIMIT 1 FOR UPDATE OF j SKIP LOCKED`
+
+	// postgresFairOrder is prepended to the order of the jobs in fair mode,
+	// so that the correlation identifier claimed least recently goes first.
+	// The argument is the name or alias of the table of the jobs.
+	postgresFairOrder = `(SELECT COALESCE(MAX(c.claimed_at), 0) FROM jobqueue_jobs c WHERE c.correlation_id = %[1]s.correlation_id OR (c.correlation_id IS NULL AND %[1]s.correlation_id IS NULL)) asc, `
+
+	// postgresReserve claims up to n waiting jobs, or jobs whose lease has
+	// expired, in a single statement.
+	postgresReserve = `UPDATE jobqueue_jobs SET state = ?, lease_token = ?, lease_expires = ?, started = ?, claimed_at = ?, heartbeat = ?, last_mod = ? WHERE id IN (SELECT id FROM jobqueue_jobs WHERE (state = ? AND run_at <= ?) OR (state = ? AND lease_expires > 0 AND lease_expires < ?) ORDER BY rank desc, priority desc, sub_priority desc, created asc, seq asc LIMIT ? FOR UPDATE SKIP LOCKED)`
+
+	// postgresMinVersion is the minimum server version, as returned by
+	// SHOW server_version_num. PostgreSQL 9.5 introduced SKIP LOCKED.
+	postgresMinVersion = 90500
+)
+
+// postgresColumns are the columns that have been added to the schema of
+// the jobqueue_jobs table, in the order to add them to existing tables.
+var postgresColumns = []struct {
+	name string
+	stmt string
+}{
+	{name: "result", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN result bytea;`},
+	{name: "log_output", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN log_output text;`},
+	{name: "timeout", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN timeout bigint NOT NULL DEFAULT 0;`},
+	{name: "redeliveries", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN redeliveries integer NOT NULL DEFAULT 0;`},
+	{name: "max_redeliveries", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN max_redeliveries integer NOT NULL DEFAULT 0;`},
+	{name: "completed_by", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN completed_by varchar(255);`},
+	{name: "trace_context", stmt: `ALTER TABLE jobqueue_jobs ADD COLUMN trace_context text;`},
+}
+
+// postgresIndexes are the indexes of the jobqueue_jobs table.
+var postgresIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS ix_jobs_topic ON jobqueue_jobs (topic);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_state ON jobqueue_jobs (state);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_next ON jobqueue_jobs (state, rank desc, priority desc, sub_priority desc, created, seq);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_state_created ON jobqueue_jobs (state, created);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_state_heartbeat ON jobqueue_jobs (state, heartbeat);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_correlation_id ON jobqueue_jobs (correlation_id);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_correlation_group_and_id ON jobqueue_jobs (correlation_group, correlation_id);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_completed ON jobqueue_jobs (completed);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_last_mod ON jobqueue_jobs (last_mod);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_worker_id ON jobqueue_jobs (worker_id);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS ix_jobs_seq ON jobqueue_jobs (seq);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_lease_token ON jobqueue_jobs (lease_token);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_unique_key ON jobqueue_jobs (unique_key);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS ix_jobs_active_unique_key ON jobqueue_jobs (unique_key) WHERE state IN ('waiting', 'working');`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_mutex_key ON jobqueue_jobs (mutex_key);`,
+	`CREATE INDEX IF NOT EXISTS ix_jobs_run_at ON jobqueue_jobs (run_at);`,
+}
+
+// Store represents a persistent PostgreSQL storage implementation.
+// It implements the jobqueue.Store interface.
+type Store struct {
+	db    *gorm.DB
+	debug bool
+
+	connectAttempts int           // number of attempts to connect in NewStore
+	connectBackoff  time.Duration // time between the first and second attempt
+
+	allowTerminalUpdates bool          // allow Update of jobs in a terminal state
+	reclaimAfter         time.Duration // min. age of working jobs that Start marks as failed (0 for all)
+	maxListLimit         int           // max. number of jobs returned by List (0 for no maximum)
+
+	logger jobqueue.Logger // receives errors, see SetLogger
+}
+
+// StoreOption is an options provider for Store.
+type StoreOption func(*Store)
+
+// NewStore initializes a new PostgreSQL-based storage. The url is either
+// a connection URL, e.g. "postgres://user@localhost/jobqueue?sslmode=disable",
+// or a connection string of key/value pairs, e.g. "dbname=jobqueue
+// sslmode=disable". NewStore creates both the database and the schema
+// if necessary. It requires PostgreSQL 9.5 or later.
+func NewStore(url string, options ...StoreOption) (*Store, error) {
+	st := &Store{
+		connectAttempts: 1,
+		logger:          jobqueue.NopLogger{},
+	}
+	for _, opt := range options {
+		opt(st)
+	}
+	opts, err := parseDSN(url)
+	if err != nil {
+		return nil, err
+	}
+	dbname := opts["dbname"]
+	if dbname == "" {
+		return nil, errors.New("no database specified")
+	}
+	// Connect, and create database and schema, retrying if the database
+	// is not available yet
+	backoff := st.connectBackoff
+	for attempt := 1; ; attempt++ {
+		err = st.connect(opts, dbname)
+		if err == nil {
+			break
+		}
+		if attempt >= st.connectAttempts {
+			return nil, err
+		}
+		st.errorf("postgres: error connecting to database (attempt %d of %d), retrying in %v: %v", attempt, st.connectAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return st, nil
+}
+
+// connect connects to the database, and creates both the database and
+// the schema if necessary.
+func (s *Store) connect(opts map[string]string, dbname string) error {
+	// First connect to the maintenance database
+	setupopts := make(map[string]string, len(opts))
+	for k, v := range opts {
+		setupopts[k] = v
+	}
+	setupopts["dbname"] = "postgres"
+	setupdb, err := sql.Open("postgres", formatDSN(setupopts))
+	if err != nil {
+		return err
+	}
+	defer setupdb.Close()
+	var count int64
+	err = setupdb.QueryRow("SELECT COUNT(*) FROM pg_database WHERE datname = $1", dbname).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		// Create database; there is no CREATE DATABASE IF NOT EXISTS
+		_, err = setupdb.Exec("CREATE DATABASE " + pq.QuoteIdentifier(dbname))
+		if e, ok := err.(*pq.Error); ok && e.Code == "42P04" {
+			// Created concurrently, e.g. by another process
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Now connect again, this time with the db name
+	db, err := gorm.Open("postgres", formatDSN(opts))
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.DB().QueryRow("SHOW server_version_num").Scan(&version)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	if version < postgresMinVersion {
+		db.Close()
+		return fmt.Errorf("postgres: server version %d is not supported; PostgreSQL 9.5 or later is required", version)
+	}
+
+	// Create schema
+	stmts := append([]string{postgresSchema, postgresLocksSchema}, postgresIndexes...)
+	for _, stmt := range stmts {
+		if _, err = db.DB().Exec(stmt); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	// Add the columns that tables of older versions are missing
+	for _, col := range postgresColumns {
+		var count int
+		err = db.DB().QueryRow(postgresColumnExists, col.name).Scan(&count)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err = db.DB().Exec(col.stmt); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	s.db = db
+	if s.debug {
+		s.db = s.db.Debug()
+	}
+	return nil
+}
+
+// parseDSN parses a connection URL or a connection string of key/value
+// pairs into its options, following the rules of libpq.
+func parseDSN(url string) (map[string]string, error) {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		var err error
+		url, err = pq.ParseURL(url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := make(map[string]string)
+	r := []rune(url)
+	for i := 0; ; {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i >= len(r) {
+			return opts, nil
+		}
+		start := i
+		for i < len(r) && r[i] != '=' && !unicode.IsSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i >= len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("postgres: missing %q after %q in connection string", "=", key)
+		}
+		i++
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		var val []rune
+		if i < len(r) && r[i] == '\'' {
+			for i++; ; i++ {
+				if i >= len(r) {
+					return nil, errors.New("postgres: unterminated quoted string in connection string")
+				}
+				if r[i] == '\'' {
+					i++
+					break
+				}
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				val = append(val, r[i])
+			}
+		} else {
+			for ; i < len(r) && !unicode.IsSpace(r[i]); i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				val = append(val, r[i])
+			}
+		}
+		opts[key] = string(val)
+	}
+}
+
+// formatDSN formats the options as a connection string of key/value
+// pairs, as accepted by parseDSN.
+func formatDSN(opts map[string]string) string {
+	escaper := strings.NewReplacer(`'`, `\'`, `\`, `\\`)
+	var kvs []string
+	for k, v := range opts {
+		kvs = append(kvs, k+"='"+escaper.Replace(v)+"'")
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, " ")
+}
+
+// Close closes the connection to the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SetDebug indicates whether to enable or disable debugging (which will
+// output SQL to the console).
+func SetDebug(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.debug = enabled
+	}
+}
+
+// SetConnectRetry specifies how often NewStore tries to connect to the
+// database, and to create the database and schema, before it gives up.
+// The time between attempts starts at backoff and doubles after each
+// attempt. NewStore gives up after the first attempt by default.
+func SetConnectRetry(attempts int, backoff time.Duration) StoreOption {
+	return func(s *Store) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		s.connectAttempts = attempts
+		s.connectBackoff = backoff
+	}
+}
+
+// SetAllowTerminalUpdates indicates whether Update may change jobs that
+// are in a terminal state already. By default, Update returns
+// jobqueue.ErrInvalidTransition for those jobs, so a job cannot be
+// finalized twice, e.g. by two managers sharing the same database.
+func SetAllowTerminalUpdates(enabled bool) StoreOption {
+	return func(s *Store) {
+		s.allowTerminalUpdates = enabled
+	}
+}
+
+// SetReclaimAfter specifies how long a job must have been working, without
+// a heartbeat in that time, before Start considers it abandoned, e.g.
+// because its manager crashed, and marks it as failed. By default, Start
+// marks all working jobs as failed.
+func SetReclaimAfter(d time.Duration) StoreOption {
+	return func(s *Store) {
+		s.reclaimAfter = d
+	}
+}
+
+// SetMaxListLimit specifies the maximum number of jobs that List returns,
+// regardless of the limit passed in the request. A request without a
+// limit gets the maximum; a request for more jobs is logged. There is no
+// maximum by default.
+func SetMaxListLimit(n int) StoreOption {
+	return func(s *Store) {
+		s.maxListLimit = n
+	}
+}
+
+func (s *Store) wrapError(err error) error {
+	if err == gorm.ErrRecordNotFound {
+		// Map gorm.ErrRecordNotFound to jobqueue-specific "not found" error
+		return jobqueue.ErrNotFound
+	}
+	return err
+}
+
+// Start is called when the manager starts up.
+// We ensure that stale jobs are marked as failed so that we have place
+// for new jobs (see SetReclaimAfter).
+func (s *Store) Start() error {
+	now := time.Now()
+	qry := s.db.Model(&Job{}).Where("state = ?", jobqueue.Working)
+	if s.reclaimAfter > 0 {
+		// Keep the jobs that other managers are working on
+		cutoff := now.Add(-s.reclaimAfter).UnixNano()
+		qry = qry.Where("heartbeat < ?", cutoff).Where(postgresClaimedBefore, cutoff, cutoff)
+	}
+	fields := map[string]interface{}{
+		"state":     jobqueue.Failed,
+		"completed": now.UnixNano(),
+		"last_mod":  now.UnixNano(),
+	}
+	releaseLease(fields)
+	err := qry.Updates(fields).Error
+	return s.wrapError(err)
+}
+
+// Create adds a new job to the store.
+func (s *Store) Create(job *jobqueue.Job) error {
+	return s.create(s.db, job)
+}
+
+// CreateOrGet adds a new job to the store, unless there is a waiting or
+// working job with the same unique key already.
+func (s *Store) CreateOrGet(job *jobqueue.Job) (*jobqueue.Job, bool, error) {
+	if job.UniqueKey == "" {
+		if err := s.Create(job); err != nil {
+			return nil, false, err
+		}
+		return job, true, nil
+	}
+	tx := s.db.Begin()
+	// Serialize concurrent calls with the same key: Unlike FOR UPDATE in
+	// MySQL, row locks do not keep others from inserting the row.
+	err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", job.UniqueKey).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, false, s.wrapError(err)
+	}
+	var existing Job
+	err = tx.Where("unique_key = ? AND state IN (?)", job.UniqueKey, []string{jobqueue.Waiting, jobqueue.Working}).
+		First(&existing).Error
+	if err == nil {
+		tx.Rollback()
+		found, err := existing.ToJob()
+		if err != nil {
+			return nil, false, err
+		}
+		return found, false, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil, false, s.wrapError(err)
+	}
+	if err := s.create(tx, job); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, s.wrapError(err)
+	}
+	return job, true, nil
+}
+
+// create adds a new job via db.
+func (s *Store) create(db *gorm.DB, job *jobqueue.Job) error {
+	j, err := newJob(job)
+	if err != nil {
+		return err
+	}
+	j.LastMod = j.Created
+	err = db.Create(j).Error
+	if e, ok := err.(*pq.Error); ok && e.Code == "23505" && e.Constraint == "ix_jobs_active_unique_key" {
+		return jobqueue.ErrDuplicate
+	}
+	return s.wrapError(err)
+}
+
+// Update updates the job in the store.
+func (s *Store) Update(job *jobqueue.Job) error {
+	j, err := newJob(job)
+	if err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	var state string
+	err = tx.Raw("SELECT state FROM jobqueue_jobs WHERE id = ? FOR UPDATE", job.ID).Row().Scan(&state)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return jobqueue.ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	if jobqueue.IsTerminal(state) && !s.allowTerminalUpdates {
+		// E.g. another worker has finalized the job already
+		tx.Rollback()
+		return jobqueue.ErrInvalidTransition
+	}
+	j.LastMod = time.Now().UnixNano()
+	// Do not use Save here: It would re-create a job that has been
+	// deleted in the meantime.
+	columns := j.columns()
+	if j.State != jobqueue.Working {
+		releaseLease(columns)
+	}
+	res := tx.Model(&Job{}).Where("id = ?", j.ID).UpdateColumns(columns)
+	if res.Error != nil {
+		tx.Rollback()
+		return s.wrapError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return jobqueue.ErrNotFound
+	}
+	if err := tx.Commit().Error; err != nil {
+		return s.wrapError(err)
+	}
+	job.Updated = j.LastMod
+	return nil
+}
+
+// ResetRetries sets the retry counter of a waiting job back to zero.
+func (s *Store) ResetRetries(id string) error {
+	res := s.db.Model(&Job{}).
+		Where("id = ? AND state = ?", id, jobqueue.Waiting).
+		UpdateColumns(map[string]interface{}{
+			"retry":    0,
+			"last_mod": time.Now().UnixNano(),
+		})
+	if res.Error != nil {
+		return s.wrapError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return jobqueue.ErrNotFound
+	}
+	return nil
+}
+
+// Heartbeat records that the worker is still working on the job.
+func (s *Store) Heartbeat(id string) error {
+	err := s.db.Model(&Job{}).
+		Where("id = ? AND state = ?", id, jobqueue.Working).
+		UpdateColumn("heartbeat", time.Now().UnixNano()).
+		Error
+	return s.wrapError(err)
+}
+
+// ReclaimExpired recovers working jobs without a recent heartbeat.
+func (s *Store) ReclaimExpired(olderThan time.Duration) (int, error) {
+	now := time.Now()
+	cutoff := now.Add(-olderThan).UnixNano()
+	// Jobs reserved via ReserveBatch are kept until their lease expires
+	const expired = "state = ? AND heartbeat < ? AND lease_expires < ? AND " + postgresClaimedBefore
+
+	tx := s.db.Begin()
+	poisoned := tx.Model(&Job{}).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("max_redeliveries > 0 AND redeliveries >= max_redeliveries").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Failed,
+			"completed":     now.UnixNano(),
+			"last_error":    jobqueue.ErrMaxRedeliveries.Error(),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if poisoned.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(poisoned.Error)
+	}
+	failed := tx.Model(&Job{}).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("retry >= max_retry").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Failed,
+			"completed":     now.UnixNano(),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if failed.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(failed.Error)
+	}
+	retried := tx.Model(&Job{}).
+		Where(expired, jobqueue.Working, cutoff, now.UnixNano(), cutoff, cutoff).
+		Where("retry < max_retry").
+		UpdateColumns(map[string]interface{}{
+			"state":         jobqueue.Waiting,
+			"retry":         gorm.Expr("retry + 1"),
+			"redeliveries":  gorm.Expr("redeliveries + 1"),
+			"last_mod":      now.UnixNano(),
+			"lease_token":   nil,
+			"lease_expires": 0,
+		})
+	if retried.Error != nil {
+		tx.Rollback()
+		return 0, s.wrapError(retried.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, s.wrapError(err)
+	}
+	return int(poisoned.RowsAffected + failed.RowsAffected + retried.RowsAffected), nil
+}
+
+// CompareAndSetState changes the state of a job if it is currently in
+// the from state.
+func (s *Store) CompareAndSetState(id, from, to string) (bool, error) {
+	fields := map[string]interface{}{
+		"state":    to,
+		"last_mod": time.Now().UnixNano(),
+	}
+	if to != jobqueue.Working {
+		releaseLease(fields)
+	}
+	res := s.db.Model(&Job{}).
+		Where("id = ? AND state = ?", id, from).
+		UpdateColumns(fields)
+	if res.Error != nil {
+		return false, s.wrapError(res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// RenameTopic moves the jobs of a topic to another topic, e.g. when a
+// topic gets renamed. If states are given, only the jobs in one of them
+// are moved, e.g. jobqueue.Waiting to leave the history alone. Do not
+// move working jobs while a manager works on jobs of the topic: A working
+// job is saved with its old topic when it completes.
+func (s *Store) RenameTopic(from, to string, states ...string) (int64, error) {
+	qry := s.db.Model(&Job{}).Where("topic = ?", from)
+	if len(states) > 0 {
+		qry = qry.Where("state IN (?)", states)
+	}
+	res := qry.UpdateColumns(map[string]interface{}{
+		"topic":    to,
+		"last_mod": time.Now().UnixNano(),
+	})
+	if res.Error != nil {
+		return 0, s.wrapError(res.Error)
+	}
+	return res.RowsAffected, nil
+}
+
+// ReserveBatch claims up to n jobs and leases them for the given duration.
+// The jobs are claimed in a single UPDATE that skips locked rows, so
+// concurrent calls never return the same job.
+func (s *Store) ReserveBatch(n int, lease time.Duration) ([]*jobqueue.ReservedJob, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	token := uuid.New().String()
+	now := time.Now()
+	expires := now.Add(lease)
+	err := s.db.Exec(postgresReserve,
+		jobqueue.Working, token, expires.UnixNano(), now.UnixNano(), now.UnixNano(), now.UnixNano(), now.UnixNano(),
+		jobqueue.Waiting, now.UnixNano(), jobqueue.Working, now.UnixNano(), n).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	var list []*Job
+	err = s.db.Where("lease_token = ?", token).
+		Order(postgresNextOrder).
+		Find(&list).
+		Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	var reserved []*jobqueue.ReservedJob
+	for _, j := range list {
+		job, err := j.ToJob()
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		reserved = append(reserved, &jobqueue.ReservedJob{Job: job, Token: token, LeaseExpires: expires})
+	}
+	return reserved, nil
+}
+
+// FailAndRetry records a failed attempt of a working job, and either
+// retries it after delay or moves it into the Failed state.
+func (s *Store) FailAndRetry(id string, delay time.Duration, errMsg string) error {
+	tx := s.db.Begin()
+	var j Job
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).First(&j).Error
+	if err != nil {
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	if j.State != jobqueue.Working {
+		tx.Rollback()
+		return jobqueue.ErrInvalidTransition
+	}
+	now := time.Now()
+	fields := map[string]interface{}{
+		"last_error": errMsg,
+		"last_mod":   now.UnixNano(),
+	}
+	releaseLease(fields)
+	if j.Retry >= j.MaxRetry {
+		fields["state"] = jobqueue.Failed
+		fields["completed"] = now.UnixNano()
+	} else {
+		fields["state"] = jobqueue.Waiting
+		fields["retry"] = j.Retry + 1
+		runAt := now.Add(delay).UnixNano()
+		fields["run_at"] = runAt
+		fields["priority"] = -runAt
+	}
+	err = tx.Model(&Job{}).Where("id = ?", id).UpdateColumns(fields).Error
+	if err != nil {
+		tx.Rollback()
+		return s.wrapError(err)
+	}
+	return s.wrapError(tx.Commit().Error)
+}
+
+// ImportTerminal adds jobs that are in a terminal state already,
+// in a single transaction.
+func (s *Store) ImportTerminal(jobs []*jobqueue.Job) error {
+	var list []*Job
+	for _, job := range jobs {
+		if !jobqueue.IsTerminal(job.State) {
+			return fmt.Errorf("postgres: cannot import job %s in state %s", job.ID, job.State)
+		}
+		j, err := newJob(job)
+		if err != nil {
+			return err
+		}
+		if j.LastMod == 0 {
+			j.LastMod = j.Completed
+		}
+		list = append(list, j)
+	}
+	tx := s.db.Begin()
+	for _, j := range list {
+		if err := tx.Create(j).Error; err != nil {
+			tx.Rollback()
+			return s.wrapError(err)
+		}
+	}
+	return s.wrapError(tx.Commit().Error)
+}
+
+// Next claims the next job to execute, or nil if no executable job is available.
+//
+// The job is selected with FOR UPDATE SKIP LOCKED and moved into the
+// Working state in the same transaction, so concurrent calls skip it.
+func (s *Store) Next(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	order := postgresNextOrder
+	switch {
+	case req.FIFO:
+		order = "created asc, seq asc"
+	case req.LIFO:
+		order = "created desc, seq desc"
+	}
+	if req.Fair {
+		order = fmt.Sprintf(postgresFairOrder, "jobqueue_jobs") + order
+	}
+
+	tx := s.db.Begin()
+	rejected := []string{""} // jobs vetoed by req.Gate; never empty for NOT IN
+	var j Job
+	for {
+		j = Job{}
+		cond, args := excludeTopics(req, "jobqueue_jobs", jobqueue.Waiting, time.Now().UnixNano(), req.WorkerVersion, rejected)
+		err := tx.Raw(fmt.Sprintf(postgresNextCandidate, cond, order), args...).Scan(&j).Error
+		if err == gorm.ErrRecordNotFound {
+			tx.Rollback()
+			return nil, jobqueue.ErrNotFound
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		ok, err := s.gate(req, &j)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		rejected = append(rejected, j.ID)
+	}
+	if err := s.claimJob(tx, &j, req); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, s.wrapError(err)
+	}
+	return j.ToJob()
+}
+
+// excludeTopics returns the condition that filters out the jobs of the
+// topics excluded by req, for the table with the given name or alias, and
+// the arguments of the query including the ones of the condition.
+func excludeTopics(req *jobqueue.NextRequest, table string, args ...interface{}) (string, []interface{}) {
+	if len(req.ExcludeTopics) == 0 {
+		return "", args
+	}
+	return fmt.Sprintf(" AND %s.topic NOT IN (?)", table), append(args, req.ExcludeTopics)
+}
+
+// gate asks the claim gate of the request, if any, whether j may be claimed.
+func (s *Store) gate(req *jobqueue.NextRequest, j *Job) (bool, error) {
+	if req.Gate == nil {
+		return true, nil
+	}
+	job, err := j.ToJob()
+	if err != nil {
+		return false, s.wrapError(err)
+	}
+	return req.Gate(job)
+}
+
+// claimJob moves the locked job j into the Working state via tx, on
+// behalf of the worker of req.
+func (s *Store) claimJob(tx *gorm.DB, j *Job, req *jobqueue.NextRequest) error {
+	now := time.Now().UnixNano()
+	j.State = jobqueue.Working
+	j.Started = now
+	j.ClaimedAt = now
+	j.Heartbeat = now
+	j.LastMod = now
+	j.WorkerID = sql.NullString{String: req.WorkerID, Valid: req.WorkerID != ""}
+	err := tx.Model(&Job{}).Where("id = ?", j.ID).UpdateColumns(map[string]interface{}{
+		"state":         j.State,
+		"started":       j.Started,
+		"claimed_at":    j.ClaimedAt,
+		"heartbeat":     j.Heartbeat,
+		"last_mod":      j.LastMod,
+		"worker_id":     j.WorkerID,
+		"lease_token":   nil,
+		"lease_expires": 0,
+	}).Error
+	return s.wrapError(err)
+}
+
+// NextWithMutex claims the next job to execute whose mutex key is not
+// held by another working job.
+func (s *Store) NextWithMutex(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	order := "j.rank desc, j.priority desc, j.sub_priority desc, j.created asc, j.seq asc"
+	switch {
+	case req.FIFO:
+		order = "j.created asc, j.seq asc"
+	case req.LIFO:
+		order = "j.created desc, j.seq desc"
+	}
+	if req.Fair {
+		order = fmt.Sprintf(postgresFairOrder, "j") + order
+	}
+	tx := s.db.Begin()
+	var j Job
+	cond, args := excludeTopics(req, "j", jobqueue.Waiting, time.Now().UnixNano(), req.WorkerVersion, jobqueue.Working)
+	err := tx.Raw(fmt.Sprintf(postgresNextWithMutex, cond, order), args...).Scan(&j).Error
+	if err == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil, jobqueue.ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, s.wrapError(err)
+	}
+	if j.MutexKey.Valid {
+		// Lock the key, so concurrent claims of the key wait for us
+		err = tx.Exec(`INSERT INTO jobqueue_locks (mutex_key, job_id) VALUES (?, ?) ON CONFLICT (mutex_key) DO UPDATE SET job_id = EXCLUDED.job_id`, j.MutexKey.String, j.ID).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		// Make sure no one else has claimed a job with the key in the meantime
+		var count int64
+		err = tx.Raw(`SELECT COUNT(*) FROM jobqueue_jobs WHERE mutex_key = ? AND state = ?`, j.MutexKey.String, jobqueue.Working).Row().Scan(&count)
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+		if count > 0 {
+			tx.Rollback()
+			return nil, jobqueue.ErrNotFound
+		}
+	}
+	if err := s.claimJob(tx, &j, req); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if j.MutexKey.Valid {
+		// The working job holds the key from now on. Concurrent claims
+		// of the key still wait for us, as we keep the row locked.
+		err = tx.Exec(`DELETE FROM jobqueue_locks WHERE mutex_key = ?`, j.MutexKey.String).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, s.wrapError(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, s.wrapError(err)
+	}
+	return j.ToJob()
+}
+
+// Delete removes a job from the store.
+func (s *Store) Delete(job *jobqueue.Job) error {
+	err := s.db.Where("id = ?", job.ID).Delete(&Job{}).Error
+	return s.wrapError(err)
+}
+
+// Lookup retrieves a single job in the store by its identifier.
+func (s *Store) Lookup(id string) (*jobqueue.Job, error) {
+	var j Job
+	err := s.db.Where("id = ?", id).First(&j).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	job, err := j.ToJob()
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	return job, nil
+}
+
+// LookupByCorrelationID returns the details of jobs by their correlation identifier.
+// If no such job could be found, an empty array is returned.
+func (s *Store) LookupByCorrelationID(correlationID string) ([]*jobqueue.Job, error) {
+	var jobs []Job
+	err := s.db.Where("correlation_id = ?", correlationID).Find(&jobs).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	result := make([]*jobqueue.Job, len(jobs))
+	for i := range jobs {
+		job, err := jobs[i].ToJob()
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		result[i] = job
+	}
+	return result, nil
+}
+
+// filter applies the filters of the ListRequest to qry.
+func (s *Store) filter(qry *gorm.DB, request *jobqueue.ListRequest) *gorm.DB {
+	if request.Topic != "" {
+		qry = qry.Where("topic = ?", request.Topic)
+	}
+	if request.State != "" {
+		qry = qry.Where("state = ?", request.State)
+	}
+	if request.CorrelationGroup != "" {
+		qry = qry.Where("correlation_group = ?", request.CorrelationGroup)
+	}
+	if request.CorrelationID != "" {
+		qry = qry.Where("correlation_id = ?", request.CorrelationID)
+	}
+	if request.CreatedAfter > 0 {
+		qry = qry.Where("created > ?", request.CreatedAfter)
+	}
+	if request.CreatedBefore > 0 {
+		qry = qry.Where("created < ?", request.CreatedBefore)
+	}
+	return qry
+}
+
+// listLimit returns the number of jobs that List returns at most for the
+// given limit, taking the maximum set via SetMaxListLimit into account.
+func (s *Store) listLimit(limit int) int {
+	if s.maxListLimit <= 0 || (limit > 0 && limit <= s.maxListLimit) {
+		return limit
+	}
+	if limit > 0 {
+		// Only report limits that have been asked for explicitly
+		s.logger.Printf("postgres: clamping list limit of %d to %d", limit, s.maxListLimit)
+	}
+	return s.maxListLimit
+}
+
+// List returns a list of all jobs stored in the data store.
+func (s *Store) List(request *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
+	rsp := &jobqueue.ListResponse{}
+
+	// Count
+	err := s.filter(s.db.Model(&Job{}), request).Count(&rsp.Total).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+
+	// Find
+	qry := s.db.Order("last_mod desc, seq desc").
+		Offset(request.Offset).
+		Limit(s.listLimit(request.Limit))
+	var list []*Job
+	err = s.filter(qry, request).Find(&list).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	for _, j := range list {
+		job, err := j.ToJob()
+		if err != nil {
+			return nil, s.wrapError(err)
+		}
+		rsp.Jobs = append(rsp.Jobs, job)
+	}
+	return rsp, nil
+}
+
+// Stats returns statistics about the jobs in the store.
+func (s *Store) Stats(req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
+	stats := new(jobqueue.Stats)
+	buildFilter := func(state string) *gorm.DB {
+		f := s.db.Model(&Job{}).Where("state = ?", state)
+		if req.Topic != "" {
+			f = f.Where("topic = ?", req.Topic)
+		}
+		if req.CorrelationGroup != "" {
+			f = f.Where("correlation_group = ?", req.CorrelationGroup)
+		}
+		return f
+	}
+	err := buildFilter(jobqueue.Waiting).Count(&stats.Waiting).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	err = buildFilter(jobqueue.Working).Count(&stats.Working).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	err = buildFilter(jobqueue.Succeeded).Count(&stats.Succeeded).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	err = buildFilter(jobqueue.Failed).Count(&stats.Failed).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	err = buildFilter(jobqueue.Cancelled).Count(&stats.Cancelled).Error
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	return stats, nil
+}
+
+// StatsByTopic returns statistics about the jobs in the store, grouped
+// by topic. It implements jobqueue.TopicStatsStore.
+func (s *Store) StatsByTopic() (map[string]*jobqueue.Stats, error) {
+	rows, err := s.db.Raw("SELECT topic, state, COUNT(*) FROM jobqueue_jobs GROUP BY topic, state").Rows()
+	if err != nil {
+		return nil, s.wrapError(err)
+	}
+	defer rows.Close()
+	result := make(map[string]*jobqueue.Stats)
+	for rows.Next() {
+		var topic, state string
+		var count int
+		if err := rows.Scan(&topic, &state, &count); err != nil {
+			return nil, s.wrapError(err)
+		}
+		stats, found := result[topic]
+		if !found {
+			stats = new(jobqueue.Stats)
+			result[topic] = stats
+		}
+		switch state {
+		case jobqueue.Waiting:
+			stats.Waiting = count
+		case jobqueue.Working:
+			stats.Working = count
+		case jobqueue.Succeeded:
+			stats.Succeeded = count
+		case jobqueue.Failed:
+			stats.Failed = count
+		case jobqueue.Cancelled:
+			stats.Cancelled = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.wrapError(err)
+	}
+	return result, nil
+}
+
+// -- PostgreSQL-internal representation of a task --
+
+type Job struct {
+	ID               string `gorm:"primary_key"`
+	Topic            string
+	State            string
+	Args             sql.NullString // jsonb
+	Rank             int
+	Priority         int64
+	SubPriority      int64
+	Retry            int
+	MaxRetry         int
+	CorrelationGroup sql.NullString
+	CorrelationID    sql.NullString
+	Created          int64
+	Started          int64
+	Completed        int64
+	LastMod          int64
+	Repeats          int
+	RepeatEvery      int64
+	WorkerID         sql.NullString
+	MinWorkerVersion int
+	Seq              int64          `gorm:"AUTO_INCREMENT"` // assigned by the database
+	LeaseToken       sql.NullString // set by ReserveBatch
+	LeaseExpires     int64          // set by ReserveBatch
+	LastError        sql.NullString
+	CallbackURL      sql.NullString
+	UniqueKey        sql.NullString
+	Heartbeat        int64
+	MutexKey         sql.NullString
+	RunAt            int64
+	ClaimedAt        int64
+	Result           []byte
+	LogOutput        sql.NullString
+	Timeout          int64
+	Redeliveries     int
+	MaxRedeliveries  int
+	CompletedBy      sql.NullString
+	TraceContext     sql.NullString
+}
+
+func (Job) TableName() string {
+	return "jobqueue_jobs"
+}
+
+func newJob(job *jobqueue.Job) (*Job, error) {
+	var args string
+	if job.Args != nil {
+		v, err := json.Marshal(job.Args)
+		if err != nil {
+			return nil, err
+		}
+		args = string(v)
+	}
+	var traceContext string
+	if len(job.TraceContext) > 0 {
+		v, err := json.Marshal(job.TraceContext)
+		if err != nil {
+			return nil, err
+		}
+		traceContext = string(v)
+	}
+	return &Job{
+		ID:               job.ID,
+		Topic:            job.Topic,
+		State:            job.State,
+		Args:             sql.NullString{String: args, Valid: args != ""},
+		Rank:             job.Rank,
+		Priority:         job.Priority,
+		SubPriority:      job.SubPriority,
+		Retry:            job.Retry,
+		MaxRetry:         job.MaxRetry,
+		CorrelationGroup: sql.NullString{String: job.CorrelationGroup, Valid: job.CorrelationGroup != ""},
+		CorrelationID:    sql.NullString{String: job.CorrelationID, Valid: job.CorrelationID != ""},
+		Created:          job.Created,
+		LastMod:          job.Updated,
+		Started:          job.Started,
+		Completed:        job.Completed,
+		Repeats:          job.Repeats,
+		RepeatEvery:      int64(job.RepeatEvery),
+		WorkerID:         sql.NullString{String: job.WorkerID, Valid: job.WorkerID != ""},
+		MinWorkerVersion: job.MinWorkerVersion,
+		LastError:        sql.NullString{String: job.LastError, Valid: job.LastError != ""},
+		CallbackURL:      sql.NullString{String: job.CallbackURL, Valid: job.CallbackURL != ""},
+		UniqueKey:        sql.NullString{String: job.UniqueKey, Valid: job.UniqueKey != ""},
+		MutexKey:         sql.NullString{String: job.MutexKey, Valid: job.MutexKey != ""},
+		Heartbeat:        job.Heartbeat,
+		RunAt:            job.RunAt,
+		ClaimedAt:        job.ClaimedAt,
+		Result:           job.Result,
+		LogOutput:        sql.NullString{String: job.LogOutput, Valid: job.LogOutput != ""},
+		Timeout:          int64(job.Timeout),
+		Redeliveries:     job.Redeliveries,
+		MaxRedeliveries:  job.MaxRedeliveries,
+		CompletedBy:      sql.NullString{String: job.CompletedBy, Valid: job.CompletedBy != ""},
+		TraceContext:     sql.NullString{String: traceContext, Valid: traceContext != ""},
+	}, nil
+}
+
+// columns returns the values of all columns of j except the identifier.
+func (j *Job) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"topic":              j.Topic,
+		"state":              j.State,
+		"args":               j.Args,
+		"rank":               j.Rank,
+		"priority":           j.Priority,
+		"sub_priority":       j.SubPriority,
+		"retry":              j.Retry,
+		"max_retry":          j.MaxRetry,
+		"correlation_group":  j.CorrelationGroup,
+		"correlation_id":     j.CorrelationID,
+		"created":            j.Created,
+		"started":            j.Started,
+		"completed":          j.Completed,
+		"last_mod":           j.LastMod,
+		"repeats":            j.Repeats,
+		"repeat_every":       j.RepeatEvery,
+		"worker_id":          j.WorkerID,
+		"min_worker_version": j.MinWorkerVersion,
+		"last_error":         j.LastError,
+		"callback_url":       j.CallbackURL,
+		"unique_key":         j.UniqueKey,
+		"heartbeat":          j.Heartbeat,
+		"mutex_key":          j.MutexKey,
+		"run_at":             j.RunAt,
+		"claimed_at":         j.ClaimedAt,
+		"result":             j.Result,
+		"log_output":         j.LogOutput,
+		"timeout":            j.Timeout,
+		"redeliveries":       j.Redeliveries,
+		"max_redeliveries":   j.MaxRedeliveries,
+		"completed_by":       j.CompletedBy,
+		"trace_context":      j.TraceContext,
+	}
+}
+
+// releaseLease adds the columns to fields that release the lease of a job
+// reserved via ReserveBatch.
+func releaseLease(fields map[string]interface{}) {
+	fields["lease_token"] = nil
+	fields["lease_expires"] = 0
+}
+
+func (j *Job) ToJob() (*jobqueue.Job, error) {
+	var args []interface{}
+	if j.Args.Valid && j.Args.String != "" {
+		if err := json.Unmarshal([]byte(j.Args.String), &args); err != nil {
+			return nil, err
+		}
+	}
+	var traceContext jobqueue.TraceContext
+	if j.TraceContext.Valid && j.TraceContext.String != "" {
+		if err := json.Unmarshal([]byte(j.TraceContext.String), &traceContext); err != nil {
+			return nil, err
+		}
+	}
+	job := &jobqueue.Job{
+		ID:               j.ID,
+		Topic:            j.Topic,
+		State:            j.State,
+		Args:             args,
+		Rank:             j.Rank,
+		Priority:         j.Priority,
+		SubPriority:      j.SubPriority,
+		Retry:            j.Retry,
+		MaxRetry:         j.MaxRetry,
+		CorrelationGroup: j.CorrelationGroup.String,
+		CorrelationID:    j.CorrelationID.String,
+		Created:          j.Created,
+		Started:          j.Started,
+		Updated:          j.LastMod,
+		Completed:        j.Completed,
+		Repeats:          j.Repeats,
+		RepeatEvery:      time.Duration(j.RepeatEvery),
+		WorkerID:         j.WorkerID.String,
+		MinWorkerVersion: j.MinWorkerVersion,
+		LastError:        j.LastError.String,
+		CallbackURL:      j.CallbackURL.String,
+		UniqueKey:        j.UniqueKey.String,
+		Heartbeat:        j.Heartbeat,
+		MutexKey:         j.MutexKey.String,
+		RunAt:            j.RunAt,
+		ClaimedAt:        j.ClaimedAt,
+		Result:           j.Result,
+		LogOutput:        j.LogOutput.String,
+		Timeout:          time.Duration(j.Timeout),
+		Redeliveries:     j.Redeliveries,
+		MaxRedeliveries:  j.MaxRedeliveries,
+		CompletedBy:      j.CompletedBy.String,
+		TraceContext:     traceContext,
+	}
+	return job, nil
+}
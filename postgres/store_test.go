@@ -0,0 +1,284 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/olivere/jobqueue"
+)
+
+const (
+	testDBURL = "postgres://postgres@127.0.0.1:5432/jobqueue_e2e?sslmode=disable"
+)
+
+func isTravis() bool {
+	return os.Getenv("TRAVIS") != ""
+}
+
+// dropDatabase drops the database specified in the dburl connection string.
+func dropDatabase(t *testing.T, dburl string) {
+	opts, err := parseDSN(dburl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbname := opts["dbname"]
+	if dbname == "" {
+		t.Fatal("no database specified")
+	}
+	// Connect to the maintenance database
+	opts["dbname"] = "postgres"
+	db, err := sql.Open("postgres", formatDSN(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Drop database
+	_, err = db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(dbname))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		URL  string
+		Want map[string]string
+	}{
+		{
+			URL:  "postgres://postgres@127.0.0.1:5432/jobqueue_e2e?sslmode=disable",
+			Want: map[string]string{"user": "postgres", "host": "127.0.0.1", "port": "5432", "dbname": "jobqueue_e2e", "sslmode": "disable"},
+		},
+		{
+			URL:  "postgresql://alice:s3cr%20t@db/jobs",
+			Want: map[string]string{"user": "alice", "password": "s3cr t", "host": "db", "dbname": "jobs"},
+		},
+		{
+			URL:  "dbname=jobs  host = localhost password='it\\'s secret' sslmode=",
+			Want: map[string]string{"dbname": "jobs", "host": "localhost", "password": "it's secret", "sslmode": ""},
+		},
+	}
+	for i, tt := range tests {
+		opts, err := parseDSN(tt.URL)
+		if err != nil {
+			t.Fatalf("#%d: parseDSN returned %v", i, err)
+		}
+		if !reflect.DeepEqual(opts, tt.Want) {
+			t.Fatalf("#%d: want %v, have %v", i, tt.Want, opts)
+		}
+		// Formatting and parsing again must not change the options
+		again, err := parseDSN(formatDSN(opts))
+		if err != nil {
+			t.Fatalf("#%d: parseDSN of formatted options returned %v", i, err)
+		}
+		if !reflect.DeepEqual(again, tt.Want) {
+			t.Fatalf("#%d: want %v after formatting, have %v", i, tt.Want, again)
+		}
+	}
+
+	if _, err := parseDSN("dbname"); err == nil {
+		t.Fatal("expected an error for a missing =")
+	}
+	if _, err := parseDSN("password='secret"); err == nil {
+		t.Fatal("expected an error for an unterminated quote")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	defer dropDatabase(t, testDBURL)
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	st.Close()
+
+	// Creating the store again must keep the existing schema
+	st, err = NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	st.Close()
+}
+
+// TestJobSuccess is the green case where a job is called and it is
+// processed without problems.
+func TestJobSuccess(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	jobDone := make(chan struct{}, 1)
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+	defer st.Close()
+
+	m := jobqueue.New(jobqueue.SetStore(st))
+
+	f := func(args ...interface{}) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected len(args) == 1, have %d", len(args))
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return fmt.Errorf("expected type of 1st arg == string, have %T", args[0])
+		}
+		if have, want := s, "Hello"; have != want {
+			return fmt.Errorf("expected 1st arg = %q, have %q", want, have)
+		}
+		jobDone <- struct{}{}
+		return nil
+	}
+	err = m.Register("topic", f)
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	job := &jobqueue.Job{Topic: "topic", Args: []interface{}{"Hello"}}
+	err = m.Add(job)
+	if err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-jobDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected job to be processed")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+}
+
+func TestNextClaimsJob(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+	defer st.Close()
+
+	now := time.Now().UnixNano()
+	low := &jobqueue.Job{ID: "low", Topic: "topic", State: jobqueue.Waiting, Args: []interface{}{"a", 1.0}, Priority: 1, Created: now}
+	high := &jobqueue.Job{ID: "high", Topic: "topic", State: jobqueue.Waiting, Priority: 2, Created: now}
+	delayed := &jobqueue.Job{ID: "delayed", Topic: "topic", State: jobqueue.Waiting, Priority: 3, Created: now, RunAt: now + int64(time.Hour)}
+	for _, job := range []*jobqueue.Job{low, high, delayed} {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	for _, want := range []string{"high", "low"} {
+		job, err := st.Next(&jobqueue.NextRequest{})
+		if err != nil {
+			t.Fatalf("Next failed with %v", err)
+		}
+		if job.ID != want {
+			t.Fatalf("expected job %q, have %q", want, job.ID)
+		}
+		if job.State != jobqueue.Working || job.ClaimedAt == 0 {
+			t.Fatalf("expected job to be claimed, have state %q and ClaimedAt %d", job.State, job.ClaimedAt)
+		}
+	}
+	job, err := st.Lookup("low")
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if want, have := []interface{}{"a", 1.0}, job.Args; !reflect.DeepEqual(want, have) {
+		t.Fatalf("expected args %v, have %v", want, have)
+	}
+	if _, err := st.Next(&jobqueue.NextRequest{}); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, have %v", err)
+	}
+}
+
+func TestCreateDuplicate(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	err = st.Create(&jobqueue.Job{ID: "2", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"})
+	if have, want := err, jobqueue.ErrDuplicate; have != want {
+		t.Fatalf("Create returned %v, want %v", have, want)
+	}
+
+	// Once the first job has completed, the key can be used again
+	if _, err := st.CompareAndSetState("1", jobqueue.Waiting, jobqueue.Succeeded); err != nil {
+		t.Fatalf("CompareAndSetState failed with %v", err)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "3", Topic: "topic", State: jobqueue.Waiting, UniqueKey: "refresh-account-42"}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+}
+
+func TestNextWithMutex(t *testing.T) {
+	if !isTravis() {
+		t.Skip("skipping integration test; it will only run on travis")
+		return
+	}
+
+	st, err := NewStore(testDBURL, SetDebug(true))
+	if err != nil {
+		t.Fatalf("NewStore returned %v", err)
+	}
+	defer dropDatabase(t, testDBURL)
+	defer st.Close()
+
+	for _, id := range []string{"a1", "a2"} {
+		if err := st.Create(&jobqueue.Job{ID: id, Topic: "topic", State: jobqueue.Waiting, MutexKey: "account-1"}); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	job, err := st.NextWithMutex(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("NextWithMutex failed with %v", err)
+	}
+	if have, want := job.MutexKey, "account-1"; have != want {
+		t.Fatalf("MutexKey = %q, want %q", have, want)
+	}
+	if _, err := st.NextWithMutex(&jobqueue.NextRequest{}); err != jobqueue.ErrNotFound {
+		t.Fatalf("NextWithMutex returned %v, want %v", err, jobqueue.ErrNotFound)
+	}
+
+	// The lock does not outlive the claim
+	var locks int64
+	if err := st.db.Raw(`SELECT COUNT(*) FROM jobqueue_locks`).Row().Scan(&locks); err != nil {
+		t.Fatalf("counting locks failed with %v", err)
+	}
+	if have, want := locks, int64(0); have != want {
+		t.Fatalf("locks = %d, want %d", have, want)
+	}
+}
@@ -4,5 +4,24 @@
 
 package jobqueue
 
+import "context"
+
 // Processor is responsible to process a job for a certain topic.
 type Processor func(...interface{}) error
+
+// ResultProcessor is a Processor that returns a result when it succeeds,
+// e.g. a JSON document. The result is stored in Job.Result. See
+// Manager.RegisterResult.
+type ResultProcessor func(...interface{}) ([]byte, error)
+
+// DefaultProcessor is responsible to process jobs of all topics that have
+// no Processor registered. It gets passed the whole job, so it can e.g.
+// dispatch by topic. It may set Job.Result when it succeeds. See
+// Manager.RegisterDefault.
+type DefaultProcessor func(*Job) error
+
+// ContextProcessor is a Processor that gets passed a context, which is
+// cancelled when the manager does not want to wait for the job anymore,
+// e.g. when CloseWithTimeout times out. See Manager.RegisterContext and
+// SetCancellationPolicy.
+type ContextProcessor func(ctx context.Context, args ...interface{}) error
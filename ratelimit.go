@@ -0,0 +1,81 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxCorrelationLimiters is the number of correlation identifiers that
+// the manager keeps rate limiters for. Limiters of the correlation
+// identifiers used least recently are dropped first.
+const maxCorrelationLimiters = 10000
+
+// correlationLimits rate-limits the execution of jobs per correlation
+// identifier with a token bucket each. It is only used by the scheduler.
+type correlationLimits struct {
+	rate     float64 // tokens added per second
+	burst    int     // max. number of tokens
+	size     int     // max. number of limiters
+	limiters map[string]*list.Element
+	lru      *list.List // of *tokenBucket, most recently used first
+}
+
+// tokenBucket is the rate limiter of a single correlation identifier.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time // time tokens was last updated
+}
+
+func newCorrelationLimits(rate float64, burst int) *correlationLimits {
+	if burst < 1 {
+		burst = 1
+	}
+	return &correlationLimits{
+		rate:     rate,
+		burst:    burst,
+		size:     maxCorrelationLimiters,
+		limiters: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// reserve takes a token for executing a job with the given correlation
+// identifier at now. If there is no token left, it returns how long to
+// wait for the next token instead. Jobs without a correlation identifier
+// are not limited.
+func (l *correlationLimits) reserve(key string, now time.Time) time.Duration {
+	if l == nil || key == "" {
+		return 0
+	}
+	var b *tokenBucket
+	if e, found := l.limiters[key]; found {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > float64(l.burst) {
+			b.tokens = float64(l.burst)
+		}
+		b.last = now
+	} else {
+		b = &tokenBucket{key: key, tokens: float64(l.burst), last: now}
+		l.limiters[key] = l.lru.PushFront(b)
+		if l.lru.Len() > l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.limiters, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if l.rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
@@ -0,0 +1,56 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCorrelationLimitsReserve(t *testing.T) {
+	l := newCorrelationLimits(2, 2)
+	now := time.Now()
+
+	// Burst
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve("a", now); wait != 0 {
+			t.Fatalf("#%d: wait = %v, want 0", i, wait)
+		}
+	}
+	if have, want := l.reserve("a", now), 500*time.Millisecond; have != want {
+		t.Fatalf("wait = %v, want %v", have, want)
+	}
+	// Other correlation identifiers are not affected
+	if wait := l.reserve("b", now); wait != 0 {
+		t.Fatalf("wait = %v, want 0", wait)
+	}
+	// Nor are jobs without a correlation identifier
+	if wait := l.reserve("", now); wait != 0 {
+		t.Fatalf("wait = %v, want 0", wait)
+	}
+	// Refill
+	if wait := l.reserve("a", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("wait = %v, want 0", wait)
+	}
+}
+
+func TestCorrelationLimitsEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newCorrelationLimits(1, 1)
+	l.size = 2
+	now := time.Now()
+	l.reserve("a", now)
+	l.reserve("b", now)
+	l.reserve("a", now) // a is used more recently than b now
+	l.reserve("c", now)
+	if have, want := len(l.limiters), 2; have != want {
+		t.Fatalf("len(limiters) = %d, want %d", have, want)
+	}
+	if _, found := l.limiters["b"]; found {
+		t.Fatal("expected limiter of b to be evicted")
+	}
+	if _, found := l.limiters["a"]; !found {
+		t.Fatal("expected limiter of a to be kept")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import "sync"
+
+// recentJobs is a ring buffer of the most recently completed jobs.
+type recentJobs struct {
+	mu   sync.Mutex
+	jobs []*Job // ring buffer
+	next int    // index in jobs to write to next
+	n    int    // number of jobs in the buffer
+}
+
+func newRecentJobs(size int) *recentJobs {
+	return &recentJobs{jobs: make([]*Job, size)}
+}
+
+// add records a copy of job, dropping the oldest job if the buffer is full.
+func (r *recentJobs) add(job *Job) {
+	if len(r.jobs) == 0 {
+		return
+	}
+	dup := *job
+	r.mu.Lock()
+	r.jobs[r.next] = &dup
+	r.next = (r.next + 1) % len(r.jobs)
+	if r.n < len(r.jobs) {
+		r.n++
+	}
+	r.mu.Unlock()
+}
+
+// list returns up to k jobs, most recent first.
+func (r *recentJobs) list(k int) []*Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if k > r.n {
+		k = r.n
+	}
+	var list []*Job
+	for i := 1; i <= k; i++ {
+		idx := (r.next - i + len(r.jobs)) % len(r.jobs)
+		dup := *r.jobs[idx]
+		list = append(list, &dup)
+	}
+	return list
+}
@@ -0,0 +1,122 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"sort"
+	"time"
+)
+
+// Schedule describes the next occurrence of a repeating job, i.e. a job
+// with Repeats and RepeatEvery set, or of a schedule registered via
+// RegisterSchedule. Use Manager.Schedules to list them.
+type Schedule struct {
+	Topic            string        `json:"topic"`       // topic of the job
+	CorrelationGroup string        `json:"cgroup"`      // external group of the job
+	CorrelationID    string        `json:"cid"`         // external identifier of the job
+	PreviousJobID    string        `json:"prevjobid"`   // identifier of the previous occurrence
+	Remaining        int           `json:"remaining"`   // number of occurrences left, including the next one
+	RepeatEvery      time.Duration `json:"repeatevery"` // interval between occurrences
+	NextRunAt        time.Time     `json:"next_run_at"` // time when the next occurrence is due
+	Spec             string        `json:"spec"`        // cron expression of a schedule registered via RegisterSchedule
+}
+
+// repeat schedules the next occurrence of a repeating job. The next
+// occurrence is added as a new job right away, but is not executed before
+// job.RepeatEvery has passed (see Job.RunAt), so it survives a restart
+// of the manager. remaining is the number of occurrences left, including
+// the next one.
+func (m *Manager) repeat(job *Job, remaining int) {
+	next := &Job{
+		Topic:            job.Topic,
+		Args:             job.Args,
+		Rank:             job.Rank,
+		SubPriority:      job.SubPriority,
+		MaxRetry:         job.MaxRetry,
+		MaxRedeliveries:  job.MaxRedeliveries,
+		CorrelationGroup: job.CorrelationGroup,
+		CorrelationID:    job.CorrelationID,
+		MinWorkerVersion: job.MinWorkerVersion,
+		CallbackURL:      job.CallbackURL,
+		MutexKey:         job.MutexKey,
+		Timeout:          job.Timeout,
+		Repeats:          remaining,
+		RepeatEvery:      job.RepeatEvery,
+		store:            job.store,
+	}
+	if err := m.AddDelayed(next, job.RepeatEvery); err != nil {
+		m.errorf("jobqueue: error adding next occurrence of job %v: %v", job.ID, err)
+		return
+	}
+	m.testJobRepeated() // testing hook
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.repeats == nil {
+		// Manager not started or already stopped
+		return
+	}
+	// Occurrences that are claimed by other managers, or deleted, are
+	// never claimed here, so forget them once they are due
+	m.pruneRepeats(time.Now())
+	m.repeats[next.ID] = &Schedule{
+		Topic:            job.Topic,
+		CorrelationGroup: job.CorrelationGroup,
+		CorrelationID:    job.CorrelationID,
+		PreviousJobID:    job.ID,
+		Remaining:        remaining,
+		RepeatEvery:      job.RepeatEvery,
+		NextRunAt:        time.Unix(0, next.RunAt),
+	}
+}
+
+// Schedules returns the pending occurrences of repeating jobs and of
+// schedules registered via RegisterSchedule, ordered by the time they are
+// due.
+func (m *Manager) Schedules() []*Schedule {
+	m.mu.Lock()
+	m.pruneRepeats(time.Now())
+	var list []*Schedule
+	for _, sched := range m.repeats {
+		dup := *sched
+		list = append(list, &dup)
+	}
+	for _, c := range m.crons {
+		if c.next.IsZero() {
+			continue
+		}
+		list = append(list, &Schedule{
+			Topic:            c.job.Topic,
+			CorrelationGroup: c.group,
+			CorrelationID:    c.job.CorrelationID,
+			NextRunAt:        c.next,
+			Spec:             c.spec,
+		})
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextRunAt.Before(list[j].NextRunAt)
+	})
+	return list
+}
+
+// pruneRepeats forgets the occurrences of repeating jobs that are due at
+// the given time, as they are ordinary jobs then. The caller must hold m.mu.
+func (m *Manager) pruneRepeats(now time.Time) {
+	for id, sched := range m.repeats {
+		if !sched.NextRunAt.After(now) {
+			delete(m.repeats, id)
+		}
+	}
+}
+
+// stopRepeats forgets the pending occurrences of repeating jobs that the
+// manager has added. The occurrences remain in the store, so they are
+// executed when a manager is started again.
+func (m *Manager) stopRepeats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.repeats = nil
+}
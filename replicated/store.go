@@ -0,0 +1,482 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package replicated implements a jobqueue.Store that replicates the jobs
+// to several backends, e.g. two MySQL databases on different hosts, so
+// that the outage of a single backend does not take down the queue.
+//
+// The consistency model is as follows. The first backend is the primary,
+// the others are replicas. A backend is considered unavailable for an
+// operation if it returns an error other than jobqueue.ErrNotFound,
+// jobqueue.ErrInvalidTransition, jobqueue.ErrDuplicate, or
+// jobqueue.ErrConflict.
+//
+// Writes, e.g. Create, Update, and Delete, are applied to all backends,
+// one after the other. A write succeeds if at least as many backends
+// have accepted it as the write quorum requires (see SetWriteQuorum).
+// Backends that missed a write, e.g. because they were down, are not
+// caught up automatically. Each backend keeps its own version of a job
+// (see Job.Updated), so only the primary checks the version on Update;
+// the replicas are updated unconditionally.
+//
+// Reads, e.g. Lookup, List, and Stats, are served by the primary. If it
+// is unavailable, they fail over to the replicas in order. Lookup also
+// repairs on read: If the primary does not know a job, but a replica
+// does, the job is returned and copied to the primary. This may also
+// resurrect a job that was deleted while the replica was down.
+//
+// Claims, e.g. Next and ReserveBatch, are performed on the primary, or on
+// the first available replica if the primary is unavailable, as they must
+// be atomic. The claimed jobs are then written to the other backends.
+// Jobs that have been claimed on one backend while another one was down
+// may be claimed again from the latter after a failover, i.e. jobs are
+// executed at least once.
+package replicated
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/olivere/jobqueue"
+)
+
+// Store replicates jobs to several backends. It implements the
+// jobqueue.Store interface. See the package documentation for its
+// consistency model.
+type Store struct {
+	backends []jobqueue.Store // primary first, then replicas
+	quorum   int              // number of backends a write must reach
+	logger   jobqueue.Logger  // receives errors, see SetLogger
+}
+
+// StoreOption is an options provider for Store.
+type StoreOption func(*Store)
+
+// NewStore creates a store that replicates jobs to the given backends.
+// The first backend is the primary. At least one backend is required.
+func NewStore(backends []jobqueue.Store, options ...StoreOption) (*Store, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("replicated: no backends")
+	}
+	st := &Store{
+		backends: backends,
+		quorum:   1,
+		logger:   jobqueue.NopLogger{},
+	}
+	for _, opt := range options {
+		opt(st)
+	}
+	if st.quorum < 1 || st.quorum > len(backends) {
+		return nil, fmt.Errorf("replicated: write quorum must be between 1 and %d, have %d", len(backends), st.quorum)
+	}
+	return st, nil
+}
+
+// SetWriteQuorum specifies the number of backends that must accept a write
+// for it to succeed. The default is 1, i.e. writes succeed as long as a
+// single backend is available. Set it to the number of backends to ensure
+// that every job is stored in all backends, at the cost of availability.
+func SetWriteQuorum(n int) StoreOption {
+	return func(s *Store) {
+		s.quorum = n
+	}
+}
+
+// SetLogger specifies the logger of the store. It receives the errors of
+// backends that could not be brought up to date, e.g. after a claim. By
+// default, the store logs nothing (see jobqueue.NopLogger).
+func SetLogger(logger jobqueue.Logger) StoreOption {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// errorf reports an error via the logger of the store.
+func (s *Store) errorf(format string, v ...interface{}) {
+	if l, ok := s.logger.(jobqueue.LeveledLogger); ok {
+		l.Errorf(format, v...)
+		return
+	}
+	s.logger.Printf(format, v...)
+}
+
+// unavailable returns true if err indicates that a backend is unavailable,
+// rather than the outcome of the operation, e.g. jobqueue.ErrNotFound.
+func unavailable(err error) bool {
+	switch err {
+	case nil, jobqueue.ErrNotFound, jobqueue.ErrInvalidTransition, jobqueue.ErrDuplicate, jobqueue.ErrConflict:
+		return false
+	}
+	return true
+}
+
+// write applies op to all backends, see the package documentation.
+func (s *Store) write(op func(jobqueue.Store) error) error {
+	var accepted int
+	var outcome, failure error
+	for _, b := range s.backends {
+		err := op(b)
+		switch {
+		case err == nil:
+			accepted++
+		case unavailable(err):
+			if failure == nil {
+				failure = err
+			}
+		case outcome == nil:
+			outcome = err
+		}
+	}
+	if accepted >= s.quorum {
+		return nil
+	}
+	if accepted == 0 && outcome != nil {
+		return outcome
+	}
+	if failure != nil {
+		return fmt.Errorf("replicated: write reached %d of %d backends, %d required: %v", accepted, len(s.backends), s.quorum, failure)
+	}
+	return fmt.Errorf("replicated: write reached %d of %d backends, %d required", accepted, len(s.backends), s.quorum)
+}
+
+// unsupported returns the error for a backend that does not implement
+// the optional interface that op requires. It counts as unavailable, so
+// reads fail over to the next backend.
+func unsupported(op string) error {
+	return fmt.Errorf("replicated: backend does not support %s", op)
+}
+
+// read runs op on the first available backend, see the package
+// documentation. It returns the index of that backend.
+func (s *Store) read(op func(jobqueue.Store) error) (int, error) {
+	var err error
+	for i, b := range s.backends {
+		if err = op(b); !unavailable(err) {
+			return i, err
+		}
+	}
+	return -1, err
+}
+
+// replicate writes jobs that have been claimed on the backend with the
+// given index to all other backends.
+func (s *Store) replicate(from int, jobs ...*jobqueue.Job) {
+	for i, b := range s.backends {
+		if i == from {
+			continue
+		}
+		for _, job := range jobs {
+			// The version of the job is the one of the backend it
+			// has been claimed on, see Update
+			j := *job
+			j.Updated = 0
+			err := b.Update(&j)
+			if err == jobqueue.ErrNotFound {
+				err = b.Create(&j)
+			}
+			if err != nil {
+				s.errorf("replicated: error replicating job %v to backend %d: %v", job.ID, i, err)
+			}
+		}
+	}
+}
+
+// Start starts all backends.
+func (s *Store) Start() error {
+	return s.write(func(b jobqueue.Store) error {
+		return b.Start()
+	})
+}
+
+// Create adds a new job to all backends.
+func (s *Store) Create(job *jobqueue.Job) error {
+	return s.write(func(b jobqueue.Store) error {
+		return b.Create(job)
+	})
+}
+
+// CreateOrGet adds a new job, unless there is an active job with the same
+// unique key. The check is performed by the first available backend.
+func (s *Store) CreateOrGet(job *jobqueue.Job) (*jobqueue.Job, bool, error) {
+	var result *jobqueue.Job
+	var created bool
+	i, err := s.read(func(b jobqueue.Store) error {
+		cb, ok := b.(jobqueue.CreateOrGetStore)
+		if !ok {
+			return unsupported("CreateOrGet")
+		}
+		var err error
+		result, created, err = cb.CreateOrGet(job)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		s.replicate(i, result)
+	}
+	return result, created, nil
+}
+
+// Update updates the job in all backends. If the primary refuses the
+// update with jobqueue.ErrConflict, the replicas are left alone. The
+// replicas are updated without a version, as Job.Updated is the version
+// of the primary.
+func (s *Store) Update(job *jobqueue.Job) error {
+	var (
+		primary  = true
+		conflict bool
+	)
+	return s.write(func(b jobqueue.Store) error {
+		j := *job
+		if !primary {
+			if conflict {
+				return jobqueue.ErrConflict
+			}
+			j.Updated = 0
+			return b.Update(&j)
+		}
+		primary = false
+		err := b.Update(&j)
+		switch err {
+		case nil:
+			job.Updated = j.Updated
+		case jobqueue.ErrConflict:
+			conflict = true
+		}
+		return err
+	})
+}
+
+// Delete removes the job from all backends.
+func (s *Store) Delete(job *jobqueue.Job) error {
+	return s.write(func(b jobqueue.Store) error {
+		return b.Delete(job)
+	})
+}
+
+// Next claims the next job to execute on the first available backend, and
+// writes it to the others.
+func (s *Store) Next(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	var job *jobqueue.Job
+	i, err := s.read(func(b jobqueue.Store) error {
+		var err error
+		job, err = b.Next(req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if job != nil {
+		s.replicate(i, job)
+	}
+	return job, nil
+}
+
+// NextWithMutex claims the next job to execute whose MutexKey is not held
+// on the first available backend, and writes it to the others.
+func (s *Store) NextWithMutex(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	var job *jobqueue.Job
+	i, err := s.read(func(b jobqueue.Store) error {
+		mb, ok := b.(jobqueue.MutexStore)
+		if !ok {
+			return unsupported("NextWithMutex")
+		}
+		var err error
+		job, err = mb.NextWithMutex(req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if job != nil {
+		s.replicate(i, job)
+	}
+	return job, nil
+}
+
+// ReserveBatch reserves up to n jobs on the first available backend, and
+// writes them to the others.
+func (s *Store) ReserveBatch(n int, lease time.Duration) ([]*jobqueue.ReservedJob, error) {
+	var reserved []*jobqueue.ReservedJob
+	i, err := s.read(func(b jobqueue.Store) error {
+		rb, ok := b.(jobqueue.BatchReserveStore)
+		if !ok {
+			return unsupported("ReserveBatch")
+		}
+		var err error
+		reserved, err = rb.ReserveBatch(n, lease)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*jobqueue.Job, len(reserved))
+	for k, r := range reserved {
+		jobs[k] = r.Job
+	}
+	s.replicate(i, jobs...)
+	return reserved, nil
+}
+
+// CompareAndSetState changes the state of the job on the first available
+// backend. If it has been changed, the change is applied to the others.
+func (s *Store) CompareAndSetState(id, from, to string) (bool, error) {
+	var changed bool
+	i, err := s.read(func(b jobqueue.Store) error {
+		var err error
+		changed, err = b.CompareAndSetState(id, from, to)
+		return err
+	})
+	if err != nil || !changed {
+		return changed, err
+	}
+	for k, b := range s.backends {
+		if k == i {
+			continue
+		}
+		if _, err := b.CompareAndSetState(id, from, to); err != nil {
+			s.errorf("replicated: error replicating state of job %v to backend %d: %v", id, k, err)
+		}
+	}
+	return true, nil
+}
+
+// ResetRetries resets the retry counter of a waiting job in all backends.
+func (s *Store) ResetRetries(id string) error {
+	return s.write(func(b jobqueue.Store) error {
+		return b.ResetRetries(id)
+	})
+}
+
+// RenameTopic moves the jobs of a topic, optionally only those in one of
+// the given states, to another topic in all backends. It returns the
+// number of jobs moved in the first available backend.
+func (s *Store) RenameTopic(from, to string, states ...string) (int64, error) {
+	var n int64 = -1
+	err := s.write(func(b jobqueue.Store) error {
+		rb, ok := b.(jobqueue.TopicRenameStore)
+		if !ok {
+			return unsupported("RenameTopic")
+		}
+		moved, err := rb.RenameTopic(from, to, states...)
+		if err == nil && n < 0 {
+			n = moved
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// FailAndRetry records a failed attempt of a working job in all backends.
+func (s *Store) FailAndRetry(id string, delay time.Duration, errMsg string) error {
+	return s.write(func(b jobqueue.Store) error {
+		rb, ok := b.(jobqueue.RetryStore)
+		if !ok {
+			return unsupported("FailAndRetry")
+		}
+		return rb.FailAndRetry(id, delay, errMsg)
+	})
+}
+
+// ImportTerminal adds completed jobs to all backends.
+func (s *Store) ImportTerminal(jobs []*jobqueue.Job) error {
+	return s.write(func(b jobqueue.Store) error {
+		ib, ok := b.(jobqueue.ImportStore)
+		if !ok {
+			return unsupported("ImportTerminal")
+		}
+		return ib.ImportTerminal(jobs)
+	})
+}
+
+// Heartbeat records a heartbeat of the job in all backends.
+func (s *Store) Heartbeat(id string) error {
+	return s.write(func(b jobqueue.Store) error {
+		return b.Heartbeat(id)
+	})
+}
+
+// ReclaimExpired recovers working jobs without a recent heartbeat in all
+// backends. It returns the number of jobs reclaimed in the first
+// available backend.
+func (s *Store) ReclaimExpired(olderThan time.Duration) (int, error) {
+	n := -1
+	err := s.write(func(b jobqueue.Store) error {
+		reclaimed, err := b.ReclaimExpired(olderThan)
+		if err == nil && n < 0 {
+			n = reclaimed
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Stats returns statistics about the jobs in the first available backend.
+func (s *Store) Stats(req *jobqueue.StatsRequest) (*jobqueue.Stats, error) {
+	var stats *jobqueue.Stats
+	_, err := s.read(func(b jobqueue.Store) error {
+		var err error
+		stats, err = b.Stats(req)
+		return err
+	})
+	return stats, err
+}
+
+// Lookup returns the job with the specified identifier from the first
+// available backend that knows it. If the job is found in a replica only,
+// it is copied to the backends before it that did not know it.
+func (s *Store) Lookup(id string) (*jobqueue.Job, error) {
+	var missing []jobqueue.Store
+	var err error
+	for _, b := range s.backends {
+		var job *jobqueue.Job
+		job, err = b.Lookup(id)
+		switch {
+		case err == jobqueue.ErrNotFound:
+			missing = append(missing, b)
+		case err == nil:
+			for _, m := range missing {
+				if err := m.Create(job); err != nil {
+					s.errorf("replicated: error repairing job %v: %v", id, err)
+				}
+			}
+			return job, nil
+		}
+	}
+	if len(missing) > 0 {
+		return nil, jobqueue.ErrNotFound
+	}
+	return nil, err
+}
+
+// LookupByCorrelationID returns the jobs with the given correlation
+// identifier from the first available backend.
+func (s *Store) LookupByCorrelationID(correlationID string) ([]*jobqueue.Job, error) {
+	var jobs []*jobqueue.Job
+	_, err := s.read(func(b jobqueue.Store) error {
+		var err error
+		jobs, err = b.LookupByCorrelationID(correlationID)
+		return err
+	})
+	return jobs, err
+}
+
+// List returns a list of jobs from the first available backend.
+func (s *Store) List(req *jobqueue.ListRequest) (*jobqueue.ListResponse, error) {
+	var rsp *jobqueue.ListResponse
+	_, err := s.read(func(b jobqueue.Store) error {
+		var err error
+		rsp, err = b.List(req)
+		return err
+	})
+	return rsp, err
+}
@@ -0,0 +1,340 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package replicated
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/olivere/jobqueue"
+)
+
+var errDown = errors.New("backend is down")
+
+// flakyStore is an in-memory backend that can be taken down.
+type flakyStore struct {
+	*jobqueue.InMemoryStore
+
+	mu   sync.Mutex
+	down bool
+}
+
+func newFlakyStore() *flakyStore {
+	return &flakyStore{InMemoryStore: jobqueue.NewInMemoryStore()}
+}
+
+func (st *flakyStore) setDown(down bool) {
+	st.mu.Lock()
+	st.down = down
+	st.mu.Unlock()
+}
+
+func (st *flakyStore) isDown() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.down
+}
+
+func (st *flakyStore) Create(job *jobqueue.Job) error {
+	if st.isDown() {
+		return errDown
+	}
+	return st.InMemoryStore.Create(job)
+}
+
+func (st *flakyStore) Update(job *jobqueue.Job) error {
+	if st.isDown() {
+		return errDown
+	}
+	return st.InMemoryStore.Update(job)
+}
+
+func (st *flakyStore) Next(req *jobqueue.NextRequest) (*jobqueue.Job, error) {
+	if st.isDown() {
+		return nil, errDown
+	}
+	return st.InMemoryStore.Next(req)
+}
+
+func (st *flakyStore) Lookup(id string) (*jobqueue.Job, error) {
+	if st.isDown() {
+		return nil, errDown
+	}
+	return st.InMemoryStore.Lookup(id)
+}
+
+func TestNewStore(t *testing.T) {
+	if _, err := NewStore(nil); err == nil {
+		t.Fatal("expected error without backends")
+	}
+	backends := []jobqueue.Store{jobqueue.NewInMemoryStore(), jobqueue.NewInMemoryStore()}
+	if _, err := NewStore(backends, SetWriteQuorum(3)); err == nil {
+		t.Fatal("expected error with a quorum larger than the number of backends")
+	}
+	if _, err := NewStore(backends, SetWriteQuorum(2)); err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+}
+
+func TestWritesReachAllBackends(t *testing.T) {
+	primary, replica := newFlakyStore(), newFlakyStore()
+	st, err := NewStore([]jobqueue.Store{primary, replica})
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	job := &jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	for i, b := range []*flakyStore{primary, replica} {
+		if _, err := b.Lookup(job.ID); err != nil {
+			t.Fatalf("backend %d: Lookup failed with %v", i, err)
+		}
+	}
+
+	// Claims are replicated as well
+	claimed, err := st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("expected to claim job %q, have %+v", job.ID, claimed)
+	}
+	for i, b := range []*flakyStore{primary, replica} {
+		found, err := b.Lookup(job.ID)
+		if err != nil {
+			t.Fatalf("backend %d: Lookup failed with %v", i, err)
+		}
+		if have, want := found.State, jobqueue.Working; have != want {
+			t.Fatalf("backend %d: State = %q, want %q", i, have, want)
+		}
+	}
+
+	// Errors about the job itself are returned as is
+	if err := st.Update(&jobqueue.Job{ID: "2", State: jobqueue.Working}); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, have %v", err)
+	}
+}
+
+func TestReadsFailOver(t *testing.T) {
+	primary, replica := newFlakyStore(), newFlakyStore()
+	st, err := NewStore([]jobqueue.Store{primary, replica})
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	job := &jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+
+	primary.setDown(true)
+	found, err := st.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if found.ID != job.ID {
+		t.Fatalf("expected job %q, have %q", job.ID, found.ID)
+	}
+	claimed, err := st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	if claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("expected to claim job %q from the replica, have %+v", job.ID, claimed)
+	}
+
+	// A job created while the primary is down is repaired on read
+	other := &jobqueue.Job{ID: "2", Topic: "topic", State: jobqueue.Waiting}
+	if err := st.Create(other); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	primary.setDown(false)
+	if _, err := primary.Lookup(other.ID); err != jobqueue.ErrNotFound {
+		t.Fatalf("expected primary to have missed job %q, have %v", other.ID, err)
+	}
+	if _, err := st.Lookup(other.ID); err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if _, err := primary.Lookup(other.ID); err != nil {
+		t.Fatalf("expected job %q to be repaired in the primary, have %v", other.ID, err)
+	}
+
+	// All backends are down
+	primary.setDown(true)
+	replica.setDown(true)
+	if _, err := st.Lookup(job.ID); err != errDown {
+		t.Fatalf("expected %v, have %v", errDown, err)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "3"}); err == nil {
+		t.Fatal("expected Create to fail")
+	}
+}
+
+// basicStore only implements the methods of jobqueue.Store.
+type basicStore struct {
+	jobqueue.Store
+}
+
+func TestOptionalStoresFailOver(t *testing.T) {
+	primary, replica := &basicStore{jobqueue.NewInMemoryStore()}, newFlakyStore()
+	st, err := NewStore([]jobqueue.Store{primary, replica})
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	job := &jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting, MutexKey: "account-1"}
+	if err := st.Create(job); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	claimed, err := st.NextWithMutex(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("NextWithMutex failed with %v", err)
+	}
+	if claimed.ID != job.ID {
+		t.Fatalf("expected to claim job %q from the replica, have %q", job.ID, claimed.ID)
+	}
+	found, err := primary.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := found.State, jobqueue.Working; have != want {
+		t.Fatalf("expected the claim to be replicated to the primary, have state %q", have)
+	}
+
+	// Writes need the quorum of backends that support them
+	st.quorum = 2
+	if err := st.ImportTerminal([]*jobqueue.Job{{ID: "2", Topic: "topic", State: jobqueue.Succeeded}}); err == nil {
+		t.Fatal("expected ImportTerminal to fail")
+	}
+}
+
+func TestWriteQuorum(t *testing.T) {
+	primary, replica := newFlakyStore(), newFlakyStore()
+	st, err := NewStore([]jobqueue.Store{primary, replica}, SetWriteQuorum(2))
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	replica.setDown(true)
+	if err := st.Create(&jobqueue.Job{ID: "1", State: jobqueue.Waiting}); err == nil {
+		t.Fatal("expected Create to miss the quorum")
+	}
+	replica.setDown(false)
+	if err := st.Create(&jobqueue.Job{ID: "2", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+}
+
+// stringLogger records the lines logged.
+type stringLogger struct {
+	mu    sync.Mutex
+	Lines []string
+}
+
+func (l *stringLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.Lines = append(l.Lines, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func TestReplicationErrorsAreLogged(t *testing.T) {
+	primary, replica := newFlakyStore(), newFlakyStore()
+	logger := &stringLogger{}
+	st, err := NewStore([]jobqueue.Store{primary, replica}, SetLogger(logger))
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	replica.setDown(true)
+	if _, err := st.Next(&jobqueue.NextRequest{}); err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if have, want := len(logger.Lines), 1; have != want {
+		t.Fatalf("logged %d lines, want %d: %v", have, want, logger.Lines)
+	}
+}
+
+// versionedStore is an in-memory backend that checks the version of a job
+// on Update, like the MySQL store does. Each versionedStore assigns its
+// own versions.
+type versionedStore struct {
+	*jobqueue.InMemoryStore
+
+	mu      sync.Mutex
+	version int64
+}
+
+func newVersionedStore(base int64) *versionedStore {
+	return &versionedStore{InMemoryStore: jobqueue.NewInMemoryStore(), version: base}
+}
+
+func (st *versionedStore) Update(job *jobqueue.Job) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	prev, err := st.InMemoryStore.Lookup(job.ID)
+	if err != nil {
+		return err
+	}
+	if job.Updated != 0 && job.Updated != prev.Updated {
+		return jobqueue.ErrConflict
+	}
+	st.version++
+	job.Updated = st.version
+	return st.InMemoryStore.Update(job)
+}
+
+func TestUpdateWithVersionedBackends(t *testing.T) {
+	primary, replica := newVersionedStore(1000), newVersionedStore(2000)
+	st, err := NewStore([]jobqueue.Store{primary, replica}, SetWriteQuorum(2))
+	if err != nil {
+		t.Fatalf("NewStore failed with %v", err)
+	}
+	if err := st.Create(&jobqueue.Job{ID: "1", Topic: "topic", State: jobqueue.Waiting}); err != nil {
+		t.Fatalf("Create failed with %v", err)
+	}
+	claimed, err := st.Next(&jobqueue.NextRequest{})
+	if err != nil {
+		t.Fatalf("Next failed with %v", err)
+	}
+	found, err := replica.Lookup(claimed.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := found.State, jobqueue.Working; have != want {
+		t.Fatalf("expected the claim to be replicated, have state %q", have)
+	}
+
+	// The replica has a version of its own, so it must not check the
+	// version of the primary
+	stale := *claimed
+	claimed.LastError = "boom"
+	if err := st.Update(claimed); err != nil {
+		t.Fatalf("Update failed with %v", err)
+	}
+	found, err = replica.Lookup(claimed.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := found.LastError, "boom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+
+	// A conflict in the primary leaves the replicas alone
+	stale.LastError = "stale"
+	if err := st.Update(&stale); err != jobqueue.ErrConflict {
+		t.Fatalf("expected ErrConflict, have %v", err)
+	}
+	found, err = replica.Lookup(claimed.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := found.LastError, "boom"; have != want {
+		t.Fatalf("LastError = %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import "context"
+
+// Scheduler decides which job the manager claims next, e.g. to integrate
+// with an external scheduler or to implement a custom fairness policy.
+// The manager calls Next from its scheduler goroutine whenever a worker is
+// available, so implementations need not be safe for concurrent use.
+// Concurrency limits, rate limits, and pausing are still applied by the
+// manager. See SetScheduler and NewDefaultScheduler.
+type Scheduler interface {
+	// Next claims the next job to execute from one of the stores, e.g.
+	// via Store.Next, and returns it along with the store it has been
+	// claimed from. If there is no job to execute, it returns ErrNotFound.
+	// ctx is cancelled when the manager stops claiming jobs.
+	Next(ctx context.Context, state *SchedulerState) (*Job, Store, error)
+}
+
+// SchedulerState is the runtime state of the manager that is passed to
+// Scheduler.Next. It is a snapshot, so changing it has no effect.
+type SchedulerState struct {
+	Stores      []Store     // stores to claim jobs from (at least one)
+	Request     NextRequest // request reflecting the options of the manager, e.g. SetFIFOMode
+	Concurrency map[int]int // maps rank to its number of workers
+	Working     map[int]int // maps rank to its number of busy workers
+	Logger      Logger      // logger of the manager
+}
+
+// defaultScheduler claims the next job from the stores in turn.
+type defaultScheduler struct {
+	next int // index into the stores to poll next
+}
+
+// NewDefaultScheduler returns the Scheduler that the manager uses unless
+// SetScheduler is used. It polls the stores in turn with the request of
+// the manager, and moves on to the next store if one fails. Custom
+// schedulers may use it as a fallback.
+func NewDefaultScheduler() Scheduler {
+	return &defaultScheduler{}
+}
+
+// Next claims the next job from the stores in turn.
+func (s *defaultScheduler) Next(ctx context.Context, state *SchedulerState) (*Job, Store, error) {
+	for range state.Stores {
+		s.next %= len(state.Stores)
+		st := state.Stores[s.next]
+		s.next++
+		req := state.Request
+		job, err := withContext(st).NextContext(ctx, &req)
+		if err == ErrNotFound || (err == nil && job == nil) {
+			continue
+		}
+		if err != nil {
+			if len(state.Stores) == 1 || ctx.Err() != nil {
+				return nil, nil, err
+			}
+			// Do not let one failing store block the others
+			state.Logger.Printf("jobqueue: error picking next job to schedule: %v", err)
+			continue
+		}
+		return job, st, nil
+	}
+	return nil, nil, ErrNotFound
+}
@@ -0,0 +1,100 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// topicScheduler prefers the jobs of a single topic, and falls back to
+// the default scheduler if there are none.
+type topicScheduler struct {
+	topic    string
+	fallback Scheduler
+}
+
+func (s *topicScheduler) Next(ctx context.Context, state *SchedulerState) (*Job, Store, error) {
+	for _, st := range state.Stores {
+		job, err := st.Next(&NextRequest{
+			Gate: func(job *Job) (bool, error) { return job.Topic == s.topic, nil },
+		})
+		if err == ErrNotFound || (err == nil && job == nil) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return job, st, nil
+	}
+	return s.fallback.Next(ctx, state)
+}
+
+func TestManagerWithScheduler(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	done := make(chan struct{}, 4)
+
+	st := NewInMemoryStore()
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetStore(st),
+		SetConcurrency(0, 1),
+		SetScheduler(&topicScheduler{topic: "urgent", fallback: NewDefaultScheduler()}),
+	)
+	m.testJobSucceeded = func() { done <- struct{}{} }
+	p := func(args ...interface{}) error {
+		mu.Lock()
+		ran = append(ran, args[0].(string))
+		mu.Unlock()
+		return nil
+	}
+	for _, topic := range []string{"normal", "urgent"} {
+		if err := m.Register(topic, p); err != nil {
+			t.Fatalf("Register failed with %v", err)
+		}
+	}
+	// The normal jobs have the higher priorities, but the scheduler
+	// prefers the urgent ones
+	jobs := []*Job{
+		{ID: "n1", Topic: "normal", Priority: 4},
+		{ID: "n2", Topic: "normal", Priority: 3},
+		{ID: "u1", Topic: "urgent", Priority: 2},
+		{ID: "u2", Topic: "urgent", Priority: 1},
+	}
+	for _, job := range jobs {
+		job.State = Waiting
+		job.Args = []interface{}{job.ID}
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+	err := m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	for i := 0; i < len(jobs); i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Job success timed out")
+		}
+	}
+	err = m.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if have, want := strings.Join(ran, ","), "u1,u2,n1,n2"; have != want {
+		t.Fatalf("ran = %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// RunWithSignals runs the manager until the process receives SIGINT or
+// SIGTERM, or until ctx is done. It then stops the manager like
+// CloseWithTimeout, i.e. it stops picking new jobs and gives working jobs
+// up to grace to finish. If grace is negative, it waits for all working
+// jobs to finish. The manager is started unless it is running already.
+//
+// If the manager has an idle timeout (see SetIdleTimeout), RunWithSignals
+// also stops it when it becomes idle.
+//
+// RunWithSignals returns when the manager has stopped. It returns an error
+// if the manager cannot be started, or if working jobs did not finish
+// within grace. This is the typical main loop of a worker process that
+// runs in a container:
+//
+//	m := jobqueue.New(...)
+//	// Register topics here
+//	if err := jobqueue.RunWithSignals(context.Background(), m, 30*time.Second); err != nil {
+//		log.Fatal(err)
+//	}
+func RunWithSignals(ctx context.Context, m *Manager, grace time.Duration) error {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	return runWithSignals(ctx, m, grace, sigc)
+}
+
+// runWithSignals implements RunWithSignals for the given channel of signals.
+func runWithSignals(ctx context.Context, m *Manager, grace time.Duration, sigc <-chan os.Signal) error {
+	m.mu.Lock()
+	started := m.started
+	m.mu.Unlock()
+	if !started {
+		if err := m.Start(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	idlec := m.idlec
+	m.mu.Unlock()
+
+	select {
+	case sig := <-sigc:
+		m.logger.Printf("jobqueue: received signal %v, stopping", sig)
+	case <-idlec:
+		m.logger.Printf("jobqueue: idle for %v, stopping", m.idleTimeout)
+	case <-ctx.Done():
+	}
+	return m.CloseWithTimeout(grace)
+}
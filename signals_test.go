@@ -0,0 +1,175 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunWithSignalsDrains(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	err := m.Register("topic", func(args ...interface{}) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- runWithSignals(context.Background(), m, -1, sigc)
+	}()
+
+	job := &Job{Topic: "topic"}
+	for {
+		// Wait for runWithSignals to start the manager
+		m.mu.Lock()
+		running := m.started
+		m.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.Add(job); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job start timed out")
+	}
+
+	sigc <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		t.Fatalf("expected to wait for the working job, returned with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected no error, have %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Drain timed out")
+	}
+
+	job, err = m.Lookup(job.ID)
+	if err != nil {
+		t.Fatalf("Lookup failed with %v", err)
+	}
+	if have, want := job.State, Succeeded; have != want {
+		t.Fatalf("State = %q, want %q", have, want)
+	}
+}
+
+func TestRunWithSignalsGraceExpires(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	err := m.Register("topic", func(args ...interface{}) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+	if err := m.Add(&Job{Topic: "topic"}); err != nil {
+		t.Fatalf("Add failed with %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Job start timed out")
+	}
+
+	// The manager is running already, and ctx ends it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runWithSignals(ctx, m, 50*time.Millisecond, nil)
+	if err == nil {
+		t.Fatal("expected grace period to expire")
+	}
+}
+
+func TestRunWithSignalsIdleTimeout(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetIdleTimeout(1*time.Second))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+
+	start := time.Now()
+	err = runWithSignals(context.Background(), m, -1, nil)
+	if err != nil {
+		t.Fatalf("expected no error, have %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1*time.Second {
+		t.Fatalf("expected to return after the idle timeout, returned after %v", elapsed)
+	}
+}
+
+func TestRunWithSignalsIdleTimeoutWithJobs(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetIdleTimeout(2*time.Second))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err = m.Start()
+	if err != nil {
+		t.Fatalf("Start failed with %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runWithSignals(context.Background(), m, -1, nil)
+	}()
+
+	// Keep the manager busy for longer than the idle timeout
+	for i := 0; i < 15; i++ {
+		if err := m.Add(&Job{Topic: "topic"}); err != nil {
+			t.Fatalf("Add failed with %v", err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("expected not to return while jobs arrive, returned with %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	// Then let it go idle
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected no error, have %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected to return after the idle timeout")
+	}
+	stats, err := m.Stats(&StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats failed with %v", err)
+	}
+	if have, want := stats.Succeeded, 15; have != want {
+		t.Fatalf("Succeeded = %d, want %d", have, want)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"strconv"
+	"time"
+)
+
+// Names of the metrics that the manager emits to its MetricsSink.
+// Unless noted otherwise, they are tagged with the topic of the job.
+const (
+	MetricJobsAdded     = "jobs_added"     // counter of jobs added via Manager.Add
+	MetricJobsStarted   = "jobs_started"   // counter of jobs passed to a worker
+	MetricJobsSucceeded = "jobs_succeeded" // counter of jobs that succeeded
+	MetricJobsFailed    = "jobs_failed"    // counter of jobs that failed for good
+	MetricJobsRetried   = "jobs_retried"   // counter of failed attempts that are retried
+	MetricJobsCancelled = "jobs_cancelled" // counter of jobs cancelled via Manager.Cancel
+	MetricJobWait       = "job_wait"       // timer of the time jobs waited before they were started
+	MetricJobDuration   = "job_duration"   // timer of the execution time of attempts
+	MetricClaimDuration = "claim_duration" // timer of picking the next job from the store (no tags)
+	MetricWorkersBusy   = "workers_busy"   // gauge of busy workers (tagged with the rank)
+)
+
+// MetricsSink receives the metrics that the manager emits about the
+// lifecycle of jobs, e.g. to export them to a monitoring system. See
+// SetMetricsSink, and the metrics package for adapters to Prometheus,
+// StatsD, and expvar. The names of the metrics are listed above.
+//
+// The methods are called synchronously by the manager, so they should be
+// fast and must be safe for concurrent use. The tags must not be modified.
+type MetricsSink interface {
+	// Counter adds delta to the counter with the given name and tags.
+	Counter(name string, delta int64, tags map[string]string)
+
+	// Gauge sets the gauge with the given name and tags to value.
+	Gauge(name string, value float64, tags map[string]string)
+
+	// Timing records an observation of d for the timer with the given
+	// name and tags.
+	Timing(name string, d time.Duration, tags map[string]string)
+}
+
+// observe emits the metrics for the transition of job from the given
+// state into its current state.
+func (m *Manager) observe(job *Job, from string) {
+	if m.sink == nil {
+		return
+	}
+	tags := map[string]string{"topic": job.Topic}
+	switch {
+	case from == "":
+		m.sink.Counter(MetricJobsAdded, 1, tags)
+	case from == Waiting && job.State == Working:
+		m.sink.Counter(MetricJobsStarted, 1, tags)
+		if job.Created > 0 && job.Started > job.Created {
+			m.sink.Timing(MetricJobWait, time.Duration(job.Started-job.Created), tags)
+		}
+	case from == Working:
+		if job.Started > 0 {
+			m.sink.Timing(MetricJobDuration, time.Since(time.Unix(0, job.Started)), tags)
+		}
+		switch job.State {
+		case Succeeded:
+			m.sink.Counter(MetricJobsSucceeded, 1, tags)
+		case Waiting:
+			m.sink.Counter(MetricJobsRetried, 1, tags)
+		case Cancelled:
+			m.sink.Counter(MetricJobsCancelled, 1, tags)
+		default:
+			m.sink.Counter(MetricJobsFailed, 1, tags)
+		}
+	case job.State == Cancelled:
+		m.sink.Counter(MetricJobsCancelled, 1, tags)
+	case from == Succeeded:
+		// A job with AtMostOnce delivery has failed after being finalized
+		m.sink.Counter(MetricJobsFailed, 1, tags)
+	}
+}
+
+// observeBusy emits the number of busy workers of the given rank.
+func (m *Manager) observeBusy(rank, busy int) {
+	if m.sink == nil {
+		return
+	}
+	m.sink.Gauge(MetricWorkersBusy, float64(busy), map[string]string{"rank": strconv.Itoa(rank)})
+}
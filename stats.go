@@ -10,4 +10,5 @@ type Stats struct {
 	Working   int `json:"working"`   // number of jobs currently being executed
 	Succeeded int `json:"succeeded"` // number of successfully completed jobs
 	Failed    int `json:"failed"`    // number of failed jobs (even after retries)
+	Cancelled int `json:"cancelled"` // number of cancelled jobs
 }
@@ -4,12 +4,38 @@
 
 package jobqueue
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 var (
 	// ErrNotFound must be returned from Store implementation when a certain job
 	// could not be found in the specific data store.
 	ErrNotFound = errors.New("jobqueue: job not found")
+
+	// ErrInvalidTransition must be returned from Store implementations when
+	// a job cannot be moved into a state, e.g. because it is already in a
+	// terminal state.
+	ErrInvalidTransition = errors.New("jobqueue: invalid state transition")
+
+	// ErrMaxRedeliveries is recorded in Job.LastError by Store
+	// implementations when a job is moved into the Failed state because it
+	// has been reclaimed more often than Job.MaxRedeliveries allows.
+	ErrMaxRedeliveries = errors.New("jobqueue: job exceeded its max. redeliveries")
+
+	// ErrDuplicate must be returned from Store.Create when there is a
+	// waiting or working job with the same UniqueKey already. Manager.Add
+	// passes it on to the caller.
+	ErrDuplicate = errors.New("jobqueue: duplicate unique key")
+
+	// ErrConflict may be returned from Store.Update when the job has been
+	// modified in the store since it has been read, i.e. Job.Updated does
+	// not match anymore. Callers should look up the job again and retry.
+	// Only the MySQL store checks the version; the other stores overwrite
+	// concurrent changes.
+	ErrConflict = errors.New("jobqueue: job modified concurrently")
 )
 
 // Store implements persistent storage of jobs.
@@ -19,7 +45,10 @@ type Store interface {
 	// crashed jobs from a previous run into the Failed state.
 	Start() error
 
-	// Create adds a job to the store.
+	// Create adds a job to the store. If the job has a UniqueKey, and
+	// there is a waiting or working job with the same key already, Create
+	// must return ErrDuplicate and must not add the job. See CreateOrGetStore
+	// to get the existing job instead.
 	Create(*Job) error
 
 	// Delete removes a job from the store.
@@ -27,16 +56,29 @@ type Store interface {
 
 	// Update updates a job in the store. This is called frequently as jobs
 	// are processed. Update must allow for concurrent updates, e.g. by locking.
+	// If the job does not exist (anymore), e.g. because it has been deleted
+	// while being processed, Update must return ErrNotFound and must not
+	// create the job. If the job is in a terminal state already (see
+	// IsTerminal), e.g. because another worker has finalized it, Update
+	// should return ErrInvalidTransition.
 	Update(*Job) error
 
-	// Next picks the next job to execute.
+	// Next claims the next job to execute, filtered by the NextRequest.
 	//
 	// The store should take the job priorities into account when picking the
 	// next job. Jobs with higher priorities should be executed first.
+	// Jobs whose RunAt is in the future must not be picked.
+	//
+	// Next must atomically move the job into the Working state, set its
+	// Started and ClaimedAt times, and set its WorkerID to the one of the
+	// request before returning it, so that concurrent calls, e.g. by
+	// several managers sharing the store, never return the same job.
+	// Unlike Started, which may be updated later, e.g. by the manager,
+	// ClaimedAt records the claim only.
 	//
 	// If no job is ready to be executed, e.g. the job queue is idle, the
 	// store must return nil for both the job and the error.
-	Next() (*Job, error)
+	Next(*NextRequest) (*Job, error)
 
 	// Stats returns statistics about the store, e.g. the number of jobs
 	// waiting, working, succeeded, and failed. This is run when the manager
@@ -53,8 +95,290 @@ type Store interface {
 
 	// List returns a list of jobs filtered by the ListRequest.
 	List(*ListRequest) (*ListResponse, error)
+
+	// ResetRetries sets the retry counter of a waiting job back to zero,
+	// without changing its state or priority.
+	// If there is no waiting job with the identifier, ErrNotFound must
+	// be returned.
+	ResetRetries(string) error
+
+	// CompareAndSetState atomically changes the state of the job with the
+	// given identifier from the first state to the second state. It reports
+	// whether the state has been changed, i.e. it returns false if the job
+	// does not exist or is in a different state.
+	CompareAndSetState(id, from, to string) (bool, error)
+
+	// Heartbeat records that the worker is still working on the job with
+	// the given identifier, by setting its Heartbeat to the current time.
+	// It does nothing if the job is not working.
+	Heartbeat(id string) error
+
+	// ReclaimExpired recovers working jobs whose worker has not sent a
+	// heartbeat for longer than olderThan, e.g. because it crashed. Jobs
+	// with retries left are put back into the Waiting state, and their
+	// Retry and Redeliveries counters are incremented. Others are moved
+	// into the Failed state, as are jobs that have been redelivered
+	// MaxRedeliveries times already (with ErrMaxRedeliveries as their
+	// LastError), e.g. poison jobs that crash their workers. Jobs that
+	// have been claimed within olderThan are never reclaimed, see
+	// Job.ClaimedAt. It returns the number of jobs reclaimed.
+	ReclaimExpired(olderThan time.Duration) (int, error)
+}
+
+// ContextStore is a Store whose most frequent operations can be aborted
+// via a context.Context, e.g. when the manager is closed while waiting for
+// a slow query, or when the client of an HTTP handler has gone away. The
+// variants must behave like their counterparts without context, but return
+// when ctx is done, typically with ctx.Err(). Implementing ContextStore is
+// optional. The manager uses it if the store implements it.
+type ContextStore interface {
+	Store
+
+	CreateContext(ctx context.Context, job *Job) error
+	UpdateContext(ctx context.Context, job *Job) error
+	DeleteContext(ctx context.Context, job *Job) error
+	NextContext(ctx context.Context, req *NextRequest) (*Job, error)
+	LookupContext(ctx context.Context, id string) (*Job, error)
+	ListContext(ctx context.Context, req *ListRequest) (*ListResponse, error)
+	StatsContext(ctx context.Context, req *StatsRequest) (*Stats, error)
+}
+
+// TopicStatsStore is a Store that can return the statistics of all topics
+// at once, e.g. with a single query. Implementing TopicStatsStore is
+// optional. See Manager.StatsByTopic.
+type TopicStatsStore interface {
+	Store
+
+	// StatsByTopic returns statistics about the jobs in the store,
+	// grouped by topic.
+	StatsByTopic() (map[string]*Stats, error)
+}
+
+// ConcurrentStore is a Store that reports whether it may be used by
+// several workers at the same time, e.g. whether concurrent calls of Next
+// never return the same job twice, and concurrent updates do not get lost.
+// Stores that do not implement ConcurrentStore are assumed to support
+// concurrency. See Manager.Validate.
+type ConcurrentStore interface {
+	Store
+
+	// SupportsConcurrency reports whether the store may be used by
+	// several workers at the same time.
+	SupportsConcurrency() bool
+}
+
+// BatchUpdateStore is a Store that can update several jobs at once, e.g.
+// with a single statement. Implementing BatchUpdateStore is optional. The
+// manager uses it if the store implements it and completion batching is
+// enabled, see SetCompletionBatching. Otherwise, the jobs are updated one
+// by one.
+type BatchUpdateStore interface {
+	Store
+
+	// UpdateBatch updates the jobs like Update. It returns one error per
+	// job, in the order of the jobs, which is nil if the job has been
+	// updated. E.g. if one of the jobs is in a terminal state already, its
+	// error is ErrInvalidTransition, while the other jobs are updated.
+	UpdateBatch(jobs []*Job) []error
 }
 
+// CreateOrGetStore is a Store that can add a job unless there is an active
+// job with the same UniqueKey, e.g. for producers that want to wait for
+// the existing job. Implementing CreateOrGetStore is optional.
+type CreateOrGetStore interface {
+	Store
+
+	// CreateOrGet adds a job to the store, unless there is a waiting or
+	// working job with the same UniqueKey already. In that case, it returns
+	// the existing job and false, so that producers can e.g. wait for it.
+	// Otherwise, it returns the new job and true. Jobs without a UniqueKey
+	// are always added.
+	CreateOrGet(*Job) (*Job, bool, error)
+}
+
+// MutexStore is a Store that can claim jobs one at a time per MutexKey.
+// Implementing MutexStore is optional.
+type MutexStore interface {
+	Store
+
+	// NextWithMutex atomically claims the next job to execute, filtered
+	// by the NextRequest, and moves it into the Working state. It skips
+	// jobs whose MutexKey is held, i.e. there is a working job with the
+	// same MutexKey already. The key is released when that job leaves the
+	// Working state. Two concurrent calls must never claim jobs with the
+	// same MutexKey. Use it e.g. for external workers that must process
+	// the jobs of an entity serially.
+	//
+	// If no job can be claimed, the store must return ErrNotFound.
+	NextWithMutex(*NextRequest) (*Job, error)
+}
+
+// BatchReserveStore is a Store that can lease batches of jobs to external
+// pull workers. Implementing BatchReserveStore is optional.
+type BatchReserveStore interface {
+	Store
+
+	// ReserveBatch atomically claims up to n jobs for external workers and
+	// leases them for the given duration. The jobs are moved into the
+	// Working state. Jobs whose lease has expired may be reserved again.
+	// Two concurrent calls must never return the same job.
+	//
+	// The lease is released when the job leaves the Working state or is
+	// claimed via Next. ReclaimExpired must not reclaim a job whose lease
+	// is still valid.
+	ReserveBatch(n int, lease time.Duration) ([]*ReservedJob, error)
+}
+
+// RetryStore is a Store that lets external workers report failed attempts
+// of jobs. Implementing RetryStore is optional.
+type RetryStore interface {
+	Store
+
+	// FailAndRetry records a failed attempt of a working job, e.g. by an
+	// external worker. If the job has retries left, it is put back into
+	// the Waiting state, and must not be picked before delay has passed,
+	// i.e. its RunAt is set accordingly and its priority is lowered as if
+	// it was due then, like the manager does when retrying. Otherwise, it
+	// is moved into the Failed state. The error message is kept in
+	// LastError. If the job does not exist, ErrNotFound must be returned.
+	// If it is not working, ErrInvalidTransition must be returned.
+	FailAndRetry(id string, delay time.Duration, errMsg string) error
+}
+
+// ImportStore is a Store that can import the history of jobs that have
+// been completed elsewhere. Implementing ImportStore is optional.
+type ImportStore interface {
+	Store
+
+	// ImportTerminal adds jobs that have been completed elsewhere, e.g. to
+	// migrate history for reporting. All jobs must be in a terminal state
+	// (see IsTerminal), so they will never be executed. If any of the jobs
+	// is not, an error must be returned and no job must be added.
+	ImportTerminal(jobs []*Job) error
+}
+
+// TopicRenameStore is a Store that can move jobs to another topic, e.g.
+// when a topic is renamed. Implementing TopicRenameStore is optional.
+type TopicRenameStore interface {
+	Store
+
+	// RenameTopic moves the jobs of the first topic to the second topic
+	// and returns the number of jobs moved. If states are given, only the
+	// jobs in one of them are moved, e.g. Waiting; otherwise all jobs are.
+	RenameTopic(from, to string, states ...string) (int64, error)
+}
+
+// updateBatch updates jobs in st, with a single call if st implements
+// BatchUpdateStore, and returns one error per job.
+func updateBatch(st Store, jobs []*Job) []error {
+	if bs, ok := st.(BatchUpdateStore); ok {
+		return bs.UpdateBatch(jobs)
+	}
+	errs := make([]error, len(jobs))
+	for i, job := range jobs {
+		errs[i] = st.Update(job)
+	}
+	return errs
+}
+
+// withContext returns st as a ContextStore. If st does not implement
+// ContextStore, its operations are not started if ctx is done already,
+// but cannot be aborted once they are running.
+func withContext(st Store) ContextStore {
+	if cst, ok := st.(ContextStore); ok {
+		return cst
+	}
+	return contextStore{st}
+}
+
+// contextStore adds context variants to a Store, see withContext.
+type contextStore struct {
+	Store
+}
+
+func (s contextStore) CreateContext(ctx context.Context, job *Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Create(job)
+}
+
+func (s contextStore) UpdateContext(ctx context.Context, job *Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Update(job)
+}
+
+func (s contextStore) DeleteContext(ctx context.Context, job *Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(job)
+}
+
+func (s contextStore) NextContext(ctx context.Context, req *NextRequest) (*Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Next(req)
+}
+
+func (s contextStore) LookupContext(ctx context.Context, id string) (*Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Lookup(id)
+}
+
+func (s contextStore) ListContext(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.List(req)
+}
+
+func (s contextStore) StatsContext(ctx context.Context, req *StatsRequest) (*Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Stats(req)
+}
+
+// ReservedJob is a job that has been reserved via BatchReserveStore.ReserveBatch.
+type ReservedJob struct {
+	Job          *Job      // the reserved job
+	Token        string    // identifies the reservation
+	LeaseExpires time.Time // time when the job may be reserved again
+}
+
+// NextRequest specifies a filter for picking the next job to execute.
+//
+// If Fair is set, the store picks a job of the correlation identifier that
+// has been claimed least recently, and only then applies the order of
+// rank, priority, or creation time. Jobs without a correlation identifier
+// share a turn. This keeps a correlation identifier with many waiting jobs
+// from delaying the others, at the cost of a more expensive query.
+type NextRequest struct {
+	WorkerVersion int       // only pick jobs with a MinWorkerVersion up to this version
+	FIFO          bool      // pick the oldest job, ignoring rank and priority
+	LIFO          bool      // pick the newest job, ignoring rank and priority (FIFO takes precedence)
+	Gate          ClaimGate // vetoes claiming jobs in Next (optional)
+	Fair          bool      // round-robin across correlation identifiers
+	ExcludeTopics []string  // do not pick jobs of these topics (optional)
+	WorkerID      string    // set as WorkerID of the claimed job (optional)
+}
+
+// ClaimGate decides whether Store.Next may claim the given job, e.g.
+// depending on a feature flag or a maintenance window. It is called after
+// the store has picked the job, but before the job is claimed. If it
+// returns false, the job is left in the Waiting state and the store moves
+// on to the next job. If it returns an error, Next returns that error.
+//
+// The job passed to the gate must not be modified. Stores may hold locks
+// while calling the gate, so it should be fast and must not call the store.
+type ClaimGate func(*Job) (bool, error)
+
 // StatsRequest returns information about the number of managed jobs.
 type StatsRequest struct {
 	Topic            string // filter by topic
@@ -67,6 +391,8 @@ type ListRequest struct {
 	CorrelationGroup string // filter by correlation group
 	CorrelationID    string // filter by correlation identifier
 	State            string // filter by job state
+	CreatedAfter     int64  // filter by jobs created after this time (in UnixNano)
+	CreatedBefore    int64  // filter by jobs created before this time (in UnixNano)
 	Limit            int    // maximum number of jobs to return
 	Offset           int    // number of jobs to skip (for pagination)
 }
@@ -0,0 +1,67 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import "fmt"
+
+// stuckJobsPageSize is the number of waiting jobs that StuckJobs
+// requests from the store at a time.
+const stuckJobsPageSize = 100
+
+// StuckJob is a waiting job that cannot currently progress, as returned
+// by Manager.StuckJobs.
+type StuckJob struct {
+	Job    *Job
+	Reason string // why the job cannot progress
+}
+
+// StuckJobs returns the waiting jobs that this manager will never execute
+// as it is configured, together with the reason, e.g. to find out why a
+// queue does not drain. A job is stuck if
+//
+//   - there is no processor for its topic (and no default processor),
+//   - it requires a newer worker version than SetWorkerVersion specifies, or
+//   - it has used up more retries than MaxRetry allows.
+//
+// Like List, StuckJobs only considers the first store of the manager.
+func (m *Manager) StuckJobs() ([]StuckJob, error) {
+	var stuck []StuckJob
+	for offset := 0; ; offset += stuckJobsPageSize {
+		rsp, err := m.st.List(&ListRequest{
+			State:  Waiting,
+			Offset: offset,
+			Limit:  stuckJobsPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range rsp.Jobs {
+			if reason := m.stuckReason(job); reason != "" {
+				stuck = append(stuck, StuckJob{Job: job, Reason: reason})
+			}
+		}
+		if len(rsp.Jobs) < stuckJobsPageSize {
+			return stuck, nil
+		}
+	}
+}
+
+// stuckReason returns why job cannot progress, or an empty string
+// if it can.
+func (m *Manager) stuckReason(job *Job) string {
+	m.mu.Lock()
+	_, found := m.tm[job.Topic]
+	hasDefault := m.defaultProc != nil
+	m.mu.Unlock()
+	switch {
+	case !found && !hasDefault:
+		return fmt.Sprintf("no processor registered for topic %s", job.Topic)
+	case job.MinWorkerVersion > m.version:
+		return fmt.Sprintf("requires worker version %d, have %d", job.MinWorkerVersion, m.version)
+	case job.Retry > job.MaxRetry:
+		return fmt.Sprintf("retried %d times, exceeding MaxRetry of %d", job.Retry, job.MaxRetry)
+	}
+	return ""
+}
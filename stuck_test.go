@@ -0,0 +1,69 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManagerStuckJobs(t *testing.T) {
+	st := NewInMemoryStore()
+	m := New(SetLogger(&stringLogger{}), SetStore(st), SetWorkerVersion(1))
+	err := m.Register("topic", func(args ...interface{}) error { return nil })
+	if err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	jobs := []*Job{
+		{ID: "ok", Topic: "topic", State: Waiting},
+		{ID: "done", Topic: "unknown", State: Succeeded},
+		{ID: "unknown-topic", Topic: "unknown", State: Waiting},
+		{ID: "newer-version", Topic: "topic", State: Waiting, MinWorkerVersion: 2},
+		{ID: "retries", Topic: "topic", State: Waiting, Retry: 3, MaxRetry: 1},
+	}
+	for _, job := range jobs {
+		if err := st.Create(job); err != nil {
+			t.Fatalf("Create failed with %v", err)
+		}
+	}
+
+	stuck, err := m.StuckJobs()
+	if err != nil {
+		t.Fatalf("StuckJobs failed with %v", err)
+	}
+	reasons := make(map[string]string)
+	for _, s := range stuck {
+		reasons[s.Job.ID] = s.Reason
+	}
+	if have, want := len(reasons), 3; have != want {
+		t.Fatalf("len(StuckJobs) = %d, want %d: %v", have, want, reasons)
+	}
+	tests := map[string]string{
+		"unknown-topic": "no processor",
+		"newer-version": "worker version 2",
+		"retries":       "MaxRetry",
+	}
+	for id, want := range tests {
+		reason, found := reasons[id]
+		if !found {
+			t.Fatalf("expected job %q to be stuck", id)
+		}
+		if !strings.Contains(reason, want) {
+			t.Fatalf("job %q: Reason = %q, want it to contain %q", id, reason, want)
+		}
+	}
+
+	// A default processor picks up jobs of any topic
+	if err := m.RegisterDefault(func(job *Job) error { return nil }); err != nil {
+		t.Fatalf("RegisterDefault failed with %v", err)
+	}
+	stuck, err = m.StuckJobs()
+	if err != nil {
+		t.Fatalf("StuckJobs failed with %v", err)
+	}
+	if have, want := len(stuck), 2; have != want {
+		t.Fatalf("len(StuckJobs) = %d, want %d", have, want)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import "context"
+
+// TraceContext carries the context of a trace across process boundaries,
+// e.g. as a W3C traceparent header. It is stored with the job, so that
+// the span around its execution continues the trace of the code that
+// added it. See Tracer.
+type TraceContext map[string]string
+
+// Tracer starts spans around the execution of jobs, e.g. to continue the
+// trace of the request that added a job via Job.TraceContext. See
+// SetTracer, and the tracing package for an adapter to OpenTelemetry.
+type Tracer interface {
+	// Start starts a span for an attempt to execute job. The context
+	// returned is passed to processors registered via RegisterContext,
+	// so it should carry the span. It must be derived from ctx, which is
+	// cancelled when the manager stops. The returned function is called
+	// when the attempt has finished, with the error it failed with, or
+	// nil if it succeeded.
+	Start(ctx context.Context, job *Job) (context.Context, func(err error))
+}
+
+// SetTracer specifies a tracer that starts a span around every attempt to
+// execute a job. Jobs are not traced by default.
+func SetTracer(tracer Tracer) ManagerOption {
+	return func(m *Manager) {
+		m.tracer = tracer
+	}
+}
+
+// trace returns a processor that executes job via p within a span of the
+// tracer of the manager.
+func (m *Manager) trace(job *Job, p Processor) Processor {
+	return func(args ...interface{}) error {
+		m.mu.Lock()
+		ctx := m.ctx
+		m.mu.Unlock()
+		ctx, end := m.tracer.Start(ctx, job)
+		m.mu.Lock()
+		if e := m.running[job.ID]; e != nil {
+			e.ctx = ctx
+		}
+		m.mu.Unlock()
+		err := p(args...)
+		end(err)
+		return err
+	}
+}
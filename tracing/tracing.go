@@ -0,0 +1,112 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+// Package tracing implements jobqueue.Tracer with OpenTelemetry.
+//
+// Use Inject before adding a job to store the trace context of the caller
+// with the job, and pass the Tracer to the manager via jobqueue.SetTracer.
+// The span around the execution of the job then continues the trace of
+// the caller, even if the job is executed by another process.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/olivere/jobqueue"
+)
+
+const instrumentationName = "github.com/olivere/jobqueue"
+
+// Tracer starts OpenTelemetry spans around the execution of jobs. It
+// implements jobqueue.Tracer.
+type Tracer struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	tracer     trace.Tracer
+}
+
+// Option is an option for a Tracer.
+type Option func(*Tracer)
+
+// SetTracerProvider specifies the provider of the tracer that starts the
+// spans. It defaults to the global provider, see otel.GetTracerProvider.
+func SetTracerProvider(provider trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.provider = provider
+	}
+}
+
+// SetPropagator specifies how the trace context is stored with a job. It
+// defaults to W3C Trace Context, see propagation.TraceContext.
+func SetPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(t *Tracer) {
+		t.propagator = propagator
+	}
+}
+
+// New creates a new Tracer.
+func New(options ...Option) *Tracer {
+	t := &Tracer{
+		provider:   otel.GetTracerProvider(),
+		propagator: propagation.TraceContext{},
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+	t.tracer = t.provider.Tracer(instrumentationName)
+	return t
+}
+
+// Inject stores the trace context of ctx with job. Call it before adding
+// the job to the manager.
+func (t *Tracer) Inject(ctx context.Context, job *jobqueue.Job) {
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return
+	}
+	if job.TraceContext == nil {
+		job.TraceContext = make(jobqueue.TraceContext)
+	}
+	for k, v := range carrier {
+		job.TraceContext[k] = v
+	}
+}
+
+// Start starts a span for an attempt to execute job. The span is named
+// after the topic of the job and continues the trace stored with it via
+// Inject, if any.
+func (t *Tracer) Start(ctx context.Context, job *jobqueue.Job) (context.Context, func(err error)) {
+	if len(job.TraceContext) > 0 {
+		ctx = t.propagator.Extract(ctx, propagation.MapCarrier(job.TraceContext))
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("jobqueue.job.id", job.ID),
+		attribute.String("jobqueue.job.topic", job.Topic),
+		attribute.Int("jobqueue.job.retry", job.Retry),
+		attribute.Int("jobqueue.job.max_retry", job.MaxRetry),
+	}
+	if job.CorrelationID != "" {
+		attrs = append(attrs, attribute.String("jobqueue.job.correlation_id", job.CorrelationID))
+	}
+	ctx, span := t.tracer.Start(ctx, job.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetStatus(codes.Ok, "")
+		}
+		span.End()
+	}
+}
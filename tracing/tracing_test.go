@@ -0,0 +1,95 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/olivere/jobqueue"
+)
+
+func TestTracerContinuesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := New(SetTracerProvider(provider))
+
+	// The code that adds the job
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	job := &jobqueue.Job{ID: "1", Topic: "email", CorrelationID: "order-1", MaxRetry: 3}
+	tracer.Inject(ctx, job)
+	parent.End()
+	if _, found := job.TraceContext["traceparent"]; !found {
+		t.Fatalf("expected trace context to contain traceparent, got %v", job.TraceContext)
+	}
+
+	// The manager that executes the job
+	ctx, end := tracer.Start(context.Background(), job)
+	if have, want := trace.SpanContextFromContext(ctx).TraceID(), parent.SpanContext().TraceID(); have != want {
+		t.Fatalf("TraceID = %v, want %v", have, want)
+	}
+	end(errors.New("kaboom"))
+
+	spans := recorder.Ended()
+	if have, want := len(spans), 2; have != want {
+		t.Fatalf("len(spans) = %d, want %d", have, want)
+	}
+	span := spans[1]
+	if have, want := span.Name(), "email"; have != want {
+		t.Errorf("Name = %q, want %q", have, want)
+	}
+	if have, want := span.Parent().SpanID(), parent.SpanContext().SpanID(); have != want {
+		t.Errorf("Parent = %v, want %v", have, want)
+	}
+	if have, want := span.Status().Code, codes.Error; have != want {
+		t.Errorf("Status = %v, want %v", have, want)
+	}
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for k, v := range map[string]string{
+		"jobqueue.job.id":             "1",
+		"jobqueue.job.topic":          "email",
+		"jobqueue.job.retry":          "0",
+		"jobqueue.job.max_retry":      "3",
+		"jobqueue.job.correlation_id": "order-1",
+	} {
+		if attrs[k] != v {
+			t.Errorf("attribute %s = %q, want %q", k, attrs[k], v)
+		}
+	}
+}
+
+func TestTracerWithoutTraceContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := New(SetTracerProvider(provider))
+
+	job := &jobqueue.Job{ID: "1", Topic: "email"}
+	tracer.Inject(context.Background(), job)
+	if job.TraceContext != nil {
+		t.Fatalf("expected no trace context, got %v", job.TraceContext)
+	}
+	_, end := tracer.Start(context.Background(), job)
+	end(nil)
+
+	spans := recorder.Ended()
+	if have, want := len(spans), 1; have != want {
+		t.Fatalf("len(spans) = %d, want %d", have, want)
+	}
+	if spans[0].Parent().IsValid() {
+		t.Errorf("expected a root span, got parent %v", spans[0].Parent())
+	}
+	if have, want := spans[0].Status().Code, codes.Ok; have != want {
+		t.Errorf("Status = %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// Transition describes a change of the state of a job by the manager,
+// e.g. when a job is added, started, or completed. Use Manager.Subscribe
+// to receive them.
+type Transition struct {
+	JobID            string `json:"id"`     // identifier of the job
+	Topic            string `json:"topic"`  // topic of the job
+	CorrelationGroup string `json:"cgroup"` // external group of the job
+	CorrelationID    string `json:"cid"`    // external identifier of the job
+	From             string `json:"from"`   // previous state (empty for new jobs)
+	To               string `json:"to"`     // new state
+	Time             int64  `json:"time"`   // time of the transition (in UnixNano)
+}
+
+// Subscription receives the transitions of jobs. Create one via
+// Manager.Subscribe.
+type Subscription struct {
+	// C receives the transitions. It is closed when the subscription is
+	// closed or dropped.
+	C <-chan *Transition
+
+	c       chan *Transition
+	feed    *transitionFeed
+	dropped bool // guarded by feed.mu
+}
+
+// Close ends the subscription and closes C. It is safe to call Close
+// more than once.
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	if _, found := s.feed.subs[s]; found {
+		delete(s.feed.subs, s)
+		close(s.c)
+	}
+}
+
+// Dropped reports whether the subscription has been dropped because it
+// did not keep up with the transitions. Subscribers should then reload
+// the state of the jobs they are interested in, as they have missed
+// transitions, and subscribe again.
+func (s *Subscription) Dropped() bool {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	return s.dropped
+}
+
+// transitionFeed fans out transitions to subscriptions.
+type transitionFeed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscribe returns a subscription to the transitions of all jobs of the
+// manager. Up to size transitions are buffered for the subscriber. The
+// manager never waits for subscribers: If the buffer is full, the
+// subscription is dropped, see Subscription.Dropped. Call Close when
+// done with the subscription.
+func (m *Manager) Subscribe(size int) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	c := make(chan *Transition, size)
+	s := &Subscription{C: c, c: c, feed: &m.feed}
+	m.feed.mu.Lock()
+	if m.feed.subs == nil {
+		m.feed.subs = make(map[*Subscription]struct{})
+	}
+	m.feed.subs[s] = struct{}{}
+	m.feed.mu.Unlock()
+	return s
+}
+
+// transition publishes that job has moved from the given state into its
+// current state, and records the metrics of the transition.
+func (m *Manager) transition(job *Job, from string) {
+	m.metrics.transition(job, from)
+	m.observe(job, from)
+
+	m.feed.mu.Lock()
+	defer m.feed.mu.Unlock()
+	if len(m.feed.subs) == 0 {
+		return
+	}
+	t := &Transition{
+		JobID:            job.ID,
+		Topic:            job.Topic,
+		CorrelationGroup: job.CorrelationGroup,
+		CorrelationID:    job.CorrelationID,
+		From:             from,
+		To:               job.State,
+		Time:             time.Now().UnixNano(),
+	}
+	for s := range m.feed.subs {
+		select {
+		case s.c <- t:
+		default:
+			// Slow subscriber
+			s.dropped = true
+			delete(m.feed.subs, s)
+			close(s.c)
+		}
+	}
+}
@@ -21,6 +21,17 @@ $(function() {
       });
     }
 
+    function updateScheduleList(domid, schedules) {
+      $(domid).html('');
+      _.each(schedules, function(sched) {
+        var html = '<li class="list-group-item">';
+        html = html + '<span class="badge">' + sched.remaining + ' left</span>';
+        html = html + (sched.cid || sched.topic) + ' next at ' + new Date(sched.next_run_at).toLocaleString();
+        html = html + '</li>';
+        $(domid).append(html);
+      });
+    }
+
     function unixNanoToTime(nanos) {
       if (!nanos) {
         return '';
@@ -95,6 +106,7 @@ $(function() {
             if (e.failed) {
               updateJobList('#JOBS_FAILED', e.failed);
             }
+            updateScheduleList('#SCHEDULES', e.schedules);
             break;
           case 'JOB_LOOKUP':
             if (e.message) {
@@ -0,0 +1,97 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/olivere/jobqueue"
+)
+
+const (
+	// Number of transitions buffered for a client of the event stream.
+	// Clients that fall further behind are dropped.
+	eventsBufferSize = 256
+
+	// Send comments to the client with this period, so that proxies keep
+	// the connection open and disconnected clients are detected.
+	eventsKeepAlive = 30 * time.Second
+)
+
+// eventsserver streams the transitions of jobs as Server-Sent Events.
+//
+// Clients can filter the transitions by the query parameters topic,
+// correlation_group, and correlation_id. Each transition is sent as
+// an event of type "transition" with the jobqueue.Transition as JSON
+// data. If a client does not keep up with the transitions, an event of
+// type "resync" is sent and the stream is closed; the client should
+// then reload the jobs it is interested in and connect again.
+type eventsserver struct {
+	m *jobqueue.Manager
+}
+
+// ServeHTTP handles event stream requests from the peer.
+func (srv eventsserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	topic := q.Get("topic")
+	cgroup := q.Get("correlation_group")
+	cid := q.Get("correlation_id")
+
+	sub := srv.m.Subscribe(eventsBufferSize)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// Client disconnected
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case t, ok := <-sub.C:
+			if !ok {
+				if sub.Dropped() {
+					fmt.Fprint(w, "event: resync\ndata: {\"reason\":\"slow consumer\"}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			if (topic != "" && t.Topic != topic) ||
+				(cgroup != "" && t.CorrelationGroup != cgroup) ||
+				(cid != "" && t.CorrelationID != cid) {
+				continue
+			}
+			data, err := json.Marshal(t)
+			if err != nil {
+				log.Printf("%v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: transition\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/jobqueue"
+)
+
+func TestEventsStreamsTransitions(t *testing.T) {
+	m := jobqueue.New()
+	nop := func(...interface{}) error { return nil }
+	if err := m.Register("clicks", nop); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register("views", nop); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(eventsserver{m: m})
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/jobs/events?topic=clicks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if want, have := "text/event-stream", rsp.Header.Get("Content-Type"); want != have {
+		t.Fatalf("expected Content-Type %q, have %q", want, have)
+	}
+
+	// The client is subscribed as soon as the headers have been received
+	if err := m.Add(&jobqueue.Job{Topic: "views"}); err != nil {
+		t.Fatal(err)
+	}
+	job := &jobqueue.Job{Topic: "clicks"}
+	if err := m.Add(job); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan [2]string, 1)
+	go func() {
+		var event string
+		scanner := bufio.NewScanner(rsp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				events <- [2]string{event, strings.TrimPrefix(line, "data: ")}
+				return
+			}
+		}
+	}()
+
+	select {
+	case e := <-events:
+		if want, have := "transition", e[0]; want != have {
+			t.Fatalf("expected event %q, have %q", want, have)
+		}
+		var tr jobqueue.Transition
+		if err := json.Unmarshal([]byte(e[1]), &tr); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := job.ID, tr.JobID; want != have {
+			t.Fatalf("expected transition of job %q, have %q", want, have)
+		}
+		if want, have := "", tr.From; want != have {
+			t.Fatalf("expected From = %q, have %q", want, have)
+		}
+		if want, have := jobqueue.Waiting, tr.To; want != have {
+			t.Fatalf("expected To = %q, have %q", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event")
+	}
+}
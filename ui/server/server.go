@@ -27,6 +27,7 @@ func New(m *jobqueue.Manager) *Server {
 func (srv *Server) Serve(addr string) error {
 	r := http.DefaultServeMux
 	r.Handle("/ws", wsserver{m: srv.m})
+	r.Handle("/jobs/events", eventsserver{m: srv.m})
 	r.Handle("/", http.FileServer(http.Dir("public")))
 	StateUpdates = make(chan *State)
 	defer close(StateUpdates)
@@ -37,12 +38,13 @@ func (srv *Server) Serve(addr string) error {
 
 // State is the current state of the job queue.
 type State struct {
-	Type      string          `json:"type"`
-	Stats     *jobqueue.Stats `json:"stats,omitempty"`
-	Waiting   []*jobqueue.Job `json:"waiting,omitempty"`
-	Working   []*jobqueue.Job `json:"working,omitempty"`
-	Succeeded []*jobqueue.Job `json:"succeeded,omitempty"`
-	Failed    []*jobqueue.Job `json:"failed,omitempty"`
+	Type      string               `json:"type"`
+	Stats     *jobqueue.Stats      `json:"stats,omitempty"`
+	Waiting   []*jobqueue.Job      `json:"waiting,omitempty"`
+	Working   []*jobqueue.Job      `json:"working,omitempty"`
+	Succeeded []*jobqueue.Job      `json:"succeeded,omitempty"`
+	Failed    []*jobqueue.Job      `json:"failed,omitempty"`
+	Schedules []*jobqueue.Schedule `json:"schedules,omitempty"`
 }
 
 var StateUpdates chan *State
@@ -80,6 +82,7 @@ func watcher(m *jobqueue.Manager) {
 				panic(err)
 			}
 			newState.Failed = rsp.Jobs
+			newState.Schedules = m.Schedules()
 			StateUpdates <- newState
 		}
 	}
@@ -0,0 +1,108 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validate checks the configuration of the manager for problems that
+// would otherwise only show up at runtime, e.g. several workers using a
+// store that does not support concurrency (see ConcurrentStore), or
+// options for topics that have no processor. Call it after registering
+// the processors and before Start. It returns an error that describes all
+// problems found, or nil if there are none.
+func (m *Manager) Validate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Processors
+	if len(m.tm) == 0 && m.defaultProc == nil {
+		problem("no processors registered")
+	}
+	topics := make(map[string]bool)
+	for topic := range m.delivery {
+		topics[topic] = true
+	}
+	for topic := range m.batchPolicies {
+		topics[topic] = true
+	}
+	for topic := range m.latencyTargets {
+		topics[topic] = true
+	}
+	for topic := range m.retryDelta {
+		topics[topic] = true
+	}
+	for topic := range m.timeouts {
+		topics[topic] = true
+	}
+	for topic := range m.auto {
+		topics[topic] = true
+	}
+	for topic := range m.topicLimits {
+		topics[topic] = true
+	}
+	if m.defaultProc == nil {
+		var unknown []string
+		for topic := range topics {
+			if _, found := m.tm[topic]; !found {
+				unknown = append(unknown, topic)
+			}
+		}
+		sort.Strings(unknown)
+		for _, topic := range unknown {
+			problem("options specified for topic %s, but it has no processor", topic)
+		}
+	}
+
+	// Stores
+	var workers int
+	for _, n := range m.concurrency {
+		workers += n
+	}
+	if workers > 1 {
+		for i, st := range m.stores {
+			if cst, ok := st.(ConcurrentStore); ok && !cst.SupportsConcurrency() {
+				problem("store %d does not support concurrency, but the manager runs %d workers", i, workers)
+			}
+		}
+	}
+
+	// Options
+	if m.zeroRetryState == Waiting || m.zeroRetryState == Working {
+		problem("failure state for jobs without retries must not be %s", m.zeroRetryState)
+	}
+	if m.retryStormHook != nil && (m.retryStormMax < 1 || m.retryStormWindow <= 0) {
+		problem("retry storm hook needs a positive threshold and window")
+	}
+	for topic, timeout := range m.timeouts {
+		if timeout < 0 {
+			problem("timeout of topic %s must not be negative", topic)
+		}
+	}
+	for topic, target := range m.latencyTargets {
+		if target < 0 {
+			problem("latency target of topic %s must not be negative", topic)
+		}
+	}
+	if m.heartbeat < 0 {
+		problem("heartbeat interval must not be negative")
+	}
+	if m.idleTimeout < 0 {
+		problem("idle timeout must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("jobqueue: invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
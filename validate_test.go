@@ -0,0 +1,76 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// serialStore is an InMemoryStore that claims not to support concurrency.
+type serialStore struct {
+	*InMemoryStore
+}
+
+func (st *serialStore) SupportsConcurrency() bool {
+	return false
+}
+
+func TestManagerValidate(t *testing.T) {
+	m := New(SetLogger(&stringLogger{}), SetConcurrency(0, 1), SetConcurrency(1, 1))
+	if err := m.Register("topic", func(args ...interface{}) error { return nil }); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("expected no error, have %v", err)
+	}
+}
+
+func TestManagerValidateConcurrency(t *testing.T) {
+	st := &serialStore{InMemoryStore: NewInMemoryStore()}
+
+	// A single worker is fine
+	m := New(SetLogger(&stringLogger{}), SetStore(st), SetConcurrency(0, 1))
+	if err := m.Register("topic", func(args ...interface{}) error { return nil }); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("expected no error, have %v", err)
+	}
+
+	m = New(SetLogger(&stringLogger{}), SetStore(st), SetConcurrency(0, 4))
+	if err := m.Register("topic", func(args ...interface{}) error { return nil }); err != nil {
+		t.Fatalf("Register failed with %v", err)
+	}
+	err := m.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := "store 0 does not support concurrency, but the manager runs 4 workers"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected error to contain %q, have %q", want, err)
+	}
+}
+
+func TestManagerValidateReportsAllProblems(t *testing.T) {
+	m := New(
+		SetLogger(&stringLogger{}),
+		SetTopicTimeout("unknown", time.Second),
+		SetZeroRetryFailureState(Waiting),
+	)
+	err := m.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"no processors registered",
+		"options specified for topic unknown, but it has no processor",
+		"failure state for jobs without retries must not be waiting",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, have %q", want, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016-present Oliver Eilhard. All rights reserved.
+// Use of this source code is governed by a MIT-license.
+// See http://olivere.mit-license.org/license.txt for details.
+
+package jobqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// WebhookPayload is posted as JSON to the CallbackURL of a job when it
+// has completed.
+type WebhookPayload struct {
+	ID            string `json:"id"`
+	Topic         string `json:"topic"`
+	CorrelationID string `json:"correlationid,omitempty"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"` // error of the last failed attempt
+}
+
+// notify posts the outcome of job to its CallbackURL, if any. It runs in
+// the background, and failing to deliver the notification is only logged:
+// The job has been finalized already.
+func (m *Manager) notify(job *Job) {
+	if job.CallbackURL == "" {
+		return
+	}
+	payload := WebhookPayload{
+		ID:            job.ID,
+		Topic:         job.Topic,
+		CorrelationID: job.CorrelationID,
+		State:         job.State,
+	}
+	if job.State != Succeeded {
+		payload.Error = job.LastError
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		m.errorf("jobqueue: unable to notify %s about job %v: %v", job.CallbackURL, job.ID, err)
+		return
+	}
+	m.mu.Lock()
+	ctx := m.ctx
+	m.mu.Unlock()
+	url, id := job.CallbackURL, job.ID
+	m.background.Go(func() {
+		var err error
+		for attempt := 0; attempt <= m.webhookRetries; attempt++ {
+			if d := m.backoff(attempt); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					// Manager closed; give up retrying
+					m.errorf("jobqueue: unable to notify %s about job %v: %v", url, id, err)
+					return
+				}
+			}
+			if err = m.postWebhook(url, body); err == nil {
+				return
+			}
+		}
+		m.errorf("jobqueue: unable to notify %s about job %v: %v", url, id, err)
+	})
+}
+
+// postWebhook posts body to url.
+func (m *Manager) postWebhook(url string, body []byte) error {
+	res, err := m.webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
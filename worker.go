@@ -2,6 +2,7 @@ package jobqueue
 
 import (
 	"fmt"
+	"runtime/debug"
 	"time"
 )
 
@@ -15,18 +16,17 @@ type worker struct {
 // on jobc for new jobs to process.
 func newWorker(m *Manager, jobc <-chan *Job) *worker {
 	w := &worker{m: m, jobc: jobc}
-	go w.run()
+	m.workerRoutines.Go(w.run)
 	return w
 }
 
 // run is the main goroutine in the worker. It listens for new jobs, then
 // calls process.
 func (w *worker) run() {
-	defer w.m.workersWg.Done()
 	for job := range w.jobc {
 		err := w.process(job)
 		if err != nil {
-			w.m.logger.Printf("jobqueue: job %v failed: %v", job.ID, err)
+			w.m.errorf("jobqueue: job %v failed: %v", job.ID, err)
 		}
 	}
 }
@@ -36,47 +36,329 @@ func (w *worker) process(job *Job) error {
 	defer func() {
 		w.m.mu.Lock()
 		w.m.working[job.Rank]--
+		busy := w.m.working[job.Rank]
+		if auto := w.m.auto[job.Topic]; auto != nil {
+			auto.inflight--
+		}
+		if w.m.inflight[job.Topic]--; w.m.inflight[job.Topic] <= 0 {
+			delete(w.m.inflight, job.Topic)
+		}
+		w.m.lastActive = time.Now()
+		delete(w.m.running, job.ID)
 		w.m.mu.Unlock()
+		w.m.observeBusy(job.Rank, busy)
 	}()
 
 	// Find the topic
 	w.m.mu.Lock()
 	p, found := w.m.tm[job.Topic]
+	if cp := w.m.contexts[job.Topic]; cp != nil {
+		timeout := job.Timeout
+		if timeout <= 0 {
+			timeout = w.m.timeouts[job.Topic]
+		}
+		p = func(args ...interface{}) error {
+			if w.m.maxLogOutput <= 0 {
+				return w.m.callContext(cp, nil, timeout, job.ID, args...)
+			}
+			out := newLogBuffer(w.m.maxLogOutput)
+			err := w.m.callContext(cp, out, timeout, job.ID, args...)
+			job.LogOutput = out.String()
+			return err
+		}
+	}
+	if rp := w.m.results[job.Topic]; rp != nil {
+		p = func(args ...interface{}) error {
+			result, err := rp(args...)
+			if err == nil {
+				job.Result = result
+			}
+			return err
+		}
+	}
+	if !found && w.m.defaultProc != nil {
+		def := w.m.defaultProc
+		p, found = func(...interface{}) error { return def(job) }, true
+	}
+	mode := w.m.delivery[job.Topic]
 	w.m.mu.Unlock()
 	if !found {
 		return fmt.Errorf("no processor found for topic %s", job.Topic)
 	}
+	if hook := w.m.beforeExecute; hook != nil {
+		// Run the hook as part of the execution, so that its error
+		// counts as a failed attempt
+		proc := p
+		p = func(...interface{}) error {
+			if err := hook(job); err != nil {
+				return err
+			}
+			return proc(job.Args...)
+		}
+	}
+	{
+		// Turn a panic of the processor into a failed attempt, so that the
+		// worker keeps running and the job does not get stuck
+		proc := p
+		p = func(args ...interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("jobqueue: processor panicked: %v\n%s", r, debug.Stack())
+				}
+			}()
+			return proc(args...)
+		}
+	}
+	if auto := w.m.auto[job.Topic]; auto != nil {
+		// Let the concurrency of the topic adapt to the execution
+		proc := p
+		p = func(args ...interface{}) error {
+			start := time.Now()
+			err := proc(args...)
+			w.m.mu.Lock()
+			auto.observe(time.Since(start), err != nil)
+			w.m.mu.Unlock()
+			return err
+		}
+	}
+	if interval := w.m.heartbeat; interval > 0 {
+		// Report that the job is alive while the processor runs
+		proc := p
+		p = func(args ...interface{}) error {
+			stop := w.heartbeat(job, interval)
+			defer stop()
+			return proc(args...)
+		}
+	}
+	if w.m.tracer != nil {
+		p = w.m.trace(job, p)
+	}
+	if w.m.cancelRequested(job.ID) {
+		// Cancelled while waiting for a worker
+		return w.abort(job, nil)
+	}
+	if mode == AtMostOnce {
+		return w.processAtMostOnce(p, job)
+	}
 
 	w.m.testJobStarted() // testing hook
 
 	// Execute the job
 	err := p(job.Args...)
+	if err != nil && w.m.cancelRequested(job.ID) {
+		return w.abort(job, err)
+	}
+	if _, cancelled := err.(cancelledError); cancelled {
+		return w.cancelled(job, err)
+	}
+	if e, ok := err.(BatchError); ok {
+		err = w.m.batch(job, e)
+	}
 	if err != nil {
-		w.m.logger.Printf("jobqueue: Job %v failed with: %v", job.ID, err)
+		w.m.errorf("jobqueue: Job %v failed with: %v", job.ID, err)
+		job.LastError = err.Error()
 
 		if job.Retry >= job.MaxRetry {
 			// Failed
 			w.m.testJobFailed() // testing hook
-			job.State = Failed
+			job.State = w.failedState(job)
 			job.Completed = time.Now().UnixNano()
-			return w.m.st.Update(job)
+			job.CompletedBy = w.m.workerID
+			if err := w.m.finalize(job); err != nil {
+				return err
+			}
+			w.m.transition(job, Working)
+			w.m.event(job, "failed after %d retries: %v", job.Retry, job.LastError)
+			w.deadLetter(job)
+			w.done(job, false)
+			return nil
 		}
 
-		// Retry
+		// Retry, but not before the backoff has passed
 		w.m.testJobRetry() // testing hook
-		job.Priority = -time.Now().Add(w.m.backoff(job.Retry)).UnixNano()
+		runAt := time.Now().Add(w.m.backoff(job.Retry)).UnixNano()
+		job.Priority = -runAt + w.m.retryDelta[job.Topic]
+		job.RunAt = runAt
 		job.State = Waiting
 		job.Retry++
-		return w.m.st.Update(job)
+		if err := w.m.storeOf(job).Update(job); err != nil {
+			return err
+		}
+		w.m.transition(job, Working)
+		w.m.event(job, "scheduled for retry %d of %d at %v", job.Retry, job.MaxRetry, time.Unix(0, runAt))
+		w.m.retried(job)
+		return nil
 	}
 
 	// Successfully executed the job
 	job.State = Succeeded
 	job.Completed = time.Now().UnixNano()
-	err = w.m.st.Update(job)
+	job.CompletedBy = w.m.workerID
+	err = w.m.finalize(job)
 	if err != nil {
 		return err
 	}
+	w.m.transition(job, Working)
+	w.m.event(job, "succeeded")
 	w.m.testJobSucceeded()
+	w.done(job, true)
 	return nil
 }
+
+// processAtMostOnce runs a single job of a topic with AtMostOnce delivery.
+// The job is marked as succeeded before the processor is executed, so it
+// is never executed again, even if the worker crashes while executing it.
+func (w *worker) processAtMostOnce(p Processor, job *Job) error {
+	job.State = Succeeded
+	job.Completed = time.Now().UnixNano()
+	job.CompletedBy = w.m.workerID
+	if err := w.m.storeOf(job).Update(job); err != nil {
+		return err
+	}
+	w.m.transition(job, Working)
+
+	w.m.testJobStarted() // testing hook
+
+	// Execute the job
+	err := p(job.Args...)
+	if err != nil {
+		w.m.errorf("jobqueue: Job %v failed with: %v", job.ID, err)
+		job.LastError = err.Error()
+
+		// Failed, and never retried. The job has been finalized as
+		// succeeded before, so Update would refuse to change it.
+		w.m.testJobFailed() // testing hook
+		state := w.failedState(job)
+		if _, err := w.m.storeOf(job).CompareAndSetState(job.ID, Succeeded, state); err != nil {
+			return err
+		}
+		job.State = state
+		w.m.transition(job, Succeeded)
+		w.m.event(job, "failed: %v", job.LastError)
+		w.deadLetter(job)
+		w.done(job, false)
+		return nil
+	}
+
+	w.m.event(job, "succeeded")
+	w.m.testJobSucceeded()
+	w.done(job, true)
+	return nil
+}
+
+// cancelled handles a job whose processor has failed with err after its
+// context has been cancelled, according to the cancellation policy.
+func (w *worker) cancelled(job *Job, err error) error {
+	job.LastError = err.Error()
+	if w.m.cancellation == FailOnCancel {
+		w.m.testJobFailed() // testing hook
+		job.State = Failed
+		job.Completed = time.Now().UnixNano()
+		job.CompletedBy = w.m.workerID
+		if err := w.m.storeOf(job).Update(job); err != nil {
+			return err
+		}
+		w.m.transition(job, Working)
+		w.m.event(job, "failed after cancellation: %v", job.LastError)
+		w.done(job, false)
+		return nil
+	}
+	// Requeue, so that it is executed again, e.g. by another manager
+	job.State = Waiting
+	if err := w.m.storeOf(job).Update(job); err != nil {
+		return err
+	}
+	w.m.transition(job, Working)
+	w.m.event(job, "requeued after cancellation: %v", job.LastError)
+	return nil
+}
+
+// abort moves job into the Cancelled state after it has been cancelled
+// via Manager.Cancel. err is the error its processor has failed with, or
+// nil if the processor has not been executed.
+func (w *worker) abort(job *Job, err error) error {
+	if err != nil {
+		job.LastError = err.Error()
+	}
+	job.State = Cancelled
+	job.Completed = time.Now().UnixNano()
+	job.CompletedBy = w.m.workerID
+	if err := w.m.storeOf(job).Update(job); err != nil {
+		return err
+	}
+	w.m.transition(job, Working)
+	w.m.event(job, "cancelled")
+	w.m.recent.add(job)
+	w.m.forgetRetries(job)
+	w.m.notify(job)
+	return nil
+}
+
+// heartbeat records a heartbeat of job in the given interval until the
+// returned function is called.
+func (w *worker) heartbeat(job *Job, interval time.Duration) (stop func()) {
+	st := w.m.storeOf(job)
+	id := job.ID
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	w.m.background.Go(func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := st.Heartbeat(id); err != nil {
+					w.m.errorf("jobqueue: error recording heartbeat of job %v: %v", id, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	})
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// failedState returns the state for job after it has failed.
+func (w *worker) failedState(job *Job) string {
+	if job.MaxRetry == 0 && w.m.zeroRetryState != "" {
+		return w.m.zeroRetryState
+	}
+	return Failed
+}
+
+// deadLetter passes job to the dead-letter hook, if any, after it has
+// exhausted its retries.
+func (w *worker) deadLetter(job *Job) {
+	if hook := w.m.deadLetterHook; hook != nil {
+		hook(job)
+	}
+}
+
+// done is called when job has completed. succeeded indicates whether
+// the job has succeeded.
+func (w *worker) done(job *Job, succeeded bool) {
+	w.m.checkLatency(job)
+	w.m.recent.add(job)
+	w.m.forgetRetries(job)
+	w.m.notify(job)
+	w.repeat(job, succeeded)
+}
+
+// repeat schedules the next occurrence of job if it is a repeating job.
+// succeeded indicates whether the current occurrence has succeeded.
+func (w *worker) repeat(job *Job, succeeded bool) {
+	if job.Repeats <= 0 {
+		return
+	}
+	remaining := job.Repeats
+	if succeeded || w.m.repeatFailures {
+		remaining--
+	}
+	if remaining > 0 {
+		w.m.repeat(job, remaining)
+	}
+}